@@ -0,0 +1,160 @@
+// Package bson implements encoding and decoding of BSON documents as
+// described at https://bsonspec.org, without depending on an external driver.
+package bson
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Type is the type byte of a BSON element
+type Type byte
+
+// BSON element types
+const (
+	TypeDouble        Type = 0x01
+	TypeString        Type = 0x02
+	TypeDocument      Type = 0x03
+	TypeArray         Type = 0x04
+	TypeBinary        Type = 0x05
+	TypeUndefined     Type = 0x06
+	TypeObjectID      Type = 0x07
+	TypeBoolean       Type = 0x08
+	TypeDateTime      Type = 0x09
+	TypeNull          Type = 0x0A
+	TypeRegex         Type = 0x0B
+	TypeDBPointer     Type = 0x0C
+	TypeJavaScript    Type = 0x0D
+	TypeSymbol        Type = 0x0E
+	TypeCodeWithScope Type = 0x0F
+	TypeInt32         Type = 0x10
+	TypeTimestamp     Type = 0x11
+	TypeInt64         Type = 0x12
+	TypeDecimal128    Type = 0x13
+	TypeMinKey        Type = 0xFF
+	TypeMaxKey        Type = 0x7F
+)
+
+// String returns the name of the type as used by the $type query operator
+func (t Type) String() string {
+	switch t {
+	case TypeDouble:
+		return "double"
+	case TypeString:
+		return "string"
+	case TypeDocument:
+		return "object"
+	case TypeArray:
+		return "array"
+	case TypeBinary:
+		return "binData"
+	case TypeUndefined:
+		return "undefined"
+	case TypeObjectID:
+		return "objectId"
+	case TypeBoolean:
+		return "bool"
+	case TypeDateTime:
+		return "date"
+	case TypeNull:
+		return "null"
+	case TypeRegex:
+		return "regex"
+	case TypeDBPointer:
+		return "dbPointer"
+	case TypeJavaScript:
+		return "javascript"
+	case TypeSymbol:
+		return "symbol"
+	case TypeCodeWithScope:
+		return "javascriptWithScope"
+	case TypeInt32:
+		return "int"
+	case TypeTimestamp:
+		return "timestamp"
+	case TypeInt64:
+		return "long"
+	case TypeDecimal128:
+		return "decimal"
+	case TypeMinKey:
+		return "minKey"
+	case TypeMaxKey:
+		return "maxKey"
+	}
+	return fmt.Sprintf("unknown(0x%02x)", byte(t))
+}
+
+// E is a single element of an ordered document
+type E struct {
+	Key   string
+	Value any
+}
+
+// D is an ordered BSON document. Commands must be built with D because the
+// server uses the first key as the command name.
+type D []E
+
+// Lookup returns the value of the first element with the given key
+func (d D) Lookup(key string) (any, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set replaces the value of key, or appends the element if it is missing
+func (d D) Set(key string, value any) D {
+	for i := range d {
+		if d[i].Key == key {
+			d[i].Value = value
+			return d
+		}
+	}
+	return append(d, E{Key: key, Value: value})
+}
+
+// String renders the document in a relaxed extended JSON like form for
+// logging and error messages
+func (d D) String() string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, e := range d {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q: %s", e.Key, formatValue(e.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// A is a BSON array
+type A []any
+
+// M is an unordered BSON document. Keys are encoded in sorted order so the
+// output is deterministic.
+type M map[string]any
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", v)
+	case D:
+		return v.String()
+	case Raw:
+		return v.String()
+	case A:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			parts[i] = formatValue(elem)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
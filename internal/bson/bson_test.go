@@ -0,0 +1,262 @@
+package bson
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarshalSpecExamples(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  any
+		hex  string
+	}{
+		{
+			name: "hello world",
+			doc:  D{{Key: "hello", Value: "world"}},
+			hex:  "160000000268656c6c6f0006000000776f726c640000",
+		},
+		{
+			name: "array of mixed values",
+			doc:  D{{Key: "BSON", Value: A{"awesome", 5.05, int32(1986)}}},
+			hex:  "310000000442534f4e002600000002300008000000617765736f6d65000131003333333333331440103200c20700000000",
+		},
+		{
+			name: "empty document",
+			doc:  D{},
+			hex:  "0500000000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(tt.doc)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if got := hex.EncodeToString(data); got != tt.hex {
+				t.Errorf("Expected %s, got %s", tt.hex, got)
+			}
+		})
+	}
+}
+
+func TestRoundTripAllTypes(t *testing.T) {
+	oid := NewObjectID()
+	dec, err := ParseDecimal128("1234.5678")
+	if err != nil {
+		t.Fatalf("ParseDecimal128 failed: %v", err)
+	}
+
+	doc := D{
+		{Key: "double", Value: 3.25},
+		{Key: "string", Value: "héllo"},
+		{Key: "document", Value: D{{Key: "a", Value: int32(1)}}},
+		{Key: "array", Value: A{int32(1), "two", D{{Key: "three", Value: int64(3)}}}},
+		{Key: "binary", Value: Binary{Subtype: BinaryGeneric, Data: []byte{1, 2, 3}}},
+		{Key: "uuid", Value: Binary{Subtype: BinaryUUID, Data: bytes.Repeat([]byte{0xAB}, 16)}},
+		{Key: "oldBinary", Value: Binary{Subtype: BinaryBinaryOld, Data: []byte("old")}},
+		{Key: "undefined", Value: Undefined{}},
+		{Key: "objectId", Value: oid},
+		{Key: "true", Value: true},
+		{Key: "false", Value: false},
+		{Key: "datetime", Value: DateTime(1700000000123)},
+		{Key: "null", Value: nil},
+		{Key: "regex", Value: Regex{Pattern: "^a.*b$", Options: "im"}},
+		{Key: "dbPointer", Value: DBPointer{DB: "db.coll", Pointer: oid}},
+		{Key: "javascript", Value: JavaScript("function() { return 1 }")},
+		{Key: "symbol", Value: Symbol("sym")},
+		{Key: "codeWithScope", Value: CodeWithScope{Code: "x + y", Scope: D{{Key: "x", Value: int32(1)}}}},
+		{Key: "int32", Value: int32(-42)},
+		{Key: "timestamp", Value: Timestamp{T: 1700000000, I: 7}},
+		{Key: "int64", Value: int64(math.MaxInt64)},
+		{Key: "decimal", Value: dec},
+		{Key: "minKey", Value: MinKey{}},
+		{Key: "maxKey", Value: MaxKey{}},
+	}
+
+	data, err := Marshal(doc)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := Raw(data).Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(doc, decoded) {
+		t.Errorf("Round trip mismatch:\nexpected %v\ngot      %v", doc, decoded)
+	}
+
+	again, err := Marshal(decoded)
+	if err != nil {
+		t.Fatalf("Marshal of decoded document failed: %v", err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Error("Re-encoding the decoded document produced different bytes")
+	}
+}
+
+func TestMarshalGoTypes(t *testing.T) {
+	now := time.UnixMilli(1700000000123)
+	data, err := Marshal(M{
+		"int":     42,
+		"bigInt":  int64(1) << 40,
+		"uint8":   uint8(7),
+		"float32": float32(1.5),
+		"time":    now,
+		"bytes":   []byte("raw"),
+		"strings": []string{"a", "b"},
+		"map":     map[string]int{"z": 1},
+		"ptr":     (*int)(nil),
+	})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	raw := Raw(data)
+	checks := []struct {
+		key string
+		typ Type
+	}{
+		{"int", TypeInt32},
+		{"bigInt", TypeInt64},
+		{"uint8", TypeInt32},
+		{"float32", TypeDouble},
+		{"time", TypeDateTime},
+		{"bytes", TypeBinary},
+		{"strings", TypeArray},
+		{"map", TypeDocument},
+		{"ptr", TypeNull},
+	}
+	for _, c := range checks {
+		if got := raw.Lookup(c.key).Type; got != c.typ {
+			t.Errorf("Expected %s to encode as %s, got %s", c.key, c.typ, got)
+		}
+	}
+
+	// M keys are encoded in sorted order
+	elements, err := raw.Elements()
+	if err != nil {
+		t.Fatalf("Elements failed: %v", err)
+	}
+	if elements[0].Key != "bigInt" {
+		t.Errorf("Expected sorted keys, first key is %q", elements[0].Key)
+	}
+	if !raw.Lookup("time").Time().Equal(now) {
+		t.Errorf("Expected time %v, got %v", now, raw.Lookup("time").Time())
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	if _, err := Marshal("not a document"); err == nil {
+		t.Error("Expected error when marshaling a string as a document")
+	}
+	if _, err := Marshal(D{{Key: "bad\x00key", Value: 1}}); err == nil {
+		t.Error("Expected error for key containing NUL")
+	}
+	if _, err := Marshal(D{{Key: "ch", Value: make(chan int)}}); err == nil {
+		t.Error("Expected error for unsupported type")
+	}
+	if _, err := Marshal(D{{Key: "u", Value: uint64(math.MaxUint64)}}); err == nil {
+		t.Error("Expected error for overflowing uint64")
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	tests := map[string]string{
+		"too short":          "0400000000",
+		"length too large":   "ff00000000",
+		"missing terminator": "0500000001",
+		"unknown type":       "0800000020610000",
+		"string overflow":    "1000000002610010000000616263000000",
+		"bad boolean":        "0900000008610002" + "00",
+		"unterminated key":   "070000000261620000",
+	}
+	for name, h := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := hex.DecodeString(h)
+			if err != nil {
+				t.Fatalf("bad test hex: %v", err)
+			}
+			if _, err := Unmarshal(data); err == nil {
+				t.Error("Expected Unmarshal to fail")
+			}
+		})
+	}
+}
+
+func TestRawLookup(t *testing.T) {
+	data, err := Marshal(D{
+		{Key: "ok", Value: 1.0},
+		{Key: "cursor", Value: D{
+			{Key: "id", Value: int64(99)},
+			{Key: "ns", Value: "test.col"},
+			{Key: "firstBatch", Value: A{D{{Key: "x", Value: int32(1)}}}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	raw := Raw(data)
+
+	if ok, _ := raw.Lookup("ok").AsFloat64OK(); ok != 1 {
+		t.Errorf("Expected ok 1, got %v", ok)
+	}
+	if id, _ := raw.Lookup("cursor", "id").AsInt64OK(); id != 99 {
+		t.Errorf("Expected cursor id 99, got %d", id)
+	}
+	if ns := raw.Lookup("cursor", "ns").StringValue(); ns != "test.col" {
+		t.Errorf("Expected ns test.col, got %q", ns)
+	}
+	if x := raw.Lookup("cursor", "firstBatch", "0", "x").Int32(); x != 1 {
+		t.Errorf("Expected nested x 1, got %d", x)
+	}
+	if _, err := raw.LookupErr("missing"); err != ErrElementNotFound {
+		t.Errorf("Expected ErrElementNotFound, got %v", err)
+	}
+	if _, err := raw.LookupErr("ok", "child"); err == nil {
+		t.Error("Expected error when descending into a double")
+	}
+
+	values, err := raw.Lookup("cursor", "firstBatch").Array().Values()
+	if err != nil || len(values) != 1 || values[0].Type != TypeDocument {
+		t.Errorf("Unexpected firstBatch values %v: %v", values, err)
+	}
+}
+
+func TestObjectID(t *testing.T) {
+	a := NewObjectID()
+	b := NewObjectID()
+	if a == b {
+		t.Error("Expected distinct ObjectIDs")
+	}
+	if a.Compare(b) >= 0 {
+		t.Error("Expected ObjectIDs from the same second to increase")
+	}
+
+	parsed, err := ObjectIDFromHex(a.Hex())
+	if err != nil || parsed != a {
+		t.Errorf("Hex round trip failed: %v", err)
+	}
+	if _, err := ObjectIDFromHex("xyz"); err == nil {
+		t.Error("Expected error for invalid hex")
+	}
+	if time.Since(a.Timestamp()) > time.Minute {
+		t.Errorf("Unexpected ObjectID timestamp %v", a.Timestamp())
+	}
+}
+
+func TestTimestampCompare(t *testing.T) {
+	a := Timestamp{T: 10, I: 2}
+	if a.Compare(Timestamp{T: 10, I: 3}) != -1 || a.Compare(Timestamp{T: 9, I: 5}) != 1 || a.Compare(a) != 0 {
+		t.Error("Unexpected timestamp ordering")
+	}
+}
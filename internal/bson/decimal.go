@@ -0,0 +1,200 @@
+package bson
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal128 is an IEEE 754-2008 128-bit decimal floating point number in
+// the binary integer decimal encoding used by BSON
+type Decimal128 struct {
+	h, l uint64
+}
+
+const (
+	decimalExponentBias = 6176
+	decimalMaxExponent  = 6111
+	decimalMinExponent  = -6176
+	decimalMaxDigits    = 34
+)
+
+var decimalMaxSignificand = new(big.Int).Sub(new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalMaxDigits), nil), big.NewInt(1))
+
+// NewDecimal128 builds a Decimal128 from its high and low 64-bit halves
+func NewDecimal128(h, l uint64) Decimal128 {
+	return Decimal128{h: h, l: l}
+}
+
+// GetBytes returns the high and low 64-bit halves of the value
+func (d Decimal128) GetBytes() (uint64, uint64) {
+	return d.h, d.l
+}
+
+// IsNaN reports whether the value is NaN
+func (d Decimal128) IsNaN() bool {
+	return d.h>>58&0x1F == 0x1F
+}
+
+// IsInf returns 1 for +Infinity, -1 for -Infinity and 0 otherwise
+func (d Decimal128) IsInf() int {
+	if d.h>>58&0x1F != 0x1E {
+		return 0
+	}
+	if d.h>>63 == 1 {
+		return -1
+	}
+	return 1
+}
+
+// parts returns the sign, unbiased exponent and significand of a finite value
+func (d Decimal128) parts() (negative bool, exponent int, significand *big.Int) {
+	negative = d.h>>63 == 1
+	significand = new(big.Int)
+	if d.h>>61&3 == 3 {
+		// The significand would exceed the maximum, so it is treated as zero
+		exponent = int(d.h>>47&0x3FFF) - decimalExponentBias
+		return negative, exponent, significand
+	}
+	exponent = int(d.h>>49&0x3FFF) - decimalExponentBias
+	significand.SetUint64(d.h & (1<<49 - 1))
+	significand.Lsh(significand, 64)
+	significand.Or(significand, new(big.Int).SetUint64(d.l))
+	if significand.Cmp(decimalMaxSignificand) > 0 {
+		// Non-canonical significands above the maximum are treated as zero
+		significand.SetUint64(0)
+	}
+	return negative, exponent, significand
+}
+
+// String formats the value following the BSON Decimal128 specification
+func (d Decimal128) String() string {
+	if d.IsNaN() {
+		return "NaN"
+	}
+	switch d.IsInf() {
+	case 1:
+		return "Infinity"
+	case -1:
+		return "-Infinity"
+	}
+
+	negative, exponent, significand := d.parts()
+	digits := significand.String()
+	var b strings.Builder
+	if negative {
+		b.WriteByte('-')
+	}
+
+	adjusted := exponent + len(digits) - 1
+	if exponent <= 0 && adjusted >= -6 {
+		// Regular notation
+		if exponent == 0 {
+			b.WriteString(digits)
+			return b.String()
+		}
+		point := len(digits) + exponent
+		if point > 0 {
+			b.WriteString(digits[:point])
+			b.WriteByte('.')
+			b.WriteString(digits[point:])
+		} else {
+			b.WriteString("0.")
+			b.WriteString(strings.Repeat("0", -point))
+			b.WriteString(digits)
+		}
+		return b.String()
+	}
+
+	// Scientific notation
+	b.WriteByte(digits[0])
+	if len(digits) > 1 {
+		b.WriteByte('.')
+		b.WriteString(digits[1:])
+	}
+	b.WriteByte('E')
+	if adjusted >= 0 {
+		b.WriteByte('+')
+	}
+	b.WriteString(strconv.Itoa(adjusted))
+	return b.String()
+}
+
+// ParseDecimal128 parses a decimal string such as "1.25", "-0.0", "1E+3",
+// "NaN" or "Infinity". Values that cannot be represented exactly are rejected.
+func ParseDecimal128(s string) (Decimal128, error) {
+	orig := s
+	negative := false
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+
+	switch strings.ToLower(s) {
+	case "nan":
+		return Decimal128{h: 0x1F << 58}, nil
+	case "inf", "infinity":
+		d := Decimal128{h: 0x1E << 58}
+		if negative {
+			d.h |= 1 << 63
+		}
+		return d, nil
+	}
+
+	mantissa, expPart, hasExp := strings.Cut(strings.ToUpper(s), "E")
+	exponent := 0
+	if hasExp {
+		e, err := strconv.Atoi(expPart)
+		if err != nil {
+			return Decimal128{}, fmt.Errorf("invalid decimal128 exponent in %q", orig)
+		}
+		exponent = e
+	}
+
+	intPart, fracPart, _ := strings.Cut(mantissa, ".")
+	digits := intPart + fracPart
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Decimal128{}, fmt.Errorf("invalid decimal128 string %q", orig)
+	}
+	exponent -= len(fracPart)
+
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		digits = "0"
+	}
+
+	// Drop trailing zeros that do not fit, which keeps the value exact
+	for len(digits) > decimalMaxDigits && digits[len(digits)-1] == '0' {
+		digits = digits[:len(digits)-1]
+		exponent++
+	}
+	for exponent < decimalMinExponent && len(digits) > 1 && digits[len(digits)-1] == '0' {
+		digits = digits[:len(digits)-1]
+		exponent++
+	}
+	// Clamp large exponents by padding the significand with zeros
+	for exponent > decimalMaxExponent && len(digits) < decimalMaxDigits && digits != "0" {
+		digits += "0"
+		exponent--
+	}
+	if digits == "0" {
+		exponent = max(min(exponent, decimalMaxExponent), decimalMinExponent)
+	}
+	if len(digits) > decimalMaxDigits || exponent > decimalMaxExponent || exponent < decimalMinExponent {
+		return Decimal128{}, fmt.Errorf("decimal128 value %q cannot be represented exactly", orig)
+	}
+
+	significand, _ := new(big.Int).SetString(digits, 10)
+	if significand.Cmp(decimalMaxSignificand) > 0 {
+		return Decimal128{}, fmt.Errorf("decimal128 value %q out of range", orig)
+	}
+
+	low := new(big.Int).And(significand, new(big.Int).SetUint64(^uint64(0))).Uint64()
+	high := new(big.Int).Rsh(significand, 64).Uint64()
+	high |= uint64(exponent+decimalExponentBias) << 49
+	if negative {
+		high |= 1 << 63
+	}
+	return Decimal128{h: high, l: low}, nil
+}
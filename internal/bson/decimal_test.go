@@ -0,0 +1,88 @@
+package bson
+
+import "testing"
+
+func TestDecimal128Strings(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		h, l uint64
+	}{
+		{in: "0", want: "0", h: 0x3040000000000000, l: 0},
+		{in: "-0", want: "-0", h: 0xb040000000000000, l: 0},
+		{in: "1", want: "1", h: 0x3040000000000000, l: 1},
+		{in: "-1", want: "-1", h: 0xb040000000000000, l: 1},
+		{in: "0.1", want: "0.1", h: 0x303e000000000000, l: 1},
+		{in: "1.25", want: "1.25", h: 0x303c000000000000, l: 125},
+		{in: "0.001234", want: "0.001234", h: 0x3034000000000000, l: 1234},
+		{in: "1E+3", want: "1E+3", h: 0x3046000000000000, l: 1},
+		{in: "1.000000000000000000000000000000000E+6144", want: "1.000000000000000000000000000000000E+6144", h: 0x5ffe314dc6448d93, l: 0x38c15b0a00000000},
+		{in: "1E-7", want: "1E-7", h: 0x3032000000000000, l: 1},
+		{in: "9.999999999999999999999999999999999E+6144", want: "9.999999999999999999999999999999999E+6144", h: 0x5fffed09bead87c0, l: 0x378d8e63ffffffff},
+		{in: "NaN", want: "NaN", h: 0x7c00000000000000, l: 0},
+		{in: "Infinity", want: "Infinity", h: 0x7800000000000000, l: 0},
+		{in: "-Infinity", want: "-Infinity", h: 0xf800000000000000, l: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			d, err := ParseDecimal128(tt.in)
+			if err != nil {
+				t.Fatalf("ParseDecimal128 failed: %v", err)
+			}
+			if h, l := d.GetBytes(); h != tt.h || l != tt.l {
+				t.Errorf("Expected bits %016x%016x, got %016x%016x", tt.h, tt.l, h, l)
+			}
+			if got := d.String(); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDecimal128Clamping(t *testing.T) {
+	// Exponent above the maximum is clamped by padding the significand
+	d, err := ParseDecimal128("1E+6112")
+	if err != nil {
+		t.Fatalf("ParseDecimal128 failed: %v", err)
+	}
+	if got := d.String(); got != "1.0E+6112" {
+		t.Errorf("Expected 1.0E+6112, got %q", got)
+	}
+
+	// Trailing zeros beyond 34 digits are dropped exactly
+	d, err = ParseDecimal128("10000000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf("ParseDecimal128 failed: %v", err)
+	}
+	if got := d.String(); got != "1.000000000000000000000000000000000E+34" {
+		t.Errorf("Unexpected string %q", got)
+	}
+}
+
+func TestDecimal128Invalid(t *testing.T) {
+	for _, in := range []string{"", "abc", "1.2.3", "1E", "E5", "12345678901234567890123456789012345", "1E-6177"} {
+		if _, err := ParseDecimal128(in); err == nil {
+			t.Errorf("Expected %q to be rejected", in)
+		}
+	}
+}
+
+func TestDecimal128NonCanonicalSignificand(t *testing.T) {
+	// bson-corpus decimal128 non-canonical vectors: a significand of 10^34 or
+	// more in the normal encoding is non-canonical and read as zero
+	tests := []struct {
+		h, l uint64
+		want string
+	}{
+		{h: 0x3041ed09bead87c0, l: 0x378d8e6400000000, want: "0"},
+		{h: 0xb041ed09bead87c0, l: 0x378d8e6400000000, want: "-0"},
+		{h: 0x3045ed09bead87c0, l: 0x378d8e6400000000, want: "0E+2"},
+		{h: 0x3041ffffffffffff, l: 0xffffffffffffffff, want: "0"},
+	}
+	for _, tt := range tests {
+		if got := NewDecimal128(tt.h, tt.l).String(); got != tt.want {
+			t.Errorf("%016x%016x: expected %q, got %q", tt.h, tt.l, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package bson
+
+import "fmt"
+
+// Unmarshal decodes an encoded document into an ordered D. Embedded
+// documents decode to D and arrays to A.
+func Unmarshal(data []byte) (D, error) {
+	elements, err := Raw(data).Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	d := make(D, 0, len(elements))
+	for _, e := range elements {
+		if err := e.Value.validate(); err != nil {
+			return nil, fmt.Errorf("element %q: %w", e.Key, err)
+		}
+		value, err := e.Value.Interface()
+		if err != nil {
+			return nil, fmt.Errorf("element %q: %w", e.Key, err)
+		}
+		d = append(d, E{Key: e.Key, Value: value})
+	}
+	return d, nil
+}
@@ -0,0 +1,281 @@
+package bson
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Marshal encodes a document. doc may be a D, M, Raw, map with string keys
+// or a pointer to one of those.
+func Marshal(doc any) ([]byte, error) {
+	return AppendDocument(nil, doc)
+}
+
+// AppendDocument appends the encoding of doc to dst
+func AppendDocument(dst []byte, doc any) ([]byte, error) {
+	typ, out, err := appendValue(dst, doc)
+	if err != nil {
+		return dst, err
+	}
+	if typ != TypeDocument {
+		return dst, fmt.Errorf("cannot marshal %T as a document", doc)
+	}
+	return out, nil
+}
+
+// appendDocumentD encodes an ordered document
+func appendDocumentD(dst []byte, d D) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	var err error
+	for _, e := range d {
+		if dst, err = appendElement(dst, e.Key, e.Value); err != nil {
+			return dst, err
+		}
+	}
+	return finishDocument(dst, start), nil
+}
+
+// appendArray encodes a slice as an array document with "0", "1", ... keys
+func appendArray(dst []byte, length int, elem func(i int) any) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	var err error
+	for i := 0; i < length; i++ {
+		if dst, err = appendElement(dst, strconv.Itoa(i), elem(i)); err != nil {
+			return dst, err
+		}
+	}
+	return finishDocument(dst, start), nil
+}
+
+func finishDocument(dst []byte, start int) []byte {
+	dst = append(dst, 0)
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
+
+// appendElement writes the type byte, key and value of a single element
+func appendElement(dst []byte, key string, value any) ([]byte, error) {
+	if strings.IndexByte(key, 0) >= 0 {
+		return dst, fmt.Errorf("key %q contains a NUL byte", key)
+	}
+	typePos := len(dst)
+	dst = append(dst, 0)
+	dst = appendCString(dst, key)
+	typ, dst, err := appendValue(dst, value)
+	if err != nil {
+		return dst, fmt.Errorf("key %q: %w", key, err)
+	}
+	dst[typePos] = byte(typ)
+	return dst, nil
+}
+
+// appendValue appends the encoded value and returns its BSON type
+func appendValue(dst []byte, value any) (Type, []byte, error) {
+	switch v := value.(type) {
+	case nil, Null:
+		return TypeNull, dst, nil
+	case D:
+		out, err := appendDocumentD(dst, v)
+		return TypeDocument, out, err
+	case *D:
+		out, err := appendDocumentD(dst, *v)
+		return TypeDocument, out, err
+	case M:
+		out, err := appendDocumentD(dst, sortedD(v))
+		return TypeDocument, out, err
+	case map[string]any:
+		out, err := appendDocumentD(dst, sortedD(v))
+		return TypeDocument, out, err
+	case Raw:
+		if err := v.Validate(); err != nil {
+			return TypeDocument, dst, err
+		}
+		return TypeDocument, append(dst, v...), nil
+	case A:
+		out, err := appendArray(dst, len(v), func(i int) any { return v[i] })
+		return TypeArray, out, err
+	case []any:
+		out, err := appendArray(dst, len(v), func(i int) any { return v[i] })
+		return TypeArray, out, err
+	case RawArray:
+		if err := Raw(v).Validate(); err != nil {
+			return TypeArray, dst, err
+		}
+		return TypeArray, append(dst, v...), nil
+	case RawValue:
+		if _, err := valueSize(v.Type, v.Value); err != nil {
+			return v.Type, dst, err
+		}
+		return v.Type, append(dst, v.Value...), nil
+	case float64:
+		return TypeDouble, binary.LittleEndian.AppendUint64(dst, math.Float64bits(v)), nil
+	case float32:
+		return TypeDouble, binary.LittleEndian.AppendUint64(dst, math.Float64bits(float64(v))), nil
+	case string:
+		return TypeString, appendString(dst, v), nil
+	case bool:
+		if v {
+			return TypeBoolean, append(dst, 1), nil
+		}
+		return TypeBoolean, append(dst, 0), nil
+	case int32:
+		return TypeInt32, binary.LittleEndian.AppendUint32(dst, uint32(v)), nil
+	case int64:
+		return TypeInt64, binary.LittleEndian.AppendUint64(dst, uint64(v)), nil
+	case int:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return TypeInt32, binary.LittleEndian.AppendUint32(dst, uint32(int32(v))), nil
+		}
+		return TypeInt64, binary.LittleEndian.AppendUint64(dst, uint64(v)), nil
+	case int8:
+		return TypeInt32, binary.LittleEndian.AppendUint32(dst, uint32(int32(v))), nil
+	case int16:
+		return TypeInt32, binary.LittleEndian.AppendUint32(dst, uint32(int32(v))), nil
+	case uint8:
+		return TypeInt32, binary.LittleEndian.AppendUint32(dst, uint32(v)), nil
+	case uint16:
+		return TypeInt32, binary.LittleEndian.AppendUint32(dst, uint32(v)), nil
+	case uint32:
+		return TypeInt64, binary.LittleEndian.AppendUint64(dst, uint64(v)), nil
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return TypeInt64, dst, fmt.Errorf("uint value %d overflows int64", v)
+		}
+		return TypeInt64, binary.LittleEndian.AppendUint64(dst, uint64(v)), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return TypeInt64, dst, fmt.Errorf("uint64 value %d overflows int64", v)
+		}
+		return TypeInt64, binary.LittleEndian.AppendUint64(dst, v), nil
+	case []byte:
+		return TypeBinary, appendBinary(dst, Binary{Subtype: BinaryGeneric, Data: v}), nil
+	case Binary:
+		return TypeBinary, appendBinary(dst, v), nil
+	case Undefined:
+		return TypeUndefined, dst, nil
+	case ObjectID:
+		return TypeObjectID, append(dst, v[:]...), nil
+	case DateTime:
+		return TypeDateTime, binary.LittleEndian.AppendUint64(dst, uint64(v)), nil
+	case time.Time:
+		return TypeDateTime, binary.LittleEndian.AppendUint64(dst, uint64(v.UnixMilli())), nil
+	case Regex:
+		if strings.IndexByte(v.Pattern, 0) >= 0 || strings.IndexByte(v.Options, 0) >= 0 {
+			return TypeRegex, dst, fmt.Errorf("regex contains a NUL byte")
+		}
+		dst = appendCString(dst, v.Pattern)
+		return TypeRegex, appendCString(dst, sortOptions(v.Options)), nil
+	case DBPointer:
+		dst = appendString(dst, v.DB)
+		return TypeDBPointer, append(dst, v.Pointer[:]...), nil
+	case JavaScript:
+		return TypeJavaScript, appendString(dst, string(v)), nil
+	case Symbol:
+		return TypeSymbol, appendString(dst, string(v)), nil
+	case CodeWithScope:
+		start := len(dst)
+		dst = append(dst, 0, 0, 0, 0)
+		dst = appendString(dst, string(v.Code))
+		scope := v.Scope
+		if scope == nil {
+			scope = D{}
+		}
+		dst, err := AppendDocument(dst, scope)
+		if err != nil {
+			return TypeCodeWithScope, dst, err
+		}
+		binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+		return TypeCodeWithScope, dst, nil
+	case Timestamp:
+		dst = binary.LittleEndian.AppendUint32(dst, v.I)
+		return TypeTimestamp, binary.LittleEndian.AppendUint32(dst, v.T), nil
+	case Decimal128:
+		dst = binary.LittleEndian.AppendUint64(dst, v.l)
+		return TypeDecimal128, binary.LittleEndian.AppendUint64(dst, v.h), nil
+	case MinKey:
+		return TypeMinKey, dst, nil
+	case MaxKey:
+		return TypeMaxKey, dst, nil
+	}
+
+	return appendReflect(dst, value)
+}
+
+// appendReflect handles slices, arrays, maps and pointers of supported types
+func appendReflect(dst []byte, value any) (Type, []byte, error) {
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return TypeNull, dst, nil
+		}
+		return appendValue(dst, rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return TypeNull, dst, nil
+		}
+		out, err := appendArray(dst, rv.Len(), func(i int) any { return rv.Index(i).Interface() })
+		return TypeArray, out, err
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		d := make(D, 0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			d = append(d, E{Key: iter.Key().String(), Value: iter.Value().Interface()})
+		}
+		sort.Slice(d, func(i, j int) bool { return d[i].Key < d[j].Key })
+		out, err := appendDocumentD(dst, d)
+		return TypeDocument, out, err
+	}
+	return 0, dst, fmt.Errorf("unsupported type %T", value)
+}
+
+func sortedD(m map[string]any) D {
+	d := make(D, 0, len(m))
+	for k, v := range m {
+		d = append(d, E{Key: k, Value: v})
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i].Key < d[j].Key })
+	return d
+}
+
+// sortOptions returns regex options in alphabetical order, as the spec requires
+func sortOptions(options string) string {
+	b := []byte(options)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return string(b)
+}
+
+func appendCString(dst []byte, s string) []byte {
+	dst = append(dst, s...)
+	return append(dst, 0)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(s)+1))
+	dst = append(dst, s...)
+	return append(dst, 0)
+}
+
+func appendBinary(dst []byte, b Binary) []byte {
+	if b.Subtype == BinaryBinaryOld {
+		// The old binary subtype repeats the length inside the payload
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(b.Data)+4))
+		dst = append(dst, b.Subtype)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(b.Data)))
+		return append(dst, b.Data...)
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(b.Data)))
+	dst = append(dst, b.Subtype)
+	return append(dst, b.Data...)
+}
@@ -0,0 +1,222 @@
+package bson
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ObjectID is the 12-byte BSON ObjectId
+type ObjectID [12]byte
+
+// NilObjectID is the zero value ObjectID
+var NilObjectID ObjectID
+
+var (
+	objectIDProcessUnique = processUnique()
+	objectIDCounter       = randomUint32()
+)
+
+// NewObjectID generates a new ObjectID from the current time, a per-process
+// random value and an incrementing counter
+func NewObjectID() ObjectID {
+	return NewObjectIDFromTimestamp(time.Now())
+}
+
+// NewObjectIDFromTimestamp generates a new ObjectID with the given creation time
+func NewObjectIDFromTimestamp(t time.Time) ObjectID {
+	var id ObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(t.Unix()))
+	copy(id[4:9], objectIDProcessUnique[:])
+	counter := atomic.AddUint32(&objectIDCounter, 1)
+	id[9] = byte(counter >> 16)
+	id[10] = byte(counter >> 8)
+	id[11] = byte(counter)
+	return id
+}
+
+// ObjectIDFromHex parses a 24 character hex string
+func ObjectIDFromHex(s string) (ObjectID, error) {
+	var id ObjectID
+	if len(s) != 24 {
+		return id, fmt.Errorf("invalid ObjectId hex length: %d", len(s))
+	}
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return id, fmt.Errorf("invalid ObjectId hex: %w", err)
+	}
+	return id, nil
+}
+
+// Hex returns the hex encoding of the ObjectID
+func (id ObjectID) Hex() string {
+	return hex.EncodeToString(id[:])
+}
+
+// String returns the ObjectID in shell notation
+func (id ObjectID) String() string {
+	return fmt.Sprintf("ObjectId(%q)", id.Hex())
+}
+
+// Timestamp returns the creation time encoded in the ObjectID
+func (id ObjectID) Timestamp() time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint32(id[0:4])), 0)
+}
+
+// IsZero reports whether the ObjectID is NilObjectID
+func (id ObjectID) IsZero() bool {
+	return id == NilObjectID
+}
+
+// Compare orders ObjectIDs bytewise, as the server does for electionId
+func (id ObjectID) Compare(other ObjectID) int {
+	for i := range id {
+		if id[i] != other[i] {
+			if id[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func processUnique() [5]byte {
+	var b [5]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Errorf("cannot initialize ObjectId generator: %w", err))
+	}
+	return b
+}
+
+func randomUint32() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Errorf("cannot initialize ObjectId generator: %w", err))
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// DateTime is a BSON UTC datetime in milliseconds since the Unix epoch
+type DateTime int64
+
+// NewDateTimeFromTime converts a time.Time to a DateTime
+func NewDateTimeFromTime(t time.Time) DateTime {
+	return DateTime(t.UnixMilli())
+}
+
+// Time converts the DateTime to a time.Time in UTC
+func (d DateTime) Time() time.Time {
+	return time.UnixMilli(int64(d)).UTC()
+}
+
+// String returns the DateTime in shell notation
+func (d DateTime) String() string {
+	return fmt.Sprintf("ISODate(%q)", d.Time().Format("2006-01-02T15:04:05.000Z07:00"))
+}
+
+// Binary subtypes
+const (
+	BinaryGeneric     byte = 0x00
+	BinaryFunction    byte = 0x01
+	BinaryBinaryOld   byte = 0x02
+	BinaryUUIDOld     byte = 0x03
+	BinaryUUID        byte = 0x04
+	BinaryMD5         byte = 0x05
+	BinaryEncrypted   byte = 0x06
+	BinaryColumn      byte = 0x07
+	BinarySensitive   byte = 0x08
+	BinaryVector      byte = 0x09
+	BinaryUserDefined byte = 0x80
+)
+
+// Binary is BSON binary data with its subtype
+type Binary struct {
+	Subtype byte
+	Data    []byte
+}
+
+// String returns the binary value in shell notation
+func (b Binary) String() string {
+	return fmt.Sprintf("Binary(%d, %x)", b.Subtype, b.Data)
+}
+
+// Regex is a BSON regular expression
+type Regex struct {
+	Pattern string
+	Options string
+}
+
+// String returns the regular expression in shell notation
+func (r Regex) String() string {
+	return fmt.Sprintf("/%s/%s", r.Pattern, r.Options)
+}
+
+// Timestamp is the internal BSON timestamp used for replication and
+// $clusterTime. T is seconds since the epoch and I an ordinal.
+type Timestamp struct {
+	T uint32
+	I uint32
+}
+
+// Compare orders timestamps by T then I
+func (ts Timestamp) Compare(other Timestamp) int {
+	switch {
+	case ts.T < other.T:
+		return -1
+	case ts.T > other.T:
+		return 1
+	case ts.I < other.I:
+		return -1
+	case ts.I > other.I:
+		return 1
+	}
+	return 0
+}
+
+// IsZero reports whether the timestamp is unset
+func (ts Timestamp) IsZero() bool {
+	return ts.T == 0 && ts.I == 0
+}
+
+// String returns the timestamp in shell notation
+func (ts Timestamp) String() string {
+	return fmt.Sprintf("Timestamp(%d, %d)", ts.T, ts.I)
+}
+
+// MinKey compares lower than every other BSON value
+type MinKey struct{}
+
+// MaxKey compares higher than every other BSON value
+type MaxKey struct{}
+
+// Undefined is the deprecated BSON undefined value
+type Undefined struct{}
+
+// Null is an explicit BSON null. A nil value encodes the same way.
+type Null struct{}
+
+// JavaScript is BSON JavaScript code
+type JavaScript string
+
+// Symbol is the deprecated BSON symbol type
+type Symbol string
+
+// CodeWithScope is JavaScript code with an associated scope document
+type CodeWithScope struct {
+	Code  JavaScript
+	Scope any
+}
+
+// DBPointer is the deprecated BSON database pointer
+type DBPointer struct {
+	DB      string
+	Pointer ObjectID
+}
+
+func (MinKey) String() string    { return "MinKey" }
+func (MaxKey) String() string    { return "MaxKey" }
+func (Undefined) String() string { return "undefined" }
+func (Null) String() string      { return "null" }
@@ -0,0 +1,503 @@
+package bson
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrElementNotFound is returned by Raw.LookupErr when a key is missing
+var ErrElementNotFound = errors.New("element not found")
+
+// Raw is an encoded BSON document. It is used to read replies without
+// decoding them fully and to pass documents through the proxy untouched.
+type Raw []byte
+
+// RawArray is an encoded BSON array
+type RawArray []byte
+
+// RawElement is a single element of a Raw document
+type RawElement struct {
+	Key   string
+	Value RawValue
+}
+
+// RawValue is an encoded BSON value together with its type
+type RawValue struct {
+	Type  Type
+	Value []byte
+}
+
+// Validate checks that the document and every nested document is well formed
+func (r Raw) Validate() error {
+	_, err := r.elements(true)
+	return err
+}
+
+// Elements returns the top level elements of the document
+func (r Raw) Elements() ([]RawElement, error) {
+	return r.elements(false)
+}
+
+func (r Raw) elements(deep bool) ([]RawElement, error) {
+	length, err := documentLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var elements []RawElement
+	pos := 4
+	for pos < length-1 {
+		typ := Type(r[pos])
+		pos++
+
+		keyEnd := bytes.IndexByte(r[pos:length-1], 0)
+		if keyEnd < 0 {
+			return nil, fmt.Errorf("unterminated element key")
+		}
+		key := string(r[pos : pos+keyEnd])
+		pos += keyEnd + 1
+
+		size, err := valueSize(typ, r[pos:length-1])
+		if err != nil {
+			return nil, fmt.Errorf("element %q: %w", key, err)
+		}
+		value := RawValue{Type: typ, Value: r[pos : pos+size]}
+		if deep {
+			if err := value.validate(); err != nil {
+				return nil, fmt.Errorf("element %q: %w", key, err)
+			}
+		}
+		elements = append(elements, RawElement{Key: key, Value: value})
+		pos += size
+	}
+
+	return elements, nil
+}
+
+// Lookup follows a path of keys through embedded documents and arrays. It
+// returns a zero RawValue if the path does not exist.
+func (r Raw) Lookup(key ...string) RawValue {
+	v, _ := r.LookupErr(key...)
+	return v
+}
+
+// LookupErr is like Lookup but reports why the path could not be followed
+func (r Raw) LookupErr(key ...string) (RawValue, error) {
+	if len(key) == 0 {
+		return RawValue{}, fmt.Errorf("empty lookup path")
+	}
+	elements, err := r.Elements()
+	if err != nil {
+		return RawValue{}, err
+	}
+	for _, e := range elements {
+		if e.Key != key[0] {
+			continue
+		}
+		if len(key) == 1 {
+			return e.Value, nil
+		}
+		if e.Value.Type != TypeDocument && e.Value.Type != TypeArray {
+			return RawValue{}, fmt.Errorf("cannot descend into %s element %q", e.Value.Type, e.Key)
+		}
+		return Raw(e.Value.Value).LookupErr(key[1:]...)
+	}
+	return RawValue{}, ErrElementNotFound
+}
+
+// String renders the document for logging
+func (r Raw) String() string {
+	d, err := Unmarshal(r)
+	if err != nil {
+		return fmt.Sprintf("<invalid bson: %v>", err)
+	}
+	return d.String()
+}
+
+// Values returns the values of the array in order
+func (a RawArray) Values() ([]RawValue, error) {
+	elements, err := Raw(a).Elements()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]RawValue, len(elements))
+	for i, e := range elements {
+		values[i] = e.Value
+	}
+	return values, nil
+}
+
+// String renders the array for logging
+func (a RawArray) String() string {
+	v, err := RawValue{Type: TypeArray, Value: a}.Interface()
+	if err != nil {
+		return fmt.Sprintf("<invalid bson: %v>", err)
+	}
+	return formatValue(v)
+}
+
+// IsZero reports whether the value is unset, e.g. after a failed Lookup
+func (v RawValue) IsZero() bool {
+	return v.Type == 0 && len(v.Value) == 0
+}
+
+func (v RawValue) validate() error {
+	switch v.Type {
+	case TypeDocument, TypeArray:
+		return Raw(v.Value).Validate()
+	case TypeCodeWithScope:
+		_, err := v.codeWithScope()
+		return err
+	case TypeString, TypeJavaScript, TypeSymbol:
+		if v.Value[len(v.Value)-1] != 0 {
+			return fmt.Errorf("string is not NUL terminated")
+		}
+	case TypeBoolean:
+		if v.Value[0] > 1 {
+			return fmt.Errorf("invalid boolean byte 0x%02x", v.Value[0])
+		}
+	}
+	return nil
+}
+
+// Interface decodes the value into its Go representation
+func (v RawValue) Interface() (any, error) {
+	switch v.Type {
+	case TypeDouble:
+		return v.Double(), nil
+	case TypeString:
+		return v.StringValue(), nil
+	case TypeDocument:
+		return Unmarshal(v.Value)
+	case TypeArray:
+		values, err := RawArray(v.Value).Values()
+		if err != nil {
+			return nil, err
+		}
+		a := make(A, len(values))
+		for i, elem := range values {
+			if err := elem.validate(); err != nil {
+				return nil, err
+			}
+			if a[i], err = elem.Interface(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case TypeBinary:
+		return v.Binary(), nil
+	case TypeUndefined:
+		return Undefined{}, nil
+	case TypeObjectID:
+		return v.ObjectID(), nil
+	case TypeBoolean:
+		return v.Boolean(), nil
+	case TypeDateTime:
+		return v.DateTime(), nil
+	case TypeNull:
+		return nil, nil
+	case TypeRegex:
+		return v.Regex(), nil
+	case TypeDBPointer:
+		n := int(binary.LittleEndian.Uint32(v.Value))
+		p := DBPointer{DB: string(v.Value[4 : 4+n-1])}
+		copy(p.Pointer[:], v.Value[4+n:])
+		return p, nil
+	case TypeJavaScript:
+		return JavaScript(v.StringValue()), nil
+	case TypeSymbol:
+		return Symbol(v.StringValue()), nil
+	case TypeCodeWithScope:
+		return v.codeWithScope()
+	case TypeInt32:
+		return v.Int32(), nil
+	case TypeTimestamp:
+		return v.Timestamp(), nil
+	case TypeInt64:
+		return v.Int64(), nil
+	case TypeDecimal128:
+		return v.Decimal128(), nil
+	case TypeMinKey:
+		return MinKey{}, nil
+	case TypeMaxKey:
+		return MaxKey{}, nil
+	}
+	return nil, fmt.Errorf("unknown element type 0x%02x", byte(v.Type))
+}
+
+func (v RawValue) codeWithScope() (CodeWithScope, error) {
+	data := v.Value
+	if len(data) < 4+5+5 {
+		return CodeWithScope{}, fmt.Errorf("code with scope too short")
+	}
+	n, err := valueSize(TypeString, data[4:])
+	if err != nil {
+		return CodeWithScope{}, err
+	}
+	code := RawValue{Type: TypeString, Value: data[4 : 4+n]}
+	if err := code.validate(); err != nil {
+		return CodeWithScope{}, err
+	}
+	length, err := documentLength(data[4+n:])
+	if err != nil {
+		return CodeWithScope{}, fmt.Errorf("code with scope: %w", err)
+	}
+	if 4+n+length != len(data) {
+		return CodeWithScope{}, fmt.Errorf("code with scope length mismatch")
+	}
+	scope, err := Unmarshal(data[4+n:])
+	if err != nil {
+		return CodeWithScope{}, fmt.Errorf("code with scope: %w", err)
+	}
+	return CodeWithScope{Code: JavaScript(code.StringValue()), Scope: scope}, nil
+}
+
+// Double returns the value of a double, or 0 for other types
+func (v RawValue) Double() float64 {
+	if v.Type != TypeDouble {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(v.Value))
+}
+
+// StringValue returns the value of a string, or "" for other types
+func (v RawValue) StringValue() string {
+	s, _ := v.StringValueOK()
+	return s
+}
+
+// StringValueOK returns the value of a string, JavaScript or symbol element
+func (v RawValue) StringValueOK() (string, bool) {
+	switch v.Type {
+	case TypeString, TypeJavaScript, TypeSymbol:
+		return string(v.Value[4 : len(v.Value)-1]), true
+	}
+	return "", false
+}
+
+// Document returns the value of an embedded document
+func (v RawValue) Document() Raw {
+	if v.Type != TypeDocument {
+		return nil
+	}
+	return Raw(v.Value)
+}
+
+// Array returns the value of an array
+func (v RawValue) Array() RawArray {
+	if v.Type != TypeArray {
+		return nil
+	}
+	return RawArray(v.Value)
+}
+
+// Binary returns the value of a binary element
+func (v RawValue) Binary() Binary {
+	if v.Type != TypeBinary {
+		return Binary{}
+	}
+	n := int(binary.LittleEndian.Uint32(v.Value))
+	b := Binary{Subtype: v.Value[4], Data: v.Value[5 : 5+n]}
+	if b.Subtype == BinaryBinaryOld && len(b.Data) >= 4 {
+		b.Data = b.Data[4:]
+	}
+	return b
+}
+
+// ObjectID returns the value of an ObjectId element
+func (v RawValue) ObjectID() ObjectID {
+	var id ObjectID
+	if v.Type == TypeObjectID {
+		copy(id[:], v.Value)
+	}
+	return id
+}
+
+// Boolean returns the value of a boolean element
+func (v RawValue) Boolean() bool {
+	return v.Type == TypeBoolean && v.Value[0] == 1
+}
+
+// DateTime returns the value of a datetime element
+func (v RawValue) DateTime() DateTime {
+	if v.Type != TypeDateTime {
+		return 0
+	}
+	return DateTime(binary.LittleEndian.Uint64(v.Value))
+}
+
+// Time returns the value of a datetime element as a time.Time
+func (v RawValue) Time() time.Time {
+	return v.DateTime().Time()
+}
+
+// Regex returns the value of a regular expression element
+func (v RawValue) Regex() Regex {
+	if v.Type != TypeRegex {
+		return Regex{}
+	}
+	pattern, rest, _ := bytes.Cut(v.Value, []byte{0})
+	options, _, _ := bytes.Cut(rest, []byte{0})
+	return Regex{Pattern: string(pattern), Options: string(options)}
+}
+
+// Int32 returns the value of an int32 element
+func (v RawValue) Int32() int32 {
+	if v.Type != TypeInt32 {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(v.Value))
+}
+
+// Int64 returns the value of an int64 element
+func (v RawValue) Int64() int64 {
+	if v.Type != TypeInt64 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(v.Value))
+}
+
+// AsInt64OK converts any numeric element to int64. Doubles must be integral.
+func (v RawValue) AsInt64OK() (int64, bool) {
+	switch v.Type {
+	case TypeInt32:
+		return int64(v.Int32()), true
+	case TypeInt64:
+		return v.Int64(), true
+	case TypeDouble:
+		f := v.Double()
+		if f != math.Trunc(f) || f < math.MinInt64 || f > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(f), true
+	}
+	return 0, false
+}
+
+// AsFloat64OK converts any numeric element to float64
+func (v RawValue) AsFloat64OK() (float64, bool) {
+	switch v.Type {
+	case TypeInt32:
+		return float64(v.Int32()), true
+	case TypeInt64:
+		return float64(v.Int64()), true
+	case TypeDouble:
+		return v.Double(), true
+	}
+	return 0, false
+}
+
+// Timestamp returns the value of a timestamp element
+func (v RawValue) Timestamp() Timestamp {
+	if v.Type != TypeTimestamp {
+		return Timestamp{}
+	}
+	return Timestamp{
+		I: binary.LittleEndian.Uint32(v.Value[0:4]),
+		T: binary.LittleEndian.Uint32(v.Value[4:8]),
+	}
+}
+
+// Decimal128 returns the value of a decimal element
+func (v RawValue) Decimal128() Decimal128 {
+	if v.Type != TypeDecimal128 {
+		return Decimal128{}
+	}
+	return Decimal128{
+		l: binary.LittleEndian.Uint64(v.Value[0:8]),
+		h: binary.LittleEndian.Uint64(v.Value[8:16]),
+	}
+}
+
+// documentLength validates the length prefix and terminator of a document
+func documentLength(doc []byte) (int, error) {
+	if len(doc) < 5 {
+		return 0, fmt.Errorf("document too short: %d bytes", len(doc))
+	}
+	length := int(int32(binary.LittleEndian.Uint32(doc[0:4])))
+	if length < 5 || length > len(doc) {
+		return 0, fmt.Errorf("invalid document length: %d", length)
+	}
+	if doc[length-1] != 0 {
+		return 0, fmt.Errorf("document is not NUL terminated")
+	}
+	return length, nil
+}
+
+// valueSize returns the encoded size of a value of the given type at the
+// start of data
+func valueSize(typ Type, data []byte) (int, error) {
+	var size int
+	switch typ {
+	case TypeDouble, TypeDateTime, TypeInt64, TypeTimestamp:
+		size = 8
+	case TypeDecimal128:
+		size = 16
+	case TypeInt32:
+		size = 4
+	case TypeObjectID:
+		size = 12
+	case TypeBoolean:
+		size = 1
+	case TypeNull, TypeUndefined, TypeMinKey, TypeMaxKey:
+		size = 0
+	case TypeString, TypeJavaScript, TypeSymbol:
+		if len(data) < 4 {
+			return 0, fmt.Errorf("truncated string")
+		}
+		size = 4 + int(int32(binary.LittleEndian.Uint32(data)))
+		if size < 5 {
+			return 0, fmt.Errorf("invalid string length")
+		}
+	case TypeDocument, TypeArray:
+		length, err := documentLength(data)
+		if err != nil {
+			return 0, err
+		}
+		size = length
+	case TypeCodeWithScope:
+		if len(data) < 4 {
+			return 0, fmt.Errorf("truncated code with scope")
+		}
+		size = int(int32(binary.LittleEndian.Uint32(data)))
+		if size < 14 {
+			return 0, fmt.Errorf("invalid code with scope length")
+		}
+	case TypeBinary:
+		if len(data) < 5 {
+			return 0, fmt.Errorf("truncated binary")
+		}
+		size = 5 + int(int32(binary.LittleEndian.Uint32(data)))
+		if size < 5 {
+			return 0, fmt.Errorf("invalid binary length")
+		}
+	case TypeRegex:
+		for i := 0; i < 2; i++ {
+			end := bytes.IndexByte(data[size:], 0)
+			if end < 0 {
+				return 0, fmt.Errorf("unterminated regex")
+			}
+			size += end + 1
+		}
+	case TypeDBPointer:
+		if len(data) < 4 {
+			return 0, fmt.Errorf("truncated dbpointer")
+		}
+		size = 4 + int(int32(binary.LittleEndian.Uint32(data)))
+		if size < 5 {
+			return 0, fmt.Errorf("invalid dbpointer length")
+		}
+		size += 12
+	default:
+		return 0, fmt.Errorf("unknown element type 0x%02x", byte(typ))
+	}
+
+	if size > len(data) {
+		return 0, fmt.Errorf("%s value overflows document", typ)
+	}
+	return size, nil
+}
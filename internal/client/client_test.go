@@ -2,18 +2,92 @@ package client
 
 import (
 	"context"
+	"encoding/binary"
+	"io"
+	"net"
 	"testing"
 	"time"
 
+	"mongo-playground/internal/bson"
 	"mongo-playground/internal/proxy"
 	pb "mongo-playground/proto/proxy"
 )
 
+// fakeMongod answers every message with a reply containing an empty cursor,
+// a supported maxWireVersion and ok: 1, which is enough for the handshake,
+// insert and find. The OP_QUERY handshake is answered with an OP_REPLY and
+// other messages with an OP_MSG.
+func fakeMongod(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	body, err := bson.Marshal(bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: bson.A{}},
+			{Key: "id", Value: int64(0)},
+		}},
+		{Key: "maxWireVersion", Value: 21},
+		{Key: "ok", Value: 1.0},
+	})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	reply := append([]byte{0, 0, 0, 0, 0}, body...)
+	legacyReply := (&proxy.LegacyReply{Documents: []bson.Raw{body}}).Encode()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					header := make([]byte, 16)
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					length := binary.LittleEndian.Uint32(header[0:4])
+					if _, err := io.CopyN(io.Discard, conn, int64(length)-16); err != nil {
+						return
+					}
+					opCode, payload := proxy.OpMsg, reply
+					if int32(binary.LittleEndian.Uint32(header[12:16])) == proxy.OpQuery {
+						opCode, payload = proxy.OpReply, legacyReply
+					}
+					out := make([]byte, 16, 16+len(payload))
+					binary.LittleEndian.PutUint32(out[0:4], uint32(16+len(payload)))
+					copy(out[8:12], header[4:8])
+					binary.LittleEndian.PutUint32(out[12:16], uint32(opCode))
+					if _, err := conn.Write(append(out, payload...)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
 func TestClient_InsertAndFind(t *testing.T) {
 	addr := "127.0.0.1:50051"
 
+	// Connect the backend replica set
+	replset := proxy.NewReplset([]string{fakeMongod(t)})
+	if err := replset.Connect(context.Background()); err != nil {
+		t.Fatalf("failed Connect: %v", err)
+	}
+	t.Cleanup(func() { replset.Disconnect() })
+
 	// Start the server
-	srv := proxy.NewServer()
+	srv := proxy.NewServer(replset)
 	srv.Start(addr)
 	t.Cleanup(srv.Stop)
 
@@ -29,7 +103,11 @@ func TestClient_InsertAndFind(t *testing.T) {
 	t.Cleanup(cancel)
 
 	// Insert a document
-	insResp, err := client.Insert(ctx, &pb.InsertRequest{Db: "test", Collection: "col"})
+	document, err := bson.Marshal(bson.D{{Key: "name", Value: "John"}})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	insResp, err := client.Insert(ctx, &pb.InsertRequest{Db: "test", Collection: "col", Documents: [][]byte{document}})
 	if err != nil {
 		t.Fatalf("Insert error: %v", err)
 	}
@@ -0,0 +1,409 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mongo-playground/internal/bson"
+)
+
+// Authentication mechanisms
+const (
+	MechanismSCRAMSHA1   = "SCRAM-SHA-1"
+	MechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	MechanismX509        = "MONGODB-X509"
+)
+
+// minSCRAMIterations is the lowest iteration count accepted from a server
+const minSCRAMIterations = 4096
+
+// Credential authenticates the pooled connections of a Replset
+type Credential struct {
+	Username string
+	Password string
+
+	// Source is the database holding the user. Defaults to admin, or to
+	// $external for MONGODB-X509.
+	Source string
+
+	// Mechanism is MechanismSCRAMSHA256, MechanismSCRAMSHA1 or
+	// MechanismX509. When empty the mechanism is negotiated with the server,
+	// preferring SCRAM-SHA-256 and using SCRAM-SHA-1 when the server does
+	// not list the user's mechanisms.
+	Mechanism string
+}
+
+// source returns the authentication database
+func (c Credential) source() string {
+	switch {
+	case c.Source != "":
+		return c.Source
+	case c.Mechanism == MechanismX509:
+		return "$external"
+	}
+	return "admin"
+}
+
+// validate checks the credential against the TLS options it is used with
+func (c Credential) validate(tlsOpts *TLSOptions) error {
+	switch c.Mechanism {
+	case "", MechanismSCRAMSHA1, MechanismSCRAMSHA256:
+		if c.Username == "" {
+			return fmt.Errorf("SCRAM authentication requires a username")
+		}
+	case MechanismX509:
+		if tlsOpts == nil || tlsOpts.CertFile == "" {
+			return fmt.Errorf("%s requires TLS with a client certificate", MechanismX509)
+		}
+		if c.Password != "" {
+			return fmt.Errorf("%s does not accept a password", MechanismX509)
+		}
+		if c.source() != "$external" {
+			return fmt.Errorf("%s requires the $external source", MechanismX509)
+		}
+	default:
+		return fmt.Errorf("unsupported authentication mechanism %q", c.Mechanism)
+	}
+	return nil
+}
+
+// scramKeyID identifies the salted password of one credential on the server
+type scramKeyID struct {
+	mechanism  string
+	salt       string
+	iterations int
+}
+
+// scramKeys are derived from the salted password, which is expensive to
+// compute and therefore cached per salt and iteration count
+type scramKeys struct {
+	clientKey []byte
+	serverKey []byte
+}
+
+// authenticator runs SASL conversations for a credential, caching the
+// derived keys across connections
+type authenticator struct {
+	cred Credential
+
+	mu   sync.Mutex
+	keys map[scramKeyID]scramKeys
+}
+
+// newAuthenticator returns nil when cred is nil, i.e. auth is disabled
+func newAuthenticator(cred *Credential) *authenticator {
+	if cred == nil {
+		return nil
+	}
+	return &authenticator{cred: *cred, keys: make(map[scramKeyID]scramKeys)}
+}
+
+// authenticate runs the SASL conversation on a freshly dialed connection,
+// given the reply to its handshake hello
+func (a *authenticator) authenticate(ctx context.Context, c *connection, hello bson.Raw) error {
+	mechanism := a.cred.Mechanism
+	if mechanism == "" {
+		var err error
+		if mechanism, err = a.negotiate(hello); err != nil {
+			return err
+		}
+	}
+	if mechanism == MechanismX509 {
+		return a.authenticateX509(ctx, c)
+	}
+
+	var newHash func() hash.Hash
+	password := a.cred.Password
+	switch mechanism {
+	case MechanismSCRAMSHA256:
+		newHash = sha256.New
+		prepared, err := saslPrep(password)
+		if err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+		password = prepared
+	case MechanismSCRAMSHA1:
+		newHash = sha1.New
+		password = mongoPasswordDigest(a.cred.Username, password)
+	default:
+		return fmt.Errorf("unsupported authentication mechanism %q", mechanism)
+	}
+
+	nonce, err := newSCRAMNonce()
+	if err != nil {
+		return err
+	}
+	client := &scramClient{
+		mechanism: mechanism,
+		newHash:   newHash,
+		username:  a.cred.Username,
+		password:  password,
+		nonce:     nonce,
+		keys:      a.cachedKeys,
+	}
+	if err := a.converse(ctx, c, client); err != nil {
+		return fmt.Errorf("authentication of %q on %s with %s failed: %w", a.cred.Username, c.addr, mechanism, err)
+	}
+	return nil
+}
+
+// authenticateX509 authenticates with the client certificate presented
+// during the TLS handshake. Without a username the server derives the user
+// from the certificate subject.
+func (a *authenticator) authenticateX509(ctx context.Context, c *connection) error {
+	command := bson.D{
+		{Key: "authenticate", Value: 1},
+		{Key: "mechanism", Value: MechanismX509},
+	}
+	if a.cred.Username != "" {
+		command = append(command, bson.E{Key: "user", Value: a.cred.Username})
+	}
+	command = append(command, bson.E{Key: "$db", Value: a.cred.source()})
+
+	if _, err := saslCommand(ctx, c, command); err != nil {
+		return fmt.Errorf("authentication on %s with %s failed: %w", c.addr, MechanismX509, err)
+	}
+	return nil
+}
+
+// negotiate picks the strongest SCRAM mechanism the user supports from the
+// saslSupportedMechs of the handshake hello reply. Servers before 4.0,
+// which predate SCRAM-SHA-256, and servers that do not know the user leave
+// it out, in which case SCRAM-SHA-1 is used.
+func (a *authenticator) negotiate(hello bson.Raw) (string, error) {
+	mechanisms := stringArray(hello.Lookup("saslSupportedMechs"))
+	if slices.Contains(mechanisms, MechanismSCRAMSHA256) {
+		return MechanismSCRAMSHA256, nil
+	}
+	if len(mechanisms) == 0 || slices.Contains(mechanisms, MechanismSCRAMSHA1) {
+		return MechanismSCRAMSHA1, nil
+	}
+	return "", fmt.Errorf("no supported authentication mechanism in %v", mechanisms)
+}
+
+// converse runs saslStart and saslContinue until the server is done
+func (a *authenticator) converse(ctx context.Context, c *connection, client *scramClient) error {
+	db := a.cred.source()
+
+	reply, err := saslCommand(ctx, c, bson.D{
+		{Key: "saslStart", Value: 1},
+		{Key: "mechanism", Value: client.mechanism},
+		{Key: "payload", Value: []byte(client.first())},
+		{Key: "autoAuthorize", Value: 1},
+		{Key: "options", Value: bson.D{{Key: "skipEmptyExchange", Value: true}}},
+		{Key: "$db", Value: db},
+	})
+	if err != nil {
+		return err
+	}
+	conversationID := reply.Lookup("conversationId")
+
+	final, err := client.final(saslPayload(reply))
+	if err != nil {
+		return err
+	}
+	reply, err = saslCommand(ctx, c, bson.D{
+		{Key: "saslContinue", Value: 1},
+		{Key: "conversationId", Value: conversationID},
+		{Key: "payload", Value: []byte(final)},
+		{Key: "$db", Value: db},
+	})
+	if err != nil {
+		return err
+	}
+	if err := client.verify(saslPayload(reply)); err != nil {
+		return err
+	}
+
+	// Servers that ignore skipEmptyExchange expect one more empty round
+	for !reply.Lookup("done").Boolean() {
+		reply, err = saslCommand(ctx, c, bson.D{
+			{Key: "saslContinue", Value: 1},
+			{Key: "conversationId", Value: conversationID},
+			{Key: "payload", Value: []byte{}},
+			{Key: "$db", Value: db},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedKeys returns the keys for a salt and iteration count, deriving and
+// caching them on first use
+func (a *authenticator) cachedKeys(id scramKeyID, derive func() scramKeys) scramKeys {
+	a.mu.Lock()
+	keys, ok := a.keys[id]
+	a.mu.Unlock()
+	if ok {
+		return keys
+	}
+
+	keys = derive()
+	a.mu.Lock()
+	a.keys[id] = keys
+	a.mu.Unlock()
+	return keys
+}
+
+// saslCommand runs one authentication command and returns the reply body
+func saslCommand(ctx context.Context, c *connection, command bson.D) (bson.Raw, error) {
+	reply, err := c.runCommand(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Body, nil
+}
+
+// saslPayload returns the payload of a SASL reply
+func saslPayload(reply bson.Raw) string {
+	return string(reply.Lookup("payload").Binary().Data)
+}
+
+// mongoPasswordDigest is the password used by SCRAM-SHA-1, which MongoDB
+// hashes before salting
+func mongoPasswordDigest(username, password string) string {
+	sum := md5.Sum([]byte(username + ":mongo:" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSCRAMNonce returns a random client nonce
+func newSCRAMNonce() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// scramClient is the client side of one SCRAM conversation (RFC 5802)
+type scramClient struct {
+	mechanism string
+	newHash   func() hash.Hash
+	username  string
+	password  string
+	nonce     string
+	keys      func(scramKeyID, func() scramKeys) scramKeys
+
+	firstBare   string
+	authMessage string
+	serverKey   []byte
+}
+
+// first returns the client-first-message
+func (s *scramClient) first() string {
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.username)
+	s.firstBare = "n=" + username + ",r=" + s.nonce
+	return "n,," + s.firstBare
+}
+
+// final computes the client-final-message from the server-first-message
+func (s *scramClient) final(serverFirst string) (string, error) {
+	attrs := parseSCRAMAttributes(serverFirst)
+	if msg, ok := attrs["e"]; ok {
+		return "", fmt.Errorf("server error: %s", msg)
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return "", fmt.Errorf("invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return "", fmt.Errorf("invalid salt")
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < minSCRAMIterations {
+		return "", fmt.Errorf("invalid iteration count %q", attrs["i"])
+	}
+
+	id := scramKeyID{mechanism: s.mechanism, salt: string(salt), iterations: iterations}
+	derive := func() scramKeys {
+		salted := pbkdf2(s.newHash, []byte(s.password), salt, iterations)
+		return scramKeys{
+			clientKey: s.hmac(salted, "Client Key"),
+			serverKey: s.hmac(salted, "Server Key"),
+		}
+	}
+	var keys scramKeys
+	if s.keys != nil {
+		keys = s.keys(id, derive)
+	} else {
+		keys = derive()
+	}
+	s.serverKey = keys.serverKey
+
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.firstBare + "," + serverFirst + "," + withoutProof
+
+	h := s.newHash()
+	h.Write(keys.clientKey)
+	storedKey := h.Sum(nil)
+	proof := s.hmac(storedKey, s.authMessage)
+	for i := range proof {
+		proof[i] ^= keys.clientKey[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server signature in the server-final-message
+func (s *scramClient) verify(serverFinal string) error {
+	attrs := parseSCRAMAttributes(serverFinal)
+	if msg, ok := attrs["e"]; ok {
+		return fmt.Errorf("server error: %s", msg)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(signature, s.hmac(s.serverKey, s.authMessage)) {
+		return fmt.Errorf("invalid server signature")
+	}
+	return nil
+}
+
+func (s *scramClient) hmac(key []byte, message string) []byte {
+	mac := hmac.New(s.newHash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// parseSCRAMAttributes splits a SCRAM message into its attributes
+func parseSCRAMAttributes(message string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(message, ",") {
+		if key, value, ok := strings.Cut(part, "="); ok {
+			attrs[key] = value
+		}
+	}
+	return attrs
+}
+
+// pbkdf2 derives a key of the hash size from a password (RFC 8018). SCRAM
+// only ever needs the first block.
+func pbkdf2(newHash func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(newHash, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := bytes.Clone(u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
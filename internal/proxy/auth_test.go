@@ -0,0 +1,390 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+func TestSCRAMConversationRFCVectors(t *testing.T) {
+	tests := []struct {
+		name        string
+		mechanism   string
+		newHash     func() hash.Hash
+		nonce       string
+		serverFirst string
+		clientFinal string
+		serverFinal string
+	}{
+		{
+			// RFC 5802, section 5
+			name:        "SHA-1",
+			mechanism:   MechanismSCRAMSHA1,
+			newHash:     sha1.New,
+			nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+			serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			// RFC 7677, section 3
+			name:        "SHA-256",
+			mechanism:   MechanismSCRAMSHA256,
+			newHash:     sha256.New,
+			nonce:       "rOprNGfwEbeRWgbNEkqO",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &scramClient{
+				mechanism: tt.mechanism,
+				newHash:   tt.newHash,
+				username:  "user",
+				password:  "pencil",
+				nonce:     tt.nonce,
+			}
+			if first := client.first(); first != "n,,n=user,r="+tt.nonce {
+				t.Errorf("Unexpected client-first-message %q", first)
+			}
+			final, err := client.final(tt.serverFirst)
+			if err != nil {
+				t.Fatalf("final failed: %v", err)
+			}
+			if final != tt.clientFinal {
+				t.Errorf("Expected client-final-message %q, got %q", tt.clientFinal, final)
+			}
+			if err := client.verify(tt.serverFinal); err != nil {
+				t.Errorf("verify failed: %v", err)
+			}
+			if err := client.verify("v=" + base64.StdEncoding.EncodeToString([]byte("forged"))); err == nil {
+				t.Error("Expected a forged server signature to be rejected")
+			}
+		})
+	}
+}
+
+func TestSCRAMRejectsInvalidServerFirst(t *testing.T) {
+	tests := []string{
+		"r=othernonce,s=QSXCR+Q6sek8bf92,i=4096",
+		"r=abc,s=QSXCR+Q6sek8bf92,i=4096",
+		"r=abcdef,s=!!!,i=4096",
+		"r=abcdef,s=QSXCR+Q6sek8bf92,i=1000",
+		"e=other-error",
+	}
+	for _, serverFirst := range tests {
+		client := &scramClient{mechanism: MechanismSCRAMSHA256, newHash: sha256.New, username: "user", password: "pencil", nonce: "abc"}
+		client.first()
+		if _, err := client.final(serverFirst); err == nil {
+			t.Errorf("Expected %q to be rejected", serverFirst)
+		}
+	}
+}
+
+func TestSCRAMEscapesUsername(t *testing.T) {
+	client := &scramClient{username: "a=b,c", nonce: "n"}
+	if first := client.first(); first != "n,,n=a=3Db=2Cc,r=n" {
+		t.Errorf("Unexpected client-first-message %q", first)
+	}
+}
+
+func TestMongoPasswordDigest(t *testing.T) {
+	// The digest stored by MongoDB for user "user" with password "pencil"
+	if got := mongoPasswordDigest("user", "pencil"); got != "1c33006ec1ffd90f9cadcbcc0e118200" {
+		t.Errorf("Unexpected digest %s", got)
+	}
+}
+
+func TestSASLPrep(t *testing.T) {
+	// Examples from RFC 4013, section 3
+	tests := []struct {
+		in, out string
+		fails   bool
+	}{
+		{in: "I­X", out: "IX"},
+		{in: "user", out: "user"},
+		{in: "USER", out: "USER"},
+		{in: "ª", out: "a"},
+		{in: "Ⅸ", out: "IX"},
+		{in: "a b", out: "a b"},
+		{in: "\u0007", fails: true},
+		{in: "ا1", fails: true},
+		{in: "ا1ب", out: "ا1ب"},
+	}
+	for _, tt := range tests {
+		got, err := saslPrep(tt.in)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("saslPrep(%q): expected an error", tt.in)
+			}
+			continue
+		}
+		if err != nil || got != tt.out {
+			t.Errorf("saslPrep(%q) = %q, %v; expected %q", tt.in, got, err, tt.out)
+		}
+	}
+}
+
+func TestAuthenticatorCachesKeys(t *testing.T) {
+	a := newAuthenticator(&Credential{Username: "user", Password: "pencil"})
+	derived := 0
+	derive := func() scramKeys {
+		derived++
+		return scramKeys{clientKey: []byte{1}, serverKey: []byte{2}}
+	}
+
+	id := scramKeyID{mechanism: MechanismSCRAMSHA256, salt: "salt", iterations: 4096}
+	a.cachedKeys(id, derive)
+	a.cachedKeys(id, derive)
+	if derived != 1 {
+		t.Errorf("Expected keys to be derived once, got %d", derived)
+	}
+	id.salt = "other"
+	a.cachedKeys(id, derive)
+	if derived != 2 {
+		t.Errorf("Expected a new salt to derive new keys, got %d derivations", derived)
+	}
+}
+
+// mockSCRAMServer answers hello and SASL conversations for one user
+type mockSCRAMServer struct {
+	t          *testing.T
+	username   string
+	password   string
+	mechanisms []string
+	salt       []byte
+
+	mu            sync.Mutex
+	conversations map[int32]*mockSCRAMConversation
+	nextID        int32
+	succeeded     int
+	failed        int
+}
+
+type mockSCRAMConversation struct {
+	mechanism   string
+	authMessage string
+	nonce       string
+}
+
+func newMockSCRAMServer(t *testing.T, username, password string, mechanisms ...string) *mockSCRAMServer {
+	return &mockSCRAMServer{
+		t:             t,
+		username:      username,
+		password:      password,
+		mechanisms:    mechanisms,
+		salt:          []byte("0123456789abcdef"),
+		conversations: make(map[int32]*mockSCRAMConversation),
+	}
+}
+
+func (s *mockSCRAMServer) handle(opCode int32, payload []byte) []byte {
+	request, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+	if err != nil {
+		s.t.Errorf("mock received invalid OP_MSG: %v", err)
+		return testOpMsgPayload(s.t, bson.D{{Key: "ok", Value: 0.0}})
+	}
+	elements, _ := request.Body.Elements()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch elements[0].Key {
+	case "hello":
+		reply := bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "maxWireVersion", Value: 21}}
+		if user := request.Body.Lookup("saslSupportedMechs").StringValue(); user == "admin."+s.username {
+			mechanisms := make(bson.A, len(s.mechanisms))
+			for i, m := range s.mechanisms {
+				mechanisms[i] = m
+			}
+			reply = append(reply, bson.E{Key: "saslSupportedMechs", Value: mechanisms})
+		}
+		return testOpMsgPayload(s.t, append(reply, bson.E{Key: "ok", Value: 1.0}))
+	case "saslStart":
+		return testOpMsgPayload(s.t, s.start(request.Body))
+	case "saslContinue":
+		return testOpMsgPayload(s.t, s.next(request.Body))
+	}
+	return testOpMsgPayload(s.t, bson.D{{Key: "ok", Value: 1.0}})
+}
+
+func (s *mockSCRAMServer) hash(mechanism string) func() hash.Hash {
+	if mechanism == MechanismSCRAMSHA1 {
+		return sha1.New
+	}
+	return sha256.New
+}
+
+func (s *mockSCRAMServer) start(body bson.Raw) bson.D {
+	mechanism := body.Lookup("mechanism").StringValue()
+	clientFirst := string(body.Lookup("payload").Binary().Data)
+	bare := strings.TrimPrefix(clientFirst, "n,,")
+	attrs := parseSCRAMAttributes(bare)
+	if attrs["n"] != s.username {
+		s.failed++
+		return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: "Authentication failed."}, {Key: "code", Value: 18}}
+	}
+
+	s.nextID++
+	conv := &mockSCRAMConversation{mechanism: mechanism, nonce: attrs["r"] + "servernonce"}
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=4096", conv.nonce, base64.StdEncoding.EncodeToString(s.salt))
+	conv.authMessage = bare + "," + serverFirst + ",c=biws,r=" + conv.nonce
+	s.conversations[s.nextID] = conv
+
+	return bson.D{
+		{Key: "conversationId", Value: s.nextID},
+		{Key: "done", Value: false},
+		{Key: "payload", Value: []byte(serverFirst)},
+		{Key: "ok", Value: 1.0},
+	}
+}
+
+func (s *mockSCRAMServer) next(body bson.Raw) bson.D {
+	id := body.Lookup("conversationId").Int32()
+	conv := s.conversations[id]
+	delete(s.conversations, id)
+	if conv == nil {
+		return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: "no such conversation"}}
+	}
+
+	password := s.password
+	if conv.mechanism == MechanismSCRAMSHA1 {
+		password = mongoPasswordDigest(s.username, password)
+	}
+	client := &scramClient{newHash: s.hash(conv.mechanism), password: password}
+	salted := pbkdf2(client.newHash, []byte(password), s.salt, 4096)
+	clientKey := client.hmac(salted, "Client Key")
+	serverKey := client.hmac(salted, "Server Key")
+	h := client.newHash()
+	h.Write(clientKey)
+	expected := client.hmac(h.Sum(nil), conv.authMessage)
+	for i := range expected {
+		expected[i] ^= clientKey[i]
+	}
+
+	attrs := parseSCRAMAttributes(string(body.Lookup("payload").Binary().Data))
+	if attrs["r"] != conv.nonce || attrs["p"] != base64.StdEncoding.EncodeToString(expected) {
+		s.failed++
+		return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: "Authentication failed."}, {Key: "code", Value: 18}}
+	}
+
+	s.succeeded++
+	signature := base64.StdEncoding.EncodeToString(client.hmac(serverKey, conv.authMessage))
+	return bson.D{
+		{Key: "conversationId", Value: id},
+		{Key: "done", Value: true},
+		{Key: "payload", Value: []byte("v=" + signature)},
+		{Key: "ok", Value: 1.0},
+	}
+}
+
+func (s *mockSCRAMServer) counts() (succeeded, failed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.succeeded, s.failed
+}
+
+// connectWithCredential connects a Replset with auth to a mock SCRAM server
+func connectWithCredential(t *testing.T, scram *mockSCRAMServer, cred *Credential) (*Replset, error) {
+	t.Helper()
+
+	server, err := newMockMongoServerWithHandler(scram.handle)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	opts := DefaultOptions()
+	opts.Credential = cred
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { replset.Disconnect() })
+	return replset, nil
+}
+
+func TestReplsetAuthenticatesPooledConnections(t *testing.T) {
+	for _, mechanism := range []string{MechanismSCRAMSHA256, MechanismSCRAMSHA1} {
+		t.Run(mechanism, func(t *testing.T) {
+			scram := newMockSCRAMServer(t, "alice", "s3cret", mechanism)
+			replset, err := connectWithCredential(t, scram, &Credential{Username: "alice", Password: "s3cret"})
+			if err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+
+			// Run commands concurrently so that the pool opens several connections
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					if _, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil); err != nil {
+						t.Errorf("SendCommand failed: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			succeeded, failed := scram.counts()
+			if created := replset.PoolStats()[0].Created; uint64(succeeded) != created || failed != 0 {
+				t.Errorf("Expected each of %d connections to authenticate, got %d successes and %d failures", created, succeeded, failed)
+			}
+			if len(replset.auth.keys) != 1 {
+				t.Errorf("Expected the salted password to be cached once, got %d entries", len(replset.auth.keys))
+			}
+		})
+	}
+}
+
+func TestReplsetAuthenticationFailure(t *testing.T) {
+	scram := newMockSCRAMServer(t, "alice", "s3cret", MechanismSCRAMSHA256)
+	_, err := connectWithCredential(t, scram, &Credential{Username: "alice", Password: "wrong", Mechanism: MechanismSCRAMSHA256})
+	if err == nil || !strings.Contains(err.Error(), "Authentication failed") {
+		t.Fatalf("Expected an authentication error, got %v", err)
+	}
+}
+
+func TestAuthenticatorNegotiate(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello bson.D
+		want  string
+	}{
+		{name: "SCRAM-SHA-256 listed", hello: bson.D{{Key: "saslSupportedMechs", Value: bson.A{MechanismSCRAMSHA1, MechanismSCRAMSHA256}}}, want: MechanismSCRAMSHA256},
+		{name: "SCRAM-SHA-1 only", hello: bson.D{{Key: "saslSupportedMechs", Value: bson.A{MechanismSCRAMSHA1}}}, want: MechanismSCRAMSHA1},
+		{name: "mechanisms missing", hello: bson.D{{Key: "ok", Value: 1.0}}, want: MechanismSCRAMSHA1},
+		{name: "no SCRAM mechanism", hello: bson.D{{Key: "saslSupportedMechs", Value: bson.A{"PLAIN"}}}},
+	}
+	a := newAuthenticator(&Credential{Username: "alice", Password: "s3cret"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.negotiate(mustMarshal(t, tt.hello))
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("Expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Expected %q, got %q (%v)", tt.want, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"mongo-playground/internal/bson"
+)
+
+// commandOverhead is the room kept in every message for the fields added
+// to a command when it is sent, such as lsid, txnNumber and $clusterTime
+const commandOverhead = 16 * 1024
+
+// writeSequenceIdentifiers are the document sequence identifiers of the
+// write commands whose statements are split into batches
+var writeSequenceIdentifiers = map[string]string{
+	"insert": "documents",
+	"update": "updates",
+	"delete": "deletes",
+}
+
+// sequenceIdentifier returns the identifier of the document sequence of
+// the named command, "documents" for commands other than update and delete
+func sequenceIdentifier(name string) string {
+	if identifier, ok := writeSequenceIdentifiers[name]; ok {
+		return identifier
+	}
+	return "documents"
+}
+
+// splitBatches splits documents into batches that fit the message size and
+// the write batch size of server, given the size of the command body
+func splitBatches(bodySize int, identifier string, documents []bson.Raw, server ServerDescription) ([][]bson.Raw, error) {
+	maxMessageSize := int(server.MaxMessageSizeBytes)
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSizeBytes
+	}
+	maxCount := int(server.MaxWriteBatchSize)
+	if maxCount <= 0 {
+		maxCount = 100000
+	}
+	maxDocumentSize := int(server.MaxBSONObjectSize)
+	if maxDocumentSize <= 0 {
+		maxDocumentSize = 16 * 1024 * 1024
+	}
+
+	// The header, flag bits, body section and sequence section header are
+	// in every message
+	fixed := HeaderSize + 4 + 1 + bodySize + 1 + 4 + len(identifier) + 1 + commandOverhead
+	if fixed >= maxMessageSize {
+		return nil, fmt.Errorf("%w: command of %d bytes leaves no room for documents", errMessageTooLarge, bodySize)
+	}
+
+	var batches [][]bson.Raw
+	start, size := 0, fixed
+	for i, doc := range documents {
+		if len(doc) > maxDocumentSize {
+			return nil, fmt.Errorf("document %d of %d bytes exceeds maxBsonObjectSize of %d bytes", i, len(doc), maxDocumentSize)
+		}
+		if i > start && (i-start == maxCount || size+len(doc) > maxMessageSize) {
+			batches = append(batches, documents[start:i])
+			start, size = i, fixed
+		}
+		size += len(doc)
+	}
+	return append(batches, documents[start:]), nil
+}
+
+// writeResult accumulates the replies to the batches of a write command
+type writeResult struct {
+	n                 int64
+	nModified         int64
+	hasNModified      bool
+	upserted          bson.A
+	writeErrors       bson.A
+	writeConcernError bson.Raw
+	labels            []string
+	last              *Message
+}
+
+// add merges the reply to the batch starting at offset, shifting the
+// indexes of its write errors and upserts to positions in the whole write
+func (w *writeResult) add(reply *Message, offset int) {
+	w.last = reply
+	body := reply.Body
+	n, _ := body.Lookup("n").AsInt64OK()
+	w.n += n
+	if nModified, ok := body.Lookup("nModified").AsInt64OK(); ok {
+		w.nModified += nModified
+		w.hasNModified = true
+	}
+	for _, key := range []string{"upserted", "writeErrors"} {
+		values, _ := body.Lookup(key).Array().Values()
+		for _, v := range values {
+			doc := shiftIndex(v.Document(), offset)
+			if key == "upserted" {
+				w.upserted = append(w.upserted, doc)
+			} else {
+				w.writeErrors = append(w.writeErrors, doc)
+			}
+		}
+	}
+	if wce := body.Lookup("writeConcernError"); wce.Type == bson.TypeDocument {
+		w.writeConcernError = wce.Document()
+	}
+	for _, label := range stringArray(body.Lookup("errorLabels")) {
+		if !slices.Contains(w.labels, label) {
+			w.labels = append(w.labels, label)
+		}
+	}
+}
+
+// shiftIndex returns doc with offset added to its index field
+func shiftIndex(doc bson.Raw, offset int) bson.D {
+	elements, _ := doc.Elements()
+	out := make(bson.D, 0, len(elements))
+	for _, e := range elements {
+		if index, ok := e.Value.AsInt64OK(); ok && e.Key == "index" {
+			out = append(out, bson.E{Key: "index", Value: int32(index) + int32(offset)})
+			continue
+		}
+		out = append(out, bson.E{Key: e.Key, Value: e.Value})
+	}
+	return out
+}
+
+// reply returns the merged reply in the shape of a single write reply
+func (w *writeResult) reply() (*Message, error) {
+	merged := bson.D{{Key: "n", Value: w.n}}
+	if w.hasNModified {
+		merged = append(merged, bson.E{Key: "nModified", Value: w.nModified})
+	}
+	if len(w.upserted) > 0 {
+		merged = append(merged, bson.E{Key: "upserted", Value: w.upserted})
+	}
+	if len(w.writeErrors) > 0 {
+		merged = append(merged, bson.E{Key: "writeErrors", Value: w.writeErrors})
+	}
+	if w.writeConcernError != nil {
+		merged = append(merged, bson.E{Key: "writeConcernError", Value: w.writeConcernError})
+	}
+	if len(w.labels) > 0 {
+		labels := make(bson.A, len(w.labels))
+		for i, label := range w.labels {
+			labels[i] = label
+		}
+		merged = append(merged, bson.E{Key: "errorLabels", Value: labels})
+	}
+	merged = append(merged, bson.E{Key: "ok", Value: 1.0})
+
+	body, err := bson.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode merged reply: %w", err)
+	}
+	return &Message{Header: w.last.Header, FlagBits: w.last.FlagBits, Body: body}, nil
+}
+
+// sameBatchLimits reports whether writes are split into the same batches
+// for a and b
+func sameBatchLimits(a, b ServerDescription) bool {
+	return a.MaxMessageSizeBytes == b.MaxMessageSizeBytes && a.MaxWriteBatchSize == b.MaxWriteBatchSize && a.MaxBSONObjectSize == b.MaxBSONObjectSize
+}
+
+// sendBatches splits documents by the limits of server, sends the write
+// command once per batch and merges the replies. The first batch is sent to
+// server; each later batch is sent to a newly selected primary, and the
+// remaining documents are split again when its limits differ. An ordered
+// write stops after the first batch with write errors, an unordered one
+// sends every batch. A command error stops the write; after the first batch
+// it is returned with the merged replies of the batches already written,
+// whose counts it reports.
+func (r *Replset) sendBatches(ctx context.Context, server ServerDescription, command bson.D, body bson.Raw, identifier string, documents []bson.Raw) (*Message, error) {
+	batches, err := splitBatches(len(body), identifier, documents, server)
+	if err != nil {
+		return nil, err
+	}
+	if len(batches) == 1 {
+		return r.sendWrite(ctx, server, command, body, []DocumentSequence{{Identifier: identifier, Documents: batches[0]}})
+	}
+
+	ordered := true
+	if v := body.Lookup("ordered"); v.Type == bson.TypeBoolean {
+		ordered = v.Boolean()
+	}
+	var result writeResult
+	offset := 0
+	for i := 0; i < len(batches); i++ {
+		var reply *Message
+		var err error
+		if i > 0 {
+			server, batches, err = r.nextBatchServer(ctx, server, len(body), identifier, documents[offset:], batches, i)
+		}
+		if err == nil {
+			reply, err = r.sendWrite(ctx, server, command, body, []DocumentSequence{{Identifier: identifier, Documents: batches[i]}})
+		}
+		var writeErr *WriteException
+		if err != nil && !errors.As(err, &writeErr) {
+			if i == 0 {
+				return reply, err
+			}
+			merged, mergeErr := result.reply()
+			if mergeErr != nil {
+				return nil, mergeErr
+			}
+			return merged, fmt.Errorf("batch %d of %d failed after earlier batches reported n %d and %d write errors: %w", i+1, len(batches), result.n, len(result.writeErrors), err)
+		}
+		result.add(reply, offset)
+		offset += len(batches[i])
+		if ordered && writeErr != nil && len(writeErr.WriteErrors) > 0 {
+			break
+		}
+	}
+
+	reply, err := result.reply()
+	if err != nil {
+		return nil, err
+	}
+	return reply, replyError(reply.Body)
+}
+
+// nextBatchServer selects the primary for batch i of a write. When its
+// limits differ from those of previous, the remaining documents are split
+// again for it, replacing the batches from i on.
+func (r *Replset) nextBatchServer(ctx context.Context, previous ServerDescription, bodySize int, identifier string, remaining []bson.Raw, batches [][]bson.Raw, i int) (ServerDescription, [][]bson.Raw, error) {
+	server, err := r.selectServer(ctx, selectWritable)
+	if err != nil {
+		return previous, batches, err
+	}
+	if sameBatchLimits(server, previous) {
+		return server, batches, nil
+	}
+	rest, err := splitBatches(bodySize, identifier, remaining, server)
+	if err != nil {
+		return server, batches, err
+	}
+	return server, append(batches[:i:i], rest...), nil
+}
+
+// sendWrite sends one batch of a command to server, retrying eligible writes
+// once after a failover unless Options.RetryWrites is disabled
+func (r *Replset) sendWrite(ctx context.Context, server ServerDescription, command bson.D, body bson.Raw, sequences []DocumentSequence) (*Message, error) {
+	var statements []bson.Raw
+	for _, seq := range sequences {
+		if seq.Identifier == writeSequenceIdentifiers[command[0].Key] {
+			statements = seq.Documents
+		}
+	}
+	if *r.opts.RetryWrites && isRetryableWrite(body, statements) && !inTransaction(ctx) {
+		return r.retryableWrite(ctx, server, command, sequences)
+	}
+	return r.sendCommandTo(ctx, server, command, sequences)
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"mongo-playground/internal/bson"
+)
+
+func TestSplitBatches(t *testing.T) {
+	doc := mustMarshal(t, bson.D{{Key: "x", Value: strings.Repeat("y", 100)}})
+	documents := make([]bson.Raw, 10)
+	for i := range documents {
+		documents[i] = doc
+	}
+	fixed := HeaderSize + 4 + 1 + 50 + 1 + 4 + len("documents") + 1 + commandOverhead
+
+	tests := []struct {
+		name   string
+		server ServerDescription
+		want   []int
+	}{
+		{"defaults", ServerDescription{}, []int{10}},
+		{"batch size", ServerDescription{MaxWriteBatchSize: 4}, []int{4, 4, 2}},
+		{"message size", ServerDescription{MaxMessageSizeBytes: int32(fixed + 3*len(doc))}, []int{3, 3, 3, 1}},
+		{"both", ServerDescription{MaxWriteBatchSize: 2, MaxMessageSizeBytes: int32(fixed + 3*len(doc))}, []int{2, 2, 2, 2, 2}},
+	}
+	for _, tt := range tests {
+		batches, err := splitBatches(50, "documents", documents, tt.server)
+		if err != nil {
+			t.Errorf("%s: splitBatches failed: %v", tt.name, err)
+			continue
+		}
+		sizes := make([]int, len(batches))
+		for i, batch := range batches {
+			sizes[i] = len(batch)
+		}
+		if !slices.Equal(sizes, tt.want) {
+			t.Errorf("%s: expected batch sizes %v, got %v", tt.name, tt.want, sizes)
+		}
+	}
+
+	if _, err := splitBatches(50, "documents", documents, ServerDescription{MaxBSONObjectSize: 50}); err == nil || !strings.Contains(err.Error(), "maxBsonObjectSize") {
+		t.Errorf("Expected an oversized document error, got %v", err)
+	}
+	if _, err := splitBatches(50, "documents", documents, ServerDescription{MaxMessageSizeBytes: int32(fixed)}); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("Expected a message too large error, got %v", err)
+	}
+}
+
+func TestSequenceIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"insert": "documents",
+		"update": "updates",
+		"delete": "deletes",
+		"bulk":   "documents",
+	}
+	for command, want := range tests {
+		if got := sequenceIdentifier(command); got != want {
+			t.Errorf("%s: expected %q, got %q", command, want, got)
+		}
+	}
+}
+
+// batchWriteMock answers inserts with a duplicate key error for every
+// document whose x field is in failing, and records each batch it receives
+func batchWriteMock(t *testing.T, failing ...int32) (*mockReplicaSet, *[][]int32, *sync.Mutex) {
+	mock := newMockReplicaSet(t, 1)
+	mock.helloExtra = bson.D{{Key: "maxWriteBatchSize", Value: 2}}
+	var mu sync.Mutex
+	var batches [][]int32
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if command.Body.Lookup("insert").Type == 0 {
+			return bson.D{{Key: "ok", Value: 1.0}}
+		}
+		documents, ok := command.Sequence("documents")
+		if !ok {
+			t.Errorf("Expected a documents sequence in %v", command.Body)
+			return bson.D{{Key: "ok", Value: 1.0}}
+		}
+		var xs []int32
+		var writeErrors bson.A
+		for i, doc := range documents {
+			x := doc.Lookup("x").Int32()
+			xs = append(xs, x)
+			for _, f := range failing {
+				if x == f {
+					writeErrors = append(writeErrors, bson.D{{Key: "index", Value: int32(i)}, {Key: "code", Value: int32(11000)}, {Key: "errmsg", Value: "E11000 duplicate key"}})
+				}
+			}
+		}
+		mu.Lock()
+		batches = append(batches, xs)
+		mu.Unlock()
+		reply := bson.D{{Key: "n", Value: int32(len(documents) - len(writeErrors))}}
+		if writeErrors != nil {
+			reply = append(reply, bson.E{Key: "writeErrors", Value: writeErrors})
+		}
+		return append(reply, bson.E{Key: "ok", Value: 1.0})
+	})
+	return mock, &batches, &mu
+}
+
+func batchDocuments(t *testing.T, n int) []bson.Raw {
+	documents := make([]bson.Raw, n)
+	for i := range documents {
+		documents[i] = mustMarshal(t, bson.D{{Key: "x", Value: int32(i)}})
+	}
+	return documents
+}
+
+func TestReplsetSendCommandSplitsBatches(t *testing.T) {
+	mock, batches, mu := batchWriteMock(t)
+	replset := connectTestReplset(t, mock)
+
+	reply, err := replset.SendCommand(context.Background(), bson.D{{Key: "insert", Value: "col"}, {Key: "$db", Value: "test"}}, batchDocuments(t, 5))
+	if err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	if n, _ := reply.Body.Lookup("n").AsInt64OK(); n != 5 {
+		t.Errorf("Expected the merged n of 5, got %v", reply.Body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*batches) != 3 || len((*batches)[0]) != 2 || len((*batches)[2]) != 1 {
+		t.Errorf("Expected batches of 2, 2 and 1 documents, got %v", *batches)
+	}
+}
+
+func TestReplsetSendCommandOrderedBatchesStopAtWriteError(t *testing.T) {
+	mock, batches, mu := batchWriteMock(t, 3)
+	replset := connectTestReplset(t, mock)
+
+	reply, err := replset.SendCommand(context.Background(), bson.D{{Key: "insert", Value: "col"}, {Key: "$db", Value: "test"}}, batchDocuments(t, 6))
+	var bulkErr *BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		t.Fatalf("Expected a BulkWriteException, got %v", err)
+	}
+	if len(bulkErr.WriteErrors) != 1 || bulkErr.WriteErrors[0].Index != 3 || bulkErr.WriteErrors[0].Request.Lookup("x").Int32() != 3 {
+		t.Errorf("Expected the write error at index 3, got %+v", bulkErr.WriteErrors)
+	}
+	if n, _ := reply.Body.Lookup("n").AsInt64OK(); n != 3 {
+		t.Errorf("Expected n of 3, got %v", reply.Body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*batches) != 2 {
+		t.Errorf("Expected the ordered write to stop after the second batch, got %v", *batches)
+	}
+}
+
+func TestReplsetSendCommandUnorderedBatchesContinue(t *testing.T) {
+	mock, batches, mu := batchWriteMock(t, 1, 4)
+	replset := connectTestReplset(t, mock)
+
+	command := bson.D{{Key: "insert", Value: "col"}, {Key: "ordered", Value: false}, {Key: "$db", Value: "test"}}
+	reply, err := replset.SendCommand(context.Background(), command, batchDocuments(t, 6))
+	var bulkErr *BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		t.Fatalf("Expected a BulkWriteException, got %v", err)
+	}
+	if len(bulkErr.WriteErrors) != 2 || bulkErr.WriteErrors[0].Index != 1 || bulkErr.WriteErrors[1].Index != 4 {
+		t.Errorf("Expected write errors at indexes 1 and 4, got %+v", bulkErr.WriteErrors)
+	}
+	if n, _ := reply.Body.Lookup("n").AsInt64OK(); n != 4 {
+		t.Errorf("Expected n of 4, got %v", reply.Body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*batches) != 3 {
+		t.Errorf("Expected every batch of the unordered write to be sent, got %v", *batches)
+	}
+}
+
+func TestReplsetSendCommandBatchCommandErrorKeepsResults(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	mock.helloExtra = bson.D{{Key: "maxWriteBatchSize", Value: 2}}
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if command.Body.Lookup("insert").Type == 0 {
+			return bson.D{{Key: "ok", Value: 1.0}}
+		}
+		documents, _ := command.Sequence("documents")
+		if documents[0].Lookup("x").Int32() == 2 {
+			return bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(2)}, {Key: "errmsg", Value: "bad value"}}
+		}
+		return bson.D{
+			{Key: "n", Value: int32(1)},
+			{Key: "writeErrors", Value: bson.A{bson.D{{Key: "index", Value: int32(1)}, {Key: "code", Value: int32(11000)}, {Key: "errmsg", Value: "E11000 duplicate key"}}}},
+			{Key: "ok", Value: 1.0},
+		}
+	})
+	replset := connectTestReplset(t, mock)
+
+	command := bson.D{{Key: "insert", Value: "col"}, {Key: "ordered", Value: false}, {Key: "$db", Value: "test"}}
+	reply, err := replset.SendCommand(context.Background(), command, batchDocuments(t, 6))
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Code != 2 {
+		t.Fatalf("Expected the command error of the second batch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "batch 2 of 3") || !strings.Contains(err.Error(), "n 1 and 1 write errors") {
+		t.Errorf("Expected the error to report the earlier batches, got %v", err)
+	}
+	if reply == nil {
+		t.Fatal("Expected the merged reply of the first batch")
+	}
+	if n, _ := reply.Body.Lookup("n").AsInt64OK(); n != 1 {
+		t.Errorf("Expected n of 1, got %v", reply.Body)
+	}
+	writeErrors, _ := reply.Body.Lookup("writeErrors").Array().Values()
+	if len(writeErrors) != 1 || writeErrors[0].Document().Lookup("index").Int32() != 1 {
+		t.Errorf("Expected the write error of the first batch, got %v", reply.Body)
+	}
+}
+
+func TestReplsetSendCommandResplitsForNewPrimaryLimits(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	mock.helloExtra = bson.D{{Key: "maxWriteBatchSize", Value: 3}}
+	var mu sync.Mutex
+	var replset *Replset
+	var sizes []int
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if command.Body.Lookup("insert").Type == 0 {
+			return bson.D{{Key: "ok", Value: 1.0}}
+		}
+		documents, _ := command.Sequence("documents")
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, len(documents))
+		if len(sizes) == 1 {
+			// The primary reports a smaller batch size before the next batch
+			desc := replset.Topology().Servers[mock.addrs[0]]
+			desc.MaxWriteBatchSize = 2
+			replset.topology.apply(desc)
+		}
+		return bson.D{{Key: "n", Value: int32(len(documents))}, {Key: "ok", Value: 1.0}}
+	})
+	connected := connectTestReplset(t, mock)
+	mu.Lock()
+	replset = connected
+	mu.Unlock()
+
+	reply, err := connected.SendCommand(context.Background(), bson.D{{Key: "insert", Value: "col"}, {Key: "$db", Value: "test"}}, batchDocuments(t, 6))
+	if err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	if n, _ := reply.Body.Lookup("n").AsInt64OK(); n != 6 {
+		t.Errorf("Expected the merged n of 6, got %v", reply.Body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []int{3, 2, 1}; !slices.Equal(sizes, want) {
+		t.Errorf("Expected batches of %v documents, got %v", want, sizes)
+	}
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// LabelResumableChangeStream is the error label servers from 4.4 attach
+// to errors a change stream can resume after
+const LabelResumableChangeStream = "ResumableChangeStreamError"
+
+// minResumableLabelWireVersion is the first wire version (MongoDB 4.4) that
+// labels the errors a change stream can resume after
+const minResumableLabelWireVersion = 9
+
+// codeCursorNotFound is returned for a cursor the server no longer has
+const codeCursorNotFound = 43
+
+// Server error codes after which a change stream on a server before 4.4
+// can be resumed
+var resumableChangeStreamCodes = map[int32]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	43:    true, // CursorNotFound
+	63:    true, // StaleShardVersion
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	133:   true, // FailedToSatisfyReadPreference
+	150:   true, // StaleEpoch
+	189:   true, // PrimarySteppedDown
+	234:   true, // RetryChangeStream
+	262:   true, // ExceededTimeLimit
+	9001:  true, // SocketException
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13388: true, // StaleConfig
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// Full document modes of change events for updates
+const (
+	FullDocumentDefault      = "default"
+	FullDocumentUpdateLookup = "updateLookup"
+)
+
+// ChangeStreamOptions configures a change stream
+type ChangeStreamOptions struct {
+	// FullDocument set to FullDocumentUpdateLookup adds the current version
+	// of the document to update events. Empty leaves the server default.
+	FullDocument string
+
+	// ResumeAfter and StartAfter start the stream after the event with the
+	// given resume token. StartAfter also accepts the token of an
+	// invalidate event. StartAtOperationTime starts the stream at a cluster
+	// time instead. At most one of them may be set.
+	ResumeAfter          bson.Raw
+	StartAfter           bson.Raw
+	StartAtOperationTime *bson.Timestamp
+
+	// BatchSize and MaxAwaitTime apply to the cursor of the stream, see
+	// CursorOptions. MaxAwaitTime is how long a getMore waits for events.
+	BatchSize    int32
+	MaxAwaitTime time.Duration
+}
+
+// ChangeStream iterates over the change events of a collection, database
+// or cluster. It keeps the resume token of the latest event and resumes
+// from it transparently after a resumable error such as a failover. A
+// ChangeStream is not safe for concurrent use.
+type ChangeStream struct {
+	replset    *Replset
+	db         string
+	collection string
+	pipeline   bson.A
+	opts       ChangeStreamOptions
+
+	cursor      *Cursor
+	resumeToken bson.Raw
+
+	// operationTime is the time the stream started at, used to resume a
+	// stream that has not returned any event or resume token yet
+	operationTime bson.Timestamp
+
+	// returned is set once an event was returned, after which resuming
+	// uses resumeAfter even when the stream was opened with startAfter
+	returned bool
+
+	current bson.Raw
+	err     error
+}
+
+// Watch opens a change stream. With a collection it watches that
+// collection, with only db every collection of the database, and with
+// neither the whole cluster. The pipeline stages are applied to the events
+// after $changeStream.
+func (r *Replset) Watch(ctx context.Context, db, collection string, pipeline bson.A, opts ChangeStreamOptions) (*ChangeStream, error) {
+	if collection != "" && db == "" {
+		return nil, fmt.Errorf("a collection change stream needs a database")
+	}
+	set := 0
+	for _, ok := range []bool{opts.ResumeAfter != nil, opts.StartAfter != nil, opts.StartAtOperationTime != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of ResumeAfter, StartAfter and StartAtOperationTime may be set")
+	}
+
+	cs := &ChangeStream{replset: r, db: db, collection: collection, pipeline: pipeline, opts: opts}
+	if err := cs.open(ctx); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// open runs the aggregate of the stream, starting from the latest resume
+// token when resuming
+func (cs *ChangeStream) open(ctx context.Context) error {
+	stage := bson.D{}
+	if cs.opts.FullDocument != "" {
+		stage = append(stage, bson.E{Key: "fullDocument", Value: cs.opts.FullDocument})
+	}
+	switch {
+	case cs.resumeToken != nil && cs.opts.StartAfter != nil && !cs.returned:
+		stage = append(stage, bson.E{Key: "startAfter", Value: cs.resumeToken})
+	case cs.resumeToken != nil:
+		stage = append(stage, bson.E{Key: "resumeAfter", Value: cs.resumeToken})
+	case cs.opts.ResumeAfter != nil:
+		stage = append(stage, bson.E{Key: "resumeAfter", Value: cs.opts.ResumeAfter})
+	case cs.opts.StartAfter != nil:
+		stage = append(stage, bson.E{Key: "startAfter", Value: cs.opts.StartAfter})
+	case cs.opts.StartAtOperationTime != nil:
+		stage = append(stage, bson.E{Key: "startAtOperationTime", Value: *cs.opts.StartAtOperationTime})
+	case !cs.operationTime.IsZero():
+		stage = append(stage, bson.E{Key: "startAtOperationTime", Value: cs.operationTime})
+	}
+	db := cs.db
+	if db == "" {
+		db = "admin"
+		stage = append(stage, bson.E{Key: "allChangesForCluster", Value: true})
+	}
+
+	pipeline := append(bson.A{bson.D{{Key: "$changeStream", Value: stage}}}, cs.pipeline...)
+	var target any = cs.collection
+	if cs.collection == "" {
+		target = 1
+	}
+	command := bson.D{
+		{Key: "aggregate", Value: target},
+		{Key: "pipeline", Value: pipeline},
+		{Key: "cursor", Value: bson.D{}},
+		{Key: "$db", Value: db},
+	}
+
+	cursor, err := cs.replset.RunCursorCommand(ctx, command, CursorOptions{BatchSize: cs.opts.BatchSize, AwaitData: true, MaxAwaitTime: cs.opts.MaxAwaitTime})
+	if err != nil {
+		return err
+	}
+	cs.cursor = cursor
+	if cs.resumeToken == nil && cs.opts.ResumeAfter == nil && cs.opts.StartAfter == nil && cs.opts.StartAtOperationTime == nil {
+		cs.operationTime = cursor.operationTime
+	}
+	cs.updateBatchToken()
+	return nil
+}
+
+// Next blocks until the next change event arrives, resuming the stream
+// after resumable errors. It returns false when the stream is closed by
+// the server, for example after an invalidate event, or an error occurs,
+// which Err reports.
+func (cs *ChangeStream) Next(ctx context.Context) bool {
+	for cs.err == nil {
+		if cs.cursor.tryNext(ctx) {
+			event := cs.cursor.Current()
+			token := event.Lookup("_id")
+			if token.Type != bson.TypeDocument {
+				cs.err = fmt.Errorf("cannot resume change stream: event has no _id resume token")
+				cs.cursor.Close(ctx)
+				break
+			}
+			cs.resumeToken = token.Document()
+			cs.returned = true
+			cs.current = event
+			cs.updateBatchToken()
+			return true
+		}
+
+		err := cs.cursor.Err()
+		if err == nil {
+			cs.updateBatchToken()
+			if cs.cursor.ID() == 0 {
+				break
+			}
+			continue
+		}
+		if !isResumableChangeStreamError(err, cs.cursor.server.MaxWireVersion) || ctx.Err() != nil {
+			cs.err = err
+			break
+		}
+		// The failed cursor was already killed
+		if err := cs.open(ctx); err != nil {
+			cs.err = fmt.Errorf("failed to resume change stream: %w", err)
+			break
+		}
+	}
+	cs.current = nil
+	return false
+}
+
+// updateBatchToken takes the postBatchResumeToken of the cursor once its
+// batch is consumed, which lets the stream resume past events the server
+// filtered out
+func (cs *ChangeStream) updateBatchToken() {
+	if cs.cursor.RemainingBatchLength() == 0 && cs.cursor.postBatchResumeToken != nil {
+		cs.resumeToken = cs.cursor.postBatchResumeToken
+	}
+}
+
+// Current returns the change event Next advanced to
+func (cs *ChangeStream) Current() bson.Raw {
+	return cs.current
+}
+
+// ResumeToken returns the token to pass as ResumeAfter to continue after
+// the latest event, or nil before the server provided one
+func (cs *ChangeStream) ResumeToken() bson.Raw {
+	return cs.resumeToken
+}
+
+// Err returns the error that stopped the stream, if any
+func (cs *ChangeStream) Err() error {
+	return cs.err
+}
+
+// Close closes the cursor of the stream
+func (cs *ChangeStream) Close(ctx context.Context) error {
+	cs.current = nil
+	return cs.cursor.Close(ctx)
+}
+
+// isResumableChangeStreamError reports whether a change stream can resume
+// after err from a server with maxWireVersion. From 4.4 the server labels
+// resumable errors, and only a lost cursor resumes without the label.
+func isResumableChangeStreamError(err error, maxWireVersion int32) bool {
+	if isNetworkError(err) || HasErrorLabel(err, LabelResumableChangeStream) {
+		return true
+	}
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	if maxWireVersion >= minResumableLabelWireVersion {
+		return cmdErr.Code == codeCursorNotFound
+	}
+	return resumableChangeStreamCodes[cmdErr.Code]
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// mockChangeStream serves a change stream that returns one event per
+// getMore. fail decides the reply of a getMore by its number, returning
+// nil to answer normally.
+type mockChangeStream struct {
+	mu         sync.Mutex
+	events     int
+	getMores   int
+	aggregates []bson.Raw
+	fail       func(getMore int) bson.D
+}
+
+func (m *mockChangeStream) handle(member int, command *Message) bson.D {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if command.Body.Lookup("aggregate").Type != 0 {
+		m.aggregates = append(m.aggregates, command.Body)
+		return bson.D{
+			{Key: "cursor", Value: bson.D{
+				{Key: "id", Value: int64(42)},
+				{Key: "ns", Value: "test.col"},
+				{Key: "firstBatch", Value: bson.A{}},
+				{Key: "postBatchResumeToken", Value: bson.D{{Key: "_data", Value: "pbrt0"}}},
+			}},
+			{Key: "operationTime", Value: bson.Timestamp{T: 7, I: 1}},
+			{Key: "ok", Value: 1.0},
+		}
+	}
+	if command.Body.Lookup("getMore").Type == 0 {
+		return bson.D{{Key: "ok", Value: 1.0}}
+	}
+
+	m.getMores++
+	if m.fail != nil {
+		if reply := m.fail(m.getMores); reply != nil {
+			return reply
+		}
+	}
+	m.events++
+	event := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: m.events}}},
+		{Key: "operationType", Value: "insert"},
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "id", Value: int64(42)},
+			{Key: "ns", Value: "test.col"},
+			{Key: "nextBatch", Value: bson.A{event}},
+		}},
+		{Key: "ok", Value: 1.0},
+	}
+}
+
+func (m *mockChangeStream) aggregateCommands() []bson.Raw {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]bson.Raw(nil), m.aggregates...)
+}
+
+func TestChangeStreamResumesAfterError(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxWireVersion int32
+		reply          bson.D
+	}{
+		{"network error", 21, nil},
+		{"listed code before 4.4", 8, bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 10107}, {Key: "errmsg", Value: "not primary"}}},
+		{"cursor not found", 21, bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 43}, {Key: "errmsg", Value: "cursor not found"}}},
+		{"resumable label", 21, bson.D{
+			{Key: "ok", Value: 0.0}, {Key: "code", Value: 280},
+			{Key: "errorLabels", Value: bson.A{LabelResumableChangeStream}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockReplicaSet(t, 1)
+			mock.helloExtra = bson.D{{Key: "maxWireVersion", Value: tt.maxWireVersion}}
+			stream := &mockChangeStream{}
+			dropped := false
+			stream.fail = func(getMore int) bson.D {
+				if getMore == 3 && !dropped {
+					dropped = true
+					if tt.reply == nil {
+						return bson.D{}
+					}
+					return tt.reply
+				}
+				return nil
+			}
+			// An empty reply stands for a dropped connection
+			mock.setHandler(func(member int, command *Message) bson.D {
+				reply := stream.handle(member, command)
+				if len(reply) == 0 {
+					return nil
+				}
+				return reply
+			})
+			replset := connectTestReplset(t, mock)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			cs, err := replset.Watch(ctx, "test", "col", nil, ChangeStreamOptions{})
+			if err != nil {
+				t.Fatalf("Watch failed: %v", err)
+			}
+			defer cs.Close(ctx)
+			for i := 1; i <= 3; i++ {
+				if !cs.Next(ctx) {
+					t.Fatalf("Next %d failed: %v", i, cs.Err())
+				}
+				if got := cs.Current().Lookup("_id", "_data").Int32(); got != int32(i) {
+					t.Errorf("Expected event %d, got %v", i, cs.Current())
+				}
+			}
+
+			aggregates := stream.aggregateCommands()
+			if len(aggregates) != 2 {
+				t.Fatalf("Expected the stream to be resumed once, got %d aggregates", len(aggregates))
+			}
+			stage := aggregates[1].Lookup("pipeline").Array()
+			values, _ := stage.Values()
+			resumeAfter := values[0].Document().Lookup("$changeStream", "resumeAfter", "_data").Int32()
+			if resumeAfter != 2 {
+				t.Errorf("Expected to resume after event 2, got %v", aggregates[1])
+			}
+			if got := cs.ResumeToken().Lookup("_data").Int32(); got != 3 {
+				t.Errorf("Expected the resume token of event 3, got %v", cs.ResumeToken())
+			}
+		})
+	}
+}
+
+func TestChangeStreamNotResumedWithoutLabel(t *testing.T) {
+	// From 4.4 a listed code without the label is not resumable
+	mock := newMockReplicaSet(t, 1)
+	stream := &mockChangeStream{fail: func(getMore int) bson.D {
+		return bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 10107}, {Key: "errmsg", Value: "not primary"}}
+	}}
+	mock.setHandler(stream.handle)
+	replset := connectTestReplset(t, mock)
+	ctx := context.Background()
+
+	cs, err := replset.Watch(ctx, "test", "col", nil, ChangeStreamOptions{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if cs.Next(ctx) {
+		t.Fatal("Expected Next to fail")
+	}
+	if cs.Err() == nil || len(stream.aggregateCommands()) != 1 {
+		t.Errorf("Expected the error to end the stream without resuming, got %v", cs.Err())
+	}
+}
+
+func TestChangeStreamNotResumed(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	stream := &mockChangeStream{fail: func(getMore int) bson.D {
+		return bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 11601}, {Key: "codeName", Value: "Interrupted"}}
+	}}
+	mock.setHandler(stream.handle)
+	replset := connectTestReplset(t, mock)
+	ctx := context.Background()
+
+	cs, err := replset.Watch(ctx, "test", "col", nil, ChangeStreamOptions{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if cs.Next(ctx) {
+		t.Fatal("Expected Next to fail")
+	}
+	if cs.Err() == nil || len(stream.aggregateCommands()) != 1 {
+		t.Errorf("Expected a non resumable error without resuming, got %v", cs.Err())
+	}
+}
+
+func TestChangeStreamStartOptions(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	stream := &mockChangeStream{}
+	mock.setHandler(stream.handle)
+	replset := connectTestReplset(t, mock)
+	ctx := context.Background()
+
+	changeStreamStage := func(command bson.Raw) bson.Raw {
+		values, _ := command.Lookup("pipeline").Array().Values()
+		return values[0].Document().Lookup("$changeStream").Document()
+	}
+
+	// Cluster wide streams run on admin
+	cs, err := replset.Watch(ctx, "", "", bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}},
+		ChangeStreamOptions{FullDocument: FullDocumentUpdateLookup, StartAtOperationTime: &bson.Timestamp{T: 5, I: 1}})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	cs.Close(ctx)
+	aggregate := stream.aggregateCommands()[0]
+	stage := changeStreamStage(aggregate)
+	if aggregate.Lookup("$db").StringValue() != "admin" || aggregate.Lookup("aggregate").Int32() != 1 || !stage.Lookup("allChangesForCluster").Boolean() {
+		t.Errorf("Expected a cluster wide change stream, got %v", aggregate)
+	}
+	if stage.Lookup("startAtOperationTime").Timestamp() != (bson.Timestamp{T: 5, I: 1}) || stage.Lookup("fullDocument").StringValue() != FullDocumentUpdateLookup {
+		t.Errorf("Expected the start options in $changeStream, got %v", stage)
+	}
+	if values, _ := aggregate.Lookup("pipeline").Array().Values(); len(values) != 2 {
+		t.Errorf("Expected the pipeline to follow $changeStream, got %v", aggregate)
+	}
+
+	startAfter := mustMarshal(t, bson.D{{Key: "_data", Value: "invalidate"}})
+	cs, err = replset.Watch(ctx, "test", "", nil, ChangeStreamOptions{StartAfter: startAfter})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer cs.Close(ctx)
+	aggregate = stream.aggregateCommands()[1]
+	if aggregate.Lookup("aggregate").Int32() != 1 || changeStreamStage(aggregate).Lookup("startAfter").Document().String() != startAfter.String() {
+		t.Errorf("Expected a database change stream with startAfter, got %v", aggregate)
+	}
+	if cs.ResumeToken().Lookup("_data").StringValue() != "pbrt0" {
+		t.Errorf("Expected the postBatchResumeToken of the empty first batch, got %v", cs.ResumeToken())
+	}
+
+	if _, err := replset.Watch(ctx, "test", "col", nil, ChangeStreamOptions{ResumeAfter: startAfter, StartAfter: startAfter}); err == nil {
+		t.Error("Expected conflicting start options to be rejected")
+	}
+}
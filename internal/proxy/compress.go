@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"mongo-playground/internal/bson"
+	"mongo-playground/internal/snappy"
+)
+
+// Compressor names for Options.Compressors
+const (
+	CompressorSnappy = "snappy"
+	CompressorZlib   = "zlib"
+)
+
+// Compressor ids in OP_COMPRESSED messages
+const (
+	compressorNoop   uint8 = 0
+	compressorSnappy uint8 = 1
+	compressorZlib   uint8 = 2
+)
+
+// compressedHeaderSize is the size of the fields preceding the compressed
+// message: the original opcode, its uncompressed size and the compressor id
+const compressedHeaderSize = 9
+
+// Commands that are never compressed, since they negotiate compression or
+// carry credentials
+var uncompressedCommands = map[string]bool{
+	"hello":           true,
+	"ismaster":        true,
+	"saslstart":       true,
+	"saslcontinue":    true,
+	"getnonce":        true,
+	"authenticate":    true,
+	"createuser":      true,
+	"updateuser":      true,
+	"copydbsaslstart": true,
+	"copydbgetnonce":  true,
+	"copydb":          true,
+}
+
+// compressor compresses messages with one algorithm
+type compressor struct {
+	id   uint8
+	name string
+
+	// level is the zlib compression level
+	level int
+}
+
+// newCompressor returns the compressor named name
+func newCompressor(name string, zlibLevel int) (*compressor, error) {
+	switch name {
+	case CompressorSnappy:
+		return &compressor{id: compressorSnappy, name: name}, nil
+	case CompressorZlib:
+		if zlibLevel < zlib.DefaultCompression || zlibLevel > zlib.BestCompression {
+			return nil, fmt.Errorf("invalid zlib compression level %d", zlibLevel)
+		}
+		return &compressor{id: compressorZlib, name: name, level: zlibLevel}, nil
+	}
+	return nil, fmt.Errorf("unsupported compressor %q", name)
+}
+
+// compress compresses src
+func (c *compressor) compress(src []byte) ([]byte, error) {
+	switch c.id {
+	case compressorSnappy:
+		return snappy.Encode(nil, src), nil
+	case compressorZlib:
+		var buf bytes.Buffer
+		w, err := zlib.NewWriterLevel(&buf, c.level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(src); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return src, nil
+}
+
+// decompress decompresses src, which must expand to exactly size bytes
+func decompress(id uint8, src []byte, size int) ([]byte, error) {
+	var out []byte
+	switch id {
+	case compressorNoop:
+		out = src
+	case compressorSnappy:
+		n, err := snappy.DecodedLen(src)
+		if err != nil {
+			return nil, err
+		}
+		if n != size {
+			return nil, fmt.Errorf("decompressed size %d does not match %d", n, size)
+		}
+		if out, err = snappy.Decode(nil, src); err != nil {
+			return nil, err
+		}
+	case compressorZlib:
+		r, err := zlib.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		// Reading one byte more than announced detects a size mismatch
+		// without trusting the announced size for the allocation
+		if out, err = io.ReadAll(io.LimitReader(r, int64(size)+1)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compressor id %d", id)
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("decompressed size %d does not match %d", len(out), size)
+	}
+	return out, nil
+}
+
+// compressible reports whether a message may be sent compressed
+func compressible(opCode int32, payload []byte) bool {
+	var body bson.Raw
+	switch opCode {
+	case OpMsg:
+		// The flag bits and the kind byte of the body section precede it
+		if len(payload) < 5 || payload[4] != sectionBody {
+			return false
+		}
+		body = payload[5:]
+	default:
+		return false
+	}
+	elements, err := body.Elements()
+	if err != nil || len(elements) == 0 {
+		return false
+	}
+	return !uncompressedCommands[strings.ToLower(elements[0].Key)]
+}
+
+// compressMessage wraps a message in an OP_COMPRESSED payload
+func compressMessage(c *compressor, opCode int32, payload []byte) ([]byte, error) {
+	compressed, err := c.compress(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress message with %s: %w", c.name, err)
+	}
+	out := make([]byte, 0, compressedHeaderSize+len(compressed))
+	out = binary.LittleEndian.AppendUint32(out, uint32(opCode))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(payload)))
+	out = append(out, c.id)
+	return append(out, compressed...), nil
+}
+
+// decompressMessage unwraps an OP_COMPRESSED payload and returns the header
+// and payload of the original message. Messages expanding beyond
+// maxMessageSize are rejected before they are decompressed.
+func decompressMessage(header MessageHeader, payload []byte, maxMessageSize int32) (MessageHeader, []byte, error) {
+	if len(payload) < compressedHeaderSize {
+		return MessageHeader{}, nil, fmt.Errorf("OP_COMPRESSED too short: %d bytes", len(payload))
+	}
+	opCode := int32(binary.LittleEndian.Uint32(payload[0:4]))
+	size := int32(binary.LittleEndian.Uint32(payload[4:8]))
+	if size < 0 || int64(size)+HeaderSize > int64(maxMessageSize) {
+		return MessageHeader{}, nil, fmt.Errorf("%w: uncompressed size %d", errMessageTooLarge, size)
+	}
+	original, err := decompress(payload[8], payload[compressedHeaderSize:], int(size))
+	if err != nil {
+		return MessageHeader{}, nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	header.OpCode = opCode
+	header.MessageLength = HeaderSize + size
+	return header, original, nil
+}
+
+// negotiatedCompressor returns the first compressor the member accepted in
+// its hello reply, or nil to send messages uncompressed
+func (r *Replset) negotiatedCompressor(hello bson.Raw) *compressor {
+	for _, name := range stringArray(hello.Lookup("compression")) {
+		if comp, err := newCompressor(name, *r.opts.ZlibCompressionLevel); err == nil {
+			return comp
+		}
+	}
+	return nil
+}
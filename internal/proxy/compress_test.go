@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mongo-playground/internal/bson"
+)
+
+func TestCompressMessageRoundTrip(t *testing.T) {
+	payload := testOpMsgPayload(t, bson.D{
+		{Key: "insert", Value: "col"},
+		{Key: "comment", Value: strings.Repeat("compressible ", 1000)},
+		{Key: "$db", Value: "test"},
+	})
+
+	for _, name := range []string{CompressorSnappy, CompressorZlib} {
+		t.Run(name, func(t *testing.T) {
+			comp, err := newCompressor(name, 6)
+			if err != nil {
+				t.Fatalf("newCompressor failed: %v", err)
+			}
+			if !compressible(OpMsg, payload) {
+				t.Fatal("Expected insert to be compressible")
+			}
+			compressed, err := compressMessage(comp, OpMsg, payload)
+			if err != nil {
+				t.Fatalf("compressMessage failed: %v", err)
+			}
+			if len(compressed) >= len(payload) {
+				t.Errorf("Expected %d bytes to shrink, got %d", len(payload), len(compressed))
+			}
+
+			header, original, err := decompressMessage(MessageHeader{RequestID: 7, OpCode: OpCompressed}, compressed, DefaultMaxMessageSizeBytes)
+			if err != nil {
+				t.Fatalf("decompressMessage failed: %v", err)
+			}
+			if header.OpCode != OpMsg || header.RequestID != 7 || header.MessageLength != int32(HeaderSize+len(payload)) {
+				t.Errorf("Unexpected header %+v", header)
+			}
+			if !bytes.Equal(original, payload) {
+				t.Error("Decompressed payload differs from the original")
+			}
+
+			// The announced size must match the decompressed size
+			corrupt := append([]byte(nil), compressed...)
+			corrupt[4]++
+			if _, _, err := decompressMessage(MessageHeader{OpCode: OpCompressed}, corrupt, DefaultMaxMessageSizeBytes); err == nil {
+				t.Error("Expected a size mismatch to be rejected")
+			}
+			// The uncompressed size is bounded by the message size limit
+			if _, _, err := decompressMessage(MessageHeader{OpCode: OpCompressed}, compressed, 1024); !errors.Is(err, errMessageTooLarge) {
+				t.Errorf("Expected errMessageTooLarge, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	for _, command := range []string{"hello", "isMaster", "saslStart", "saslContinue", "authenticate", "createUser"} {
+		if compressible(OpMsg, testOpMsgPayload(t, bson.D{{Key: command, Value: 1}})) {
+			t.Errorf("Expected %s not to be compressed", command)
+		}
+	}
+	if !compressible(OpMsg, testOpMsgPayload(t, bson.D{{Key: "find", Value: "col"}})) {
+		t.Error("Expected find to be compressed")
+	}
+	if compressible(OpQuery, []byte{0, 0, 0, 0}) {
+		t.Error("Expected only OP_MSG to be compressed")
+	}
+}
+
+func TestNewCompressor(t *testing.T) {
+	if _, err := newCompressor("zstd", -1); err == nil {
+		t.Error("Expected zstd to be unsupported")
+	}
+	if _, err := newCompressor(CompressorZlib, 10); err == nil {
+		t.Error("Expected zlib level 10 to be rejected")
+	}
+
+	opts := DefaultOptions()
+	opts.Compressors = []string{"lz4"}
+	replset := NewReplsetWithOptions([]string{"127.0.0.1:1"}, opts)
+	if err := replset.Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "compressors") {
+		t.Errorf("Expected Connect to reject an unsupported compressor, got %v", err)
+	}
+}
+
+func TestReplsetNegotiatesCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		offered  []string
+		accepted []string
+		want     string
+	}{
+		{"snappy", []string{CompressorSnappy, CompressorZlib}, []string{CompressorSnappy, CompressorZlib}, CompressorSnappy},
+		{"zlib", []string{CompressorSnappy, CompressorZlib}, []string{CompressorZlib}, CompressorZlib},
+		{"none in common", []string{CompressorSnappy}, []string{CompressorZlib}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockReplicaSet(t, 1)
+			mock.compressors = tt.accepted
+			mock.setHandler(func(member int, command *Message) bson.D {
+				if command.Body.Lookup("find").Type != 0 {
+					return bson.D{{Key: "cursor", Value: bson.D{
+						{Key: "id", Value: int64(0)},
+						{Key: "ns", Value: "test.col"},
+						{Key: "firstBatch", Value: bson.A{bson.D{{Key: "x", Value: strings.Repeat("y", 500)}}}},
+					}}, {Key: "ok", Value: 1.0}}
+				}
+				return bson.D{{Key: "ok", Value: 1.0}}
+			})
+			opts := DefaultOptions()
+			opts.Compressors = tt.offered
+			replset := NewReplsetWithOptions(mock.addrs, opts)
+			ctx := context.Background()
+			if err := replset.Connect(ctx); err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			defer replset.Disconnect()
+
+			reply, err := replset.SendCommand(ctx, bson.D{{Key: "find", Value: "col"}, {Key: "$db", Value: "test"}}, nil)
+			if err != nil {
+				t.Fatalf("SendCommand failed: %v", err)
+			}
+			values, _ := reply.Body.Lookup("cursor", "firstBatch").Array().Values()
+			if len(values) != 1 || len(values[0].Document().Lookup("x").StringValue()) != 500 {
+				t.Errorf("Unexpected reply %v", reply.Body)
+			}
+
+			mock.mu.Lock()
+			compressedWith := append([]string(nil), mock.compressedWith[0]...)
+			mock.mu.Unlock()
+			if want := []string{tt.want}; !reflect.DeepEqual(compressedWith, want) {
+				t.Errorf("Expected find to be compressed with %q, got %q", tt.want, compressedWith)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// WriteConcern describes the acknowledgement requested for writes
+type WriteConcern struct {
+	// W is the number of members that must acknowledge a write, as an int,
+	// int32 or int64, or a mode such as "majority"
+	W any
+
+	// Journal requests acknowledgement after the write reached the journal
+	Journal *bool
+
+	// WTimeout bounds how long the server waits for W members
+	WTimeout time.Duration
+}
+
+// Acknowledged reports whether the server replies to writes at all
+func (wc *WriteConcern) Acknowledged() bool {
+	if wc == nil {
+		return true
+	}
+	return !wc.unacknowledgedW() || (wc.Journal != nil && *wc.Journal)
+}
+
+// unacknowledgedW reports whether W requests no acknowledgement, whichever
+// integer type it is given as
+func (wc *WriteConcern) unacknowledgedW() bool {
+	switch w := wc.W.(type) {
+	case int:
+		return w == 0
+	case int32:
+		return w == 0
+	case int64:
+		return w == 0
+	}
+	return false
+}
+
+// unacknowledged reports whether a command requests w:0 without journaling,
+// so that the server does not report the outcome of the write
+func unacknowledged(body bson.Raw) bool {
+	w, ok := body.Lookup("writeConcern", "w").AsInt64OK()
+	return ok && w == 0 && !body.Lookup("writeConcern", "j").Boolean()
+}
+
+// writeConcernCommands are the writes sent with Options.WriteConcern
+var writeConcernCommands = map[string]bool{
+	"insert":        true,
+	"update":        true,
+	"delete":        true,
+	"findAndModify": true,
+}
+
+// withWriteConcern returns command with the writeConcern of wc, unless wc
+// is nil, the command is not a write or it sets its own write concern
+func withWriteConcern(command bson.D, wc *WriteConcern) bson.D {
+	if wc == nil || len(command) == 0 || !writeConcernCommands[command[0].Key] {
+		return command
+	}
+	if _, ok := command.Lookup("writeConcern"); ok {
+		return command
+	}
+	return append(command[:len(command):len(command)], bson.E{Key: "writeConcern", Value: wc.document()})
+}
+
+// document returns the writeConcern field of a command
+func (wc *WriteConcern) document() bson.D {
+	var doc bson.D
+	if wc.W != nil {
+		doc = append(doc, bson.E{Key: "w", Value: wc.W})
+	}
+	if wc.Journal != nil {
+		doc = append(doc, bson.E{Key: "j", Value: *wc.Journal})
+	}
+	if wc.WTimeout > 0 {
+		doc = append(doc, bson.E{Key: "wtimeout", Value: wc.WTimeout.Milliseconds()})
+	}
+	return doc
+}
+
+// Read concern levels
+const (
+	ReadConcernLocal        = "local"
+	ReadConcernAvailable    = "available"
+	ReadConcernMajority     = "majority"
+	ReadConcernLinearizable = "linearizable"
+	ReadConcernSnapshot     = "snapshot"
+)
+
+// parseReadConcernLevel validates a readConcernLevel option
+func parseReadConcernLevel(s string) (string, error) {
+	switch s {
+	case ReadConcernLocal, ReadConcernAvailable, ReadConcernMajority, ReadConcernLinearizable, ReadConcernSnapshot:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown read concern level %q", s)
+}
+
+// ReadConcern describes the consistency and isolation of reads
+type ReadConcern struct {
+	Level string
+}
+
+// document returns the readConcern field of a command
+func (rc *ReadConcern) document() bson.D {
+	return bson.D{{Key: "level", Value: rc.Level}}
+}
+
+// readConcernCommands are the reads sent with Options.ReadConcern
+var readConcernCommands = map[string]bool{
+	"find":      true,
+	"aggregate": true,
+	"count":     true,
+	"distinct":  true,
+}
+
+// withReadConcern returns command with the readConcern of rc, unless rc is
+// nil, the command does not take a read concern or it sets its own
+func withReadConcern(command bson.D, rc *ReadConcern) bson.D {
+	if rc == nil || len(command) == 0 || !readConcernCommands[command[0].Key] {
+		return command
+	}
+	if _, ok := command.Lookup("readConcern"); ok {
+		return command
+	}
+	return append(command[:len(command):len(command)], bson.E{Key: "readConcern", Value: rc.document()})
+}
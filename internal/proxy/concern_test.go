@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+func TestReplsetSendsDefaultConcerns(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var commands commandRecorder
+	mock.setHandler(clusterTimeHandler(&commands))
+	opts := DefaultOptions()
+	opts.ReadConcern = &ReadConcern{Level: ReadConcernMajority}
+	opts.WriteConcern = &WriteConcern{W: "majority"}
+	replset := NewReplsetWithOptions(mock.addrs, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	documents := []bson.Raw{mustMarshal(t, bson.D{{Key: "_id", Value: 1}})}
+	tests := []struct {
+		name         string
+		send         func() error
+		readConcern  string
+		writeConcern string
+	}{
+		{
+			name:        "find",
+			send:        func() error { _, err := replset.SendQuery(ctx, findCommand()); return err },
+			readConcern: ReadConcernMajority,
+		},
+		{
+			name: "find with its own read concern",
+			send: func() error {
+				command := bson.D{{Key: "find", Value: "col"}, {Key: "readConcern", Value: bson.D{{Key: "level", Value: ReadConcernLocal}}}, {Key: "$db", Value: "test"}}
+				_, err := replset.SendQuery(ctx, command)
+				return err
+			},
+			readConcern: ReadConcernLocal,
+		},
+		{
+			name: "update",
+			send: func() error {
+				_, err := replset.SendCommand(ctx, bson.D{{Key: "update", Value: "col"}, {Key: "$db", Value: "test"}}, documents)
+				return err
+			},
+			writeConcern: "majority",
+		},
+		{
+			name: "insert with its own write concern",
+			send: func() error {
+				command := bson.D{{Key: "insert", Value: "col"}, {Key: "writeConcern", Value: bson.D{{Key: "w", Value: "1"}}}, {Key: "$db", Value: "test"}}
+				_, err := replset.SendCommand(ctx, command, documents)
+				return err
+			},
+			writeConcern: "1",
+		},
+		{
+			name: "other commands",
+			send: func() error {
+				_, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil)
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.send(); err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+			sent := commands.all()
+			last := sent[len(sent)-1]
+			if got := last.Lookup("readConcern", "level").StringValue(); got != tt.readConcern {
+				t.Errorf("Expected read concern %q, got %v", tt.readConcern, last)
+			}
+			if got := last.Lookup("writeConcern", "w").StringValue(); got != tt.writeConcern {
+				t.Errorf("Expected write concern %q, got %v", tt.writeConcern, last)
+			}
+		})
+	}
+}
+
+func TestWriteConcernAcknowledged(t *testing.T) {
+	journal := true
+	tests := []struct {
+		name string
+		wc   *WriteConcern
+		want bool
+	}{
+		{name: "nil", wc: nil, want: true},
+		{name: "default w", wc: &WriteConcern{}, want: true},
+		{name: "majority", wc: &WriteConcern{W: "majority"}, want: true},
+		{name: "int 1", wc: &WriteConcern{W: 1}, want: true},
+		{name: "int 0", wc: &WriteConcern{W: 0}, want: false},
+		{name: "int32 0", wc: &WriteConcern{W: int32(0)}, want: false},
+		{name: "int64 0", wc: &WriteConcern{W: int64(0)}, want: false},
+		{name: "int64 2", wc: &WriteConcern{W: int64(2)}, want: true},
+		{name: "int64 0 journaled", wc: &WriteConcern{W: int64(0), Journal: &journal}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.wc.Acknowledged(); got != tt.want {
+				t.Errorf("Expected Acknowledged %v, got %v", tt.want, got)
+			}
+			// The command sent with the write concern agrees
+			if tt.wc == nil {
+				return
+			}
+			command := withWriteConcern(bson.D{{Key: "insert", Value: "col"}}, tt.wc)
+			if got := unacknowledged(mustMarshal(t, command)); got == tt.want {
+				t.Errorf("Expected unacknowledged %v for %v, got %v", !tt.want, command, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// killCursorsTimeout bounds the killCursors command sent when a getMore
+// fails, whose own context may already have ended
+const killCursorsTimeout = 5 * time.Second
+
+// CursorOptions configures how a cursor fetches its batches
+type CursorOptions struct {
+	// BatchSize is the number of documents requested per batch. Zero leaves
+	// the choice to the server, which returns 101 documents in the first
+	// batch and up to 16 MiB in later ones.
+	BatchSize int32
+
+	// Tailable keeps the cursor of a Find on a capped collection open after
+	// the last document, and AwaitData makes its getMore wait for new
+	// documents. For RunCursorCommand, AwaitData marks a cursor the command
+	// opens as awaitData, as the aggregate of a change stream does.
+	Tailable  bool
+	AwaitData bool
+
+	// MaxAwaitTime bounds how long a getMore on a tailable awaitData cursor
+	// waits for new documents. It is ignored for other cursors.
+	MaxAwaitTime time.Duration
+
+	// Exhaust sends the first getMore with exhaustAllowed, so that the
+	// server streams every remaining batch without further getMore round
+	// trips. The connection stays reserved for the cursor until it is
+	// exhausted or closed.
+	Exhaust bool
+}
+
+// Cursor iterates over the results of a command that returns a cursor,
+// fetching further batches with getMore as the current one is consumed.
+// A cursor is pinned to the server that ran the command, since cursors
+// only exist on that member. A Cursor is not safe for concurrent use.
+//
+// Callers must Close a cursor they do not exhaust. The server cursor is
+// killed by Close and by a getMore that fails, for example because its
+// context ended, but nothing runs while the cursor is idle between calls:
+// cancelling the context of an idle cursor leaves the server cursor open
+// until Close.
+type Cursor struct {
+	replset    *Replset
+	server     ServerDescription
+	id         int64
+	db         string
+	collection string
+	opts       CursorOptions
+
+	// awaitData is set for tailable awaitData cursors, whose getMore waits
+	// up to MaxAwaitTime for new documents
+	awaitData bool
+
+	// session is the session the cursor was opened in, which getMore and
+	// killCursors must use as well
+	session *Session
+
+	// operationTime is the operationTime of the reply that opened the
+	// cursor and postBatchResumeToken the resume token of the latest batch
+	// of a change stream
+	operationTime        bson.Timestamp
+	postBatchResumeToken bson.Raw
+
+	// stream reads the batches of an exhaust cursor after the first getMore
+	stream *exhaustStream
+
+	batch   []bson.Raw
+	current bson.Raw
+	err     error
+}
+
+// Find runs a find command on collection and returns a cursor over the
+// matching documents. A nil filter matches every document.
+func (r *Replset) Find(ctx context.Context, db, collection string, filter bson.Raw, opts CursorOptions) (*Cursor, error) {
+	command := bson.D{{Key: "find", Value: collection}}
+	if len(filter) > 0 {
+		command = append(command, bson.E{Key: "filter", Value: filter})
+	}
+	if opts.Tailable {
+		command = append(command, bson.E{Key: "tailable", Value: true})
+	}
+	if opts.AwaitData {
+		command = append(command, bson.E{Key: "awaitData", Value: true})
+	}
+	command = append(command, bson.E{Key: "$db", Value: db})
+	return r.RunCursorCommand(ctx, command, opts)
+}
+
+// RunCursorCommand runs a command that returns a cursor, such as find or
+// aggregate, and returns a cursor over its results. The command must
+// include $db. A nonzero opts.BatchSize is added to the command unless it
+// already sets one. The command is retried like other reads; getMore is not.
+func (r *Replset) RunCursorCommand(ctx context.Context, command bson.D, opts CursorOptions) (*Cursor, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("empty cursor command")
+	}
+	if opts.BatchSize < 0 {
+		return nil, fmt.Errorf("invalid batch size %d", opts.BatchSize)
+	}
+	var err error
+	if opts.BatchSize > 0 {
+		if command, err = withBatchSize(command, opts.BatchSize); err != nil {
+			return nil, err
+		}
+	}
+	command, err = withMaxTimeMS(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	server, reply, err := r.retryableRead(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	// The namespace of the command stands in until the reply names one
+	c := &Cursor{replset: r, server: server, opts: opts, session: sessionFromContext(ctx)}
+	awaitData, _ := command.Lookup("awaitData")
+	c.awaitData = opts.AwaitData || awaitData == true
+	if db, ok := command.Lookup("$db"); ok {
+		c.db, _ = db.(string)
+	}
+	c.collection, _ = command[0].Value.(string)
+	c.operationTime = reply.Body.Lookup("operationTime").Timestamp()
+	if err := c.update(reply.Body, "firstBatch"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// withBatchSize returns a copy of command requesting batches of size
+// documents. Aggregations take the batch size in their cursor document.
+func withBatchSize(command bson.D, size int32) (bson.D, error) {
+	if command[0].Key != "aggregate" {
+		if _, ok := command.Lookup("batchSize"); ok {
+			return command, nil
+		}
+		return append(command[:len(command):len(command)], bson.E{Key: "batchSize", Value: size}), nil
+	}
+
+	var cursor bson.D
+	if v, ok := command.Lookup("cursor"); ok {
+		switch doc := v.(type) {
+		case bson.D:
+			cursor = append(cursor, doc...)
+		case bson.Raw:
+			var err error
+			if cursor, err = bson.Unmarshal(doc); err != nil {
+				return nil, fmt.Errorf("invalid cursor document: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid cursor document of type %T", v)
+		}
+	}
+	if _, ok := cursor.Lookup("batchSize"); ok {
+		return command, nil
+	}
+	cursor = append(cursor, bson.E{Key: "batchSize", Value: size})
+	return append(bson.D(nil), command...).Set("cursor", cursor), nil
+}
+
+// update reads the cursor id, namespace and the named batch from the
+// cursor document of a reply
+func (c *Cursor) update(response bson.Raw, batchKey string) error {
+	cursor := response.Lookup("cursor")
+	if cursor.Type != bson.TypeDocument {
+		return fmt.Errorf("reply has no cursor document")
+	}
+	doc := cursor.Document()
+
+	id, ok := doc.Lookup("id").AsInt64OK()
+	if !ok {
+		return fmt.Errorf("reply has no cursor id")
+	}
+	if ns, ok := doc.Lookup("ns").StringValueOK(); ok {
+		db, collection, found := strings.Cut(ns, ".")
+		if !found {
+			return fmt.Errorf("invalid cursor namespace %q", ns)
+		}
+		c.db, c.collection = db, collection
+	}
+
+	batch := doc.Lookup(batchKey)
+	if batch.Type != bson.TypeArray {
+		return fmt.Errorf("reply has no cursor.%s array", batchKey)
+	}
+	values, err := batch.Array().Values()
+	if err != nil {
+		return err
+	}
+	documents := make([]bson.Raw, 0, len(values))
+	for i, v := range values {
+		if v.Type != bson.TypeDocument {
+			return fmt.Errorf("%s element %d is not a document", batchKey, i)
+		}
+		documents = append(documents, v.Document())
+	}
+
+	c.id = id
+	c.batch = documents
+	c.postBatchResumeToken = doc.Lookup("postBatchResumeToken").Document()
+	return nil
+}
+
+// ID returns the server side id of the cursor, which is zero once the
+// cursor is exhausted or closed
+func (c *Cursor) ID() int64 {
+	return c.id
+}
+
+// Namespace returns the database and collection the cursor iterates over
+func (c *Cursor) Namespace() string {
+	return c.db + "." + c.collection
+}
+
+// RemainingBatchLength returns the number of documents left in the current
+// batch, which Next returns without contacting the server
+func (c *Cursor) RemainingBatchLength() int {
+	return len(c.batch)
+}
+
+// Next advances the cursor to the next document, running getMore when the
+// current batch is consumed. It returns false when the cursor is exhausted
+// or an error occurs, which Err reports. A cursor whose getMore fails, for
+// example because ctx ended, is killed on the server.
+func (c *Cursor) Next(ctx context.Context) bool {
+	for c.err == nil && (len(c.batch) > 0 || c.id != 0) {
+		if c.tryNext(ctx) {
+			return true
+		}
+	}
+	c.current = nil
+	return false
+}
+
+// tryNext advances the cursor like Next but runs at most one getMore, so
+// it returns false without an error when that batch is empty
+func (c *Cursor) tryNext(ctx context.Context) bool {
+	if len(c.batch) == 0 && c.id != 0 && c.err == nil {
+		if err := c.getMore(ctx); err != nil {
+			c.err = err
+			c.kill()
+		}
+	}
+	if c.err != nil || len(c.batch) == 0 {
+		c.current = nil
+		return false
+	}
+	c.current = c.batch[0]
+	c.batch = c.batch[1:]
+	return true
+}
+
+// Current returns the document Next advanced to
+func (c *Cursor) Current() bson.Raw {
+	return c.current
+}
+
+// Err returns the error that stopped the iteration, if any
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// All returns the remaining documents of the cursor and closes it
+func (c *Cursor) All(ctx context.Context) ([]bson.Raw, error) {
+	var documents []bson.Raw
+	for c.Next(ctx) {
+		documents = append(documents, c.Current())
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	return documents, c.Close(ctx)
+}
+
+// Close releases the cursor, running killCursors when it is not exhausted
+func (c *Cursor) Close(ctx context.Context) error {
+	c.batch = nil
+	c.current = nil
+	c.closeStream()
+	if c.id == 0 {
+		return nil
+	}
+	err := c.killCursors(ctx)
+	c.id = 0
+	return err
+}
+
+// getMore fetches the next batch from the server the cursor is pinned to.
+// An exhaust cursor reads the batches after the first one from its stream.
+func (c *Cursor) getMore(ctx context.Context) error {
+	if c.stream != nil {
+		reply, err := c.stream.next(c.context(ctx))
+		if c.stream.done() {
+			c.stream = nil
+		}
+		return c.getMoreReply(reply, err)
+	}
+
+	command := bson.D{
+		{Key: "getMore", Value: c.id},
+		{Key: "collection", Value: c.collection},
+	}
+	if c.opts.BatchSize > 0 {
+		command = append(command, bson.E{Key: "batchSize", Value: c.opts.BatchSize})
+	}
+	// getMore only accepts maxTimeMS on awaitData cursors, where it is the
+	// time to wait for new documents rather than an operation deadline
+	if c.awaitData && c.opts.MaxAwaitTime > 0 {
+		command = append(command, bson.E{Key: "maxTimeMS", Value: c.opts.MaxAwaitTime.Milliseconds()})
+	}
+	command = append(command, bson.E{Key: "$db", Value: c.db})
+
+	var reply *Message
+	var err error
+	if c.opts.Exhaust {
+		reply, c.stream, err = c.replset.sendExhaustTo(c.context(ctx), c.server, command)
+	} else {
+		reply, err = c.replset.sendCommandTo(c.context(ctx), c.server, command, nil)
+	}
+	return c.getMoreReply(reply, err)
+}
+
+// getMoreReply updates the cursor from the reply to a getMore
+func (c *Cursor) getMoreReply(reply *Message, err error) error {
+	if err != nil {
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) {
+			// The server has already discarded a cursor it reports errors for
+			c.id = 0
+		}
+		return fmt.Errorf("getMore: %w", err)
+	}
+	return c.update(reply.Body, "nextBatch")
+}
+
+// kill runs killCursors after an interrupted getMore. Its own context
+// lets it outlive the context that ended.
+func (c *Cursor) kill() {
+	c.closeStream()
+	if c.id == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), killCursorsTimeout)
+	defer cancel()
+	_ = c.killCursors(ctx)
+	c.id = 0
+}
+
+// closeStream closes the connection of an exhaust cursor that has not
+// received its last batch
+func (c *Cursor) closeStream() {
+	if c.stream != nil {
+		c.stream.close()
+		c.stream = nil
+	}
+}
+
+// killCursors asks the server to discard the cursor
+func (c *Cursor) killCursors(ctx context.Context) error {
+	command := bson.D{
+		{Key: "killCursors", Value: c.collection},
+		{Key: "cursors", Value: bson.A{c.id}},
+		{Key: "$db", Value: c.db},
+	}
+	if _, err := c.replset.sendCommandTo(c.context(ctx), c.server, command, nil); err != nil {
+		return fmt.Errorf("killCursors: %w", err)
+	}
+	return nil
+}
+
+// context returns ctx carrying the session the cursor was opened in
+func (c *Cursor) context(ctx context.Context) context.Context {
+	if c.session == nil {
+		return ctx
+	}
+	return WithSession(ctx, c.session)
+}
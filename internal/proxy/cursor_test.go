@@ -0,0 +1,399 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+	pb "mongo-playground/proto/proxy"
+)
+
+// mockCursor serves count documents {i: n} from a cursor with the given id,
+// in batches of the requested size, and records the commands it receives
+type mockCursor struct {
+	id    int64
+	count int
+
+	mu       sync.Mutex
+	next     int
+	killed   []int64
+	getMores []bson.Raw
+}
+
+func (m *mockCursor) handle(member int, command *Message) bson.D {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	body := command.Body
+	switch {
+	case body.Lookup("find").Type != 0:
+		size, ok := body.Lookup("batchSize").AsInt64OK()
+		if !ok {
+			size = 101
+		}
+		return m.batchLocked("firstBatch", int(size))
+	case body.Lookup("aggregate").Type != 0:
+		size, ok := body.Lookup("cursor", "batchSize").AsInt64OK()
+		if !ok {
+			size = 101
+		}
+		return m.batchLocked("firstBatch", int(size))
+	case body.Lookup("getMore").Type != 0:
+		m.getMores = append(m.getMores, body)
+		if body.Lookup("getMore").Int64() != m.id {
+			return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: "cursor not found"}, {Key: "code", Value: 43}}
+		}
+		size, ok := body.Lookup("batchSize").AsInt64OK()
+		if !ok {
+			size = int64(m.count)
+		}
+		return m.batchLocked("nextBatch", int(size))
+	case body.Lookup("killCursors").Type != 0:
+		values, _ := body.Lookup("cursors").Array().Values()
+		for _, v := range values {
+			m.killed = append(m.killed, v.Int64())
+		}
+		return bson.D{{Key: "ok", Value: 1.0}}
+	}
+	return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: "no such command"}}
+}
+
+func (m *mockCursor) batchLocked(key string, size int) bson.D {
+	batch := bson.A{}
+	for ; size > 0 && m.next < m.count; size-- {
+		batch = append(batch, bson.D{{Key: "i", Value: m.next}})
+		m.next++
+	}
+	id := m.id
+	if m.next == m.count {
+		id = 0
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: key, Value: batch},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: "test.col"},
+		}},
+		{Key: "ok", Value: 1.0},
+	}
+}
+
+func (m *mockCursor) killedCursors() []int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]int64(nil), m.killed...)
+}
+
+func TestCursorIteratesAllBatches(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	cursor := &mockCursor{id: 77, count: 5}
+	mock.setHandler(cursor.handle)
+	replset := connectTestReplset(t, mock)
+
+	ctx := context.Background()
+	c, err := replset.Find(ctx, "test", "col", nil, CursorOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if c.ID() != 77 || c.Namespace() != "test.col" || c.RemainingBatchLength() != 2 {
+		t.Errorf("Unexpected cursor state: id %d, ns %s, batch %d", c.ID(), c.Namespace(), c.RemainingBatchLength())
+	}
+
+	var seen []int32
+	for c.Next(ctx) {
+		seen = append(seen, c.Current().Lookup("i").Int32())
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	if len(seen) != 5 {
+		t.Fatalf("Expected 5 documents, got %v", seen)
+	}
+	for i, v := range seen {
+		if v != int32(i) {
+			t.Errorf("Expected document %d to be %d, got %d", i, i, v)
+		}
+	}
+	if c.ID() != 0 {
+		t.Errorf("Expected an exhausted cursor to have id 0, got %d", c.ID())
+	}
+
+	cursor.mu.Lock()
+	getMores := cursor.getMores
+	cursor.mu.Unlock()
+	if len(getMores) != 2 {
+		t.Fatalf("Expected 2 getMore commands, got %d", len(getMores))
+	}
+	getMore := getMores[0]
+	if getMore.Lookup("collection").StringValue() != "col" || getMore.Lookup("$db").StringValue() != "test" ||
+		getMore.Lookup("batchSize").Int32() != 2 || getMore.Lookup("maxTimeMS").Type != 0 {
+		t.Errorf("Unexpected getMore command %v", getMore)
+	}
+
+	// An exhausted cursor is not killed
+	if err := c.Close(ctx); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if killed := cursor.killedCursors(); len(killed) != 0 {
+		t.Errorf("Expected no killCursors for an exhausted cursor, got %v", killed)
+	}
+}
+
+func TestCursorAggregateBatchSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor any
+		want   int
+	}{
+		{"empty cursor document", bson.D{}, 2},
+		{"raw cursor document", bson.Raw(mustMarshal(t, bson.D{})), 2},
+		{"cursor document with a batch size", bson.D{{Key: "batchSize", Value: int32(3)}}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockReplicaSet(t, 1)
+			cursor := &mockCursor{id: 77, count: 5}
+			mock.setHandler(cursor.handle)
+			replset := connectTestReplset(t, mock)
+
+			ctx := context.Background()
+			command := bson.D{
+				{Key: "aggregate", Value: "col"},
+				{Key: "pipeline", Value: bson.A{}},
+				{Key: "cursor", Value: tt.cursor},
+				{Key: "$db", Value: "test"},
+			}
+			c, err := replset.RunCursorCommand(ctx, command, CursorOptions{BatchSize: 2})
+			if err != nil {
+				t.Fatalf("RunCursorCommand failed: %v", err)
+			}
+			if got := c.RemainingBatchLength(); got != tt.want {
+				t.Errorf("Expected a first batch of %d documents, got %d", tt.want, got)
+			}
+			documents, err := c.All(ctx)
+			if err != nil || len(documents) != 5 {
+				t.Errorf("Expected 5 documents, got %d (%v)", len(documents), err)
+			}
+		})
+	}
+}
+
+func TestCursorCloseKillsCursor(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	cursor := &mockCursor{id: 77, count: 5}
+	mock.setHandler(cursor.handle)
+	replset := connectTestReplset(t, mock)
+
+	ctx := context.Background()
+	c, err := replset.Find(ctx, "test", "col", nil, CursorOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if !c.Next(ctx) {
+		t.Fatalf("Next failed: %v", c.Err())
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if killed := cursor.killedCursors(); len(killed) != 1 || killed[0] != 77 {
+		t.Errorf("Expected cursor 77 to be killed, got %v", killed)
+	}
+	if c.Next(ctx) {
+		t.Error("Expected Next to return false after Close")
+	}
+}
+
+func TestCursorMaxAwaitTime(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(ctx context.Context, replset *Replset, opts CursorOptions) (*Cursor, error)
+	}{
+		{
+			name: "awaitData in the command",
+			open: func(ctx context.Context, replset *Replset, opts CursorOptions) (*Cursor, error) {
+				command := bson.D{
+					{Key: "find", Value: "col"},
+					{Key: "tailable", Value: true},
+					{Key: "awaitData", Value: true},
+					{Key: "$db", Value: "test"},
+				}
+				return replset.RunCursorCommand(ctx, command, opts)
+			},
+		},
+		{
+			name: "awaitData option",
+			open: func(ctx context.Context, replset *Replset, opts CursorOptions) (*Cursor, error) {
+				opts.Tailable, opts.AwaitData = true, true
+				return replset.Find(ctx, "test", "col", nil, opts)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockReplicaSet(t, 1)
+			cursor := &mockCursor{id: 77, count: 3}
+			mock.setHandler(cursor.handle)
+			replset := connectTestReplset(t, mock)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := tt.open(ctx, replset, CursorOptions{BatchSize: 1, MaxAwaitTime: 250 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			if _, err := c.All(ctx); err != nil {
+				t.Fatalf("All failed: %v", err)
+			}
+
+			cursor.mu.Lock()
+			defer cursor.mu.Unlock()
+			if len(cursor.getMores) == 0 {
+				t.Fatal("Expected getMore commands")
+			}
+			for _, getMore := range cursor.getMores {
+				// The context deadline does not leak into getMore
+				if ms, _ := getMore.Lookup("maxTimeMS").AsInt64OK(); ms != 250 {
+					t.Errorf("Expected maxTimeMS 250 from MaxAwaitTime, got %v", getMore)
+				}
+			}
+		})
+	}
+}
+
+func TestCursorMaxAwaitTimeIgnoredWithoutAwaitData(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	cursor := &mockCursor{id: 77, count: 3}
+	mock.setHandler(cursor.handle)
+	replset := connectTestReplset(t, mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := replset.Find(ctx, "test", "col", nil, CursorOptions{BatchSize: 1, MaxAwaitTime: 250 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if _, err := c.All(ctx); err != nil {
+		t.Fatalf("All failed: %v", err)
+	}
+
+	cursor.mu.Lock()
+	defer cursor.mu.Unlock()
+	if len(cursor.getMores) == 0 {
+		t.Fatal("Expected getMore commands")
+	}
+	for _, getMore := range cursor.getMores {
+		// A server rejects maxTimeMS on the getMore of other cursors
+		if getMore.Lookup("maxTimeMS").Type != 0 {
+			t.Errorf("Expected no maxTimeMS on a plain find cursor, got %v", getMore)
+		}
+	}
+}
+
+func TestCursorIdleCancelKeepsCursorUntilClose(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	cursor := &mockCursor{id: 77, count: 5}
+	mock.setHandler(cursor.handle)
+	replset := connectTestReplset(t, mock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := replset.Find(ctx, "test", "col", nil, CursorOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if killed := cursor.killedCursors(); len(killed) != 0 {
+		t.Fatalf("Expected an idle cursor to stay open until Close, got %v killed", killed)
+	}
+
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if killed := cursor.killedCursors(); len(killed) != 1 || killed[0] != 77 {
+		t.Errorf("Expected Close to kill cursor 77, got %v", killed)
+	}
+}
+
+func TestCursorCancelledGetMoreKillsCursor(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	cursor := &mockCursor{id: 77, count: 5}
+	received := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+	var once sync.Once
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if command.Body.Lookup("getMore").Type != 0 {
+			once.Do(func() { close(received) })
+			<-hang
+		}
+		return cursor.handle(member, command)
+	})
+	replset := connectTestReplset(t, mock)
+
+	c, err := replset.Find(context.Background(), "test", "col", nil, CursorOptions{BatchSize: 1})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	for c.Next(ctx) {
+	}
+	if !errors.Is(c.Err(), context.Canceled) {
+		t.Fatalf("Expected context canceled, got %v", c.Err())
+	}
+	if killed := cursor.killedCursors(); len(killed) != 1 || killed[0] != 77 {
+		t.Errorf("Expected cursor 77 to be killed after the cancelled getMore, got %v", killed)
+	}
+	if c.ID() != 0 {
+		t.Errorf("Expected the cursor to be released, got id %d", c.ID())
+	}
+}
+
+func TestCursorGetMoreError(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	cursor := &mockCursor{id: 77, count: 5}
+	mock.setHandler(cursor.handle)
+	replset := connectTestReplset(t, mock)
+
+	ctx := context.Background()
+	c, err := replset.Find(ctx, "test", "col", nil, CursorOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	// The server forgets the cursor
+	cursor.mu.Lock()
+	cursor.id = 78
+	cursor.mu.Unlock()
+
+	documents, err := c.All(ctx)
+	if err == nil {
+		t.Fatalf("Expected getMore to fail, got %d documents", len(documents))
+	}
+	if killed := cursor.killedCursors(); len(killed) != 0 {
+		t.Errorf("Expected no killCursors for a cursor the server reported missing, got %v", killed)
+	}
+}
+
+func TestServer_FindReturnsAllBatches(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	cursor := &mockCursor{id: 77, count: 250}
+	mock.setHandler(cursor.handle)
+	s := NewServer(connectTestReplset(t, mock))
+
+	resp, err := s.Find(context.Background(), &pb.FindRequest{Db: "test", Collection: "col"})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if len(resp.Documents) != 250 {
+		t.Fatalf("Expected 250 documents, got %d", len(resp.Documents))
+	}
+	if last := bson.Raw(resp.Documents[249]).Lookup("i").Int32(); last != 249 {
+		t.Errorf("Expected the last document to be 249, got %d", last)
+	}
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"mongo-playground/internal/bson"
+)
+
+// Error labels the server attaches to errors
+const (
+	LabelRetryableWrite                 = "RetryableWriteError"
+	LabelTransientTransaction           = "TransientTransactionError"
+	LabelUnknownTransactionCommitResult = "UnknownTransactionCommitResult"
+)
+
+// Server error codes for duplicate key violations
+var duplicateKeyCodes = map[int32]bool{
+	11000: true, // DuplicateKey
+	11001: true, // legacy DuplicateKey on update
+	12582: true, // legacy DuplicateKey on insert
+}
+
+// Server error codes that say the member cannot accept writes
+var notWritablePrimaryCodes = map[int32]bool{
+	10058: true, // LegacyNotPrimary
+	10107: true, // NotWritablePrimary
+	13435: true, // NotPrimaryNoSecondaryOk
+}
+
+// CommandError is a command failure reported with ok: 0 in a reply
+type CommandError struct {
+	Code    int32
+	Name    string
+	Message string
+	Labels  []string
+	Raw     bson.Raw
+}
+
+func (e *CommandError) Error() string {
+	return formatServerError(e.Code, e.Name, e.Message)
+}
+
+// HasErrorLabel reports whether the server attached label to the error
+func (e *CommandError) HasErrorLabel(label string) bool {
+	return slices.Contains(e.Labels, label)
+}
+
+func (e *CommandError) hasCode(match func(code int32, message string) bool) bool {
+	return match(e.Code, e.Message)
+}
+
+// WriteError is the failure of one write in a write command. Index is the
+// position of the write in the command.
+type WriteError struct {
+	Index   int
+	Code    int32
+	Message string
+	Details bson.Raw
+}
+
+func (e WriteError) Error() string {
+	return fmt.Sprintf("write error at index %d: %s", e.Index, formatServerError(e.Code, "", e.Message))
+}
+
+// WriteConcernError reports that a write was applied but its write concern
+// was not satisfied
+type WriteConcernError struct {
+	Code    int32
+	Name    string
+	Message string
+	Details bson.Raw
+}
+
+func (e *WriteConcernError) Error() string {
+	return "write concern error: " + formatServerError(e.Code, e.Name, e.Message)
+}
+
+// WriteException is returned for a write command whose reply has
+// writeErrors or a writeConcernError
+type WriteException struct {
+	WriteErrors       []WriteError
+	WriteConcernError *WriteConcernError
+	Labels            []string
+	Raw               bson.Raw
+}
+
+func (e *WriteException) Error() string {
+	errs := make([]string, 0, len(e.WriteErrors)+1)
+	for _, we := range e.WriteErrors {
+		errs = append(errs, we.Error())
+	}
+	if e.WriteConcernError != nil {
+		errs = append(errs, e.WriteConcernError.Error())
+	}
+	return "write exception: " + strings.Join(errs, "; ")
+}
+
+// HasErrorLabel reports whether the server attached label to the error
+func (e *WriteException) HasErrorLabel(label string) bool {
+	return slices.Contains(e.Labels, label)
+}
+
+func (e *WriteException) hasCode(match func(code int32, message string) bool) bool {
+	for _, we := range e.WriteErrors {
+		if match(we.Code, we.Message) {
+			return true
+		}
+	}
+	return e.WriteConcernError != nil && match(e.WriteConcernError.Code, e.WriteConcernError.Message)
+}
+
+// BulkWriteError is a WriteError together with the request it refers to
+type BulkWriteError struct {
+	WriteError
+	Request bson.Raw
+}
+
+// BulkWriteException is returned for a write of several documents when
+// some of them failed or the write concern was not satisfied
+type BulkWriteException struct {
+	WriteErrors       []BulkWriteError
+	WriteConcernError *WriteConcernError
+	Labels            []string
+}
+
+func (e *BulkWriteException) Error() string {
+	errs := make([]string, 0, len(e.WriteErrors)+1)
+	for _, we := range e.WriteErrors {
+		errs = append(errs, we.Error())
+	}
+	if e.WriteConcernError != nil {
+		errs = append(errs, e.WriteConcernError.Error())
+	}
+	return "bulk write exception: " + strings.Join(errs, "; ")
+}
+
+// HasErrorLabel reports whether the server attached label to the error
+func (e *BulkWriteException) HasErrorLabel(label string) bool {
+	return slices.Contains(e.Labels, label)
+}
+
+func (e *BulkWriteException) hasCode(match func(code int32, message string) bool) bool {
+	for _, we := range e.WriteErrors {
+		if match(we.Code, we.Message) {
+			return true
+		}
+	}
+	return e.WriteConcernError != nil && match(e.WriteConcernError.Code, e.WriteConcernError.Message)
+}
+
+// networkError is a failure to reach a member or an interrupted exchange
+// with it, as opposed to an error reported by the server
+type networkError struct {
+	addr string
+	err  error
+}
+
+func (e *networkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *networkError) Unwrap() error {
+	return e.err
+}
+
+// isNetworkError reports whether err is, or wraps, a network error
+func isNetworkError(err error) bool {
+	var netErr *networkError
+	return errors.As(err, &netErr)
+}
+
+// labeledError attaches error labels the driver assigns, such as
+// TransientTransactionError on a network error inside a transaction
+type labeledError struct {
+	err    error
+	labels []string
+}
+
+func (e *labeledError) Error() string {
+	return e.err.Error()
+}
+
+func (e *labeledError) Unwrap() error {
+	return e.err
+}
+
+// HasErrorLabel reports whether label was attached to the error or the
+// server error it wraps
+func (e *labeledError) HasErrorLabel(label string) bool {
+	return slices.Contains(e.labels, label) || HasErrorLabel(e.err, label)
+}
+
+// withErrorLabel attaches label to err unless it already carries it
+func withErrorLabel(err error, label string) error {
+	if HasErrorLabel(err, label) {
+		return err
+	}
+	return &labeledError{err: err, labels: []string{label}}
+}
+
+// serverError is implemented by the errors decoded from server replies
+type serverError interface {
+	error
+	HasErrorLabel(label string) bool
+	hasCode(match func(code int32, message string) bool) bool
+}
+
+// IsDuplicateKey reports whether err is, or contains, a duplicate key error
+func IsDuplicateKey(err error) bool {
+	var se serverError
+	return errors.As(err, &se) && se.hasCode(func(code int32, message string) bool {
+		// mongos may report a shard's duplicate key error under another code
+		return duplicateKeyCodes[code] || strings.Contains(message, "E11000 duplicate key")
+	})
+}
+
+// IsNotWritablePrimary reports whether err says the server is not a
+// writable primary
+func IsNotWritablePrimary(err error) bool {
+	var se serverError
+	return errors.As(err, &se) && se.hasCode(func(code int32, message string) bool {
+		return notWritablePrimaryCodes[code] || code == 0 && strings.Contains(message, "not master")
+	})
+}
+
+// HasErrorLabel reports whether err carries the error label
+func HasErrorLabel(err error, label string) bool {
+	var le interface{ HasErrorLabel(label string) bool }
+	return errors.As(err, &le) && le.HasErrorLabel(label)
+}
+
+// formatServerError formats an error code, its name and message
+func formatServerError(code int32, name, message string) string {
+	switch {
+	case name != "":
+		return fmt.Sprintf("(%s) %s", name, message)
+	case code != 0:
+		return fmt.Sprintf("(code %d) %s", code, message)
+	case message == "":
+		return "command failed"
+	}
+	return message
+}
+
+// replyError returns the error reported in the body of a reply: a
+// CommandError when ok is not 1, a WriteException when the command
+// succeeded with writeErrors or a writeConcernError, and nil otherwise
+func replyError(body bson.Raw) error {
+	labels := stringArray(body.Lookup("errorLabels"))
+	if ok, _ := body.Lookup("ok").AsFloat64OK(); ok != 1 {
+		code, _ := body.Lookup("code").AsInt64OK()
+		return &CommandError{
+			Code:    int32(code),
+			Name:    body.Lookup("codeName").StringValue(),
+			Message: body.Lookup("errmsg").StringValue(),
+			Labels:  labels,
+			Raw:     body,
+		}
+	}
+
+	var writeErrors []WriteError
+	if v := body.Lookup("writeErrors"); v.Type == bson.TypeArray {
+		values, err := v.Array().Values()
+		if err != nil {
+			return fmt.Errorf("invalid writeErrors in reply: %w", err)
+		}
+		for _, value := range values {
+			if value.Type != bson.TypeDocument {
+				return fmt.Errorf("invalid writeErrors in reply: element is %s", value.Type)
+			}
+			doc := value.Document()
+			index, _ := doc.Lookup("index").AsInt64OK()
+			code, _ := doc.Lookup("code").AsInt64OK()
+			writeErrors = append(writeErrors, WriteError{
+				Index:   int(index),
+				Code:    int32(code),
+				Message: doc.Lookup("errmsg").StringValue(),
+				Details: doc.Lookup("errInfo").Document(),
+			})
+		}
+	}
+
+	var wcError *WriteConcernError
+	if v := body.Lookup("writeConcernError"); v.Type == bson.TypeDocument {
+		doc := v.Document()
+		code, _ := doc.Lookup("code").AsInt64OK()
+		wcError = &WriteConcernError{
+			Code:    int32(code),
+			Name:    doc.Lookup("codeName").StringValue(),
+			Message: doc.Lookup("errmsg").StringValue(),
+			Details: doc.Lookup("errInfo").Document(),
+		}
+		// Servers before 4.4 put the labels in the writeConcernError
+		for _, label := range stringArray(doc.Lookup("errorLabels")) {
+			if !slices.Contains(labels, label) {
+				labels = append(labels, label)
+			}
+		}
+	}
+
+	if len(writeErrors) == 0 && wcError == nil {
+		return nil
+	}
+	return &WriteException{WriteErrors: writeErrors, WriteConcernError: wcError, Labels: labels, Raw: body}
+}
+
+// bulkWriteException converts the WriteException of a write of several
+// documents, attaching the document each write error refers to
+func bulkWriteException(e *WriteException, documents []bson.Raw) *BulkWriteException {
+	bulk := &BulkWriteException{WriteConcernError: e.WriteConcernError, Labels: e.Labels}
+	for _, we := range e.WriteErrors {
+		bwe := BulkWriteError{WriteError: we}
+		if we.Index >= 0 && we.Index < len(documents) {
+			bwe.Request = documents[we.Index]
+		}
+		bulk.WriteErrors = append(bulk.WriteErrors, bwe)
+	}
+	return bulk
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"mongo-playground/internal/bson"
+	pb "mongo-playground/proto/proxy"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReplyError(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply bson.D
+		check func(t *testing.T, err error)
+	}{
+		{
+			name:  "success",
+			reply: bson.D{{Key: "n", Value: 1}, {Key: "ok", Value: 1.0}},
+			check: func(t *testing.T, err error) {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+			},
+		},
+		{
+			name: "command error",
+			reply: bson.D{
+				{Key: "ok", Value: 0.0},
+				{Key: "errmsg", Value: "not primary"},
+				{Key: "code", Value: 10107},
+				{Key: "codeName", Value: "NotWritablePrimary"},
+				{Key: "errorLabels", Value: bson.A{LabelRetryableWrite}},
+			},
+			check: func(t *testing.T, err error) {
+				var cmdErr *CommandError
+				if !errors.As(err, &cmdErr) || cmdErr.Code != 10107 || cmdErr.Name != "NotWritablePrimary" {
+					t.Fatalf("Expected a CommandError, got %#v", err)
+				}
+				if err.Error() != "(NotWritablePrimary) not primary" {
+					t.Errorf("Unexpected message %q", err.Error())
+				}
+				if !IsNotWritablePrimary(err) || IsDuplicateKey(err) {
+					t.Error("Expected a not writable primary error")
+				}
+				if !HasErrorLabel(err, LabelRetryableWrite) || HasErrorLabel(err, LabelTransientTransaction) {
+					t.Errorf("Unexpected labels %v", cmdErr.Labels)
+				}
+			},
+		},
+		{
+			name: "legacy not master message",
+			reply: bson.D{
+				{Key: "ok", Value: 0.0},
+				{Key: "errmsg", Value: "not master"},
+			},
+			check: func(t *testing.T, err error) {
+				if !IsNotWritablePrimary(err) {
+					t.Errorf("Expected a not writable primary error, got %v", err)
+				}
+			},
+		},
+		{
+			name: "write errors",
+			reply: bson.D{
+				{Key: "n", Value: 1},
+				{Key: "writeErrors", Value: bson.A{bson.D{
+					{Key: "index", Value: 1},
+					{Key: "code", Value: 11000},
+					{Key: "errmsg", Value: "E11000 duplicate key error collection: test.col index: _id_ dup key: { _id: 1 }"},
+				}}},
+				{Key: "ok", Value: 1.0},
+			},
+			check: func(t *testing.T, err error) {
+				var writeErr *WriteException
+				if !errors.As(err, &writeErr) || len(writeErr.WriteErrors) != 1 || writeErr.WriteConcernError != nil {
+					t.Fatalf("Expected a WriteException, got %#v", err)
+				}
+				if writeErr.WriteErrors[0].Index != 1 {
+					t.Errorf("Expected index 1, got %d", writeErr.WriteErrors[0].Index)
+				}
+				if !IsDuplicateKey(err) || IsNotWritablePrimary(err) {
+					t.Error("Expected a duplicate key error")
+				}
+			},
+		},
+		{
+			name: "write concern error",
+			reply: bson.D{
+				{Key: "n", Value: 1},
+				{Key: "writeConcernError", Value: bson.D{
+					{Key: "code", Value: 64},
+					{Key: "codeName", Value: "WriteConcernFailed"},
+					{Key: "errmsg", Value: "waiting for replication timed out"},
+					{Key: "errorLabels", Value: bson.A{LabelRetryableWrite}},
+				}},
+				{Key: "ok", Value: 1.0},
+			},
+			check: func(t *testing.T, err error) {
+				var writeErr *WriteException
+				if !errors.As(err, &writeErr) || writeErr.WriteConcernError == nil || writeErr.WriteConcernError.Code != 64 {
+					t.Fatalf("Expected a write concern error, got %#v", err)
+				}
+				if !HasErrorLabel(err, LabelRetryableWrite) {
+					t.Error("Expected labels of the write concern error to be kept")
+				}
+				if !strings.Contains(err.Error(), "(WriteConcernFailed) waiting for replication timed out") {
+					t.Errorf("Unexpected message %q", err.Error())
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.check(t, replyError(mustMarshal(t, tt.reply)))
+		})
+	}
+}
+
+func TestErrorHelpersUnwrap(t *testing.T) {
+	err := fmt.Errorf("insert: %w", &BulkWriteException{
+		WriteErrors: []BulkWriteError{{WriteError: WriteError{Index: 3, Code: 11000}}},
+		Labels:      []string{LabelTransientTransaction},
+	})
+	if !IsDuplicateKey(err) || !HasErrorLabel(err, LabelTransientTransaction) {
+		t.Errorf("Expected the helpers to see through wrapping: %v", err)
+	}
+	if IsDuplicateKey(errors.New("E11000 duplicate key")) || HasErrorLabel(nil, LabelRetryableWrite) {
+		t.Error("Expected plain errors not to match")
+	}
+}
+
+func TestReplsetSendCommandReturnsTypedErrors(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		switch {
+		case command.Body.Lookup("insert").Type != 0:
+			return bson.D{
+				{Key: "n", Value: 1},
+				{Key: "writeErrors", Value: bson.A{bson.D{
+					{Key: "index", Value: 1},
+					{Key: "code", Value: 11000},
+					{Key: "errmsg", Value: "E11000 duplicate key error"},
+				}}},
+				{Key: "ok", Value: 1.0},
+			}
+		case command.Body.Lookup("drop").Type != 0:
+			return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: "ns not found"}, {Key: "code", Value: 26}, {Key: "codeName", Value: "NamespaceNotFound"}}
+		}
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset := connectTestReplset(t, mock)
+	ctx := context.Background()
+
+	reply, err := replset.SendCommand(ctx, bson.D{{Key: "drop", Value: "col"}, {Key: "$db", Value: "test"}}, nil)
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Name != "NamespaceNotFound" {
+		t.Fatalf("Expected a CommandError, got %v", err)
+	}
+	if reply == nil {
+		t.Error("Expected the reply to be returned with the error")
+	}
+
+	documents := []bson.Raw{
+		mustMarshal(t, bson.D{{Key: "_id", Value: 1}}),
+		mustMarshal(t, bson.D{{Key: "_id", Value: 1}}),
+	}
+	insert := bson.D{{Key: "insert", Value: "col"}, {Key: "$db", Value: "test"}}
+	reply, err = replset.SendCommand(ctx, insert, documents)
+	var bulkErr *BulkWriteException
+	if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) != 1 {
+		t.Fatalf("Expected a BulkWriteException, got %v", err)
+	}
+	if string(bulkErr.WriteErrors[0].Request) != string(documents[1]) {
+		t.Errorf("Expected the failed write to refer to document 1, got %v", bulkErr.WriteErrors[0].Request)
+	}
+	if n, _ := reply.Body.Lookup("n").AsInt64OK(); n != 1 {
+		t.Errorf("Expected the reply to report 1 inserted document, got %d", n)
+	}
+
+	// A single document fails with a WriteException
+	_, err = replset.SendCommand(ctx, insert, documents[:1])
+	var writeErr *WriteException
+	if !errors.As(err, &writeErr) || !IsDuplicateKey(err) {
+		t.Errorf("Expected a duplicate key WriteException, got %v", err)
+	}
+
+	// The gRPC server reports duplicates as AlreadyExists
+	s := NewServer(replset)
+	_, err = s.Insert(ctx, &pb.InsertRequest{Db: "test", Collection: "col", Documents: [][]byte{documents[0]}})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected AlreadyExists, got %v", err)
+	}
+}
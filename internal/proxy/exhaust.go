@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"mongo-playground/internal/bson"
+)
+
+// exhaustStream reads the replies a member streams on one connection to a
+// command sent with exhaustAllowed. Each reply with moreToCome is followed
+// by another without a new request; the connection is reserved for the
+// stream until a reply without moreToCome ends it.
+type exhaustStream struct {
+	replset *Replset
+	addr    string
+	pool    *pool
+	conn    *connection
+
+	// responseTo is the request ID of the previous reply, which the next
+	// reply answers
+	responseTo int32
+}
+
+// sendExhaustTo sends a command to server with exhaustAllowed. When the
+// member answers with moreToCome, the connection stays checked out and the
+// returned stream reads the further replies; otherwise the stream is nil.
+func (r *Replset) sendExhaustTo(ctx context.Context, server ServerDescription, command bson.D) (*Message, *exhaustStream, error) {
+	body, err := r.commandBody(ctx, server, command)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, c, err := r.checkOut(ctx, server.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &exhaustStream{replset: r, addr: server.Addr, pool: p, conn: c}
+
+	payload := encodeOpMsg(FlagExhaustAllowed, body, nil)
+	if err := c.framer.checkSize(len(payload)); err != nil {
+		s.release()
+		return nil, nil, err
+	}
+	s.responseTo = nextRequestID()
+	header, response, err := roundTrip(ctx, c, OpMsg, s.responseTo, payload)
+	if err != nil {
+		err = r.connectionError(ctx, s.addr, c, err)
+		s.release()
+		return nil, nil, sessionError(ctx, err)
+	}
+	reply, err := s.receive(ctx, header, response)
+	if s.done() {
+		return reply, nil, err
+	}
+	return reply, s, err
+}
+
+// next reads the next reply of the stream
+func (s *exhaustStream) next(ctx context.Context) (*Message, error) {
+	if s.done() {
+		return nil, fmt.Errorf("exhaust stream from %s has ended", s.addr)
+	}
+	header, response, err := readReply(ctx, s.conn)
+	if err != nil {
+		err = s.replset.connectionError(ctx, s.addr, s.conn, err)
+		s.release()
+		return nil, sessionError(ctx, err)
+	}
+	return s.receive(ctx, header, response)
+}
+
+// receive decodes a reply of the stream, releasing the connection when the
+// reply is the last one
+func (s *exhaustStream) receive(ctx context.Context, header MessageHeader, response []byte) (*Message, error) {
+	reply, err := decodeReply(header, response, s.responseTo, OpMsg)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if reply.FlagBits&FlagMoreToCome != 0 {
+		s.responseTo = header.RequestID
+	} else {
+		s.release()
+	}
+	return s.replset.handleReply(ctx, s.addr, reply)
+}
+
+// done reports whether the stream has ended and released its connection
+func (s *exhaustStream) done() bool {
+	return s.conn == nil
+}
+
+// release returns the connection to its pool
+func (s *exhaustStream) release() {
+	if s.conn != nil {
+		s.pool.checkIn(s.conn)
+		s.conn = nil
+	}
+}
+
+// close ends the stream early. The member keeps sending replies, so the
+// connection cannot be reused and is closed.
+func (s *exhaustStream) close() {
+	if s.conn != nil {
+		s.conn.close()
+		s.release()
+	}
+}
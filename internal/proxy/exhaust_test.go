@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// mockExhaustCursor serves a cursor with id 42 over count documents {i: n},
+// one per batch. A getMore sent with exhaustAllowed is answered with every
+// remaining batch, each but the last with moreToCome. With hold set, the
+// stream pauses after its first reply until release is closed.
+type mockExhaustCursor struct {
+	t       *testing.T
+	count   int
+	hold    bool
+	release chan struct{}
+
+	mu       sync.Mutex
+	getMores []uint32
+	killed   []int64
+}
+
+func (m *mockExhaustCursor) handle(opCode int32, payload []byte, reply func([]byte) error) error {
+	command, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+	if err != nil {
+		m.t.Errorf("mock received invalid OP_MSG: %v", err)
+		return err
+	}
+	body := command.Body
+	switch {
+	case body.Lookup("find").Type != 0:
+		return reply(m.batch(0, "firstBatch", 0))
+	case body.Lookup("getMore").Type != 0:
+		m.mu.Lock()
+		m.getMores = append(m.getMores, command.FlagBits)
+		m.mu.Unlock()
+		for i := 1; i < m.count; i++ {
+			var flags uint32
+			if command.FlagBits&FlagExhaustAllowed != 0 && i < m.count-1 {
+				flags = FlagMoreToCome
+			}
+			if err := reply(m.batch(i, "nextBatch", flags)); err != nil {
+				return err
+			}
+			if flags == 0 {
+				break
+			}
+			if m.hold {
+				<-m.release
+			}
+		}
+		return nil
+	case body.Lookup("killCursors").Type != 0:
+		values, _ := body.Lookup("cursors").Array().Values()
+		m.mu.Lock()
+		for _, v := range values {
+			m.killed = append(m.killed, v.Int64())
+		}
+		m.mu.Unlock()
+	case body.Lookup("hello").Type != 0:
+		return reply(testOpMsgPayload(m.t, bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "maxWireVersion", Value: 21}, {Key: "ok", Value: 1.0}}))
+	}
+	return reply(testOpMsgPayload(m.t, bson.D{{Key: "ok", Value: 1.0}}))
+}
+
+// batch returns the reply holding document i, the last one closing the cursor
+func (m *mockExhaustCursor) batch(i int, key string, flags uint32) []byte {
+	id := int64(42)
+	if i == m.count-1 {
+		id = 0
+	}
+	payload := testOpMsgPayload(m.t, bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: key, Value: bson.A{bson.D{{Key: "i", Value: i}}}},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: "test.col"},
+		}},
+		{Key: "ok", Value: 1.0},
+	})
+	binary.LittleEndian.PutUint32(payload, flags)
+	return payload
+}
+
+// connectExhaustTest connects to a mock serving cursor with a single pooled
+// connection, so that a connection left mid-stream breaks later commands
+func connectExhaustTest(t *testing.T, cursor *mockExhaustCursor) *Replset {
+	t.Helper()
+
+	server, err := newMockStreamingServer(cursor.handle)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	opts := DefaultOptions()
+	opts.MaxPoolSize = 1
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { replset.Disconnect() })
+	return replset
+}
+
+func TestCursorExhaustStreamsBatches(t *testing.T) {
+	cursor := &mockExhaustCursor{t: t, count: 4}
+	replset := connectExhaustTest(t, cursor)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := replset.Find(ctx, "test", "col", nil, CursorOptions{Exhaust: true})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	documents, err := c.All(ctx)
+	if err != nil {
+		t.Fatalf("All failed: %v", err)
+	}
+	if len(documents) != 4 || documents[3].Lookup("i").Int32() != 3 {
+		t.Errorf("Expected 4 documents, got %v", documents)
+	}
+
+	cursor.mu.Lock()
+	getMores := cursor.getMores
+	cursor.mu.Unlock()
+	if len(getMores) != 1 || getMores[0]&FlagExhaustAllowed == 0 {
+		t.Errorf("Expected a single getMore with exhaustAllowed, got flags %v", getMores)
+	}
+
+	// The connection returns to the pool once the stream ends
+	if _, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil); err != nil {
+		t.Errorf("SendCommand after the stream failed: %v", err)
+	}
+}
+
+func TestCursorExhaustCloseDiscardsConnection(t *testing.T) {
+	cursor := &mockExhaustCursor{t: t, count: 4, hold: true, release: make(chan struct{})}
+	defer close(cursor.release)
+	replset := connectExhaustTest(t, cursor)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := replset.Find(ctx, "test", "col", nil, CursorOptions{Exhaust: true})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if !c.Next(ctx) {
+			t.Fatalf("Next failed: %v", c.Err())
+		}
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	cursor.mu.Lock()
+	killed := cursor.killed
+	cursor.mu.Unlock()
+	if len(killed) != 1 || killed[0] != 42 {
+		t.Errorf("Expected cursor 42 to be killed, got %v", killed)
+	}
+	if _, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil); err != nil {
+		t.Errorf("SendCommand after closing the stream failed: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxMessageSizeBytes is the message size limit used until a member
+// reports its own maxMessageSizeBytes in hello
+const DefaultMaxMessageSizeBytes = 48000000
+
+const (
+	// payloadChunkSize is how much of a large payload is allocated ahead of
+	// the bytes actually arriving, so that a peer announcing a large message
+	// and then stalling cannot make us allocate the whole announced size
+	payloadChunkSize = 1 << 20
+
+	// maxRetainedBuffer is the largest write buffer kept for reuse between
+	// messages
+	maxRetainedBuffer = 4 << 20
+)
+
+// errMessageTooLarge is returned for messages exceeding maxMessageSizeBytes
+var errMessageTooLarge = errors.New("message exceeds maxMessageSizeBytes")
+
+// framer reads and writes complete wire protocol messages on one stream,
+// reusing its buffers between messages. It is not safe for concurrent use.
+type framer struct {
+	r io.Reader
+	w io.Writer
+
+	// maxMessageSize bounds incoming and outgoing messages, header included.
+	// Compressed messages are bounded by their uncompressed size.
+	maxMessageSize int32
+
+	// compressor, if set, compresses outgoing messages that may be
+	// compressed. Incoming OP_COMPRESSED messages are always unwrapped.
+	compressor *compressor
+
+	header [HeaderSize]byte
+	out    []byte
+}
+
+// newFramer creates a framer with the default message size limit
+func newFramer(rw io.ReadWriter) *framer {
+	return &framer{r: rw, w: rw, maxMessageSize: DefaultMaxMessageSizeBytes}
+}
+
+// setMaxMessageSize updates the limit from a hello reply; zero keeps the default
+func (f *framer) setMaxMessageSize(size int32) {
+	if size <= 0 {
+		size = DefaultMaxMessageSizeBytes
+	}
+	f.maxMessageSize = size
+}
+
+// checkSize reports whether a message with the given payload fits the limit
+func (f *framer) checkSize(payloadSize int) error {
+	if size := int64(HeaderSize) + int64(payloadSize); size > int64(f.maxMessageSize) {
+		return fmt.Errorf("%w: %d > %d bytes", errMessageTooLarge, size, f.maxMessageSize)
+	}
+	return nil
+}
+
+// writeMessage frames payload with a header and writes it in a single call,
+// wrapped in OP_COMPRESSED when a compressor was negotiated
+func (f *framer) writeMessage(opCode, requestID, responseTo int32, payload []byte) error {
+	if err := f.checkSize(len(payload)); err != nil {
+		return err
+	}
+	if f.compressor != nil && compressible(opCode, payload) {
+		compressed, err := compressMessage(f.compressor, opCode, payload)
+		if err != nil {
+			return err
+		}
+		opCode, payload = OpCompressed, compressed
+	}
+
+	header := MessageHeader{
+		MessageLength: int32(HeaderSize + len(payload)),
+		RequestID:     requestID,
+		ResponseTo:    responseTo,
+		OpCode:        opCode,
+	}
+	out := appendHeader(f.out[:0], header)
+	out = append(out, payload...)
+	if cap(out) <= maxRetainedBuffer {
+		f.out = out
+	}
+
+	if _, err := f.w.Write(out); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	return nil
+}
+
+// readMessage reads one complete message, unwrapping OP_COMPRESSED. The
+// returned payload is freshly allocated, since decoded replies keep
+// referencing it.
+func (f *framer) readMessage() (MessageHeader, []byte, error) {
+	if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+		return MessageHeader{}, nil, err
+	}
+	header := parseHeader(f.header[:])
+
+	if header.MessageLength < HeaderSize {
+		return MessageHeader{}, nil, fmt.Errorf("invalid message length: %d", header.MessageLength)
+	}
+	if header.MessageLength > f.maxMessageSize {
+		return MessageHeader{}, nil, fmt.Errorf("%w: %d > %d bytes", errMessageTooLarge, header.MessageLength, f.maxMessageSize)
+	}
+
+	payload, err := readPayload(f.r, int(header.MessageLength)-HeaderSize)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return MessageHeader{}, nil, err
+	}
+	if header.OpCode == OpCompressed {
+		return decompressMessage(header, payload, f.maxMessageSize)
+	}
+	return header, payload, nil
+}
+
+// readPayload reads exactly size bytes, growing the buffer as data arrives
+// instead of trusting the announced size up front
+func readPayload(r io.Reader, size int) ([]byte, error) {
+	if size <= payloadChunkSize {
+		payload := make([]byte, size)
+		_, err := io.ReadFull(r, payload)
+		return payload, err
+	}
+
+	payload := make([]byte, 0, payloadChunkSize)
+	for len(payload) < size {
+		n := min(size-len(payload), payloadChunkSize)
+		payload = append(payload, make([]byte, n)...)
+		if _, err := io.ReadFull(r, payload[len(payload)-n:]); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+// serializeHeader converts a MessageHeader to its wire protocol representation
+func serializeHeader(header MessageHeader) []byte {
+	return appendHeader(make([]byte, 0, HeaderSize), header)
+}
+
+// appendHeader appends the wire protocol representation of a header to b
+func appendHeader(b []byte, header MessageHeader) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(header.MessageLength))
+	b = binary.LittleEndian.AppendUint32(b, uint32(header.RequestID))
+	b = binary.LittleEndian.AppendUint32(b, uint32(header.ResponseTo))
+	return binary.LittleEndian.AppendUint32(b, uint32(header.OpCode))
+}
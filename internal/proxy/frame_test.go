@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// frameMessage builds a complete message as it appears on the wire
+func frameMessage(requestID, responseTo, opCode int32, payload []byte) []byte {
+	header := MessageHeader{
+		MessageLength: int32(HeaderSize + len(payload)),
+		RequestID:     requestID,
+		ResponseTo:    responseTo,
+		OpCode:        opCode,
+	}
+	return append(serializeHeader(header), payload...)
+}
+
+// readFramer returns a framer reading from r
+func readFramer(r io.Reader) *framer {
+	return &framer{r: r, w: io.Discard, maxMessageSize: DefaultMaxMessageSizeBytes}
+}
+
+func TestFramerReadsPartialReads(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 1000)
+	stream := append(frameMessage(1, 7, OpMsg, payload), frameMessage(2, 8, OpMsg, nil)...)
+
+	// Every Read returns a single byte, so each message needs many reads
+	f := readFramer(iotest.OneByteReader(bytes.NewReader(stream)))
+	header, got, err := f.readMessage()
+	if err != nil {
+		t.Fatalf("readMessage failed: %v", err)
+	}
+	if header.ResponseTo != 7 || !bytes.Equal(got, payload) {
+		t.Errorf("Unexpected first message %+v with %d payload bytes", header, len(got))
+	}
+
+	header, got, err = f.readMessage()
+	if err != nil {
+		t.Fatalf("readMessage failed: %v", err)
+	}
+	if header.ResponseTo != 8 || len(got) != 0 {
+		t.Errorf("Unexpected second message %+v", header)
+	}
+
+	if _, _, err := f.readMessage(); err != io.EOF {
+		t.Errorf("Expected EOF at end of stream, got %v", err)
+	}
+}
+
+func TestFramerRejectsTruncatedMessage(t *testing.T) {
+	msg := frameMessage(1, 0, OpMsg, make([]byte, 100))
+	for _, n := range []int{1, HeaderSize - 1, HeaderSize, len(msg) - 1} {
+		f := readFramer(bytes.NewReader(msg[:n]))
+		if _, _, err := f.readMessage(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Truncated at %d bytes: expected unexpected EOF, got %v", n, err)
+		}
+	}
+}
+
+func TestFramerEnforcesMaxMessageSize(t *testing.T) {
+	f := readFramer(bytes.NewReader(frameMessage(1, 0, OpMsg, make([]byte, 100))))
+	f.setMaxMessageSize(64)
+	if _, _, err := f.readMessage(); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("Expected errMessageTooLarge reading, got %v", err)
+	}
+
+	var out bytes.Buffer
+	f = newFramer(&out)
+	f.setMaxMessageSize(64)
+	if err := f.writeMessage(OpMsg, 1, 0, make([]byte, 100)); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("Expected errMessageTooLarge writing, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected nothing to be written, got %d bytes", out.Len())
+	}
+
+	f.setMaxMessageSize(0)
+	if f.maxMessageSize != DefaultMaxMessageSizeBytes {
+		t.Errorf("Expected the default limit for an unset size, got %d", f.maxMessageSize)
+	}
+}
+
+func TestFramerRejectsInvalidLength(t *testing.T) {
+	for _, length := range []int32{-1, 0, HeaderSize - 1, -0x7fffffff} {
+		header := make([]byte, HeaderSize)
+		binary.LittleEndian.PutUint32(header, uint32(length))
+		f := readFramer(bytes.NewReader(header))
+		if _, _, err := f.readMessage(); err == nil {
+			t.Errorf("Expected an error for message length %d", length)
+		}
+	}
+}
+
+func TestFramerDoesNotTrustAnnouncedSize(t *testing.T) {
+	// A peer announcing a message at the size limit and then sending only a
+	// few bytes must not cause the full size to be allocated
+	header := serializeHeader(MessageHeader{MessageLength: DefaultMaxMessageSizeBytes, OpCode: OpMsg})
+	f := readFramer(bytes.NewReader(append(header, 1, 2, 3)))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, _, err := f.readMessage(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected unexpected EOF, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 4*payloadChunkSize {
+		t.Errorf("Allocated %d bytes for a 3 byte payload", grown)
+	}
+}
+
+func TestFramerWriteMessage(t *testing.T) {
+	var out bytes.Buffer
+	f := newFramer(&out)
+	if err := f.writeMessage(OpMsg, 5, 3, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("writeMessage failed: %v", err)
+	}
+	if want := frameMessage(5, 3, OpMsg, []byte{1, 2, 3}); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("Expected %v, got %v", want, out.Bytes())
+	}
+
+	// The write buffer is reused for the next message
+	buf := f.out
+	if err := f.writeMessage(OpMsg, 6, 0, []byte{4}); err != nil {
+		t.Fatalf("writeMessage failed: %v", err)
+	}
+	if &f.out[0] != &buf[0] {
+		t.Error("Expected the write buffer to be reused")
+	}
+}
+
+func TestReplsetEnforcesMaxMessageSizeFromHello(t *testing.T) {
+	server, err := newMockMongoServerWithHandler(func(opCode int32, payload []byte) []byte {
+		return testOpMsgPayload(t, bson.D{
+			{Key: "isWritablePrimary", Value: true},
+			{Key: "maxWireVersion", Value: 21},
+			{Key: "maxMessageSizeBytes", Value: 1000},
+			{Key: "ok", Value: 1.0},
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	replset := NewReplset([]string{server.Addr()})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	ping := bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}
+	if _, err := replset.SendCommand(ctx, ping, nil); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+
+	large := mustMarshal(t, bson.D{{Key: "data", Value: make([]byte, 2000)}})
+	if _, err := replset.SendCommand(ctx, ping, []bson.Raw{large}); !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("Expected errMessageTooLarge, got %v", err)
+	}
+	// The oversized message is rejected before it is written, so the
+	// connection stays usable
+	if stats := replset.PoolStats(); stats[0].Closed != 0 {
+		t.Errorf("Expected no connection to be closed, got %+v", stats[0])
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add(frameMessage(1, 2, OpMsg, []byte{0, 0, 0, 0, 0, 5, 0, 0, 0, 0}))
+	f.Add(frameMessage(1, 2, OpMsg, nil))
+	f.Add(serializeHeader(MessageHeader{MessageLength: -1}))
+	f.Add(serializeHeader(MessageHeader{MessageLength: 0x7fffffff}))
+	f.Add(serializeHeader(MessageHeader{MessageLength: HeaderSize + 100}))
+	f.Add([]byte{1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fr := readFramer(bytes.NewReader(data))
+		fr.setMaxMessageSize(1 << 16)
+		header, payload, err := fr.readMessage()
+		if err != nil {
+			return
+		}
+		if int(header.MessageLength) != HeaderSize+len(payload) || header.MessageLength > 1<<16 {
+			t.Fatalf("Message length %d does not match %d payload bytes", header.MessageLength, len(payload))
+		}
+		// Whatever was framed must not crash the decoder either
+		decodeOpMsg(header, payload)
+	})
+}
+
+func FuzzDecodeOpMsg(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 0, 5, 0, 0, 0, 0})
+	f.Add(encodeOpMsg(0, []byte{5, 0, 0, 0, 0}, []DocumentSequence{{Identifier: "documents", Documents: nil}}))
+	f.Add(encodeOpMsg(FlagChecksumPresent, []byte{5, 0, 0, 0, 0}, nil))
+	f.Add([]byte{0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0x7f})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		msg, err := decodeOpMsg(MessageHeader{OpCode: OpMsg}, payload)
+		if err != nil {
+			return
+		}
+		if err := msg.Body.Validate(); err != nil {
+			t.Fatalf("Decoded an invalid body: %v", err)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"mongo-playground/internal/bson"
+)
+
+// minWireVersion is the oldest wire version supported, the first with
+// OP_MSG (MongoDB 3.6)
+const minWireVersion = 6
+
+// maxAppNameBytes is the longest application name servers accept in the
+// client metadata
+const maxAppNameBytes = 128
+
+// driverName identifies this driver in the client metadata
+const driverName = "mongo-playground"
+
+// driverVersion is the module version this driver was built from
+var driverVersion = func() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == driverName {
+			return info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == driverName {
+				return dep.Version
+			}
+		}
+	}
+	return "(devel)"
+}()
+
+// clientMetadata describes the driver and application in the hello that
+// opens a connection. Servers log it and report it in currentOp.
+func clientMetadata(appName string) bson.D {
+	metadata := bson.D{}
+	if appName != "" {
+		metadata = append(metadata, bson.E{Key: "application", Value: bson.D{{Key: "name", Value: appName}}})
+	}
+	return append(metadata,
+		bson.E{Key: "driver", Value: bson.D{{Key: "name", Value: driverName}, {Key: "version", Value: driverVersion}}},
+		bson.E{Key: "os", Value: bson.D{{Key: "type", Value: runtime.GOOS}, {Key: "architecture", Value: runtime.GOARCH}}},
+		bson.E{Key: "platform", Value: runtime.Version()},
+	)
+}
+
+// helloCommand builds the command that opens a connection. Without a
+// declared server API it is the legacy isMaster, sent as an OP_QUERY, which
+// every server understands, so that members too old for OP_MSG can be told
+// apart from unreachable ones. Servers that accept an API version all speak
+// OP_MSG, so with one it is hello in an OP_MSG, as the stable API requires.
+func helloCommand(opts Options) bson.D {
+	name := "isMaster"
+	if opts.ServerAPI != nil {
+		name = "hello"
+	}
+	return bson.D{
+		{Key: name, Value: 1},
+		{Key: "helloOk", Value: true},
+		{Key: "client", Value: clientMetadata(opts.AppName)},
+	}
+}
+
+// checkWireVersion rejects members too old to speak OP_MSG
+func checkWireVersion(desc ServerDescription) error {
+	if desc.MaxWireVersion < minWireVersion {
+		return fmt.Errorf("server at %s reports maximum wire version %d, but this driver requires at least %d (MongoDB 3.6) for OP_MSG",
+			desc.Addr, desc.MaxWireVersion, minWireVersion)
+	}
+	return nil
+}
+
+// handshake prepares a new pooled connection before it is handed out: it
+// sends the command built by helloCommand with the client metadata, rejects
+// members too old for OP_MSG, records the limits the member reports,
+// enables compression and authenticates
+func (r *Replset) handshake(ctx context.Context, c *connection) error {
+	var reply *Message
+	var err error
+	if r.opts.ServerAPI != nil {
+		reply, err = c.runCommand(ctx, append(r.handshakeCommand(), bson.E{Key: "$db", Value: "admin"}))
+	} else {
+		reply, err = c.runLegacyCommand(ctx, "admin", r.handshakeCommand())
+	}
+	if err != nil {
+		return fmt.Errorf("handshake with %s failed: %w", c.addr, err)
+	}
+	c.desc = parseHello(c.addr, reply.Body, 0)
+	if err := checkWireVersion(c.desc); err != nil {
+		return err
+	}
+	c.framer.setMaxMessageSize(c.desc.MaxMessageSizeBytes)
+	c.framer.compressor = r.negotiatedCompressor(reply.Body)
+
+	if r.auth != nil {
+		return r.auth.authenticate(ctx, c, reply.Body)
+	}
+	return nil
+}
+
+// handshakeCommand adds the compressors to offer and, when the mechanism
+// is negotiated, the user's SASL mechanisms to query to the handshake command
+func (r *Replset) handshakeCommand() bson.D {
+	command := helloCommand(r.opts)
+	if len(r.opts.Compressors) > 0 {
+		offered := make(bson.A, len(r.opts.Compressors))
+		for i, name := range r.opts.Compressors {
+			offered[i] = name
+		}
+		command = append(command, bson.E{Key: "compression", Value: offered})
+	}
+	if r.auth != nil && r.auth.cred.Mechanism == "" {
+		command = append(command, bson.E{Key: "saslSupportedMechs", Value: r.auth.cred.source() + "." + r.auth.cred.Username})
+	}
+	return command
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// connectHandshakeTest connects to a single mock server with the given app name
+func connectHandshakeTest(t *testing.T, appName string, handler mockHandler) (*Replset, error) {
+	t.Helper()
+
+	server, err := newMockMongoServerWithHandler(handler)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	return connectHandshakeServer(t, appName, server)
+}
+
+// connectHandshakeServer connects to server with the given app name
+func connectHandshakeServer(t *testing.T, appName string, server *mockMongoServer) (*Replset, error) {
+	t.Helper()
+	t.Cleanup(func() { server.Close() })
+
+	opts := DefaultOptions()
+	opts.AppName = appName
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { replset.Disconnect() })
+	return replset, nil
+}
+
+// legacyHello answers an OP_QUERY with an OP_REPLY holding the given hello
+// reply, or returns nil if the message is not an OP_QUERY
+func legacyHello(t *testing.T, opCode int32, payload []byte, reply bson.D) (*LegacyQuery, []byte) {
+	t.Helper()
+	if opCode != OpQuery {
+		return nil, nil
+	}
+	msg, err := DecodeLegacyMessage(opCode, payload)
+	if err != nil {
+		t.Errorf("mock received invalid OP_QUERY: %v", err)
+		return nil, nil
+	}
+	return msg.(*LegacyQuery), (&LegacyReply{Documents: []bson.Raw{mustMarshal(t, reply)}}).Encode()
+}
+
+func TestReplsetHandshakeSendsClientMetadata(t *testing.T) {
+	var mu sync.Mutex
+	var hellos []bson.Raw
+	replset, err := connectHandshakeTest(t, "inventory", func(opCode int32, payload []byte) []byte {
+		command, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+		if err != nil {
+			t.Errorf("mock received invalid OP_MSG: %v", err)
+			return nil
+		}
+		if command.Body.Lookup("hello").Type != 0 {
+			mu.Lock()
+			hellos = append(hellos, command.Body)
+			mu.Unlock()
+		}
+		return testOpMsgPayload(t, bson.D{
+			{Key: "isWritablePrimary", Value: true},
+			{Key: "maxWireVersion", Value: 17},
+			{Key: "maxBsonObjectSize", Value: 1000},
+			{Key: "maxMessageSizeBytes", Value: 5000},
+			{Key: "maxWriteBatchSize", Value: 10},
+			{Key: "ok", Value: 1.0},
+		})
+	})
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	// The pooled connection and the monitoring connection both handshake
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(hellos)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hellos) < 2 {
+		t.Fatalf("Expected a handshake on the pooled and the monitoring connection, got %d", len(hellos))
+	}
+	for _, hello := range hellos[:2] {
+		client := hello.Lookup("client").Document()
+		if client.Lookup("application", "name").StringValue() != "inventory" || client.Lookup("driver", "name").StringValue() != driverName {
+			t.Errorf("Expected the application and driver in the client metadata, got %v", client)
+		}
+		if client.Lookup("os", "type").StringValue() != runtime.GOOS || client.Lookup("driver", "version").StringValue() == "" {
+			t.Errorf("Expected the OS and driver version in the client metadata, got %v", client)
+		}
+		if !hello.Lookup("helloOk").Boolean() {
+			t.Errorf("Expected helloOk in the handshake, got %v", hello)
+		}
+	}
+
+	// The limits are recorded on the connection
+	p, err := replset.pool(replset.GetNodes()[0])
+	if err != nil {
+		t.Fatalf("pool failed: %v", err)
+	}
+	c, err := p.checkOut(context.Background())
+	if err != nil {
+		t.Fatalf("checkOut failed: %v", err)
+	}
+	defer p.checkIn(c)
+	if c.desc.MaxWireVersion != 17 || c.desc.MaxBSONObjectSize != 1000 || c.desc.MaxMessageSizeBytes != 5000 || c.desc.MaxWriteBatchSize != 10 {
+		t.Errorf("Unexpected connection description %+v", c.desc)
+	}
+	if c.framer.maxMessageSize != 5000 {
+		t.Errorf("Expected the framer to enforce maxMessageSizeBytes, got %d", c.framer.maxMessageSize)
+	}
+}
+
+func TestReplsetHandshakeUsesLegacyIsMaster(t *testing.T) {
+	var mu sync.Mutex
+	var queries []*LegacyQuery
+	var commands []bson.Raw
+	server, err := newMockLegacyServer(func(opCode int32, payload []byte) []byte {
+		query, reply := legacyHello(t, opCode, payload, bson.D{
+			{Key: "ismaster", Value: true},
+			{Key: "helloOk", Value: true},
+			{Key: "maxWireVersion", Value: 21},
+			{Key: "ok", Value: 1.0},
+		})
+		if query != nil {
+			mu.Lock()
+			queries = append(queries, query)
+			mu.Unlock()
+			return reply
+		}
+		command, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+		if err != nil {
+			t.Errorf("mock received invalid OP_MSG: %v", err)
+			return nil
+		}
+		mu.Lock()
+		commands = append(commands, command.Body)
+		mu.Unlock()
+		return testOpMsgPayload(t, bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "maxWireVersion", Value: 21}, {Key: "ok", Value: 1.0}})
+	})
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	replset, err := connectHandshakeServer(t, "", server)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	if _, err := replset.SendCommand(context.Background(), bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(queries) == 0 {
+		t.Fatal("Expected the handshake to be sent as OP_QUERY")
+	}
+	for _, query := range queries {
+		if query.FullCollectionName != "admin.$cmd" || query.NumberToReturn != -1 {
+			t.Errorf("Expected the legacy isMaster on admin.$cmd, got %+v", query)
+		}
+		if query.Query.Lookup("isMaster").Int32() != 1 || query.Query.Lookup("client", "driver", "name").StringValue() != driverName {
+			t.Errorf("Expected isMaster with the client metadata, got %v", query.Query)
+		}
+	}
+	// Commands after the handshake use OP_MSG
+	var pinged bool
+	for _, command := range commands {
+		pinged = pinged || command.Lookup("ping").Type != 0
+		if command.Lookup("client").Type != 0 {
+			t.Errorf("Expected the client metadata only in the handshake, got %v", command)
+		}
+	}
+	if !pinged {
+		t.Errorf("Expected ping over OP_MSG, got %v", commands)
+	}
+}
+
+func TestReplsetRejectsOldWireVersion(t *testing.T) {
+	// A member older than 3.6 does not understand OP_MSG and drops the
+	// connection
+	server, err := newMockLegacyServer(func(opCode int32, payload []byte) []byte {
+		_, reply := legacyHello(t, opCode, payload, bson.D{
+			{Key: "ismaster", Value: true},
+			{Key: "maxWireVersion", Value: 5},
+			{Key: "ok", Value: 1.0},
+		})
+		return reply
+	})
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	_, err = connectHandshakeServer(t, "", server)
+	if err == nil || !strings.Contains(err.Error(), "wire version 5") {
+		t.Errorf("Expected a wire version error, got %v", err)
+	}
+}
+
+func TestReplsetRejectsLongAppName(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AppName = strings.Repeat("a", maxAppNameBytes+1)
+	replset := NewReplsetWithOptions([]string{"127.0.0.1:1"}, opts)
+	if err := replset.Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "app name") {
+		t.Errorf("Expected the app name to be rejected, got %v", err)
+	}
+}
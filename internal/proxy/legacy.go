@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"mongo-playground/internal/bson"
+)
+
+// OP_QUERY flag bits
+const (
+	QueryTailableCursor  uint32 = 1 << 1
+	QuerySecondaryOk     uint32 = 1 << 2
+	QueryOplogReplay     uint32 = 1 << 3
+	QueryNoCursorTimeout uint32 = 1 << 4
+	QueryAwaitData       uint32 = 1 << 5
+	QueryExhaust         uint32 = 1 << 6
+	QueryPartial         uint32 = 1 << 7
+)
+
+// OP_REPLY response flag bits
+const (
+	ReplyCursorNotFound   uint32 = 1 << 0
+	ReplyQueryFailure     uint32 = 1 << 1
+	ReplyShardConfigStale uint32 = 1 << 2
+	ReplyAwaitCapable     uint32 = 1 << 3
+)
+
+// OP_UPDATE, OP_INSERT and OP_DELETE flag bits
+const (
+	UpdateUpsert          uint32 = 1 << 0
+	UpdateMulti           uint32 = 1 << 1
+	InsertContinueOnError uint32 = 1 << 0
+	DeleteSingleRemove    uint32 = 1 << 0
+)
+
+// LegacyMessage is a message of one of the opcodes that predate OP_MSG.
+// Servers before 3.6 only speak these, and servers up to 5.0 still accept
+// OP_QUERY commands from old clients.
+type LegacyMessage interface {
+	// OpCode returns the opcode of the message
+	OpCode() int32
+
+	// Encode returns the payload of the message, without the header
+	Encode() []byte
+}
+
+// LegacyQuery is an OP_QUERY. Commands are queries on the db.$cmd
+// collection with NumberToReturn -1.
+type LegacyQuery struct {
+	Flags              uint32
+	FullCollectionName string
+	NumberToSkip       int32
+	NumberToReturn     int32
+	Query              bson.Raw
+
+	// ReturnFieldsSelector is the optional projection
+	ReturnFieldsSelector bson.Raw
+}
+
+// LegacyReply is an OP_REPLY, the answer to OP_QUERY and OP_GET_MORE
+type LegacyReply struct {
+	ResponseFlags uint32
+	CursorID      int64
+	StartingFrom  int32
+	Documents     []bson.Raw
+}
+
+// LegacyGetMore is an OP_GET_MORE
+type LegacyGetMore struct {
+	FullCollectionName string
+	NumberToReturn     int32
+	CursorID           int64
+}
+
+// LegacyInsert is an OP_INSERT
+type LegacyInsert struct {
+	Flags              uint32
+	FullCollectionName string
+	Documents          []bson.Raw
+}
+
+// LegacyUpdate is an OP_UPDATE
+type LegacyUpdate struct {
+	FullCollectionName string
+	Flags              uint32
+	Selector           bson.Raw
+	Update             bson.Raw
+}
+
+// LegacyDelete is an OP_DELETE
+type LegacyDelete struct {
+	FullCollectionName string
+	Flags              uint32
+	Selector           bson.Raw
+}
+
+// LegacyKillCursors is an OP_KILL_CURSORS
+type LegacyKillCursors struct {
+	CursorIDs []int64
+}
+
+// OpCode returns the opcode of each legacy message type
+func (*LegacyQuery) OpCode() int32       { return OpQuery }
+func (*LegacyReply) OpCode() int32       { return OpReply }
+func (*LegacyGetMore) OpCode() int32     { return OpGetMore }
+func (*LegacyInsert) OpCode() int32      { return OpInsert }
+func (*LegacyUpdate) OpCode() int32      { return OpUpdate }
+func (*LegacyDelete) OpCode() int32      { return OpDelete }
+func (*LegacyKillCursors) OpCode() int32 { return OpKillCursors }
+
+// appendCString appends s as a null-terminated string
+func appendCString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
+
+// appendInt32 appends v in little endian
+func appendInt32(b []byte, v int32) []byte {
+	return binary.LittleEndian.AppendUint32(b, uint32(v))
+}
+
+// Encode returns the OP_QUERY payload
+func (m *LegacyQuery) Encode() []byte {
+	b := make([]byte, 0, 4+len(m.FullCollectionName)+1+8+len(m.Query)+len(m.ReturnFieldsSelector))
+	b = binary.LittleEndian.AppendUint32(b, m.Flags)
+	b = appendCString(b, m.FullCollectionName)
+	b = appendInt32(b, m.NumberToSkip)
+	b = appendInt32(b, m.NumberToReturn)
+	b = append(b, m.Query...)
+	return append(b, m.ReturnFieldsSelector...)
+}
+
+// Encode returns the OP_REPLY payload
+func (m *LegacyReply) Encode() []byte {
+	b := make([]byte, 0, opReplyHeaderSize)
+	b = binary.LittleEndian.AppendUint32(b, m.ResponseFlags)
+	b = binary.LittleEndian.AppendUint64(b, uint64(m.CursorID))
+	b = appendInt32(b, m.StartingFrom)
+	b = appendInt32(b, int32(len(m.Documents)))
+	for _, doc := range m.Documents {
+		b = append(b, doc...)
+	}
+	return b
+}
+
+// Encode returns the OP_GET_MORE payload
+func (m *LegacyGetMore) Encode() []byte {
+	b := make([]byte, 0, 4+len(m.FullCollectionName)+1+12)
+	b = appendInt32(b, 0) // ZERO, reserved
+	b = appendCString(b, m.FullCollectionName)
+	b = appendInt32(b, m.NumberToReturn)
+	return binary.LittleEndian.AppendUint64(b, uint64(m.CursorID))
+}
+
+// Encode returns the OP_INSERT payload
+func (m *LegacyInsert) Encode() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, m.Flags)
+	b = appendCString(b, m.FullCollectionName)
+	for _, doc := range m.Documents {
+		b = append(b, doc...)
+	}
+	return b
+}
+
+// Encode returns the OP_UPDATE payload
+func (m *LegacyUpdate) Encode() []byte {
+	b := make([]byte, 0, 4+len(m.FullCollectionName)+1+4+len(m.Selector)+len(m.Update))
+	b = appendInt32(b, 0) // ZERO, reserved
+	b = appendCString(b, m.FullCollectionName)
+	b = binary.LittleEndian.AppendUint32(b, m.Flags)
+	b = append(b, m.Selector...)
+	return append(b, m.Update...)
+}
+
+// Encode returns the OP_DELETE payload
+func (m *LegacyDelete) Encode() []byte {
+	b := make([]byte, 0, 4+len(m.FullCollectionName)+1+4+len(m.Selector))
+	b = appendInt32(b, 0) // ZERO, reserved
+	b = appendCString(b, m.FullCollectionName)
+	b = binary.LittleEndian.AppendUint32(b, m.Flags)
+	return append(b, m.Selector...)
+}
+
+// Encode returns the OP_KILL_CURSORS payload
+func (m *LegacyKillCursors) Encode() []byte {
+	b := make([]byte, 0, 8+8*len(m.CursorIDs))
+	b = appendInt32(b, 0) // ZERO, reserved
+	b = appendInt32(b, int32(len(m.CursorIDs)))
+	for _, id := range m.CursorIDs {
+		b = binary.LittleEndian.AppendUint64(b, uint64(id))
+	}
+	return b
+}
+
+// opReplyHeaderSize is the size of the OP_REPLY fields preceding the
+// documents: responseFlags, cursorID, startingFrom and numberReturned
+const opReplyHeaderSize = 20
+
+// legacyReader reads the fields of a legacy message in order. The first
+// error is kept and makes later reads return zero values.
+type legacyReader struct {
+	op  string
+	b   []byte
+	err error
+}
+
+func (r *legacyReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%s: %s", r.op, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *legacyReader) uint32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.fail("truncated message")
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *legacyReader) int32() int32 {
+	return int32(r.uint32())
+}
+
+func (r *legacyReader) int64() int64 {
+	if r.err != nil || len(r.b) < 8 {
+		r.fail("truncated message")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return int64(v)
+}
+
+func (r *legacyReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(r.b, 0)
+	if end < 0 {
+		r.fail("unterminated collection name")
+		return ""
+	}
+	s := string(r.b[:end])
+	r.b = r.b[end+1:]
+	return s
+}
+
+// zero reads a reserved field, which must be 0
+func (r *legacyReader) zero() {
+	if v := r.int32(); v != 0 {
+		r.fail("reserved field is %d", v)
+	}
+}
+
+func (r *legacyReader) document() bson.Raw {
+	if r.err != nil {
+		return nil
+	}
+	doc, rest, err := readDocument(r.b)
+	if err != nil {
+		r.fail("%v", err)
+		return nil
+	}
+	r.b = rest
+	return doc
+}
+
+// optionalDocument reads a document if any bytes are left
+func (r *legacyReader) optionalDocument() bson.Raw {
+	if r.err == nil && len(r.b) == 0 {
+		return nil
+	}
+	return r.document()
+}
+
+// documents reads documents until the end of the message
+func (r *legacyReader) documents() []bson.Raw {
+	var docs []bson.Raw
+	for r.err == nil && len(r.b) > 0 {
+		docs = append(docs, r.document())
+	}
+	return docs
+}
+
+// end reports an error if bytes are left over
+func (r *legacyReader) end() error {
+	if r.err == nil && len(r.b) > 0 {
+		r.fail("%d trailing bytes", len(r.b))
+	}
+	return r.err
+}
+
+// DecodeLegacyMessage decodes the payload of a message with a legacy
+// opcode, e.g. to inspect traffic of clients and servers before OP_MSG
+func DecodeLegacyMessage(opCode int32, payload []byte) (LegacyMessage, error) {
+	switch opCode {
+	case OpQuery:
+		r := &legacyReader{op: "OP_QUERY", b: payload}
+		m := &LegacyQuery{
+			Flags:              r.uint32(),
+			FullCollectionName: r.cstring(),
+			NumberToSkip:       r.int32(),
+			NumberToReturn:     r.int32(),
+			Query:              r.document(),
+		}
+		m.ReturnFieldsSelector = r.optionalDocument()
+		return m, r.end()
+
+	case OpReply:
+		return decodeOpReply(payload)
+
+	case OpGetMore:
+		r := &legacyReader{op: "OP_GET_MORE", b: payload}
+		r.zero()
+		m := &LegacyGetMore{FullCollectionName: r.cstring(), NumberToReturn: r.int32(), CursorID: r.int64()}
+		return m, r.end()
+
+	case OpInsert:
+		r := &legacyReader{op: "OP_INSERT", b: payload}
+		m := &LegacyInsert{Flags: r.uint32(), FullCollectionName: r.cstring()}
+		if m.Documents = r.documents(); r.err == nil && len(m.Documents) == 0 {
+			r.fail("no documents")
+		}
+		return m, r.end()
+
+	case OpUpdate:
+		r := &legacyReader{op: "OP_UPDATE", b: payload}
+		r.zero()
+		m := &LegacyUpdate{FullCollectionName: r.cstring(), Flags: r.uint32(), Selector: r.document(), Update: r.document()}
+		return m, r.end()
+
+	case OpDelete:
+		r := &legacyReader{op: "OP_DELETE", b: payload}
+		r.zero()
+		m := &LegacyDelete{FullCollectionName: r.cstring(), Flags: r.uint32(), Selector: r.document()}
+		return m, r.end()
+
+	case OpKillCursors:
+		r := &legacyReader{op: "OP_KILL_CURSORS", b: payload}
+		r.zero()
+		n := r.int32()
+		if r.err == nil && (n < 0 || int(n) != len(r.b)/8) {
+			r.fail("numberOfCursorIDs %d does not match %d bytes of cursor ids", n, len(r.b))
+		}
+		m := &LegacyKillCursors{}
+		for i := int32(0); r.err == nil && i < n; i++ {
+			m.CursorIDs = append(m.CursorIDs, r.int64())
+		}
+		return m, r.end()
+	}
+	return nil, fmt.Errorf("opcode %d is not a legacy opcode", opCode)
+}
+
+// decodeOpReply decodes an OP_REPLY payload
+func decodeOpReply(payload []byte) (*LegacyReply, error) {
+	r := &legacyReader{op: "OP_REPLY", b: payload}
+	m := &LegacyReply{ResponseFlags: r.uint32(), CursorID: r.int64(), StartingFrom: r.int32()}
+	numberReturned := r.int32()
+	m.Documents = r.documents()
+	if r.err == nil && int(numberReturned) != len(m.Documents) {
+		r.fail("numberReturned %d does not match %d documents", numberReturned, len(m.Documents))
+	}
+	return m, r.end()
+}
+
+// decodeCommandReply decodes the OP_REPLY to a command sent as an OP_QUERY
+// on db.$cmd into a Message whose body is the command reply
+func decodeCommandReply(header MessageHeader, payload []byte) (*Message, error) {
+	reply, err := decodeOpReply(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Documents) != 1 {
+		return nil, fmt.Errorf("OP_REPLY to a command has %d documents", len(reply.Documents))
+	}
+	doc := reply.Documents[0]
+	if reply.ResponseFlags&ReplyQueryFailure != 0 {
+		return nil, fmt.Errorf("query failed: %s", doc.Lookup("$err").StringValue())
+	}
+	return &Message{Header: header, Body: doc}, nil
+}
+
+// legacyCommand builds the OP_QUERY that runs command on db
+func legacyCommand(db string, command bson.Raw) []byte {
+	q := &LegacyQuery{FullCollectionName: db + ".$cmd", NumberToReturn: -1, Query: command}
+	return q.Encode()
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+func TestLegacyMessageRoundTrip(t *testing.T) {
+	doc := mustMarshal(t, bson.D{{Key: "x", Value: 1}})
+	other := mustMarshal(t, bson.D{{Key: "$set", Value: bson.D{{Key: "y", Value: 2}}}})
+
+	messages := []LegacyMessage{
+		&LegacyQuery{Flags: QuerySecondaryOk | QueryTailableCursor, FullCollectionName: "test.col", NumberToSkip: 5, NumberToReturn: 10, Query: doc, ReturnFieldsSelector: other},
+		&LegacyQuery{FullCollectionName: "admin.$cmd", NumberToReturn: -1, Query: doc},
+		&LegacyReply{ResponseFlags: ReplyAwaitCapable, CursorID: 1 << 40, StartingFrom: 101, Documents: []bson.Raw{doc, other}},
+		&LegacyGetMore{FullCollectionName: "test.col", NumberToReturn: 2, CursorID: -7},
+		&LegacyInsert{Flags: InsertContinueOnError, FullCollectionName: "test.col", Documents: []bson.Raw{doc, doc}},
+		&LegacyUpdate{FullCollectionName: "test.col", Flags: UpdateUpsert | UpdateMulti, Selector: doc, Update: other},
+		&LegacyDelete{FullCollectionName: "test.col", Flags: DeleteSingleRemove, Selector: doc},
+		&LegacyKillCursors{CursorIDs: []int64{1, 2, 3}},
+	}
+	for _, msg := range messages {
+		decoded, err := DecodeLegacyMessage(msg.OpCode(), msg.Encode())
+		if err != nil {
+			t.Errorf("DecodeLegacyMessage(%T) failed: %v", msg, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("Expected %+v, got %+v", msg, decoded)
+		}
+	}
+}
+
+func TestLegacyQueryEncoding(t *testing.T) {
+	query := mustMarshal(t, bson.D{{Key: "isMaster", Value: 1}})
+	want := append([]byte{
+		0x04, 0, 0, 0, // flags: secondaryOk
+		'a', 'd', 'm', 'i', 'n', '.', '$', 'c', 'm', 'd', 0,
+		0, 0, 0, 0, // numberToSkip
+		0xff, 0xff, 0xff, 0xff, // numberToReturn -1
+	}, query...)
+
+	msg := &LegacyQuery{Flags: QuerySecondaryOk, FullCollectionName: "admin.$cmd", NumberToReturn: -1, Query: query}
+	if got := msg.Encode(); !bytes.Equal(got, want) {
+		t.Errorf("Expected % x, got % x", want, got)
+	}
+}
+
+func TestDecodeLegacyMessageErrors(t *testing.T) {
+	doc := mustMarshal(t, bson.D{{Key: "x", Value: 1}})
+	reply := (&LegacyReply{Documents: []bson.Raw{doc}}).Encode()
+	miscounted := append([]byte(nil), reply...)
+	miscounted[16] = 2
+
+	tests := []struct {
+		name    string
+		opCode  int32
+		payload []byte
+		want    string
+	}{
+		{"OP_MSG", OpMsg, []byte{0, 0, 0, 0}, "not a legacy opcode"},
+		{"truncated query", OpQuery, []byte{0, 0, 0, 0, 'a', 0, 0}, "truncated"},
+		{"unterminated name", OpQuery, []byte{0, 0, 0, 0, 'a', 'b'}, "unterminated"},
+		{"query without document", OpQuery, (&LegacyQuery{FullCollectionName: "a.b"}).Encode(), "document"},
+		{"reply count mismatch", OpReply, miscounted, "numberReturned"},
+		{"reserved field", OpDelete, append([]byte{1, 0, 0, 0}, (&LegacyDelete{FullCollectionName: "a.b", Selector: doc}).Encode()[4:]...), "reserved"},
+		{"insert without documents", OpInsert, (&LegacyInsert{FullCollectionName: "a.b"}).Encode(), "no documents"},
+		{"trailing bytes", OpGetMore, append((&LegacyGetMore{FullCollectionName: "a.b"}).Encode(), 0), "trailing"},
+		{"cursor count mismatch", OpKillCursors, []byte{0, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, "numberOfCursorIDs"},
+	}
+	for _, tt := range tests {
+		_, err := DecodeLegacyMessage(tt.opCode, tt.payload)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error about %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestReplsetSendMessageLegacyCommand(t *testing.T) {
+	server, err := newMockMongoServerWithHandler(func(opCode int32, payload []byte) []byte {
+		if opCode != OpQuery {
+			return testOpMsgPayload(t, bson.D{{Key: "maxWireVersion", Value: 21}, {Key: "ok", Value: 1.0}})
+		}
+		msg, err := DecodeLegacyMessage(opCode, payload)
+		if err != nil {
+			t.Errorf("mock received invalid OP_QUERY: %v", err)
+			return nil
+		}
+		if msg.(*LegacyQuery).Query.Lookup("buildInfo").Type == 0 {
+			reply := &LegacyReply{ResponseFlags: ReplyQueryFailure, Documents: []bson.Raw{mustMarshal(t, bson.D{{Key: "$err", Value: "bad query"}})}}
+			return reply.Encode()
+		}
+		reply := &LegacyReply{Documents: []bson.Raw{mustMarshal(t, bson.D{{Key: "version", Value: "3.4.0"}, {Key: "ok", Value: 1.0}})}}
+		return reply.Encode()
+	})
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	replset := NewReplset([]string{server.Addr()})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	reply, err := replset.SendMessage(ctx, OpQuery, legacyCommand("admin", mustMarshal(t, bson.D{{Key: "buildInfo", Value: 1}})))
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if reply.Body.Lookup("version").StringValue() != "3.4.0" {
+		t.Errorf("Expected the command reply as the body, got %v", reply.Body)
+	}
+
+	query := &LegacyQuery{FullCollectionName: "test.col", NumberToReturn: 1, Query: mustMarshal(t, bson.D{})}
+	if _, err := replset.SendMessage(ctx, OpQuery, query.Encode()); err == nil || !strings.Contains(err.Error(), "bad query") {
+		t.Errorf("Expected the query failure, got %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"mongo-playground/internal/bson"
+)
+
+// OP_MSG flag bits
+const (
+	FlagChecksumPresent uint32 = 1 << 0
+	FlagMoreToCome      uint32 = 1 << 1
+	FlagExhaustAllowed  uint32 = 1 << 16
+
+	// Bits 0-15 are required: a parser must reject unknown bits in this range
+	requiredFlagBits = 0xFFFF
+	knownFlagBits    = FlagChecksumPresent | FlagMoreToCome | FlagExhaustAllowed
+)
+
+// OP_MSG section kinds
+const (
+	sectionBody             = 0
+	sectionDocumentSequence = 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// DocumentSequence is a kind 1 section of an OP_MSG: a named list of documents
+type DocumentSequence struct {
+	Identifier string
+	Documents  []bson.Raw
+}
+
+// Command is an OP_MSG command: a body sent as the kind 0 section and any
+// number of named document sequences sent as kind 1 sections. The server
+// treats each sequence as an array field of the body named by its identifier.
+type Command struct {
+	Body      bson.D
+	Sequences []DocumentSequence
+}
+
+// NewCommand returns a command with body and no document sequences
+func NewCommand(body bson.D) *Command {
+	return &Command{Body: body}
+}
+
+// AddSequence appends a document sequence named identifier and returns the
+// command, so that several sequences can be chained
+func (c *Command) AddSequence(identifier string, documents ...bson.Raw) *Command {
+	c.Sequences = append(c.Sequences, DocumentSequence{Identifier: identifier, Documents: documents})
+	return c
+}
+
+// validate checks that every sequence has a distinct identifier that does
+// not clash with a field of the body
+func (c *Command) validate() error {
+	if len(c.Body) == 0 {
+		return fmt.Errorf("command has no body")
+	}
+	seen := make(map[string]bool, len(c.Sequences))
+	for _, seq := range c.Sequences {
+		switch {
+		case seq.Identifier == "":
+			return fmt.Errorf("document sequence has no identifier")
+		case strings.IndexByte(seq.Identifier, 0) >= 0:
+			return fmt.Errorf("document sequence identifier %q contains a null byte", seq.Identifier)
+		case seen[seq.Identifier]:
+			return fmt.Errorf("duplicate document sequence %q", seq.Identifier)
+		}
+		if _, ok := c.Body.Lookup(seq.Identifier); ok {
+			return fmt.Errorf("document sequence %q duplicates a field of the command body", seq.Identifier)
+		}
+		seen[seq.Identifier] = true
+	}
+	return nil
+}
+
+// Message is a decoded OP_MSG, or the OP_REPLY to a command sent as an
+// OP_QUERY with the reply document as its body
+type Message struct {
+	Header    MessageHeader
+	FlagBits  uint32
+	Body      bson.Raw
+	Sequences []DocumentSequence
+	Checksum  uint32
+}
+
+// parseHeader decodes a 16 byte message header
+func parseHeader(b []byte) MessageHeader {
+	return MessageHeader{
+		MessageLength: int32(binary.LittleEndian.Uint32(b[0:4])),
+		RequestID:     int32(binary.LittleEndian.Uint32(b[4:8])),
+		ResponseTo:    int32(binary.LittleEndian.Uint32(b[8:12])),
+		OpCode:        int32(binary.LittleEndian.Uint32(b[12:16])),
+	}
+}
+
+// replyOpCode returns the opcode a server answers a request opcode with
+func replyOpCode(opCode int32) int32 {
+	switch opCode {
+	case OpQuery, OpGetMore:
+		return OpReply
+	case OpCommand:
+		return OpCommandReply
+	}
+	return opCode
+}
+
+// moreToCome reports whether a request is an OP_MSG with the moreToCome
+// flag bit, which the server does not reply to
+func moreToCome(opCode int32, payload []byte) bool {
+	return opCode == OpMsg && len(payload) >= 4 && binary.LittleEndian.Uint32(payload)&FlagMoreToCome != 0
+}
+
+// encodeOpMsg builds an OP_MSG payload from an encoded body and optional
+// document sequences
+func encodeOpMsg(flags uint32, body bson.Raw, sequences []DocumentSequence) []byte {
+	size := 4 + 1 + len(body)
+	for _, seq := range sequences {
+		size += 1 + 4 + len(seq.Identifier) + 1
+		for _, doc := range seq.Documents {
+			size += len(doc)
+		}
+	}
+
+	payload := make([]byte, 0, size)
+	payload = binary.LittleEndian.AppendUint32(payload, flags)
+
+	// Kind 0: Body section
+	payload = append(payload, sectionBody)
+	payload = append(payload, body...)
+
+	// Kind 1: Document sequences. The size includes the size field itself,
+	// the null-terminated identifier and all documents.
+	for _, seq := range sequences {
+		payload = append(payload, sectionDocumentSequence)
+		sizePos := len(payload)
+		payload = append(payload, 0, 0, 0, 0)
+		payload = append(payload, seq.Identifier...)
+		payload = append(payload, 0)
+		for _, doc := range seq.Documents {
+			payload = append(payload, doc...)
+		}
+		binary.LittleEndian.PutUint32(payload[sizePos:], uint32(len(payload)-sizePos))
+	}
+
+	return payload
+}
+
+// decodeReply validates a reply against the request it answers and decodes
+// it. An OP_REPLY is decoded as the reply to a command sent as OP_QUERY.
+func decodeReply(header MessageHeader, payload []byte, requestID, requestOpCode int32) (*Message, error) {
+	if header.ResponseTo != requestID {
+		return nil, fmt.Errorf("reply responseTo %d does not match request ID %d", header.ResponseTo, requestID)
+	}
+	if expected := replyOpCode(requestOpCode); header.OpCode != expected {
+		return nil, fmt.Errorf("unexpected reply opcode %d, expected %d", header.OpCode, expected)
+	}
+	switch header.OpCode {
+	case OpMsg:
+		return decodeOpMsg(header, payload)
+	case OpReply:
+		return decodeCommandReply(header, payload)
+	}
+	return nil, fmt.Errorf("cannot decode reply with opcode %d", header.OpCode)
+}
+
+// decodeOpMsg splits an OP_MSG payload into its flag bits, body and document sequences
+func decodeOpMsg(header MessageHeader, payload []byte) (*Message, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("OP_MSG too short: %d bytes", len(payload))
+	}
+
+	msg := &Message{
+		Header:   header,
+		FlagBits: binary.LittleEndian.Uint32(payload[0:4]),
+	}
+	if unknown := msg.FlagBits & requiredFlagBits &^ knownFlagBits; unknown != 0 {
+		return nil, fmt.Errorf("OP_MSG has unknown required flag bits 0x%x", unknown)
+	}
+
+	sections := payload[4:]
+	if msg.FlagBits&FlagChecksumPresent != 0 {
+		if len(sections) < 4 {
+			return nil, fmt.Errorf("OP_MSG too short for checksum")
+		}
+		msg.Checksum = binary.LittleEndian.Uint32(sections[len(sections)-4:])
+		sections = sections[:len(sections)-4]
+
+		crc := crc32.Update(0, castagnoli, serializeHeader(header))
+		crc = crc32.Update(crc, castagnoli, payload[:len(payload)-4])
+		if crc != msg.Checksum {
+			return nil, fmt.Errorf("OP_MSG checksum mismatch")
+		}
+	}
+
+	for len(sections) > 0 {
+		kind := sections[0]
+		sections = sections[1:]
+
+		switch kind {
+		case sectionBody:
+			if msg.Body != nil {
+				return nil, fmt.Errorf("OP_MSG has more than one body section")
+			}
+			doc, rest, err := readDocument(sections)
+			if err != nil {
+				return nil, fmt.Errorf("OP_MSG body: %w", err)
+			}
+			msg.Body = doc
+			sections = rest
+
+		case sectionDocumentSequence:
+			seq, rest, err := readDocumentSequence(sections)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := msg.Sequence(seq.Identifier); ok {
+				return nil, fmt.Errorf("OP_MSG has duplicate document sequence %q", seq.Identifier)
+			}
+			msg.Sequences = append(msg.Sequences, seq)
+			sections = rest
+
+		default:
+			return nil, fmt.Errorf("OP_MSG has unknown section kind %d", kind)
+		}
+	}
+
+	if msg.Body == nil {
+		return nil, fmt.Errorf("OP_MSG has no body section")
+	}
+	return msg, nil
+}
+
+// readDocument reads one length-prefixed document and returns the remaining bytes
+func readDocument(b []byte) (bson.Raw, []byte, error) {
+	if len(b) < 5 {
+		return nil, nil, fmt.Errorf("document too short: %d bytes", len(b))
+	}
+	length := int(int32(binary.LittleEndian.Uint32(b[0:4])))
+	if length < 5 || length > len(b) {
+		return nil, nil, fmt.Errorf("invalid document length: %d", length)
+	}
+	doc := bson.Raw(b[:length])
+	if err := doc.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return doc, b[length:], nil
+}
+
+// readDocumentSequence reads a kind 1 section following its kind byte
+func readDocumentSequence(b []byte) (DocumentSequence, []byte, error) {
+	if len(b) < 4 {
+		return DocumentSequence{}, nil, fmt.Errorf("OP_MSG document sequence too short")
+	}
+	size := int(int32(binary.LittleEndian.Uint32(b[0:4])))
+	if size < 5 || size > len(b) {
+		return DocumentSequence{}, nil, fmt.Errorf("invalid OP_MSG document sequence size: %d", size)
+	}
+	section, rest := b[4:size], b[size:]
+
+	end := bytes.IndexByte(section, 0)
+	if end < 0 {
+		return DocumentSequence{}, nil, fmt.Errorf("unterminated OP_MSG document sequence identifier")
+	}
+	seq := DocumentSequence{Identifier: string(section[:end])}
+	section = section[end+1:]
+
+	for len(section) > 0 {
+		doc, remaining, err := readDocument(section)
+		if err != nil {
+			return DocumentSequence{}, nil, fmt.Errorf("OP_MSG document sequence %q: %w", seq.Identifier, err)
+		}
+		seq.Documents = append(seq.Documents, doc)
+		section = remaining
+	}
+	return seq, rest, nil
+}
+
+// Sequence returns the documents of the sequence with the given identifier
+func (m *Message) Sequence(identifier string) ([]bson.Raw, bool) {
+	for _, seq := range m.Sequences {
+		if seq.Identifier == identifier {
+			return seq.Documents, true
+		}
+	}
+	return nil, false
+}
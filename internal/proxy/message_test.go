@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"mongo-playground/internal/bson"
+)
+
+// buildTestOpMsg assembles an OP_MSG payload from a body and sequences
+func buildTestOpMsg(t *testing.T, flags uint32, body bson.D, sequences ...DocumentSequence) []byte {
+	t.Helper()
+
+	payload := binary.LittleEndian.AppendUint32(nil, flags)
+	payload = append(payload, sectionBody)
+	doc, err := bson.Marshal(body)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	payload = append(payload, doc...)
+
+	for _, seq := range sequences {
+		payload = append(payload, sectionDocumentSequence)
+		sizePos := len(payload)
+		payload = append(payload, 0, 0, 0, 0)
+		payload = append(payload, seq.Identifier...)
+		payload = append(payload, 0)
+		for _, d := range seq.Documents {
+			payload = append(payload, d...)
+		}
+		binary.LittleEndian.PutUint32(payload[sizePos:], uint32(len(payload)-sizePos))
+	}
+	return payload
+}
+
+func mustMarshal(t *testing.T, doc bson.D) bson.Raw {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	return raw
+}
+
+func TestDecodeReplyWithSequences(t *testing.T) {
+	docs := []bson.Raw{
+		mustMarshal(t, bson.D{{Key: "_id", Value: 1}}),
+		mustMarshal(t, bson.D{{Key: "_id", Value: 2}}),
+	}
+	payload := buildTestOpMsg(t, 0, bson.D{{Key: "ok", Value: 1.0}},
+		DocumentSequence{Identifier: "documents", Documents: docs},
+		DocumentSequence{Identifier: "empty"},
+	)
+	header := MessageHeader{MessageLength: int32(HeaderSize + len(payload)), RequestID: 9, ResponseTo: 5, OpCode: OpMsg}
+
+	msg, err := decodeReply(header, payload, 5, OpMsg)
+	if err != nil {
+		t.Fatalf("decodeReply failed: %v", err)
+	}
+	if ok, _ := msg.Body.Lookup("ok").AsFloat64OK(); ok != 1 {
+		t.Errorf("Expected ok 1 in body, got %v", msg.Body)
+	}
+	if len(msg.Sequences) != 2 {
+		t.Fatalf("Expected 2 sequences, got %d", len(msg.Sequences))
+	}
+	got, found := msg.Sequence("documents")
+	if !found || len(got) != 2 || got[1].Lookup("_id").Int32() != 2 {
+		t.Errorf("Unexpected documents sequence: %v", got)
+	}
+	if empty, found := msg.Sequence("empty"); !found || len(empty) != 0 {
+		t.Errorf("Expected empty sequence, got %v", empty)
+	}
+}
+
+func TestDecodeReplyValidatesHeader(t *testing.T) {
+	payload := buildTestOpMsg(t, 0, bson.D{{Key: "ok", Value: 1.0}})
+
+	header := MessageHeader{ResponseTo: 4, OpCode: OpMsg}
+	if _, err := decodeReply(header, payload, 5, OpMsg); err == nil {
+		t.Error("Expected error for mismatched responseTo")
+	}
+
+	header = MessageHeader{ResponseTo: 5, OpCode: OpCommandReply}
+	if _, err := decodeReply(header, payload, 5, OpMsg); err == nil {
+		t.Error("Expected error for unexpected opcode")
+	}
+}
+
+func TestDecodeOpMsgChecksum(t *testing.T) {
+	payload := buildTestOpMsg(t, FlagChecksumPresent, bson.D{{Key: "ok", Value: 1.0}})
+	header := MessageHeader{MessageLength: int32(HeaderSize + len(payload) + 4), OpCode: OpMsg}
+	crc := crc32.Update(0, castagnoli, serializeHeader(header))
+	crc = crc32.Update(crc, castagnoli, payload)
+	payload = binary.LittleEndian.AppendUint32(payload, crc)
+
+	msg, err := decodeOpMsg(header, payload)
+	if err != nil {
+		t.Fatalf("decodeOpMsg failed: %v", err)
+	}
+	if msg.Checksum != crc {
+		t.Errorf("Expected checksum %x, got %x", crc, msg.Checksum)
+	}
+
+	payload[len(payload)-1] ^= 0xFF
+	if _, err := decodeOpMsg(header, payload); err == nil {
+		t.Error("Expected error for corrupted checksum")
+	}
+}
+
+func TestDecodeOpMsgInvalid(t *testing.T) {
+	body := mustMarshal(t, bson.D{{Key: "ok", Value: 1.0}})
+
+	tests := map[string][]byte{
+		"too short":          {0, 0},
+		"unknown flag bit":   append([]byte{0x04, 0, 0, 0, 0}, body...),
+		"no body":            {0, 0, 0, 0},
+		"two bodies":         append(append([]byte{0, 0, 0, 0, 0}, body...), append([]byte{0}, body...)...),
+		"unknown kind":       append([]byte{0, 0, 0, 0, 2}, body...),
+		"truncated body":     append([]byte{0, 0, 0, 0, 0}, body[:len(body)-1]...),
+		"bad sequence size":  append(append([]byte{0, 0, 0, 0, 0}, body...), 1, 0xFF, 0, 0, 0),
+		"bad sequence ident": append(append([]byte{0, 0, 0, 0, 0}, body...), 1, 6, 0, 0, 0, 'a', 'b'),
+		"duplicate sequence": append(append([]byte{0, 0, 0, 0, 0}, body...), 1, 6, 0, 0, 0, 'a', 0, 1, 6, 0, 0, 0, 'a', 0),
+	}
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeOpMsg(MessageHeader{OpCode: OpMsg}, payload); err == nil {
+				t.Error("Expected decodeOpMsg to fail")
+			}
+		})
+	}
+
+	// Optional flag bits above bit 15 are ignored
+	payload := append([]byte{0, 0, 0x02, 0, 0}, body...)
+	if _, err := decodeOpMsg(MessageHeader{OpCode: OpMsg}, payload); err != nil {
+		t.Errorf("Expected unknown optional flag bit to be ignored, got %v", err)
+	}
+}
+
+func TestCommandValidate(t *testing.T) {
+	doc := mustMarshal(t, bson.D{{Key: "x", Value: 1}})
+	body := bson.D{{Key: "bulkWrite", Value: 1}, {Key: "$db", Value: "admin"}}
+
+	valid := NewCommand(body).AddSequence("ops", doc, doc).AddSequence("nsInfo", doc)
+	if err := valid.validate(); err != nil {
+		t.Errorf("Expected a command with two sequences to be valid, got %v", err)
+	}
+	payload := encodeOpMsg(0, mustMarshal(t, body), valid.Sequences)
+	msg, err := decodeOpMsg(MessageHeader{OpCode: OpMsg}, payload)
+	if err != nil {
+		t.Fatalf("decodeOpMsg failed: %v", err)
+	}
+	if ops, _ := msg.Sequence("ops"); len(ops) != 2 {
+		t.Errorf("Expected 2 ops, got %d", len(ops))
+	}
+	if nsInfo, _ := msg.Sequence("nsInfo"); len(nsInfo) != 1 {
+		t.Errorf("Expected 1 nsInfo, got %d", len(nsInfo))
+	}
+
+	tests := map[string]*Command{
+		"no body":             NewCommand(nil),
+		"empty identifier":    NewCommand(body).AddSequence("", doc),
+		"null in identifier":  NewCommand(body).AddSequence("o\x00ps", doc),
+		"duplicate sequence":  NewCommand(body).AddSequence("ops", doc).AddSequence("ops", doc),
+		"duplicate body name": NewCommand(body).AddSequence("$db", doc),
+	}
+	for name, cmd := range tests {
+		if err := cmd.validate(); err == nil {
+			t.Errorf("%s: expected validate to fail", name)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"mongo-playground/internal/bson"
 )
 
 // Wire protocol constants
@@ -22,6 +25,7 @@ const (
 	OpKillCursors  = 2007
 	OpCommand      = 2010
 	OpCommandReply = 2011
+	OpCompressed   = 2012
 	OpMsg          = 2013
 
 	// Header size
@@ -38,225 +42,498 @@ type MessageHeader struct {
 
 // Replset represents a MongoDB replica set with multiple nodes
 type Replset struct {
-	nodes     []string
-	conns     map[string]net.Conn
-	mu        sync.RWMutex
-	requestID int32
+	nodes    []string
+	opts     Options
+	auth     *authenticator
+	topology *topology
+	pools    map[string]*pool
+	sessions *sessionPool
+	clock    clusterClock
+	mu       sync.RWMutex
+}
+
+// requestID is the last request ID handed out to any connection
+var requestID int32
+
+// nextRequestID returns a new request ID for an outgoing message
+func nextRequestID() int32 {
+	return atomic.AddInt32(&requestID, 1)
 }
 
-// NewReplset creates a new replica set abstraction
+// NewReplset creates a new replica set abstraction with the default options
 func NewReplset(nodes []string) *Replset {
+	return NewReplsetWithOptions(nodes, DefaultOptions())
+}
+
+// NewReplsetWithOptions creates a new replica set abstraction. Zero valued
+// options are replaced by their defaults.
+func NewReplsetWithOptions(nodes []string, opts Options) *Replset {
 	return &Replset{
-		nodes: nodes,
-		conns: make(map[string]net.Conn),
+		nodes:    nodes,
+		opts:     opts.withDefaults(),
+		auth:     newAuthenticator(opts.Credential),
+		pools:    make(map[string]*pool),
+		sessions: &sessionPool{},
 	}
 }
 
-// Connect establishes connections to all replica set nodes
+// Connect creates a connection pool for every replica set node, verifies
+// that at least one of them can be reached and starts monitoring them in the
+// background
 func (r *Replset) Connect(ctx context.Context) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.topology != nil {
+		return fmt.Errorf("replica set already connected")
+	}
+	if r.opts.TLS != nil && r.opts.tlsConfig == nil {
+		cfg, err := r.opts.TLS.config()
+		if err != nil {
+			return fmt.Errorf("invalid TLS options: %w", err)
+		}
+		r.opts.tlsConfig = cfg
+	}
+	if r.auth != nil {
+		if err := r.auth.cred.validate(r.opts.TLS); err != nil {
+			return fmt.Errorf("invalid credential: %w", err)
+		}
+	}
+	if len(r.opts.AppName) > maxAppNameBytes {
+		return fmt.Errorf("invalid app name: must be at most %d bytes", maxAppNameBytes)
+	}
+	if _, err := parseServerMonitoringMode(string(r.opts.ServerMonitoringMode)); err != nil {
+		return fmt.Errorf("invalid server monitoring mode: %w", err)
+	}
+	if err := r.readPreference(ctx).validate(r.opts.HeartbeatInterval); err != nil {
+		return fmt.Errorf("invalid read preference: %w", err)
+	}
+	for _, name := range r.opts.Compressors {
+		if _, err := newCompressor(name, *r.opts.ZlibCompressionLevel); err != nil {
+			return fmt.Errorf("invalid compressors: %w", err)
+		}
+	}
+
+	if r.opts.ServerAPI != nil {
+		if err := r.opts.ServerAPI.validate(); err != nil {
+			return fmt.Errorf("invalid server API: %w", err)
+		}
+	}
+
+	seeds := make([]string, 0, len(r.nodes))
+	var lastErr error
 	for _, node := range r.nodes {
-		conn, err := net.DialTimeout("tcp", node, 5*time.Second)
+		addr := normalizeAddr(node)
+		p := newPool(addr, r.opts, r.handshake)
+		c, err := p.checkOut(ctx)
 		if err != nil {
-			// Close any already established connections
-			r.closeConnections()
-			return fmt.Errorf("failed to connect to %s: %w", node, err)
+			p.close()
+			lastErr = err
+			continue
+		}
+		p.checkIn(c)
+		r.pools[addr] = p
+		seeds = append(seeds, addr)
+	}
+	if len(seeds) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no nodes configured")
 		}
-		r.conns[node] = conn
+		return lastErr
 	}
 
+	// Unreachable seeds stay in the topology so that they are used once
+	// they come up
+	for _, node := range r.nodes {
+		if addr := normalizeAddr(node); r.pools[addr] == nil {
+			seeds = append(seeds, addr)
+		}
+	}
+
+	r.topology = newTopology(seeds, r.opts)
+	r.topology.removed = r.removePool
+	r.topology.start()
+
 	return nil
 }
 
-// Disconnect closes all connections
+// Disconnect ends the pooled sessions, stops monitoring and closes all
+// connections
 func (r *Replset) Disconnect() error {
+	if r.IsConnected() {
+		r.endSessions()
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.closeConnections()
+
+	if r.topology != nil {
+		r.topology.close()
+		r.topology = nil
+	}
+	r.closePools()
+	return nil
 }
 
-// SendMessage sends a MongoDB wire protocol message to the primary node
-func (r *Replset) SendMessage(ctx context.Context, opCode int32, payload []byte) ([]byte, error) {
+// PoolStats returns a snapshot of the connection pool of every member
+func (r *Replset) PoolStats() []PoolStats {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	if len(r.conns) == 0 {
-		return nil, fmt.Errorf("no connections available")
-	}
-
-	// For simplicity, use the first available connection
-	// In a real implementation, you'd want to determine the primary
-	var conn net.Conn
-	for _, c := range r.conns {
-		conn = c
-		break
+	stats := make([]PoolStats, 0, len(r.pools))
+	for _, p := range r.pools {
+		stats = append(stats, p.stats())
 	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
 
-	// Generate request ID
-	r.requestID++
-	requestID := r.requestID
-
-	// Send request
-	err := sendRequest(conn, opCode, requestID, payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
+// Topology returns a snapshot of the replica set as seen by the monitors
+func (r *Replset) Topology() TopologyDescription {
+	r.mu.RLock()
+	t := r.topology
+	r.mu.RUnlock()
 
-	// Read response
-	response, err := readResponse(conn)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+	if t == nil {
+		return newTopologyDescription(nil, r.opts.ReplicaSet)
 	}
-
-	return response, nil
+	return t.description()
 }
 
-// SendQuery sends a query message using OP_MSG with kind 0 body section
-func (r *Replset) SendQuery(ctx context.Context, query []byte) ([]byte, error) {
-	// Build OP_MSG payload with kind 0 body section
-	var payload bytes.Buffer
-
-	// Flag bits (4 bytes) - 0 for normal message
-	binary.Write(&payload, binary.LittleEndian, uint32(0))
-
-	// Kind 0: Body section
-	payload.WriteByte(0)
+// selectServer waits for a member matching selector. Operations in a
+// transaction go to the member the transaction is pinned to instead.
+func (r *Replset) selectServer(ctx context.Context, selector func(TopologyDescription) []ServerDescription) (ServerDescription, error) {
+	if session := sessionFromContext(ctx); session != nil && session.inTransaction() {
+		selector = session.selectPinned
+	}
 
-	// Write the query document (should include database and collection)
-	// For example: {"find": "collection", "filter": {...}, "$db": "database"}
-	payload.Write(query)
+	r.mu.RLock()
+	t := r.topology
+	r.mu.RUnlock()
 
-	return r.SendMessage(ctx, OpMsg, payload.Bytes())
+	if t == nil {
+		return ServerDescription{}, errNotConnected
+	}
+	return t.selectServer(ctx, selector)
 }
 
-// SendCommand sends a command message using OP_MSG with kind 0 body section and optional kind 1 document sequence
-func (r *Replset) SendCommand(ctx context.Context, command []byte, documents [][]byte) ([]byte, error) {
-	// Build OP_MSG payload with kind 0 body section and optional kind 1 document sequence
-	var payload bytes.Buffer
+// pool returns the connection pool of addr, creating it for members
+// discovered after Connect
+func (r *Replset) pool(addr string) (*pool, error) {
+	r.mu.RLock()
+	p, ok := r.pools[addr]
+	r.mu.RUnlock()
+	if ok {
+		return p, nil
+	}
 
-	// Flag bits (4 bytes) - 0 for normal message
-	binary.Write(&payload, binary.LittleEndian, uint32(0))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.pools[addr]; ok {
+		return p, nil
+	}
+	if r.topology == nil {
+		return nil, errNotConnected
+	}
+	p = newPool(addr, r.opts, r.handshake)
+	r.pools[addr] = p
+	return p, nil
+}
 
-	// Kind 0: Body section
-	payload.WriteByte(0)
+// removePool closes the pool of a member that left the replica set
+func (r *Replset) removePool(addr string) {
+	r.mu.Lock()
+	p := r.pools[addr]
+	delete(r.pools, addr)
+	r.mu.Unlock()
 
-	// Write the command document (should include database)
-	// For example: {"insert": "collection", "$db": "database"}
-	payload.Write(command)
+	if p != nil {
+		p.close()
+	}
+}
 
-	// Kind 1: Document sequence (if documents provided)
-	if len(documents) > 0 {
-		payload.WriteByte(1) // Kind 1
+// SendMessage sends a MongoDB wire protocol message to the primary node and
+// returns the decoded OP_MSG reply. Errors reported in the reply are
+// returned as a *CommandError or *WriteException along with the reply. An
+// OP_MSG with the moreToCome flag bit is not answered, and its reply is nil.
+func (r *Replset) SendMessage(ctx context.Context, opCode int32, payload []byte) (*Message, error) {
+	server, err := r.selectServer(ctx, selectWritable)
+	if err != nil {
+		return nil, err
+	}
+	return r.sendMessageTo(ctx, server, opCode, payload)
+}
 
-		// Calculate total size of document sequence
-		// Size includes: size field (4 bytes) + identifier + all documents
-		var totalSize int32 = 4 // size field itself
+// sendMessageTo sends a message to a specific member on a pooled connection.
+// A message with moreToCome is only written, and its reply is nil.
+func (r *Replset) sendMessageTo(ctx context.Context, server ServerDescription, opCode int32, payload []byte) (*Message, error) {
+	addr := server.Addr
+	p, c, err := r.checkOut(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer p.checkIn(c)
 
-		// Add identifier (null-terminated string)
-		identifier := "documents"               // Default identifier for document sequence
-		totalSize += int32(len(identifier) + 1) // +1 for null terminator
+	if err := c.framer.checkSize(len(payload)); err != nil {
+		return nil, err
+	}
 
-		// Add size of all documents
-		for _, doc := range documents {
-			totalSize += int32(len(doc))
+	requestID := nextRequestID()
+	if moreToCome(opCode, payload) {
+		if err := writeRequest(ctx, c, opCode, requestID, payload); err != nil {
+			return nil, r.connectionError(ctx, addr, c, err)
 		}
+		return nil, nil
+	}
+	header, response, err := roundTrip(ctx, c, opCode, requestID, payload)
+	if err != nil {
+		return nil, r.connectionError(ctx, addr, c, err)
+	}
 
-		// Write size of the section
-		binary.Write(&payload, binary.LittleEndian, totalSize)
-
-		// Write identifier (null-terminated)
-		payload.WriteString(identifier)
-		payload.WriteByte(0)
+	reply, err := decodeReply(header, response, requestID, opCode)
+	if err != nil {
+		return nil, err
+	}
+	if reply.FlagBits&FlagMoreToCome != 0 {
+		// Only a request with exhaustAllowed may be answered by several
+		// replies, and the rest of them would be read by the next request
+		c.close()
+		return nil, fmt.Errorf("%s streamed replies to a request without exhaustAllowed", addr)
+	}
+	return r.handleReply(ctx, addr, reply)
+}
 
-		// Write all documents
-		for _, doc := range documents {
-			payload.Write(doc)
+// checkOut checks out a connection to addr from its pool
+func (r *Replset) checkOut(ctx context.Context, addr string) (*pool, *connection, error) {
+	p, err := r.pool(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := p.checkOut(ctx)
+	if err != nil {
+		if isNetworkError(err) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			r.handleNetworkError(addr, err)
 		}
+		return nil, nil, err
 	}
+	return p, c, nil
+}
 
-	return r.SendMessage(ctx, OpMsg, payload.Bytes())
+// connectionError closes a connection that failed mid-message and returns
+// the error to report, a context error if ctx caused it
+func (r *Replset) connectionError(ctx context.Context, addr string, c *connection, err error) error {
+	// The connection is left in an unknown state mid-message
+	c.close()
+	if ctxErr := contextError(ctx, err); ctxErr != nil {
+		return fmt.Errorf("request to %s: %w", addr, ctxErr)
+	}
+	if !isTimeout(err) {
+		r.handleNetworkError(addr, err)
+	}
+	return &networkError{addr: addr, err: err}
 }
 
-// serializeHeader converts a MessageHeader to its wire protocol representation
-func serializeHeader(header MessageHeader) []byte {
-	headerBytes := make([]byte, HeaderSize)
-	binary.LittleEndian.PutUint32(headerBytes[0:4], uint32(header.MessageLength))
-	binary.LittleEndian.PutUint32(headerBytes[4:8], uint32(header.RequestID))
-	binary.LittleEndian.PutUint32(headerBytes[8:12], uint32(header.ResponseTo))
-	binary.LittleEndian.PutUint32(headerBytes[12:16], uint32(header.OpCode))
-	return headerBytes
+// handleReply records the cluster time and session state of a reply and
+// returns the error it reports, if any
+func (r *Replset) handleReply(ctx context.Context, addr string, reply *Message) (*Message, error) {
+	r.clock.advance(reply.Body.Lookup("$clusterTime").Document())
+	if session := sessionFromContext(ctx); session != nil {
+		session.observe(reply.Body)
+	}
+	if isStateChangeError(reply.Body) {
+		r.markUnknown(addr, fmt.Errorf("%s", reply.Body.Lookup("errmsg").StringValue()))
+	}
+	return reply, replyError(reply.Body)
 }
 
-// sendRequest creates a message header and sends the request
-func sendRequest(conn net.Conn, opCode, requestID int32, payload []byte) error {
-	// Create message header
-	header := MessageHeader{
-		MessageLength: int32(HeaderSize + len(payload)),
-		RequestID:     requestID,
-		ResponseTo:    0,
-		OpCode:        opCode,
+// handleNetworkError clears the pool of addr and marks it unknown, since
+// its other connections are likely broken as well
+func (r *Replset) handleNetworkError(addr string, err error) {
+	r.mu.RLock()
+	p := r.pools[addr]
+	r.mu.RUnlock()
+	if p != nil {
+		p.clear()
 	}
+	r.markUnknown(addr, err)
+}
 
-	// Serialize header
-	headerBytes := serializeHeader(header)
+// markUnknown resets the description of addr after an error
+func (r *Replset) markUnknown(addr string, err error) {
+	r.mu.RLock()
+	t := r.topology
+	r.mu.RUnlock()
+	if t != nil {
+		t.markUnknown(addr, err)
+	}
+}
 
-	// Send message
-	message := append(headerBytes, payload...)
-	_, err := conn.Write(message)
+// SendQuery sends a query message using OP_MSG with kind 0 body section.
+// The reply holds only the first batch; Find and RunCursorCommand return a
+// Cursor over every batch. Reads are retried once unless Options.RetryReads
+// is disabled.
+func (r *Replset) SendQuery(ctx context.Context, query bson.D) (*Message, error) {
+	// The query document should include database and collection,
+	// for example: {"find": "collection", "filter": {...}, "$db": "database"}
+	query, err := withMaxTimeMS(ctx, query)
 	if err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
+		return nil, err
 	}
+	_, reply, err := r.retryableRead(ctx, query)
+	return reply, err
+}
 
-	return nil
+// SendCommand sends a command message using OP_MSG with kind 0 body section and optional kind 1 document sequence.
+// The documents are sent as the "updates" of an update, the "deletes" of a delete and the "documents" of other
+// commands. See RunCommand for commands with several document sequences.
+func (r *Replset) SendCommand(ctx context.Context, command bson.D, documents []bson.Raw) (*Message, error) {
+	// The command document should include database,
+	// for example: {"insert": "collection", "$db": "database"}
+	cmd := NewCommand(command)
+	if len(documents) > 0 && len(command) > 0 {
+		cmd.AddSequence(sequenceIdentifier(command[0].Key), documents...)
+	}
+	return r.RunCommand(ctx, cmd)
 }
 
-// readResponse reads a response from the connection
-func readResponse(conn net.Conn) ([]byte, error) {
-	// Read header
-	headerBytes := make([]byte, HeaderSize)
-	_, err := conn.Read(headerBytes)
+// RunCommand sends a command built with NewCommand and its document sequences, for example the "ops" and "nsInfo"
+// of a bulkWrite, to the primary. An insert, update or delete whose statements are its only sequence is split
+// into several commands when they exceed maxWriteBatchSize or maxMessageSizeBytes, and the replies are merged.
+// Eligible writes are retried once after a failover unless Options.RetryWrites is disabled. Write errors for
+// several statements are returned as a *BulkWriteException. The sequences of the reply are in Message.Sequences.
+func (r *Replset) RunCommand(ctx context.Context, cmd *Command) (*Message, error) {
+	if err := cmd.validate(); err != nil {
+		return nil, fmt.Errorf("invalid command: %w", err)
+	}
+	command, err := withMaxTimeMS(ctx, cmd.Body)
 	if err != nil {
 		return nil, err
 	}
-
-	// Parse header
-	messageLength := binary.LittleEndian.Uint32(headerBytes[0:4])
-	requestID := binary.LittleEndian.Uint32(headerBytes[4:8])
-	responseTo := binary.LittleEndian.Uint32(headerBytes[8:12])
-	opCode := binary.LittleEndian.Uint32(headerBytes[12:16])
-
-	// Read payload
-	payloadSize := int(messageLength) - HeaderSize
-	if payloadSize < 0 {
-		return nil, fmt.Errorf("invalid message length: %d", messageLength)
+	if !inTransaction(ctx) {
+		command = withWriteConcern(command, r.opts.WriteConcern)
 	}
-
-	payload := make([]byte, payloadSize)
-	_, err = conn.Read(payload)
+	body, err := bson.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+	// The server is selected once per attempt: the batches are split by the
+	// limits of the primary they are sent to
+	server, err := r.selectServer(ctx, selectWritable)
 	if err != nil {
 		return nil, err
 	}
+	identifier, ok := writeSequenceIdentifiers[command[0].Key]
+	if !ok || len(cmd.Sequences) != 1 || cmd.Sequences[0].Identifier != identifier || len(cmd.Sequences[0].Documents) == 0 {
+		return r.sendWrite(ctx, server, command, body, cmd.Sequences)
+	}
+
+	// Kind 1: Document sequences, split by the limits of the primary
+	documents := cmd.Sequences[0].Documents
+	reply, err := r.sendBatches(ctx, server, command, body, identifier, documents)
+	var writeErr *WriteException
+	if len(documents) > 1 && errors.As(err, &writeErr) {
+		return reply, bulkWriteException(writeErr, documents)
+	}
+	return reply, err
+}
 
-	// Log response details for debugging
-	_ = requestID
-	_ = responseTo
-	_ = opCode
+// roundTrip writes a request and reads its reply, bounding both by the
+// deadline of ctx. Cancelling ctx interrupts a blocked read or write.
+func roundTrip(ctx context.Context, c *connection, opCode, requestID int32, payload []byte) (MessageHeader, []byte, error) {
+	if err := writeRequest(ctx, c, opCode, requestID, payload); err != nil {
+		return MessageHeader{}, nil, err
+	}
+	return readReply(ctx, c)
+}
 
-	return payload, nil
+// writeRequest writes a request, bounded by the deadline of ctx
+func writeRequest(ctx context.Context, c *connection, opCode, requestID int32, payload []byte) error {
+	return withDeadline(ctx, c, func() error {
+		if err := c.framer.writeMessage(opCode, requestID, 0, payload); err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		return nil
+	})
 }
 
-// closeConnections closes all connections
-func (r *Replset) closeConnections() error {
-	var lastErr error
-	for node, conn := range r.conns {
-		if err := conn.Close(); err != nil {
-			lastErr = fmt.Errorf("failed to close connection to %s: %w", node, err)
+// readReply reads the next message, bounded by the deadline of ctx
+func readReply(ctx context.Context, c *connection) (MessageHeader, []byte, error) {
+	var header MessageHeader
+	var response []byte
+	err := withDeadline(ctx, c, func() error {
+		var err error
+		if header, response, err = c.framer.readMessage(); err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
 		}
+		return nil
+	})
+	return header, response, err
+}
+
+// withDeadline runs an operation on the connection with the deadline of
+// ctx, interrupting it when ctx is cancelled
+func withDeadline(ctx context.Context, c *connection, op func() error) error {
+	conn := c.conn
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set deadline: %w", err)
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	stop := context.AfterFunc(ctx, func() {
+		// A deadline in the past unblocks pending reads and writes
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+	return op()
+}
+
+// contextError returns the error of ctx if it caused err. The socket
+// deadline can fire slightly before ctx reports that it is done.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if deadline, ok := ctx.Deadline(); ok && isTimeout(err) && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// isTimeout reports whether err is a socket timeout. A timeout does not
+// imply that the member is down, so its pool is left intact.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// withMaxTimeMS adds maxTimeMS to a command from the remaining deadline of
+// ctx, so that the server gives up on the operation once the caller has
+// stopped waiting for it
+func withMaxTimeMS(ctx context.Context, command bson.D) (bson.D, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return command, nil
+	}
+	if _, set := command.Lookup("maxTimeMS"); set {
+		return command, nil
+	}
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return append(command[:len(command):len(command)], bson.E{Key: "maxTimeMS", Value: remaining}), nil
+}
+
+// closePools closes the connection pools of all members
+func (r *Replset) closePools() {
+	for _, p := range r.pools {
+		p.close()
 	}
-	r.conns = make(map[string]net.Conn)
-	return lastErr
+	r.pools = make(map[string]*pool)
 }
 
 // GetNodes returns the list of nodes in the replica set
@@ -273,5 +550,5 @@ func (r *Replset) GetNodes() []string {
 func (r *Replset) IsConnected() bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return len(r.conns) > 0
+	return r.topology != nil
 }
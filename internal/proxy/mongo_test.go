@@ -3,40 +3,120 @@ package proxy
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"mongo-playground/internal/bson"
 )
 
-// mockMongoServer simulates a MongoDB server for testing
+// mockHandler produces the reply payload for a request
+type mockHandler func(opCode int32, payload []byte) []byte
+
+// mockStreamHandler answers a request with any number of replies by calling
+// reply for each, e.g. to stream exhaust replies. A returned error drops the
+// connection.
+type mockStreamHandler func(opCode int32, payload []byte, reply func(response []byte) error) error
+
+// mockMongoServer simulates a MongoDB server for testing. The OP_QUERY
+// isMaster that opens every connection is passed to the handler as an
+// OP_MSG hello and its reply returned as an OP_REPLY, unless rawQueries is
+// set, so that most handlers only deal with OP_MSG.
 type mockMongoServer struct {
-	listener net.Listener
-	conns    []net.Conn
+	listener   net.Listener
+	handler    mockHandler
+	stream     mockStreamHandler
+	rawQueries bool
+	mu         sync.Mutex
+	conns      []net.Conn
 }
 
 func newMockMongoServer() (*mockMongoServer, error) {
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	reply, err := bson.Marshal(bson.D{{Key: "maxWireVersion", Value: 21}, {Key: "ok", Value: 1.0}})
 	if err != nil {
 		return nil, err
 	}
+	return newMockMongoServerWithHandler(func(opCode int32, payload []byte) []byte {
+		return append([]byte{0, 0, 0, 0, 0}, reply...)
+	})
+}
 
-	server := &mockMongoServer{
-		listener: listener,
-		conns:    make([]net.Conn, 0),
-	}
+func newMockMongoServerWithHandler(handler mockHandler) (*mockMongoServer, error) {
+	return startMockServer(&mockMongoServer{handler: handler})
+}
 
-	go server.acceptConnections()
+// newMockStreamingServer starts a mock server whose handler may send
+// several replies per request
+func newMockStreamingServer(handler mockStreamHandler) (*mockMongoServer, error) {
+	return startMockServer(&mockMongoServer{stream: handler})
+}
+
+// newMockLegacyServer starts a mock server whose handler receives the
+// OP_QUERY handshake as is
+func newMockLegacyServer(handler mockHandler) (*mockMongoServer, error) {
+	return startMockServer(&mockMongoServer{handler: handler, rawQueries: true})
+}
 
+// startMockServer listens on a local port and serves connections with server
+func startMockServer(server *mockMongoServer) (*mockMongoServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server.listener = listener
+	go server.acceptConnections()
 	return server, nil
 }
 
+// legacyHandshake converts an OP_QUERY isMaster on admin.$cmd into an
+// OP_MSG hello, returning a function that converts the OP_MSG reply into an
+// OP_REPLY. Other messages are returned unchanged with a nil function.
+func legacyHandshake(opCode int32, payload []byte) (int32, []byte, func([]byte) []byte) {
+	if opCode != OpQuery {
+		return opCode, payload, nil
+	}
+	msg, err := DecodeLegacyMessage(opCode, payload)
+	if err != nil {
+		return opCode, payload, nil
+	}
+	query := msg.(*LegacyQuery)
+	elements, err := query.Query.Elements()
+	if err != nil || query.FullCollectionName != "admin.$cmd" || len(elements) == 0 || elements[0].Key != "isMaster" {
+		return opCode, payload, nil
+	}
+
+	command := bson.D{{Key: "hello", Value: elements[0].Value}}
+	for _, e := range elements[1:] {
+		command = append(command, bson.E{Key: e.Key, Value: e.Value})
+	}
+	body, err := bson.Marshal(append(command, bson.E{Key: "$db", Value: "admin"}))
+	if err != nil {
+		return opCode, payload, nil
+	}
+	toReply := func(response []byte) []byte {
+		reply, err := decodeOpMsg(MessageHeader{OpCode: OpMsg}, response)
+		if err != nil {
+			return response
+		}
+		return (&LegacyReply{Documents: []bson.Raw{reply.Body}}).Encode()
+	}
+	return OpMsg, encodeOpMsg(0, body, nil), toReply
+}
+
 func (m *mockMongoServer) acceptConnections() {
 	for {
 		conn, err := m.listener.Accept()
 		if err != nil {
 			return
 		}
+		m.mu.Lock()
 		m.conns = append(m.conns, conn)
+		m.mu.Unlock()
 		go m.handleConnection(conn)
 	}
 }
@@ -44,37 +124,257 @@ func (m *mockMongoServer) acceptConnections() {
 func (m *mockMongoServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	// Read the incoming message
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
+	var replyID uint32
+	for {
+		// Read the header of the incoming message
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		messageLength := binary.LittleEndian.Uint32(header[0:4])
+		requestID := binary.LittleEndian.Uint32(header[4:8])
+		opCode := binary.LittleEndian.Uint32(header[12:16])
+		if messageLength < 16 {
+			return
+		}
+
+		payload := make([]byte, messageLength-16)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+
+		// Each reply answers the previous one, as in an exhaust stream
+		responseTo := requestID
+		handlerOpCode, handlerPayload := int32(opCode), payload
+		var toReply func([]byte) []byte
+		if !m.rawQueries {
+			handlerOpCode, handlerPayload, toReply = legacyHandshake(handlerOpCode, payload)
+		}
+		reply := func(response []byte) error {
+			if toReply != nil {
+				response = toReply(response)
+			}
+			replyID++
+			responseHeader := make([]byte, 16)
+			binary.LittleEndian.PutUint32(responseHeader[0:4], uint32(16+len(response))) // Message length (header + payload)
+			binary.LittleEndian.PutUint32(responseHeader[4:8], replyID)                  // Response request ID
+			binary.LittleEndian.PutUint32(responseHeader[8:12], responseTo)              // Response to original request
+			binary.LittleEndian.PutUint32(responseHeader[12:16], uint32(replyOpCode(int32(opCode))))
+			responseTo = replyID
+
+			// Send response (header + payload)
+			_, err := conn.Write(append(responseHeader, response...))
+			return err
+		}
+		if m.stream != nil {
+			if err := m.stream(handlerOpCode, handlerPayload, reply); err != nil {
+				return
+			}
+			continue
+		}
+
+		// Create a mock response with payload. A nil response drops the
+		// connection, as a network error would. A request with moreToCome
+		// is not answered.
+		response := m.handler(handlerOpCode, handlerPayload)
+		if response == nil {
+			return
+		}
+		if moreToCome(int32(opCode), payload) {
+			continue
+		}
+		if err := reply(response); err != nil {
+			return
+		}
+	}
+}
+
+// testOpMsgPayload builds an OP_MSG payload with a single body section
+func testOpMsgPayload(t *testing.T, body bson.D) []byte {
+	t.Helper()
+	doc, err := bson.Marshal(body)
 	if err != nil {
-		return
+		t.Fatalf("Marshal failed: %v", err)
 	}
+	return append([]byte{0, 0, 0, 0, 0}, doc...)
+}
 
-	// Parse the header
-	if n < 16 {
-		return
+// mockReplicaSet runs mock members that answer hello as a replica set named
+// rs0 and record the other commands they receive
+type mockReplicaSet struct {
+	t       *testing.T
+	servers []*mockMongoServer
+	addrs   []string
+
+	mu       sync.Mutex
+	primary  int
+	term     byte
+	received [][]string
+	handler  func(member int, command *Message) bson.D
+
+	// compressors are the compressors the members accept in hello, and
+	// compressedWith records the compressor of each received command
+	compressors    []string
+	compressedWith [][]string
+
+	// helloExtra is added to every hello reply, such as server limits,
+	// replacing the fields it repeats
+	helloExtra bson.D
+}
+
+// newMockReplicaSet starts n members with member 0 as primary
+func newMockReplicaSet(t *testing.T, n int) *mockReplicaSet {
+	t.Helper()
+
+	rs := &mockReplicaSet{t: t, term: 1, received: make([][]string, n), compressedWith: make([][]string, n)}
+	for i := 0; i < n; i++ {
+		member := i
+		server, err := newMockMongoServerWithHandler(func(opCode int32, payload []byte) []byte {
+			return rs.handle(member, opCode, payload)
+		})
+		if err != nil {
+			t.Fatalf("Failed to start mock server %d: %v", i, err)
+		}
+		rs.servers = append(rs.servers, server)
+		rs.addrs = append(rs.addrs, server.Addr())
 	}
+	t.Cleanup(func() {
+		for _, server := range rs.servers {
+			server.Close()
+		}
+	})
+	return rs
+}
+
+// setPrimary moves the primary to member i with a newer electionId, or
+// leaves the set without a primary when i is negative
+func (rs *mockReplicaSet) setPrimary(i int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.primary = i
+	rs.term++
+}
 
-	messageLength := binary.LittleEndian.Uint32(buffer[0:4])
-	requestID := binary.LittleEndian.Uint32(buffer[4:8])
-	responseTo := binary.LittleEndian.Uint32(buffer[8:12])
-	opCode := binary.LittleEndian.Uint32(buffer[12:16])
+// setHandler installs a handler for commands other than hello. A nil
+// reply drops the connection.
+func (rs *mockReplicaSet) setHandler(handler func(member int, command *Message) bson.D) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.handler = handler
+}
+
+// isPrimary reports whether member i is the current primary
+func (rs *mockReplicaSet) isPrimary(i int) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.primary == i
+}
 
-	// Create a mock response with payload
-	payload := []byte(`{"ok": 1}`)
-	responseHeader := make([]byte, 16)
-	binary.LittleEndian.PutUint32(responseHeader[0:4], uint32(16+len(payload))) // Message length (header + payload)
-	binary.LittleEndian.PutUint32(responseHeader[4:8], 1)                       // Response request ID
-	binary.LittleEndian.PutUint32(responseHeader[8:12], requestID)              // Response to original request
-	binary.LittleEndian.PutUint32(responseHeader[12:16], opCode)                // Same op code
+// commands returns the names of the commands member i received, excluding hello
+func (rs *mockReplicaSet) commands(i int) []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]string(nil), rs.received[i]...)
+}
 
-	// Send response (header + payload)
-	conn.Write(responseHeader)
-	conn.Write(payload)
+func (rs *mockReplicaSet) handle(member int, opCode int32, payload []byte) []byte {
+	// Compressed requests are answered with the same compressor
+	var comp *compressor
+	if opCode == OpCompressed {
+		header, original, err := decompressMessage(MessageHeader{OpCode: opCode}, payload, DefaultMaxMessageSizeBytes)
+		if err != nil {
+			rs.t.Errorf("mock member %d received invalid OP_COMPRESSED: %v", member, err)
+			return nil
+		}
+		names := map[uint8]string{compressorSnappy: CompressorSnappy, compressorZlib: CompressorZlib}
+		if comp, err = newCompressor(names[payload[8]], -1); err != nil {
+			rs.t.Errorf("mock member %d: %v", member, err)
+			return nil
+		}
+		opCode, payload = header.OpCode, original
+	}
+	reply := func(doc bson.D) []byte {
+		out := testOpMsgPayload(rs.t, doc)
+		if comp == nil {
+			return out
+		}
+		out, err := compressMessage(comp, OpMsg, out)
+		if err != nil {
+			rs.t.Errorf("mock member %d failed to compress reply: %v", member, err)
+		}
+		return out
+	}
+
+	command, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+	if err != nil {
+		rs.t.Errorf("mock member %d received invalid OP_MSG: %v", member, err)
+		return reply(bson.D{{Key: "ok", Value: 0.0}})
+	}
+	elements, _ := command.Body.Elements()
+	name := elements[0].Key
+
+	rs.mu.Lock()
+	if name == "hello" || name == "isMaster" {
+		doc := rs.helloLocked(member)
+		var accepted bson.A
+		for _, offered := range stringArray(command.Body.Lookup("compression")) {
+			if slices.Contains(rs.compressors, offered) {
+				accepted = append(accepted, offered)
+			}
+		}
+		rs.mu.Unlock()
+		if accepted != nil {
+			doc = append(doc, bson.E{Key: "compression", Value: accepted})
+		}
+		return reply(doc)
+	}
+	rs.received[member] = append(rs.received[member], name)
+	if comp != nil {
+		rs.compressedWith[member] = append(rs.compressedWith[member], comp.name)
+	} else {
+		rs.compressedWith[member] = append(rs.compressedWith[member], "")
+	}
+	handler := rs.handler
+	rs.mu.Unlock()
+
+	if handler != nil {
+		doc := handler(member, command)
+		if doc == nil {
+			return nil
+		}
+		return reply(doc)
+	}
+	return reply(bson.D{{Key: "ok", Value: 1.0}})
+}
 
-	_ = messageLength
-	_ = responseTo
+func (rs *mockReplicaSet) helloLocked(member int) bson.D {
+	hosts := make(bson.A, len(rs.addrs))
+	for i, addr := range rs.addrs {
+		hosts[i] = addr
+	}
+	reply := bson.D{
+		{Key: "isWritablePrimary", Value: member == rs.primary},
+		{Key: "secondary", Value: member != rs.primary},
+		{Key: "setName", Value: "rs0"},
+		{Key: "setVersion", Value: 1},
+		{Key: "hosts", Value: hosts},
+		{Key: "me", Value: rs.addrs[member]},
+		{Key: "maxWireVersion", Value: 21},
+		{Key: "logicalSessionTimeoutMinutes", Value: 30},
+	}
+	if rs.primary >= 0 {
+		reply = append(reply, bson.E{Key: "primary", Value: rs.addrs[rs.primary]})
+	}
+	if member == rs.primary {
+		var electionID bson.ObjectID
+		electionID[11] = rs.term
+		reply = append(reply, bson.E{Key: "electionId", Value: electionID})
+	}
+	for _, e := range rs.helloExtra {
+		reply = reply.Set(e.Key, e.Value)
+	}
+	return append(reply, bson.E{Key: "ok", Value: 1.0})
 }
 
 func (m *mockMongoServer) Addr() string {
@@ -82,6 +382,8 @@ func (m *mockMongoServer) Addr() string {
 }
 
 func (m *mockMongoServer) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, conn := range m.conns {
 		conn.Close()
 	}
@@ -185,13 +487,13 @@ func TestReplsetSendMessage(t *testing.T) {
 	}
 
 	// Test sending a message
-	payload := []byte("test payload")
-	response, err := replset.SendMessage(ctx, OpQuery, payload)
+	payload := testOpMsgPayload(t, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}})
+	response, err := replset.SendMessage(ctx, OpMsg, payload)
 	if err != nil {
 		t.Errorf("SendMessage failed: %v", err)
 	}
 
-	if len(response) == 0 {
+	if response == nil || len(response.Body) == 0 {
 		t.Error("Expected non-empty response")
 	}
 }
@@ -217,13 +519,13 @@ func TestReplsetSendQuery(t *testing.T) {
 	}
 
 	// Test sending a query
-	query := []byte(`{"find": "users", "$db": "testdb"}`)
+	query := bson.D{{Key: "find", Value: "users"}, {Key: "$db", Value: "testdb"}}
 	response, err := replset.SendQuery(ctx, query)
 	if err != nil {
 		t.Errorf("SendQuery failed: %v", err)
 	}
 
-	if len(response) == 0 {
+	if response == nil || len(response.Body) == 0 {
 		t.Error("Expected non-empty response")
 	}
 }
@@ -249,13 +551,13 @@ func TestReplsetSendCommand(t *testing.T) {
 	}
 
 	// Test sending a command
-	command := []byte(`{"ping": 1, "$db": "testdb"}`)
+	command := bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "testdb"}}
 	response, err := replset.SendCommand(ctx, command, nil)
 	if err != nil {
 		t.Errorf("SendCommand failed: %v", err)
 	}
 
-	if len(response) == 0 {
+	if response == nil || len(response.Body) == 0 {
 		t.Error("Expected non-empty response")
 	}
 }
@@ -281,57 +583,144 @@ func TestReplsetSendCommandWithDocuments(t *testing.T) {
 	}
 
 	// Test sending a command with documents (kind 1 section)
-	command := []byte(`{"insert": "users", "$db": "testdb"}`)
-	documents := [][]byte{
-		[]byte(`{"name": "John", "age": 30}`),
-		[]byte(`{"name": "Jane", "age": 25}`),
+	command := bson.D{{Key: "insert", Value: "users"}, {Key: "$db", Value: "testdb"}}
+	documents := make([]bson.Raw, 0, 2)
+	for _, doc := range []bson.D{
+		{{Key: "name", Value: "John"}, {Key: "age", Value: 30}},
+		{{Key: "name", Value: "Jane"}, {Key: "age", Value: 25}},
+	} {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		documents = append(documents, raw)
 	}
 	response, err := replset.SendCommand(ctx, command, documents)
 	if err != nil {
 		t.Errorf("SendCommand with documents failed: %v", err)
 	}
 
-	if len(response) == 0 {
+	if response == nil || len(response.Body) == 0 {
 		t.Error("Expected non-empty response")
 	}
 }
 
+func TestReplsetRunCommandWithSequences(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var mu sync.Mutex
+	received := make(map[string][]*Message)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		elements, _ := command.Body.Elements()
+		mu.Lock()
+		received[elements[0].Key] = append(received[elements[0].Key], command)
+		mu.Unlock()
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset := connectTestReplset(t, mock)
+	ctx := context.Background()
+
+	op := mustMarshal(t, bson.D{{Key: "insert", Value: 0}, {Key: "document", Value: bson.D{{Key: "x", Value: 1}}}})
+	ns := mustMarshal(t, bson.D{{Key: "ns", Value: "test.col"}})
+	cmd := NewCommand(bson.D{{Key: "bulkWrite", Value: 1}, {Key: "$db", Value: "admin"}}).
+		AddSequence("ops", op, op).
+		AddSequence("nsInfo", ns)
+	if _, err := replset.RunCommand(ctx, cmd); err != nil {
+		t.Fatalf("RunCommand failed: %v", err)
+	}
+
+	update := mustMarshal(t, bson.D{{Key: "q", Value: bson.D{}}, {Key: "u", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "y", Value: 2}}}}}})
+	if _, err := replset.SendCommand(ctx, bson.D{{Key: "update", Value: "col"}, {Key: "$db", Value: "test"}}, []bson.Raw{update}); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+
+	duplicate := NewCommand(bson.D{{Key: "bulkWrite", Value: 1}, {Key: "$db", Value: "admin"}}).AddSequence("ops", op).AddSequence("ops", op)
+	if _, err := replset.RunCommand(ctx, duplicate); err == nil || !strings.Contains(err.Error(), "duplicate document sequence") {
+		t.Errorf("Expected a duplicate sequence error, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received["bulkWrite"]) != 1 {
+		t.Fatalf("Expected one bulkWrite, got %d", len(received["bulkWrite"]))
+	}
+	bulk := received["bulkWrite"][0]
+	ops, _ := bulk.Sequence("ops")
+	nsInfo, _ := bulk.Sequence("nsInfo")
+	if len(bulk.Sequences) != 2 || len(ops) != 2 || len(nsInfo) != 1 {
+		t.Errorf("Expected the ops and nsInfo sequences, got %+v", bulk.Sequences)
+	}
+	if len(received["update"]) != 1 {
+		t.Fatalf("Expected one update, got %d", len(received["update"]))
+	}
+	if updates, ok := received["update"][0].Sequence("updates"); !ok || len(updates) != 1 {
+		t.Errorf("Expected the update statements in an updates sequence, got %+v", received["update"][0].Sequences)
+	}
+}
+
+func TestReplsetUnacknowledgedWriteSetsMoreToCome(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var mu sync.Mutex
+	flags := make(map[string][]uint32)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		elements, _ := command.Body.Elements()
+		mu.Lock()
+		flags[elements[0].Key] = append(flags[elements[0].Key], command.FlagBits)
+		mu.Unlock()
+		return bson.D{{Key: "n", Value: 1}, {Key: "ok", Value: 1.0}}
+	})
+	opts := DefaultOptions()
+	opts.MaxPoolSize = 1
+	replset := NewReplsetWithOptions(mock.addrs, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	doc := mustMarshal(t, bson.D{{Key: "x", Value: 1}})
+	command := bson.D{{Key: "insert", Value: "col"}, {Key: "writeConcern", Value: bson.D{{Key: "w", Value: 0}}}, {Key: "$db", Value: "test"}}
+	reply, err := replset.SendCommand(ctx, command, []bson.Raw{doc})
+	if err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	if reply.FlagBits&FlagMoreToCome == 0 || reply.Body.Lookup("n").Type != 0 {
+		t.Errorf("Expected a stand-in reply for the unacknowledged write, got %v", reply.Body)
+	}
+
+	// The pool holds one connection, so a reply to the write would be read
+	// as the reply to the next command
+	if _, err := replset.SendCommand(ctx, bson.D{{Key: "insert", Value: "col"}, {Key: "$db", Value: "test"}}, []bson.Raw{doc}); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := flags["insert"]; len(got) != 2 || got[0]&FlagMoreToCome == 0 || got[1]&FlagMoreToCome != 0 {
+		t.Errorf("Expected moreToCome only on the unacknowledged insert, got flags %v", got)
+	}
+}
+
 func TestReplsetSendMessageWithoutConnection(t *testing.T) {
 	replset := NewReplset([]string{"127.0.0.1:27017"})
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	payload := []byte("test payload")
-	_, err := replset.SendMessage(ctx, OpQuery, payload)
+	payload := testOpMsgPayload(t, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}})
+	_, err := replset.SendMessage(ctx, OpMsg, payload)
 	if err == nil {
 		t.Error("Expected SendMessage to fail without connection")
 	}
 }
 
 func TestReplsetMultipleNodes(t *testing.T) {
-	// Start multiple mock servers
-	servers := make([]*mockMongoServer, 3)
-	addrs := make([]string, 3)
-
-	for i := 0; i < 3; i++ {
-		server, err := newMockMongoServer()
-		if err != nil {
-			t.Fatalf("Failed to start mock server %d: %v", i, err)
-		}
-		servers[i] = server
-		addrs[i] = server.Addr()
-	}
-
-	// Clean up servers
-	defer func() {
-		for _, server := range servers {
-			server.Close()
-		}
-	}()
+	// Start a replica set of mock servers with the second member as primary
+	mock := newMockReplicaSet(t, 3)
+	mock.setPrimary(1)
 
 	// Create replset with multiple nodes
-	replset := NewReplset(addrs)
+	replset := NewReplset(mock.addrs)
 
 	// Connect
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -341,20 +730,38 @@ func TestReplsetMultipleNodes(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Connect failed: %v", err)
 	}
+	defer replset.Disconnect()
 
 	if !replset.IsConnected() {
 		t.Error("Expected replset to be connected")
 	}
 
-	// Test that we can send messages
-	payload := []byte("test payload")
-	response, err := replset.SendMessage(ctx, OpQuery, payload)
-	if err != nil {
-		t.Errorf("SendMessage failed: %v", err)
+	// Test that messages are always routed to the primary
+	for i := 0; i < 10; i++ {
+		payload := testOpMsgPayload(t, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}})
+		response, err := replset.SendMessage(ctx, OpMsg, payload)
+		if err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+
+		if response == nil || len(response.Body) == 0 {
+			t.Error("Expected non-empty response")
+		}
 	}
 
-	if len(response) == 0 {
-		t.Error("Expected non-empty response")
+	if got := len(mock.commands(1)); got != 10 {
+		t.Errorf("Expected 10 commands on the primary, got %d", got)
+	}
+	if got := len(mock.commands(0)) + len(mock.commands(2)); got != 0 {
+		t.Errorf("Expected no commands on secondaries, got %d", got)
+	}
+
+	desc := replset.Topology()
+	if desc.Kind != TopologyReplicaSetWithPrimary || desc.SetName != "rs0" {
+		t.Errorf("Unexpected topology %s with set name %q", desc.Kind, desc.SetName)
+	}
+	if primary, ok := desc.Primary(); !ok || primary.Addr != normalizeAddr(mock.addrs[1]) {
+		t.Errorf("Expected primary %s, got %+v", mock.addrs[1], primary)
 	}
 }
 
@@ -389,3 +796,113 @@ func TestMessageHeaderSerialization(t *testing.T) {
 		t.Errorf("Expected OpCode %d, got %d", header.OpCode, opCode)
 	}
 }
+
+// connectTestReplset connects a Replset to the members of mock
+func connectTestReplset(t *testing.T, mock *mockReplicaSet) *Replset {
+	t.Helper()
+
+	replset := NewReplset(mock.addrs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { replset.Disconnect() })
+	return replset
+}
+
+func TestReplsetSendCommandHonorsDeadline(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	hang := make(chan struct{})
+	defer close(hang)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		<-hang
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset := connectTestReplset(t, mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("SendCommand returned after %v", elapsed)
+	}
+
+	// The connection is discarded, but the member stays selectable
+	stats := replset.PoolStats()
+	if len(stats) != 1 || stats[0].Closed != 1 || stats[0].Cleared != 0 || stats[0].TotalConnections != 0 {
+		t.Errorf("Unexpected pool stats %+v", stats)
+	}
+	if _, ok := replset.Topology().Primary(); !ok {
+		t.Error("Expected the primary to stay known after a timeout")
+	}
+}
+
+func TestReplsetSendCommandCancelledMidRead(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	received := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		close(received)
+		<-hang
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset := connectTestReplset(t, mock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	_, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context canceled, got %v", err)
+	}
+	if stats := replset.PoolStats(); stats[0].TotalConnections != 0 {
+		t.Errorf("Expected the interrupted connection to be closed, got %+v", stats[0])
+	}
+}
+
+func TestReplsetSendCommandMaxTimeMS(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	maxTimeMS := make(chan bson.RawValue, 1)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		maxTimeMS <- command.Body.Lookup("maxTimeMS")
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset := connectTestReplset(t, mock)
+	ping := bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}
+
+	if _, err := replset.SendCommand(context.Background(), ping, nil); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	if value := <-maxTimeMS; !value.IsZero() {
+		t.Errorf("Expected no maxTimeMS without a deadline, got %v", value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := replset.SendCommand(ctx, ping, nil); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	if ms, ok := (<-maxTimeMS).AsInt64OK(); !ok || ms <= 0 || ms > 5000 {
+		t.Errorf("Expected maxTimeMS from the remaining deadline, got %d", ms)
+	}
+
+	// An explicit maxTimeMS is left alone
+	explicit := append(bson.D{{Key: "maxTimeMS", Value: int64(42)}}, ping...)
+	if _, err := replset.SendCommand(ctx, explicit, nil); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	if ms, _ := (<-maxTimeMS).AsInt64OK(); ms != 42 {
+		t.Errorf("Expected explicit maxTimeMS 42, got %d", ms)
+	}
+	if len(ping) != 2 {
+		t.Errorf("Expected the caller's command to be left unmodified, got %v", ping)
+	}
+}
@@ -0,0 +1,497 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// rttAlpha weights new samples in the exponentially weighted moving average RTT
+const rttAlpha = 0.2
+
+// errNotConnected is returned when an operation runs before Connect
+var errNotConnected = errors.New("replica set is not connected")
+
+// topology tracks the description of the replica set and owns one monitor
+// per member, starting and stopping them as membership changes
+type topology struct {
+	opts Options
+
+	mu       sync.Mutex
+	desc     TopologyDescription
+	monitors map[string]*monitor
+	changed  chan struct{}
+	closed   bool
+	done     chan struct{}
+
+	// removed is called when a member leaves the topology
+	removed func(addr string)
+}
+
+// newTopology creates a topology for the given seeds without starting monitors
+func newTopology(seeds []string, opts Options) *topology {
+	return &topology{
+		opts:     opts,
+		desc:     newTopologyDescription(seeds, opts.ReplicaSet),
+		monitors: make(map[string]*monitor),
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start launches a monitor for every known member, and the SRV poller for
+// mongodb+srv seeds
+func (t *topology) start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.syncMonitorsLocked()
+	if t.opts.srvHost != "" {
+		go t.pollSRV()
+	}
+}
+
+// close stops all monitors and wakes up waiting selections
+func (t *topology) close() {
+	t.mu.Lock()
+	monitors := t.monitors
+	t.monitors = make(map[string]*monitor)
+	t.closed = true
+	close(t.changed)
+	close(t.done)
+	t.mu.Unlock()
+
+	for _, m := range monitors {
+		m.stop()
+	}
+}
+
+// description returns a snapshot of the current topology
+func (t *topology) description() TopologyDescription {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.desc.clone()
+}
+
+// apply records the outcome of a server check and notifies waiters
+func (t *topology) apply(desc ServerDescription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	t.desc.apply(desc)
+	t.syncMonitorsLocked()
+
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// markUnknown resets a member after an application error so that it is not
+// selected until the next successful check
+func (t *topology) markUnknown(addr string, err error) {
+	t.apply(unknownServer(addr, err))
+	t.requestCheck(addr)
+}
+
+// requestCheck asks the monitor of addr to check it without waiting for the
+// next heartbeat
+func (t *topology) requestCheck(addr string) {
+	t.mu.Lock()
+	m := t.monitors[addr]
+	t.mu.Unlock()
+	if m != nil {
+		m.requestCheck()
+	}
+}
+
+// requestCheckAll asks every monitor to check its member, e.g. while
+// selection is waiting for a new primary
+func (t *topology) requestCheckAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range t.monitors {
+		m.requestCheck()
+	}
+}
+
+// syncMonitorsLocked starts monitors for new members and stops removed ones
+func (t *topology) syncMonitorsLocked() {
+	for addr := range t.desc.Servers {
+		if _, ok := t.monitors[addr]; !ok {
+			m := newMonitor(addr, t)
+			t.monitors[addr] = m
+			go m.run()
+		}
+	}
+	for addr, m := range t.monitors {
+		if _, ok := t.desc.Servers[addr]; !ok {
+			delete(t.monitors, addr)
+			go m.stop()
+			if t.removed != nil {
+				go t.removed(addr)
+			}
+		}
+	}
+}
+
+// selectServer waits until selector returns at least one member and picks one
+// of them at random. It gives up after ServerSelectionTimeout or when ctx ends.
+func (t *topology) selectServer(ctx context.Context, selector func(TopologyDescription) []ServerDescription) (ServerDescription, error) {
+	timer := time.NewTimer(t.opts.ServerSelectionTimeout)
+	defer timer.Stop()
+
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return ServerDescription{}, errNotConnected
+		}
+		candidates := selector(t.desc)
+		changed := t.changed
+		t.mu.Unlock()
+
+		if len(candidates) > 0 {
+			return candidates[rand.Intn(len(candidates))], nil
+		}
+		t.requestCheckAll()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ServerDescription{}, fmt.Errorf("server selection: %w", ctx.Err())
+		case <-timer.C:
+			return ServerDescription{}, fmt.Errorf("server selection timed out after %v: %s", t.opts.ServerSelectionTimeout, t.describeErrors())
+		}
+	}
+}
+
+// describeErrors summarizes why members are unavailable for selection errors
+func (t *topology) describeErrors() string {
+	desc := t.description()
+	msg := fmt.Sprintf("topology %s", desc.Kind)
+	for _, addr := range desc.Addrs() {
+		server := desc.Servers[addr]
+		msg += fmt.Sprintf(", %s: %s", addr, server.Kind)
+		if server.Err != nil {
+			msg += fmt.Sprintf(" (%v)", server.Err)
+		}
+	}
+	return msg
+}
+
+// selectWritable selects the primary, or the only server of a Single topology
+func selectWritable(t TopologyDescription) []ServerDescription {
+	switch t.Kind {
+	case TopologySingle:
+		for _, desc := range t.Servers {
+			if desc.DataBearing() {
+				return []ServerDescription{desc}
+			}
+		}
+	case TopologyReplicaSetWithPrimary:
+		if primary, ok := t.Primary(); ok {
+			return []ServerDescription{primary}
+		}
+	}
+	return nil
+}
+
+// monitor periodically runs hello against one member on a dedicated
+// connection. Members that report a topologyVersion stream their hello
+// replies instead: the monitor sends one hello with exhaustAllowed and the
+// member replies whenever its state changes, and at least every
+// HeartbeatInterval. The round trip time of a streaming member is then
+// measured by an rttMonitor on a second connection.
+type monitor struct {
+	addr     string
+	topology *topology
+
+	// helloOk and legacy record whether the member accepts hello and
+	// whether it is too old for OP_MSG, from the isMaster that opened the
+	// connection
+	helloOk bool
+	legacy  bool
+
+	// topologyVersion is the topologyVersion of the latest reply, and
+	// streaming whether the member streams further replies, answering the
+	// request ID responseTo
+	topologyVersion bson.Raw
+	streaming       bool
+	responseTo      int32
+
+	rtt        rttAverage
+	rttMonitor *rttMonitor
+
+	connMu   sync.Mutex
+	conn     net.Conn
+	checkNow chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newMonitor(addr string, t *topology) *monitor {
+	return &monitor{
+		addr:     addr,
+		topology: t,
+		checkNow: make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// run checks the server until the monitor is stopped
+func (m *monitor) run() {
+	defer close(m.done)
+	defer m.closeConn()
+	defer m.stopRTTMonitor()
+
+	for {
+		previous := m.topology.description().Servers[m.addr]
+		desc := m.check()
+		// A network error on a known server is retried once right away,
+		// since it is usually a connection closed by a stepdown
+		if desc.Kind == ServerUnknown && previous.Kind != ServerUnknown && desc.Err != nil {
+			desc = m.check()
+		}
+		m.topology.apply(desc)
+
+		// A streaming member sends the next reply when something changes
+		if m.streaming {
+			select {
+			case <-m.quit:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-m.quit:
+			return
+		case <-time.After(minHeartbeatInterval):
+		}
+		// An awaitable hello waits for changes on the member itself
+		if m.topologyVersion != nil {
+			continue
+		}
+
+		select {
+		case <-m.quit:
+			return
+		case <-m.checkNow:
+		case <-time.After(m.topology.opts.HeartbeatInterval - minHeartbeatInterval):
+		}
+	}
+}
+
+// requestCheck wakes up the monitor without blocking
+func (m *monitor) requestCheck() {
+	select {
+	case m.checkNow <- struct{}{}:
+	default:
+	}
+}
+
+// stop terminates the monitor and waits for it to exit
+func (m *monitor) stop() {
+	m.stopOnce.Do(func() { close(m.quit) })
+	// Closing the connection unblocks a check that is waiting on the network
+	if conn := m.currentConn(); conn != nil {
+		conn.Close()
+	}
+	<-m.done
+}
+
+func (m *monitor) currentConn() net.Conn {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	return m.conn
+}
+
+func (m *monitor) setConn(conn net.Conn) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	m.conn = conn
+}
+
+func (m *monitor) closeConn() {
+	if conn := m.currentConn(); conn != nil {
+		conn.Close()
+		m.setConn(nil)
+	}
+	// A new connection starts over with a polled hello
+	m.topologyVersion = nil
+	m.streaming = false
+}
+
+// check runs hello once and describes the server
+func (m *monitor) check() ServerDescription {
+	timeout := m.topology.opts.ConnectTimeout
+
+	conn := m.currentConn()
+	handshake := conn == nil
+	if conn == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		var err error
+		conn, err = dialMember(ctx, m.addr, m.topology.opts)
+		cancel()
+		if err != nil {
+			return unknownServer(m.addr, err)
+		}
+		m.setConn(conn)
+		select {
+		case <-m.quit:
+			m.closeConn()
+			return unknownServer(m.addr, errNotConnected)
+		default:
+		}
+	}
+
+	start := time.Now()
+	var reply *Message
+	var err error
+	awaited := m.topologyVersion != nil
+	switch {
+	case m.streaming:
+		reply, err = m.nextHello(conn, timeout)
+	case awaited:
+		reply, err = m.awaitHello(conn, timeout)
+	default:
+		reply, err = m.hello(conn, timeout, handshake)
+	}
+	if err != nil {
+		m.closeConn()
+		return unknownServer(m.addr, err)
+	}
+
+	// An awaited reply comes when the member has news, which says nothing
+	// about the round trip time; the rttMonitor measures it instead
+	if !awaited {
+		m.rtt.add(time.Since(start))
+	}
+	desc := parseHello(m.addr, reply.Body, m.rtt.value())
+	if handshake {
+		m.helloOk = reply.Body.Lookup("helloOk").Boolean()
+		m.legacy = desc.MaxWireVersion < minWireVersion
+	}
+	if m.topology.opts.ServerMonitoringMode != ServerMonitoringPoll {
+		m.topologyVersion = desc.TopologyVersion
+	}
+	m.streaming = m.topologyVersion != nil && reply.FlagBits&FlagMoreToCome != 0
+	m.responseTo = reply.Header.RequestID
+	if m.topologyVersion != nil && m.rttMonitor == nil {
+		m.rttMonitor = newRTTMonitor(m)
+		go m.rttMonitor.run()
+	}
+	return desc
+}
+
+// stopRTTMonitor stops measuring the round trip time on a second connection
+func (m *monitor) stopRTTMonitor() {
+	if m.rttMonitor != nil {
+		m.rttMonitor.stop()
+		m.rttMonitor = nil
+	}
+}
+
+// hello checks the member. The first check on a connection is the
+// handshake; later ones use hello in an OP_MSG, or isMaster for members that
+// did not report helloOk. Members too old for OP_MSG keep being checked with
+// OP_QUERY.
+func (m *monitor) hello(conn net.Conn, timeout time.Duration, handshake bool) (*Message, error) {
+	switch {
+	case handshake:
+		return m.handshake(conn, timeout)
+	case m.legacy:
+		return m.runLegacyCommand(conn, timeout, bson.D{{Key: "isMaster", Value: 1}})
+	case m.helloOk:
+		return m.runCommand(conn, timeout, 0, bson.D{{Key: "hello", Value: 1}, {Key: "$db", Value: "admin"}})
+	}
+	return m.runCommand(conn, timeout, 0, bson.D{{Key: "isMaster", Value: 1}, {Key: "$db", Value: "admin"}})
+}
+
+// handshake sends the command built by helloCommand with the client
+// metadata: hello in an OP_MSG when a server API is declared, the legacy
+// isMaster in an OP_QUERY otherwise
+func (m *monitor) handshake(conn net.Conn, timeout time.Duration) (*Message, error) {
+	command := helloCommand(m.topology.opts)
+	if m.topology.opts.ServerAPI != nil {
+		return m.runCommand(conn, timeout, 0, append(command, bson.E{Key: "$db", Value: "admin"}))
+	}
+	return m.runLegacyCommand(conn, timeout, command)
+}
+
+// awaitHello sends a hello that the member answers once its topologyVersion
+// differs from the latest one or after HeartbeatInterval, allowing it to
+// stream the following replies
+func (m *monitor) awaitHello(conn net.Conn, timeout time.Duration) (*Message, error) {
+	heartbeat := m.topology.opts.HeartbeatInterval
+	command := bson.D{
+		{Key: "hello", Value: 1},
+		{Key: "topologyVersion", Value: m.topologyVersion},
+		{Key: "maxAwaitTimeMS", Value: heartbeat.Milliseconds()},
+		{Key: "$db", Value: "admin"},
+	}
+	return m.runCommand(conn, timeout+heartbeat, FlagExhaustAllowed, command)
+}
+
+// nextHello reads the next hello reply a streaming member sends
+func (m *monitor) nextHello(conn net.Conn, timeout time.Duration) (*Message, error) {
+	conn.SetDeadline(time.Now().Add(timeout + m.topology.opts.HeartbeatInterval))
+	defer conn.SetDeadline(time.Time{})
+
+	header, payload, err := newFramer(conn).readMessage()
+	if err != nil {
+		return nil, err
+	}
+	return decodeReply(header, payload, m.responseTo, OpMsg)
+}
+
+func (m *monitor) runCommand(conn net.Conn, timeout time.Duration, flags uint32, command bson.D) (*Message, error) {
+	body, err := bson.Marshal(withServerAPI(command, m.topology.opts.ServerAPI))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	f := newFramer(conn)
+	requestID := nextRequestID()
+	if err := f.writeMessage(OpMsg, requestID, 0, encodeOpMsg(flags, body, nil)); err != nil {
+		return nil, err
+	}
+	header, payload, err := f.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	return decodeReply(header, payload, requestID, OpMsg)
+}
+
+// runLegacyCommand runs a command as an OP_QUERY on admin.$cmd
+func (m *monitor) runLegacyCommand(conn net.Conn, timeout time.Duration, command bson.D) (*Message, error) {
+	query, err := bson.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	f := newFramer(conn)
+	requestID := nextRequestID()
+	if err := f.writeMessage(OpQuery, requestID, 0, legacyCommand("admin", query)); err != nil {
+		return nil, err
+	}
+	header, payload, err := f.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	return decodeReply(header, payload, requestID, OpQuery)
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"compress/zlib"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Default settings used when an option is left unset
+const (
+	DefaultHeartbeatInterval      = 10 * time.Second
+	DefaultServerSelectionTimeout = 30 * time.Second
+	DefaultConnectTimeout         = 30 * time.Second
+	DefaultMaxPoolSize            = 100
+	DefaultSRVServiceName         = "mongodb"
+
+	// minHeartbeatInterval limits how often a server is checked when
+	// immediate checks are requested, e.g. after a network error
+	minHeartbeatInterval = 500 * time.Millisecond
+)
+
+// ServerMonitoringMode selects how monitors learn about changes of a member
+type ServerMonitoringMode string
+
+// Server monitoring modes. Auto and stream stream hello replies from members
+// that report a topologyVersion and poll older ones; poll always polls.
+const (
+	ServerMonitoringAuto   ServerMonitoringMode = "auto"
+	ServerMonitoringStream ServerMonitoringMode = "stream"
+	ServerMonitoringPoll   ServerMonitoringMode = "poll"
+)
+
+// parseServerMonitoringMode parses a mode case-insensitively
+func parseServerMonitoringMode(s string) (ServerMonitoringMode, error) {
+	for _, mode := range []ServerMonitoringMode{ServerMonitoringAuto, ServerMonitoringStream, ServerMonitoringPoll} {
+		if strings.EqualFold(s, string(mode)) {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("unknown server monitoring mode %q", s)
+}
+
+// Options configures a Replset
+type Options struct {
+	// ReplicaSet is the expected replica set name. Members reporting a
+	// different setName are removed from the topology.
+	ReplicaSet string
+
+	// AppName is sent to the members in the client metadata of every new
+	// connection and shows up in their logs. At most 128 bytes.
+	AppName string
+
+	// HeartbeatInterval is the time between hello checks of each member.
+	// A streaming member pushes a hello reply at least this often.
+	HeartbeatInterval time.Duration
+
+	// ServerMonitoringMode selects between streaming and polling hello
+	// checks. Empty streams from members that support it.
+	ServerMonitoringMode ServerMonitoringMode
+
+	// ServerSelectionTimeout bounds how long an operation waits for a
+	// suitable member, e.g. while a new primary is being elected
+	ServerSelectionTimeout time.Duration
+
+	// ConnectTimeout bounds dialing a member and the monitoring hello
+	ConnectTimeout time.Duration
+
+	// MaxPoolSize limits the connections per member, including those in use
+	MaxPoolSize int
+
+	// MinPoolSize is the number of connections per member kept open in the
+	// background
+	MinPoolSize int
+
+	// MaxIdleTime closes connections that stayed idle for longer. Zero
+	// keeps idle connections open indefinitely.
+	MaxIdleTime time.Duration
+
+	// Credential authenticates every pooled connection. Nil disables auth;
+	// monitoring connections are never authenticated.
+	Credential *Credential
+
+	// ReadPreference selects the members that serve reads. Empty reads
+	// from the primary. WithReadPreference overrides it per operation.
+	ReadPreference ReadPreferenceMode
+
+	// ReadPreferenceTags and MaxStaleness narrow the members eligible
+	// under ReadPreference, see the ReadPreference type
+	ReadPreferenceTags []TagSet
+	MaxStaleness       time.Duration
+
+	// LocalThreshold is the latency window for reads: members whose RTT
+	// exceeds the fastest eligible member's by more are not selected
+	LocalThreshold time.Duration
+
+	// ReadConcern is sent with find, aggregate, count and distinct, and
+	// WriteConcern with insert, update, delete and findAndModify, unless the
+	// command sets its own or runs in a transaction, whose concerns apply
+	// instead. Nil leaves the server defaults in effect.
+	ReadConcern  *ReadConcern
+	WriteConcern *WriteConcern
+
+	// TLS enables TLS for all connections, including monitoring ones
+	TLS *TLSOptions
+
+	// WaitQueueTimeout bounds how long a checkout waits for a connection
+	// when the pool is full. Zero waits until the context ends.
+	WaitQueueTimeout time.Duration
+
+	// Resolver looks up the DNS records of mongodb+srv connection strings.
+	// Nil uses the system resolver.
+	Resolver Resolver
+
+	// SRVRescanInterval is how often the SRV records of a mongodb+srv
+	// connection string are resolved again to discover new hosts
+	SRVRescanInterval time.Duration
+
+	// RetryWrites retries eligible writes once after a network error or a
+	// failover. Nil enables it; set it to a false value to disable.
+	RetryWrites *bool
+
+	// RetryReads retries reads once on a newly selected member after a
+	// network error or a failover. Nil enables it.
+	RetryReads *bool
+
+	// Compressors are offered to the members in order of preference when a
+	// connection is opened; messages are compressed with the first one the
+	// member supports. Empty disables compression.
+	Compressors []string
+
+	// ZlibCompressionLevel is the zlib level from -1 (the zlib default) to
+	// 9. Nil uses the zlib default.
+	ZlibCompressionLevel *int
+
+	// ServerAPI declares the stable API version every command is run with.
+	// Connections are then opened with hello in an OP_MSG rather than the
+	// legacy isMaster. Nil declares none.
+	ServerAPI *ServerAPI
+
+	// srvHost and srvServiceName are set by a mongodb+srv connection string
+	srvHost        string
+	srvServiceName string
+
+	// tlsConfig is loaded from TLS when connecting
+	tlsConfig *tls.Config
+}
+
+// DefaultOptions returns the options used by NewReplset
+func DefaultOptions() Options {
+	return Options{
+		HeartbeatInterval:      DefaultHeartbeatInterval,
+		ServerSelectionTimeout: DefaultServerSelectionTimeout,
+		ConnectTimeout:         DefaultConnectTimeout,
+		MaxPoolSize:            DefaultMaxPoolSize,
+		SRVRescanInterval:      DefaultSRVRescanInterval,
+		LocalThreshold:         DefaultLocalThreshold,
+	}
+}
+
+// withDefaults fills in zero values with the defaults
+func (o Options) withDefaults() Options {
+	d := DefaultOptions()
+	if o.HeartbeatInterval <= 0 {
+		o.HeartbeatInterval = d.HeartbeatInterval
+	}
+	if o.HeartbeatInterval < minHeartbeatInterval {
+		o.HeartbeatInterval = minHeartbeatInterval
+	}
+	if o.ServerMonitoringMode == "" {
+		o.ServerMonitoringMode = ServerMonitoringAuto
+	}
+	if o.ServerSelectionTimeout <= 0 {
+		o.ServerSelectionTimeout = d.ServerSelectionTimeout
+	}
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = d.ConnectTimeout
+	}
+	if o.MaxPoolSize <= 0 {
+		o.MaxPoolSize = d.MaxPoolSize
+	}
+	if o.MinPoolSize > o.MaxPoolSize {
+		o.MinPoolSize = o.MaxPoolSize
+	}
+	if o.Resolver == nil {
+		o.Resolver = net.DefaultResolver
+	}
+	if o.SRVRescanInterval <= 0 {
+		o.SRVRescanInterval = d.SRVRescanInterval
+	}
+	if o.LocalThreshold <= 0 {
+		o.LocalThreshold = d.LocalThreshold
+	}
+	if o.RetryWrites == nil {
+		retryWrites := true
+		o.RetryWrites = &retryWrites
+	}
+	if o.RetryReads == nil {
+		retryReads := true
+		o.RetryReads = &retryReads
+	}
+	if o.ZlibCompressionLevel == nil {
+		level := zlib.DefaultCompression
+		o.ZlibCompressionLevel = &level
+	}
+	if o.srvServiceName == "" {
+		o.srvServiceName = DefaultSRVServiceName
+	}
+	return o
+}
@@ -0,0 +1,465 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// errPoolClosed is returned when checking out from a pool after Disconnect
+var errPoolClosed = errors.New("connection pool closed")
+
+// poolMaintenanceInterval is how often idle connections are pruned and the
+// pool is refilled to MinPoolSize
+const poolMaintenanceInterval = time.Second
+
+// connection is a socket to one member that is owned by a pool
+type connection struct {
+	id         int64
+	addr       string
+	conn       net.Conn
+	framer     *framer
+	generation uint64
+	idleStart  time.Time
+	closed     bool
+
+	// desc describes the member as reported in the handshake of this
+	// connection, including its wire version and size limits
+	desc ServerDescription
+
+	// serverAPI is declared on every command run on the connection
+	serverAPI *ServerAPI
+}
+
+// close closes the socket; the pool discards the connection on check in
+func (c *connection) close() error {
+	c.closed = true
+	return c.conn.Close()
+}
+
+// runCommand runs a command on the connection outside of server selection,
+// e.g. during authentication
+func (c *connection) runCommand(ctx context.Context, command bson.D) (*Message, error) {
+	body, err := bson.Marshal(withServerAPI(command, c.serverAPI))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+	requestID := nextRequestID()
+	header, payload, err := roundTrip(ctx, c, OpMsg, requestID, encodeOpMsg(0, body, nil))
+	if err != nil {
+		return nil, err
+	}
+	reply, err := decodeReply(header, payload, requestID, OpMsg)
+	if err != nil {
+		return nil, err
+	}
+	return reply, replyError(reply.Body)
+}
+
+// runLegacyCommand runs a command as an OP_QUERY on db.$cmd, for the
+// handshake with servers that predate hello
+func (c *connection) runLegacyCommand(ctx context.Context, db string, command bson.D) (*Message, error) {
+	query, err := bson.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+	requestID := nextRequestID()
+	header, payload, err := roundTrip(ctx, c, OpQuery, requestID, legacyCommand(db, query))
+	if err != nil {
+		return nil, err
+	}
+	reply, err := decodeReply(header, payload, requestID, OpQuery)
+	if err != nil {
+		return nil, err
+	}
+	return reply, replyError(reply.Body)
+}
+
+// PoolStats is a snapshot of the connection pool for one member
+type PoolStats struct {
+	Addr             string
+	TotalConnections int
+	IdleConnections  int
+	InUseConnections int
+	WaitQueueLength  int
+
+	Created        uint64
+	Closed         uint64
+	CheckedOut     uint64
+	CheckOutFailed uint64
+	Cleared        uint64
+}
+
+// poolWaiter is a checkout waiting for a connection or for capacity to dial one
+type poolWaiter struct {
+	ready chan *connection
+}
+
+// handshakeFunc prepares a freshly dialed connection, e.g. by authenticating it
+type handshakeFunc func(ctx context.Context, c *connection) error
+
+// pool keeps between MinPoolSize and MaxPoolSize connections to one member.
+// Checkouts beyond MaxPoolSize wait in FIFO order until a connection is
+// checked in, the context ends or WaitQueueTimeout expires.
+type pool struct {
+	addr      string
+	opts      Options
+	handshake handshakeFunc
+
+	mu         sync.Mutex
+	idle       []*connection
+	total      int
+	inUse      int
+	waiters    []*poolWaiter
+	generation uint64
+	closed     bool
+	nextID     int64
+
+	created        atomic.Uint64
+	closedCount    atomic.Uint64
+	checkedOut     atomic.Uint64
+	checkOutFailed atomic.Uint64
+	cleared        atomic.Uint64
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newPool creates a pool and starts its background maintenance. Every new
+// connection runs handshake, if set, before it is handed out.
+func newPool(addr string, opts Options, handshake handshakeFunc) *pool {
+	p := &pool{
+		addr:      addr,
+		opts:      opts,
+		handshake: handshake,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go p.maintain()
+	return p
+}
+
+// dial opens a new connection to the member
+func (p *pool) dial(ctx context.Context, generation uint64) (*connection, error) {
+	conn, err := dialMember(ctx, p.addr, p.opts)
+	if err != nil {
+		return nil, &networkError{addr: p.addr, err: err}
+	}
+	p.created.Add(1)
+
+	p.mu.Lock()
+	p.nextID++
+	id := p.nextID
+	p.mu.Unlock()
+
+	c := &connection{id: id, addr: p.addr, conn: conn, framer: newFramer(conn), generation: generation, serverAPI: p.opts.ServerAPI}
+	if p.handshake != nil {
+		if err := p.handshake(ctx, c); err != nil {
+			c.close()
+			p.closedCount.Add(1)
+			var se serverError
+			if !errors.As(err, &se) {
+				err = &networkError{addr: p.addr, err: err}
+			}
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// checkOut returns an idle connection or dials a new one, waiting for a
+// connection to be checked in when the pool is at MaxPoolSize
+func (p *pool) checkOut(ctx context.Context) (*connection, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.checkOutFailed.Add(1)
+		return nil, errPoolClosed
+	}
+
+	// Reuse the most recently used idle connection
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.perishedLocked(c) {
+			p.discardLocked(c)
+			continue
+		}
+		p.inUse++
+		p.mu.Unlock()
+		p.checkedOut.Add(1)
+		return c, nil
+	}
+
+	if p.total < p.opts.MaxPoolSize {
+		p.total++
+		p.inUse++
+		generation := p.generation
+		p.mu.Unlock()
+		return p.dialCheckedOut(ctx, generation)
+	}
+
+	// Wait for a connection to be checked in
+	w := &poolWaiter{ready: make(chan *connection, 1)}
+	p.waiters = append(p.waiters, w)
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if p.opts.WaitQueueTimeout > 0 {
+		timer := time.NewTimer(p.opts.WaitQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case c := <-w.ready:
+		return p.granted(ctx, c)
+	case <-ctx.Done():
+		p.abandon(w)
+		p.checkOutFailed.Add(1)
+		return nil, fmt.Errorf("waiting for connection to %s: %w", p.addr, ctx.Err())
+	case <-timeout:
+		p.abandon(w)
+		p.checkOutFailed.Add(1)
+		return nil, fmt.Errorf("timed out after %v waiting for connection to %s", p.opts.WaitQueueTimeout, p.addr)
+	}
+}
+
+// granted completes a checkout that was woken up. A nil connection grants
+// capacity to dial a new one.
+func (p *pool) granted(ctx context.Context, c *connection) (*connection, error) {
+	if c == nil {
+		p.mu.Lock()
+		generation := p.generation
+		closed := p.closed
+		p.mu.Unlock()
+		if closed {
+			p.release()
+			p.checkOutFailed.Add(1)
+			return nil, errPoolClosed
+		}
+		return p.dialCheckedOut(ctx, generation)
+	}
+	p.checkedOut.Add(1)
+	return c, nil
+}
+
+// dialCheckedOut dials a connection whose capacity was already reserved
+func (p *pool) dialCheckedOut(ctx context.Context, generation uint64) (*connection, error) {
+	c, err := p.dial(ctx, generation)
+	if err != nil {
+		p.release()
+		p.checkOutFailed.Add(1)
+		return nil, err
+	}
+	p.checkedOut.Add(1)
+	return c, nil
+}
+
+// release gives back reserved capacity after a failed dial
+func (p *pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total--
+	p.inUse--
+	p.wakeWaiterLocked()
+}
+
+// abandon removes a waiter whose context ended. If a connection was handed
+// to it in the meantime, the connection is passed on.
+func (p *pool) abandon(w *poolWaiter) {
+	p.mu.Lock()
+	for i, other := range p.waiters {
+		if other == w {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.mu.Unlock()
+			return
+		}
+	}
+	p.mu.Unlock()
+
+	// The waiter was already granted a connection or capacity
+	if c := <-w.ready; c != nil {
+		p.checkIn(c)
+	} else {
+		p.release()
+	}
+}
+
+// checkIn returns a connection to the pool. Closed connections and
+// connections from before the last clear are discarded.
+func (p *pool) checkIn(c *connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inUse--
+	if p.closed || c.closed || c.generation != p.generation {
+		p.discardLocked(c)
+		p.wakeWaiterLocked()
+		return
+	}
+
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.inUse++
+		w.ready <- c
+		return
+	}
+
+	c.idleStart = time.Now()
+	p.idle = append(p.idle, c)
+}
+
+// wakeWaiterLocked grants capacity to the first waiter if the pool has room
+func (p *pool) wakeWaiterLocked() {
+	if len(p.waiters) == 0 || p.total >= p.opts.MaxPoolSize {
+		return
+	}
+	w := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	p.total++
+	p.inUse++
+	w.ready <- nil
+}
+
+// perishedLocked reports whether an idle connection must not be reused
+func (p *pool) perishedLocked(c *connection) bool {
+	if c.generation != p.generation {
+		return true
+	}
+	return p.opts.MaxIdleTime > 0 && time.Since(c.idleStart) > p.opts.MaxIdleTime
+}
+
+// discardLocked closes a connection that is leaving the pool
+func (p *pool) discardLocked(c *connection) {
+	if !c.closed {
+		c.close()
+	}
+	p.total--
+	p.closedCount.Add(1)
+}
+
+// clear invalidates all current connections after a network error or a
+// state change. Idle connections are closed now, in-use ones on check in.
+func (p *pool) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.generation++
+	p.cleared.Add(1)
+	for _, c := range p.idle {
+		p.discardLocked(c)
+	}
+	p.idle = nil
+	p.wakeWaiterLocked()
+}
+
+// close shuts the pool down, closing idle connections and failing waiters
+func (p *pool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	for _, c := range p.idle {
+		p.discardLocked(c)
+	}
+	p.idle = nil
+	waiters := p.waiters
+	p.waiters = nil
+	// Waiters are granted capacity and then observe that the pool is closed
+	p.total += len(waiters)
+	p.inUse += len(waiters)
+	p.mu.Unlock()
+
+	for _, w := range waiters {
+		w.ready <- nil
+	}
+	close(p.quit)
+	<-p.done
+}
+
+// stats returns a snapshot of the pool
+func (p *pool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		Addr:             p.addr,
+		TotalConnections: p.total,
+		IdleConnections:  len(p.idle),
+		InUseConnections: p.inUse,
+		WaitQueueLength:  len(p.waiters),
+		Created:          p.created.Load(),
+		Closed:           p.closedCount.Load(),
+		CheckedOut:       p.checkedOut.Load(),
+		CheckOutFailed:   p.checkOutFailed.Load(),
+		Cleared:          p.cleared.Load(),
+	}
+}
+
+// maintain prunes idle connections and keeps at least MinPoolSize open
+func (p *pool) maintain() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(poolMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		p.prune()
+		p.fill()
+
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune closes idle connections that exceeded MaxIdleTime or are stale
+func (p *pool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	kept := p.idle[:0]
+	for _, c := range p.idle {
+		if p.perishedLocked(c) {
+			p.discardLocked(c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	p.idle = kept
+}
+
+// fill dials connections until the pool holds MinPoolSize
+func (p *pool) fill() {
+	for {
+		p.mu.Lock()
+		if p.closed || p.total >= p.opts.MinPoolSize || p.total >= p.opts.MaxPoolSize {
+			p.mu.Unlock()
+			return
+		}
+		p.total++
+		p.inUse++
+		generation := p.generation
+		p.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.opts.ConnectTimeout)
+		c, err := p.dial(ctx, generation)
+		cancel()
+		if err != nil {
+			p.release()
+			return
+		}
+		p.checkIn(c)
+	}
+}
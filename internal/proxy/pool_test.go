@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+func newTestPool(t *testing.T, opts Options) (*pool, *mockMongoServer) {
+	t.Helper()
+
+	server, err := newMockMongoServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	p := newPool(server.Addr(), opts.withDefaults(), nil)
+	t.Cleanup(p.close)
+	return p, server
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	p, _ := newTestPool(t, Options{MaxPoolSize: 2})
+	ctx := context.Background()
+
+	c1, err := p.checkOut(ctx)
+	if err != nil {
+		t.Fatalf("checkOut failed: %v", err)
+	}
+	p.checkIn(c1)
+
+	c2, err := p.checkOut(ctx)
+	if err != nil {
+		t.Fatalf("checkOut failed: %v", err)
+	}
+	if c1 != c2 {
+		t.Error("Expected idle connection to be reused")
+	}
+	p.checkIn(c2)
+
+	stats := p.stats()
+	if stats.Created != 1 || stats.CheckedOut != 2 || stats.IdleConnections != 1 || stats.InUseConnections != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestPoolWaitQueueHonorsContext(t *testing.T) {
+	p, _ := newTestPool(t, Options{MaxPoolSize: 1})
+
+	c, err := p.checkOut(context.Background())
+	if err != nil {
+		t.Fatalf("checkOut failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.checkOut(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded while pool is full, got %v", err)
+	}
+	if stats := p.stats(); stats.WaitQueueLength != 0 || stats.CheckOutFailed != 1 {
+		t.Errorf("Expected the abandoned waiter to leave the queue, got %+v", stats)
+	}
+
+	// A waiter receives the connection as soon as it is checked in
+	got := make(chan *connection)
+	go func() {
+		waiting, err := p.checkOut(context.Background())
+		if err != nil {
+			t.Errorf("checkOut failed: %v", err)
+		}
+		got <- waiting
+	}()
+	for p.stats().WaitQueueLength == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.checkIn(c)
+
+	select {
+	case waiting := <-got:
+		if waiting != c {
+			t.Error("Expected the checked in connection to be handed to the waiter")
+		}
+		p.checkIn(waiting)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiter was not woken up")
+	}
+}
+
+func TestPoolWaitQueueTimeout(t *testing.T) {
+	p, _ := newTestPool(t, Options{MaxPoolSize: 1, WaitQueueTimeout: 20 * time.Millisecond})
+
+	c, err := p.checkOut(context.Background())
+	if err != nil {
+		t.Fatalf("checkOut failed: %v", err)
+	}
+	defer p.checkIn(c)
+
+	if _, err := p.checkOut(context.Background()); err == nil {
+		t.Fatal("Expected checkOut to time out")
+	}
+}
+
+func TestPoolClearDiscardsConnections(t *testing.T) {
+	p, _ := newTestPool(t, Options{})
+	ctx := context.Background()
+
+	idle, _ := p.checkOut(ctx)
+	inUse, _ := p.checkOut(ctx)
+	p.checkIn(idle)
+
+	p.clear()
+	if stats := p.stats(); stats.IdleConnections != 0 || stats.TotalConnections != 1 {
+		t.Errorf("Expected idle connections to be closed, got %+v", stats)
+	}
+
+	p.checkIn(inUse)
+	if stats := p.stats(); stats.TotalConnections != 0 || stats.Cleared != 1 {
+		t.Errorf("Expected stale connection to be discarded on check in, got %+v", stats)
+	}
+}
+
+func TestPoolMaxIdleTimeAndMinPoolSize(t *testing.T) {
+	p, _ := newTestPool(t, Options{MaxIdleTime: 10 * time.Millisecond, MinPoolSize: 2})
+
+	// The maintenance loop fills the pool in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for p.stats().IdleConnections < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pool was not filled to MinPoolSize: %+v", p.stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	c, err := p.checkOut(context.Background())
+	if err != nil {
+		t.Fatalf("checkOut failed: %v", err)
+	}
+	defer p.checkIn(c)
+	if stats := p.stats(); stats.Closed < 2 {
+		t.Errorf("Expected idle connections past MaxIdleTime to be closed, got %+v", stats)
+	}
+}
+
+func TestPoolClosedFailsWaiters(t *testing.T) {
+	server, err := newMockMongoServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+	p := newPool(server.Addr(), Options{MaxPoolSize: 1}.withDefaults(), nil)
+
+	c, err := p.checkOut(context.Background())
+	if err != nil {
+		t.Fatalf("checkOut failed: %v", err)
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := p.checkOut(context.Background())
+		errs <- err
+	}()
+	for p.stats().WaitQueueLength == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p.close()
+	if err := <-errs; !errors.Is(err, errPoolClosed) {
+		t.Errorf("Expected errPoolClosed, got %v", err)
+	}
+	p.checkIn(c)
+	if stats := p.stats(); stats.TotalConnections != 0 {
+		t.Errorf("Expected no connections after close, got %+v", stats)
+	}
+}
+
+func TestReplsetConcurrentCommands(t *testing.T) {
+	server, err := newMockMongoServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	opts := DefaultOptions()
+	opts.MaxPoolSize = 4
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				reply, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil)
+				if err != nil {
+					t.Errorf("SendCommand failed: %v", err)
+					return
+				}
+				if ok, _ := reply.Body.Lookup("ok").AsFloat64OK(); ok != 1 {
+					t.Errorf("Unexpected reply %v", reply.Body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := replset.PoolStats()
+	if len(stats) != 1 || stats[0].TotalConnections > 4 || stats[0].InUseConnections != 0 {
+		t.Errorf("Unexpected pool stats %+v", stats)
+	}
+}
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// ReadPreferenceMode selects which members may serve reads
+type ReadPreferenceMode string
+
+// Read preference modes
+const (
+	ReadPrimary            ReadPreferenceMode = "primary"
+	ReadPrimaryPreferred   ReadPreferenceMode = "primaryPreferred"
+	ReadSecondary          ReadPreferenceMode = "secondary"
+	ReadSecondaryPreferred ReadPreferenceMode = "secondaryPreferred"
+	ReadNearest            ReadPreferenceMode = "nearest"
+)
+
+// parseReadPreferenceMode parses a mode case-insensitively
+func parseReadPreferenceMode(s string) (ReadPreferenceMode, error) {
+	for _, mode := range []ReadPreferenceMode{ReadPrimary, ReadPrimaryPreferred, ReadSecondary, ReadSecondaryPreferred, ReadNearest} {
+		if strings.EqualFold(s, string(mode)) {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("unknown read preference mode %q", s)
+}
+
+// DefaultLocalThreshold is the width of the latency window above the
+// fastest eligible member
+const DefaultLocalThreshold = 15 * time.Millisecond
+
+// minMaxStaleness is the smallest MaxStaleness a server accepts, since
+// staleness can only be estimated to within a heartbeat
+const minMaxStaleness = 90 * time.Second
+
+// staleness estimates need this much more than one heartbeat of slack
+const idleWritePeriod = 10 * time.Second
+
+// TagSet matches members whose tags include every pair of the set. An
+// empty set matches any member.
+type TagSet map[string]string
+
+// ReadPreference describes which members may serve a read
+type ReadPreference struct {
+	Mode ReadPreferenceMode
+
+	// TagSets are tried in order; the first set that matches an eligible
+	// member selects the candidates. In nearest mode they apply to the
+	// primary like any member; primary and primaryPreferred read from the
+	// primary whatever its tags.
+	TagSets []TagSet
+
+	// MaxStaleness excludes secondaries estimated to lag the primary by
+	// more. Zero means no maximum.
+	MaxStaleness time.Duration
+}
+
+// readPreferenceKey is the context key for per operation read preferences
+type readPreferenceKey struct{}
+
+// WithReadPreference returns a context whose reads use rp instead of the
+// read preference of the replset options
+func WithReadPreference(ctx context.Context, rp ReadPreference) context.Context {
+	return context.WithValue(ctx, readPreferenceKey{}, rp)
+}
+
+// readPreference returns the read preference of ctx, falling back to the
+// options
+func (r *Replset) readPreference(ctx context.Context) ReadPreference {
+	if rp, ok := ctx.Value(readPreferenceKey{}).(ReadPreference); ok {
+		return rp
+	}
+	return ReadPreference{Mode: r.opts.ReadPreference, TagSets: r.opts.ReadPreferenceTags, MaxStaleness: r.opts.MaxStaleness}
+}
+
+// mode returns the mode, treating empty as primary
+func (rp ReadPreference) mode() ReadPreferenceMode {
+	if rp.Mode == "" {
+		return ReadPrimary
+	}
+	return rp.Mode
+}
+
+// validate checks that the preference is consistent and that MaxStaleness
+// is large enough to be measured with the given heartbeat interval
+func (rp ReadPreference) validate(heartbeat time.Duration) error {
+	if _, err := parseReadPreferenceMode(string(rp.mode())); err != nil {
+		return err
+	}
+	if rp.mode() == ReadPrimary && (len(rp.TagSets) > 0 || rp.MaxStaleness > 0) {
+		return fmt.Errorf("read preference primary cannot be combined with tag sets or maxStaleness")
+	}
+	if rp.MaxStaleness < 0 {
+		return fmt.Errorf("invalid maxStaleness %v", rp.MaxStaleness)
+	}
+	if rp.MaxStaleness > 0 {
+		if min := max(minMaxStaleness, heartbeat+idleWritePeriod); rp.MaxStaleness < min {
+			return fmt.Errorf("maxStaleness %v is less than the minimum of %v", rp.MaxStaleness, min)
+		}
+	}
+	return nil
+}
+
+// document returns the $readPreference document sent to the server
+func (rp ReadPreference) document() bson.D {
+	doc := bson.D{{Key: "mode", Value: string(rp.mode())}}
+	if len(rp.TagSets) > 0 {
+		tags := make(bson.A, len(rp.TagSets))
+		for i, set := range rp.TagSets {
+			tags[i] = set.document()
+		}
+		doc = append(doc, bson.E{Key: "tags", Value: tags})
+	}
+	if rp.MaxStaleness > 0 {
+		doc = append(doc, bson.E{Key: "maxStalenessSeconds", Value: int64(rp.MaxStaleness / time.Second)})
+	}
+	return doc
+}
+
+// document returns the tag set with its keys in sorted order
+func (ts TagSet) document() bson.D {
+	keys := make([]string, 0, len(ts))
+	for key := range ts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	doc := make(bson.D, len(keys))
+	for i, key := range keys {
+		doc[i] = bson.E{Key: key, Value: ts[key]}
+	}
+	return doc
+}
+
+// matches reports whether tags contain every pair of the set
+func (ts TagSet) matches(tags map[string]string) bool {
+	for key, value := range ts {
+		if v, ok := tags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTagSet parses a readPreferenceTags value such as "dc:ny,rack:1"
+func parseTagSet(s string) (TagSet, error) {
+	set := TagSet{}
+	if s == "" {
+		return set, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid tag %q", pair)
+		}
+		set[key] = value
+	}
+	return set, nil
+}
+
+// selectReadable returns a selector for members that match rp. Suitable
+// members are filtered by staleness and tag sets, then narrowed to those
+// within threshold of the lowest RTT.
+func selectReadable(rp ReadPreference, heartbeat, threshold time.Duration) func(TopologyDescription) []ServerDescription {
+	return func(t TopologyDescription) []ServerDescription {
+		switch t.Kind {
+		case TopologySingle:
+			// A direct connection serves every read preference
+			return selectWritable(t)
+		case TopologyReplicaSetWithPrimary, TopologyReplicaSetNoPrimary:
+		default:
+			return nil
+		}
+
+		primary, hasPrimary := t.Primary()
+		switch rp.mode() {
+		case ReadPrimary:
+			if hasPrimary {
+				return []ServerDescription{primary}
+			}
+			return nil
+		case ReadPrimaryPreferred:
+			if hasPrimary {
+				return []ServerDescription{primary}
+			}
+			return selectSecondaries(t, rp, heartbeat, threshold, false)
+		case ReadSecondaryPreferred:
+			if candidates := selectSecondaries(t, rp, heartbeat, threshold, false); len(candidates) > 0 {
+				return candidates
+			}
+			if hasPrimary {
+				return []ServerDescription{primary}
+			}
+			return nil
+		case ReadSecondary:
+			return selectSecondaries(t, rp, heartbeat, threshold, false)
+		case ReadNearest:
+			return selectSecondaries(t, rp, heartbeat, threshold, true)
+		}
+		return nil
+	}
+}
+
+// selectSecondaries applies the staleness, tag set and latency filters to
+// the secondaries, and to the primary as well when withPrimary is set
+func selectSecondaries(t TopologyDescription, rp ReadPreference, heartbeat, threshold time.Duration, withPrimary bool) []ServerDescription {
+	var candidates []ServerDescription
+	for _, desc := range t.Servers {
+		if desc.Kind == ServerRSSecondary || withPrimary && desc.Kind == ServerRSPrimary {
+			candidates = append(candidates, desc)
+		}
+	}
+	if rp.MaxStaleness > 0 {
+		candidates = withinStaleness(t, candidates, rp.MaxStaleness, heartbeat)
+	}
+	if len(rp.TagSets) > 0 {
+		candidates = matchTagSets(candidates, rp.TagSets)
+	}
+	return inLatencyWindow(candidates, threshold)
+}
+
+// withinStaleness keeps the candidates whose estimated replication lag is
+// at most maxStaleness. The primary is never stale.
+func withinStaleness(t TopologyDescription, candidates []ServerDescription, maxStaleness, heartbeat time.Duration) []ServerDescription {
+	primary, hasPrimary := t.Primary()
+	var freshest time.Time
+	if !hasPrimary {
+		for _, desc := range t.Servers {
+			if desc.Kind == ServerRSSecondary && desc.LastWriteDate.After(freshest) {
+				freshest = desc.LastWriteDate
+			}
+		}
+	}
+
+	var fresh []ServerDescription
+	for _, desc := range candidates {
+		if desc.Kind == ServerRSPrimary {
+			fresh = append(fresh, desc)
+			continue
+		}
+		var staleness time.Duration
+		if hasPrimary {
+			staleness = desc.LastUpdateTime.Sub(desc.LastWriteDate) - primary.LastUpdateTime.Sub(primary.LastWriteDate) + heartbeat
+		} else {
+			staleness = freshest.Sub(desc.LastWriteDate) + heartbeat
+		}
+		if staleness <= maxStaleness {
+			fresh = append(fresh, desc)
+		}
+	}
+	return fresh
+}
+
+// matchTagSets returns the candidates matching the first tag set that
+// matches any of them
+func matchTagSets(candidates []ServerDescription, tagSets []TagSet) []ServerDescription {
+	for _, set := range tagSets {
+		var matched []ServerDescription
+		for _, desc := range candidates {
+			if set.matches(desc.Tags) {
+				matched = append(matched, desc)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+	return nil
+}
+
+// inLatencyWindow keeps the candidates whose RTT is within threshold of the
+// fastest one
+func inLatencyWindow(candidates []ServerDescription, threshold time.Duration) []ServerDescription {
+	if len(candidates) == 0 {
+		return nil
+	}
+	fastest := candidates[0].RTT
+	for _, desc := range candidates[1:] {
+		fastest = min(fastest, desc.RTT)
+	}
+	var window []ServerDescription
+	for _, desc := range candidates {
+		if desc.RTT <= fastest+threshold {
+			window = append(window, desc)
+		}
+	}
+	return window
+}
+
+// withReadPreference adds $readPreference to a read sent to server. A
+// direct connection to a replica set member reads with primaryPreferred so
+// that the member answers even when it is a secondary. Standalones and
+// reads from the primary need no preference.
+func withReadPreference(command bson.D, rp ReadPreference, t TopologyDescription, server ServerDescription) bson.D {
+	if _, ok := command.Lookup("$readPreference"); ok {
+		return command
+	}
+	var doc bson.D
+	switch {
+	case server.Kind == ServerStandalone:
+		return command
+	case t.Kind == TopologySingle && server.Kind != ServerMongos:
+		doc = ReadPreference{Mode: ReadPrimaryPreferred}.document()
+	case rp.mode() == ReadPrimary:
+		return command
+	default:
+		doc = rp.document()
+	}
+	return append(command[:len(command):len(command)], bson.E{Key: "$readPreference", Value: doc})
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+	pb "mongo-playground/proto/proxy"
+)
+
+// testReplicaSetTopology describes a primary p and secondaries s1 to s3
+func testReplicaSetTopology() TopologyDescription {
+	now := time.Now()
+	member := func(addr string, kind ServerKind, rtt time.Duration, tags map[string]string) ServerDescription {
+		return ServerDescription{
+			Addr: addr, Kind: kind, RTT: rtt, Tags: tags,
+			LastUpdateTime: now, LastWriteDate: now,
+		}
+	}
+	return TopologyDescription{
+		Kind: TopologyReplicaSetWithPrimary,
+		Servers: map[string]ServerDescription{
+			"p:27017":  member("p:27017", ServerRSPrimary, 5*time.Millisecond, map[string]string{"dc": "east"}),
+			"s1:27017": member("s1:27017", ServerRSSecondary, 10*time.Millisecond, map[string]string{"dc": "east", "use": "analytics"}),
+			"s2:27017": member("s2:27017", ServerRSSecondary, 20*time.Millisecond, map[string]string{"dc": "west"}),
+			"s3:27017": member("s3:27017", ServerRSSecondary, 100*time.Millisecond, map[string]string{"dc": "west"}),
+		},
+	}
+}
+
+func selectedAddrs(servers []ServerDescription) []string {
+	addrs := make([]string, 0, len(servers))
+	for _, desc := range servers {
+		addrs = append(addrs, desc.Addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestSelectReadable(t *testing.T) {
+	heartbeat := 10 * time.Second
+	tests := []struct {
+		name string
+		rp   ReadPreference
+		want []string
+	}{
+		{"primary", ReadPreference{}, []string{"p:27017"}},
+		{"primaryPreferred", ReadPreference{Mode: ReadPrimaryPreferred}, []string{"p:27017"}},
+		{"secondary within the latency window", ReadPreference{Mode: ReadSecondary}, []string{"s1:27017", "s2:27017"}},
+		{"secondaryPreferred", ReadPreference{Mode: ReadSecondaryPreferred}, []string{"s1:27017", "s2:27017"}},
+		{"nearest", ReadPreference{Mode: ReadNearest}, []string{"p:27017", "s1:27017", "s2:27017"}},
+		{
+			"first matching tag set",
+			ReadPreference{Mode: ReadSecondary, TagSets: []TagSet{{"dc": "north"}, {"dc": "west"}}},
+			[]string{"s2:27017"},
+		},
+		{
+			"tag set with several tags",
+			ReadPreference{Mode: ReadSecondary, TagSets: []TagSet{{"dc": "east", "use": "analytics"}}},
+			[]string{"s1:27017"},
+		},
+		{
+			"no matching tag set",
+			ReadPreference{Mode: ReadSecondary, TagSets: []TagSet{{"dc": "north"}}},
+			nil,
+		},
+		{
+			"secondaryPreferred falls back to the primary",
+			ReadPreference{Mode: ReadSecondaryPreferred, TagSets: []TagSet{{"dc": "north"}}},
+			[]string{"p:27017"},
+		},
+		{
+			"nearest applies tag sets to the primary",
+			ReadPreference{Mode: ReadNearest, TagSets: []TagSet{{"dc": "west"}}},
+			[]string{"s2:27017"},
+		},
+		{
+			"nearest selects a primary matching the tag set",
+			ReadPreference{Mode: ReadNearest, TagSets: []TagSet{{"dc": "east"}}},
+			[]string{"p:27017", "s1:27017"},
+		},
+		{
+			"empty tag set matches any member",
+			ReadPreference{Mode: ReadSecondary, TagSets: []TagSet{{"dc": "north"}, {}}},
+			[]string{"s1:27017", "s2:27017"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectedAddrs(selectReadable(tt.rp, heartbeat, 15*time.Millisecond)(testReplicaSetTopology()))
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSelectReadableWithoutPrimary(t *testing.T) {
+	topology := testReplicaSetTopology()
+	delete(topology.Servers, "p:27017")
+	topology.Kind = TopologyReplicaSetNoPrimary
+
+	if got := selectReadable(ReadPreference{}, time.Second, 15*time.Millisecond)(topology); len(got) != 0 {
+		t.Errorf("Expected no server for primary reads, got %v", selectedAddrs(got))
+	}
+	got := selectedAddrs(selectReadable(ReadPreference{Mode: ReadPrimaryPreferred}, time.Second, 15*time.Millisecond)(topology))
+	if want := []string{"s1:27017", "s2:27017"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected primaryPreferred to use secondaries %v, got %v", want, got)
+	}
+}
+
+func TestSelectReadableMaxStaleness(t *testing.T) {
+	heartbeat := 10 * time.Second
+	rp := ReadPreference{Mode: ReadSecondary, MaxStaleness: 90 * time.Second}
+
+	topology := testReplicaSetTopology()
+	lagging := topology.Servers["s1:27017"]
+	lagging.LastWriteDate = lagging.LastUpdateTime.Add(-2 * time.Minute)
+	topology.Servers["s1:27017"] = lagging
+
+	got := selectedAddrs(selectReadable(rp, heartbeat, time.Second)(topology))
+	if want := []string{"s2:27017", "s3:27017"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the lagging secondary to be excluded, got %v", got)
+	}
+
+	// Without a primary, staleness is relative to the freshest secondary
+	delete(topology.Servers, "p:27017")
+	topology.Kind = TopologyReplicaSetNoPrimary
+	got = selectedAddrs(selectReadable(rp, heartbeat, time.Second)(topology))
+	if want := []string{"s2:27017", "s3:27017"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the lagging secondary to be excluded without a primary, got %v", got)
+	}
+}
+
+func TestReadPreferenceValidate(t *testing.T) {
+	heartbeat := 10 * time.Second
+	tests := []struct {
+		rp    ReadPreference
+		valid bool
+	}{
+		{ReadPreference{}, true},
+		{ReadPreference{Mode: ReadNearest, MaxStaleness: 90 * time.Second}, true},
+		{ReadPreference{Mode: ReadNearest, MaxStaleness: 30 * time.Second}, false},
+		{ReadPreference{Mode: ReadPrimary, TagSets: []TagSet{{"dc": "east"}}}, false},
+		{ReadPreference{Mode: ReadPrimary, MaxStaleness: 2 * time.Minute}, false},
+		{ReadPreference{Mode: "fastest"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.rp.validate(heartbeat); (err == nil) != tt.valid {
+			t.Errorf("validate(%+v) = %v, expected valid %v", tt.rp, err, tt.valid)
+		}
+	}
+
+	// The minimum grows with the heartbeat interval
+	rp := ReadPreference{Mode: ReadSecondary, MaxStaleness: 100 * time.Second}
+	if err := rp.validate(2 * time.Minute); err == nil {
+		t.Error("Expected maxStaleness below heartbeat + 10s to be rejected")
+	}
+}
+
+func TestWithReadPreference(t *testing.T) {
+	command := bson.D{{Key: "find", Value: "col"}}
+	topology := testReplicaSetTopology()
+	secondary := topology.Servers["s1:27017"]
+	rp := ReadPreference{Mode: ReadSecondary, TagSets: []TagSet{{"use": "analytics", "dc": "east"}}, MaxStaleness: 2 * time.Minute}
+
+	got := withReadPreference(command, rp, topology, secondary)
+	doc := mustMarshal(t, got).Lookup("$readPreference").Document()
+	want := mustMarshal(t, bson.D{
+		{Key: "mode", Value: "secondary"},
+		{Key: "tags", Value: bson.A{bson.D{{Key: "dc", Value: "east"}, {Key: "use", Value: "analytics"}}}},
+		{Key: "maxStalenessSeconds", Value: int64(120)},
+	})
+	if doc.String() != want.String() {
+		t.Errorf("Expected $readPreference %v, got %v", want, doc)
+	}
+	if len(command) != 1 {
+		t.Errorf("Expected the caller's command to be left unmodified, got %v", command)
+	}
+
+	if got := withReadPreference(command, ReadPreference{}, topology, topology.Servers["p:27017"]); len(got) != 1 {
+		t.Errorf("Expected no $readPreference for primary reads, got %v", got)
+	}
+
+	// A direct connection to a secondary needs primaryPreferred
+	single := TopologyDescription{Kind: TopologySingle, Servers: map[string]ServerDescription{secondary.Addr: secondary}}
+	got = withReadPreference(command, ReadPreference{}, single, secondary)
+	if mode := mustMarshal(t, got).Lookup("$readPreference", "mode").StringValue(); mode != "primaryPreferred" {
+		t.Errorf("Expected primaryPreferred for a direct connection, got %v", got)
+	}
+	standalone := ServerDescription{Addr: "a:27017", Kind: ServerStandalone}
+	if got := withReadPreference(command, rp, single, standalone); len(got) != 1 {
+		t.Errorf("Expected no $readPreference for a standalone, got %v", got)
+	}
+}
+
+func TestReplsetReadsFromSecondaries(t *testing.T) {
+	mock := newMockReplicaSet(t, 3)
+	cursor := &mockCursor{id: 0, count: 3}
+	var reads commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		reads.record(command)
+		return cursor.handle(member, command)
+	})
+
+	opts := DefaultOptions()
+	opts.ReadPreference = ReadSecondary
+	replset := NewReplsetWithOptions(mock.addrs, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	s := NewServer(replset)
+	for i := 0; i < 5; i++ {
+		cursor.mu.Lock()
+		cursor.next = 0
+		cursor.mu.Unlock()
+		if _, err := s.Find(ctx, &pb.FindRequest{Db: "test", Collection: "col"}); err != nil {
+			t.Fatalf("Find failed: %v", err)
+		}
+	}
+	if got := len(mock.commands(0)); got != 0 {
+		t.Errorf("Expected the primary to serve no reads, got %d", got)
+	}
+	if got := len(mock.commands(1)) + len(mock.commands(2)); got != 5 {
+		t.Errorf("Expected the secondaries to serve 5 reads, got %d", got)
+	}
+	for _, read := range reads.all() {
+		if mode := read.Lookup("$readPreference", "mode").StringValue(); mode != "secondary" {
+			t.Errorf("Expected $readPreference secondary, got %v", read)
+		}
+	}
+
+	// A per operation preference overrides the options
+	primaryCtx := WithReadPreference(ctx, ReadPreference{Mode: ReadPrimary})
+	if _, err := replset.SendQuery(primaryCtx, bson.D{{Key: "find", Value: "col"}, {Key: "$db", Value: "test"}}); err != nil {
+		t.Fatalf("SendQuery failed: %v", err)
+	}
+	if got := len(mock.commands(0)); got != 1 {
+		t.Errorf("Expected the primary to serve the primary read, got %d", got)
+	}
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"mongo-playground/internal/bson"
+)
+
+// minRetryableWireVersion is the first wire version (MongoDB 3.6) that
+// supports retryable writes
+const minRetryableWireVersion = 6
+
+// retryableWriteCommands are the write commands the server can deduplicate
+// by lsid and txnNumber
+var retryableWriteCommands = map[string]bool{
+	"insert":        true,
+	"update":        true,
+	"delete":        true,
+	"findAndModify": true,
+}
+
+// retryableReadCommands are the read commands that are safe to send again
+var retryableReadCommands = map[string]bool{
+	"find":            true,
+	"aggregate":       true,
+	"count":           true,
+	"distinct":        true,
+	"listCollections": true,
+	"listDatabases":   true,
+	"listIndexes":     true,
+}
+
+// Server error codes after which a read may succeed on another attempt
+var retryableReadCodes = map[int32]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	134:   true, // ReadConcernMajorityNotAvailableYet
+	189:   true, // PrimarySteppedDown
+	262:   true, // ExceededTimeLimit
+	9001:  true, // SocketException
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// isRetryableWrite reports whether a write command can be retried. Writes
+// that are unacknowledged, already part of a session, or update or delete
+// several documents per statement cannot.
+func isRetryableWrite(body bson.Raw, documents []bson.Raw) bool {
+	elements, err := body.Elements()
+	if err != nil || len(elements) == 0 || !retryableWriteCommands[elements[0].Key] {
+		return false
+	}
+	if body.Lookup("lsid").Type != 0 || body.Lookup("txnNumber").Type != 0 {
+		return false
+	}
+	if unacknowledged(body) {
+		return false
+	}
+
+	switch elements[0].Key {
+	case "update":
+		for _, statement := range statements(body, "updates", documents) {
+			if statement.Lookup("multi").Boolean() {
+				return false
+			}
+		}
+	case "delete":
+		for _, statement := range statements(body, "deletes", documents) {
+			if limit, _ := statement.Lookup("limit").AsInt64OK(); limit != 1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// statements returns the statements of a write command, whether they are
+// in the command body or sent as a document sequence
+func statements(body bson.Raw, key string, documents []bson.Raw) []bson.Raw {
+	out := append([]bson.Raw(nil), documents...)
+	values, _ := body.Lookup(key).Array().Values()
+	for _, v := range values {
+		out = append(out, v.Document())
+	}
+	return out
+}
+
+// isRetryableWriteError reports whether a failed write may be retried on a
+// newly selected primary. Write errors of individual documents never are.
+func isRetryableWriteError(err error) bool {
+	if isNetworkError(err) || HasErrorLabel(err, LabelRetryableWrite) {
+		return true
+	}
+	var cmdErr *CommandError
+	return errors.As(err, &cmdErr) && IsNotWritablePrimary(cmdErr)
+}
+
+// isRetryableRead reports whether a read command can be sent again.
+// Aggregations that write with $out or $merge cannot.
+func isRetryableRead(body bson.Raw) bool {
+	elements, err := body.Elements()
+	if err != nil || len(elements) == 0 || !retryableReadCommands[elements[0].Key] {
+		return false
+	}
+	if elements[0].Key == "aggregate" {
+		stages, _ := body.Lookup("pipeline").Array().Values()
+		for _, stage := range stages {
+			doc := stage.Document()
+			if doc.Lookup("$out").Type != 0 || doc.Lookup("$merge").Type != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isRetryableReadError reports whether a failed read may be retried
+func isRetryableReadError(err error) bool {
+	if isNetworkError(err) {
+		return true
+	}
+	var cmdErr *CommandError
+	return errors.As(err, &cmdErr) && (retryableReadCodes[cmdErr.Code] || IsNotWritablePrimary(cmdErr))
+}
+
+// supportsRetryableWrites reports whether writes to server can be retried
+func supportsRetryableWrites(server ServerDescription) bool {
+	return server.Kind != ServerStandalone && server.SessionTimeout > 0 && server.MaxWireVersion >= minRetryableWireVersion
+}
+
+// retryableWrite sends a write command to server with an lsid and txnNumber
+// and retries it once on the primary selected afterwards when it fails with
+// a retryable error. The server applies a txnNumber at most once, so the
+// retry cannot duplicate the write. The retry resends the statements as they
+// were batched for server, so it is only sent to a primary with the same
+// limits.
+func (r *Replset) retryableWrite(ctx context.Context, server ServerDescription, command bson.D, sequences []DocumentSequence) (*Message, error) {
+	timeout := r.Topology().SessionTimeout()
+	if !supportsRetryableWrites(server) || timeout == 0 {
+		return r.sendCommandTo(ctx, server, command, sequences)
+	}
+
+	// A write in an explicit session uses its logical session, others an
+	// implicit one from the pool
+	var session *serverSession
+	var err error
+	explicit := sessionFromContext(ctx)
+	if explicit != nil {
+		session, err = explicit.serverSession(timeout)
+	} else {
+		session, err = r.sessions.checkOut(timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if explicit == nil {
+		defer func() { r.sessions.checkIn(session, timeout) }()
+	}
+	session.txnNumber++
+	command = append(command[:len(command):len(command)],
+		bson.E{Key: "lsid", Value: session.lsid()},
+		bson.E{Key: "txnNumber", Value: session.txnNumber},
+	)
+
+	reply, err := r.sendCommandTo(ctx, server, command, sequences)
+	if isNetworkError(err) {
+		session.dirty = true
+	}
+	if err == nil || !isRetryableWriteError(err) || ctx.Err() != nil {
+		return reply, err
+	}
+
+	retryServer, selectErr := r.selectServer(ctx, selectWritable)
+	if selectErr != nil || !supportsRetryableWrites(retryServer) || !sameBatchLimits(server, retryServer) {
+		// The original error says more about what went wrong
+		return reply, err
+	}
+	reply, err = r.sendCommandTo(ctx, retryServer, command, sequences)
+	if isNetworkError(err) {
+		session.dirty = true
+	}
+	return reply, err
+}
+
+// retryableRead sends a read command to a member chosen by the read
+// preference of ctx and, unless RetryReads is disabled, retries it once on
+// a newly selected member after a retryable error. It returns the member
+// that answered, which cursors stay pinned to.
+func (r *Replset) retryableRead(ctx context.Context, command bson.D) (ServerDescription, *Message, error) {
+	rp := r.readPreference(ctx)
+	if err := rp.validate(r.opts.HeartbeatInterval); err != nil {
+		return ServerDescription{}, nil, err
+	}
+	// Reads in a transaction are pinned with it, and its first command
+	// carries the causal consistency read concern
+	transaction := inTransaction(ctx)
+	if transaction && rp.mode() != ReadPrimary {
+		return ServerDescription{}, nil, fmt.Errorf("read preference in a transaction must be primary")
+	}
+	if !transaction {
+		command = withReadConcern(command, r.opts.ReadConcern)
+	}
+	if session := sessionFromContext(ctx); session != nil && !transaction {
+		var err error
+		if command, err = session.withAfterClusterTime(command); err != nil {
+			return ServerDescription{}, nil, err
+		}
+	}
+	selector := selectReadable(rp, r.opts.HeartbeatInterval, r.opts.LocalThreshold)
+
+	server, reply, err := r.readFrom(ctx, command, rp, selector)
+	if err == nil || transaction || !*r.opts.RetryReads || !isRetryableReadError(err) || ctx.Err() != nil {
+		return server, reply, err
+	}
+	if body, encodeErr := bson.Marshal(command); encodeErr != nil || !isRetryableRead(body) {
+		return server, reply, err
+	}
+
+	retryServer, retryReply, retryErr := r.readFrom(ctx, command, rp, selector)
+	if retryServer.Addr == "" {
+		// Selection failed; the original error says more about what went wrong
+		return server, reply, err
+	}
+	return retryServer, retryReply, retryErr
+}
+
+// readFrom selects a member for a read and sends the command with the
+// $readPreference that member needs
+func (r *Replset) readFrom(ctx context.Context, command bson.D, rp ReadPreference, selector func(TopologyDescription) []ServerDescription) (ServerDescription, *Message, error) {
+	server, err := r.selectServer(ctx, selector)
+	if err != nil {
+		return ServerDescription{}, nil, err
+	}
+	command = withReadPreference(command, rp, r.Topology(), server)
+	reply, err := r.sendCommandTo(ctx, server, command, nil)
+	return server, reply, err
+}
+
+// sendCommandTo encodes a command and sends it to server. The command
+// carries the lsid and transaction fields of the session of ctx, if any,
+// and the latest $clusterTime for servers that support sessions. A write
+// with w:0 outside a session is not answered, and its reply is {ok: 1}
+// with FlagMoreToCome set.
+func (r *Replset) sendCommandTo(ctx context.Context, server ServerDescription, command bson.D, sequences []DocumentSequence) (*Message, error) {
+	body, err := r.commandBody(ctx, server, command)
+	if err != nil {
+		return nil, err
+	}
+	// An unacknowledged write is sent with moreToCome and not waited for.
+	// Within a session the reply is still read for the session state.
+	var flags uint32
+	if _, write := writeSequenceIdentifiers[command[0].Key]; write && sessionFromContext(ctx) == nil && unacknowledged(body) {
+		flags |= FlagMoreToCome
+	}
+	reply, err := r.sendMessageTo(ctx, server, OpMsg, encodeOpMsg(flags, body, sequences))
+	if flags&FlagMoreToCome != 0 && err == nil {
+		return unacknowledgedReply()
+	}
+	return reply, sessionError(ctx, err)
+}
+
+// commandBody adds the session, transaction and cluster time fields of ctx
+// to a command for server and encodes it
+func (r *Replset) commandBody(ctx context.Context, server ServerDescription, command bson.D) (bson.Raw, error) {
+	session := sessionFromContext(ctx)
+	if session != nil {
+		if session.replset != r {
+			return nil, fmt.Errorf("session belongs to another replica set")
+		}
+		if server.SessionTimeout == 0 {
+			return nil, fmt.Errorf("%s does not support sessions", server.Addr)
+		}
+		s, err := session.serverSession(r.Topology().SessionTimeout())
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := command.Lookup("lsid"); !ok {
+			command = append(command[:len(command):len(command)], bson.E{Key: "lsid", Value: s.lsid()})
+		}
+		if session.inTransaction() {
+			if command, err = session.transactionCommand(server, command); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if server.MaxWireVersion >= minRetryableWireVersion {
+		clusterTime := r.clock.get()
+		if session != nil {
+			clusterTime = laterClusterTime(clusterTime, session.clusterTime)
+		}
+		if _, ok := command.Lookup("$clusterTime"); !ok && clusterTime != nil {
+			command = append(command[:len(command):len(command)], bson.E{Key: "$clusterTime", Value: clusterTime})
+		}
+	}
+
+	command = withServerAPI(command, r.opts.ServerAPI)
+
+	body, err := bson.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+	return body, nil
+}
+
+// sessionError marks the server session of ctx dirty after a network
+// error, which also makes the transaction in progress retryable
+func sessionError(ctx context.Context, err error) error {
+	session := sessionFromContext(ctx)
+	if session != nil && isNetworkError(err) {
+		session.server.dirty = true
+		if session.inTransaction() {
+			err = withErrorLabel(err, LabelTransientTransaction)
+		}
+	}
+	return err
+}
+
+// unacknowledgedReply stands in for the reply to a write sent with
+// moreToCome, whose outcome is unknown
+func unacknowledgedReply() (*Message, error) {
+	body, err := bson.Marshal(bson.D{{Key: "ok", Value: 1.0}})
+	if err != nil {
+		return nil, err
+	}
+	return &Message{FlagBits: FlagMoreToCome, Body: body}, nil
+}
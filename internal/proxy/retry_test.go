@@ -0,0 +1,346 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+	pb "mongo-playground/proto/proxy"
+)
+
+// commandRecorder records the commands a mock receives
+type commandRecorder struct {
+	mu       sync.Mutex
+	commands []bson.Raw
+}
+
+func (w *commandRecorder) record(command *Message) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.commands = append(w.commands, command.Body)
+	return len(w.commands)
+}
+
+func (w *commandRecorder) all() []bson.Raw {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]bson.Raw(nil), w.commands...)
+}
+
+func insertCommand(t *testing.T, replset *Replset) (*Message, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	documents := []bson.Raw{mustMarshal(t, bson.D{{Key: "_id", Value: 1}})}
+	return replset.SendCommand(ctx, bson.D{{Key: "insert", Value: "col"}, {Key: "$db", Value: "test"}}, documents)
+}
+
+func TestRetryableWriteAfterStepDown(t *testing.T) {
+	mock := newMockReplicaSet(t, 3)
+	var writes commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if command.Body.Lookup("insert").Type == 0 {
+			return bson.D{{Key: "ok", Value: 1.0}}
+		}
+		if writes.record(command) == 1 {
+			// The primary steps down while the insert is in flight
+			mock.setPrimary(1)
+			return bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 10107}, {Key: "errmsg", Value: "not primary"}}
+		}
+		return bson.D{{Key: "n", Value: 1}, {Key: "ok", Value: 1.0}}
+	})
+	replset := connectTestReplset(t, mock)
+
+	if _, err := insertCommand(t, replset); err != nil {
+		t.Fatalf("Expected the write to be retried on the new primary, got %v", err)
+	}
+
+	attempts := writes.all()
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(attempts))
+	}
+	first, second := attempts[0], attempts[1]
+	if first.Lookup("lsid").Type != bson.TypeDocument || first.Lookup("txnNumber").Int64() != 1 {
+		t.Fatalf("Expected an lsid and txnNumber 1, got %v", first)
+	}
+	if first.Lookup("lsid").Document().String() != second.Lookup("lsid").Document().String() || second.Lookup("txnNumber").Int64() != 1 {
+		t.Errorf("Expected the retry to reuse the lsid and txnNumber, got %v and %v", first, second)
+	}
+	if got := len(mock.commands(1)); got != 1 {
+		t.Errorf("Expected the retry to reach the new primary, got %d commands", got)
+	}
+
+	// The session is reused with an increasing txnNumber
+	if _, err := insertCommand(t, replset); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	third := writes.all()[2]
+	if third.Lookup("lsid").Document().String() != first.Lookup("lsid").Document().String() || third.Lookup("txnNumber").Int64() != 2 {
+		t.Errorf("Expected txnNumber 2 on the pooled session, got %v", third)
+	}
+}
+
+func TestRetryableWriteAfterNetworkError(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var writes commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if command.Body.Lookup("insert").Type != 0 && writes.record(command) == 1 {
+			return nil
+		}
+		return bson.D{{Key: "n", Value: 1}, {Key: "ok", Value: 1.0}}
+	})
+	replset := connectTestReplset(t, mock)
+
+	if _, err := insertCommand(t, replset); err != nil {
+		t.Fatalf("Expected the write to be retried after the network error, got %v", err)
+	}
+	if got := len(writes.all()); got != 2 {
+		t.Errorf("Expected 2 attempts, got %d", got)
+	}
+	// A session used in a network error is not reused
+	if n := replset.sessions.len(); n != 0 {
+		t.Errorf("Expected the dirty session to be discarded, got %d pooled", n)
+	}
+}
+
+func TestRetryableWriteRetriesOnce(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var writes commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		writes.record(command)
+		return bson.D{
+			{Key: "ok", Value: 0.0},
+			{Key: "code", Value: 91},
+			{Key: "errmsg", Value: "shutting down"},
+			{Key: "errorLabels", Value: bson.A{LabelRetryableWrite}},
+		}
+	})
+	replset := connectTestReplset(t, mock)
+
+	_, err := insertCommand(t, replset)
+	if !HasErrorLabel(err, LabelRetryableWrite) {
+		t.Fatalf("Expected the retryable error, got %v", err)
+	}
+	if got := len(writes.all()); got != 2 {
+		t.Errorf("Expected exactly 2 attempts, got %d", got)
+	}
+}
+
+func TestRetryableWriteNotRetried(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    bson.D
+		disabled bool
+	}{
+		{
+			name: "write error",
+			reply: bson.D{
+				{Key: "writeErrors", Value: bson.A{bson.D{{Key: "index", Value: 0}, {Key: "code", Value: 11000}, {Key: "errmsg", Value: "E11000"}}}},
+				{Key: "ok", Value: 1.0},
+			},
+		},
+		{
+			name:  "other command error",
+			reply: bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 2}, {Key: "errmsg", Value: "bad value"}},
+		},
+		{
+			name:     "retry writes disabled",
+			reply:    bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 10107}, {Key: "errmsg", Value: "not primary"}},
+			disabled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockReplicaSet(t, 1)
+			var writes commandRecorder
+			mock.setHandler(func(member int, command *Message) bson.D {
+				writes.record(command)
+				return tt.reply
+			})
+			opts := DefaultOptions()
+			if tt.disabled {
+				retryWrites := false
+				opts.RetryWrites = &retryWrites
+			}
+			replset := NewReplsetWithOptions(mock.addrs, opts)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := replset.Connect(ctx); err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			defer replset.Disconnect()
+
+			if _, err := insertCommand(t, replset); err == nil {
+				t.Fatal("Expected the write to fail")
+			}
+			attempts := writes.all()
+			if len(attempts) != 1 {
+				t.Fatalf("Expected 1 attempt, got %d", len(attempts))
+			}
+			if tt.disabled && attempts[0].Lookup("txnNumber").Type != 0 {
+				t.Errorf("Expected no txnNumber with retries disabled, got %v", attempts[0])
+			}
+		})
+	}
+}
+
+func TestIsRetryableWrite(t *testing.T) {
+	tests := []struct {
+		command bson.D
+		want    bool
+	}{
+		{bson.D{{Key: "insert", Value: "col"}}, true},
+		{bson.D{{Key: "findAndModify", Value: "col"}}, true},
+		{bson.D{{Key: "find", Value: "col"}}, false},
+		{bson.D{{Key: "insert", Value: "col"}, {Key: "writeConcern", Value: bson.D{{Key: "w", Value: 0}}}}, false},
+		{bson.D{{Key: "insert", Value: "col"}, {Key: "txnNumber", Value: int64(3)}}, false},
+		{bson.D{{Key: "update", Value: "col"}, {Key: "updates", Value: bson.A{bson.D{{Key: "q", Value: bson.D{}}, {Key: "multi", Value: false}}}}}, true},
+		{bson.D{{Key: "update", Value: "col"}, {Key: "updates", Value: bson.A{bson.D{{Key: "q", Value: bson.D{}}, {Key: "multi", Value: true}}}}}, false},
+		{bson.D{{Key: "delete", Value: "col"}, {Key: "deletes", Value: bson.A{bson.D{{Key: "q", Value: bson.D{}}, {Key: "limit", Value: 1}}}}}, true},
+		{bson.D{{Key: "delete", Value: "col"}, {Key: "deletes", Value: bson.A{bson.D{{Key: "q", Value: bson.D{}}, {Key: "limit", Value: 0}}}}}, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableWrite(mustMarshal(t, tt.command), nil); got != tt.want {
+			t.Errorf("isRetryableWrite(%v) = %v, expected %v", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestServer_InsertSurvivesFailover(t *testing.T) {
+	mock := newMockReplicaSet(t, 3)
+	var writes commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if writes.record(command) == 1 {
+			mock.setPrimary(2)
+			return nil
+		}
+		if !mock.isPrimary(member) {
+			return bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 10107}, {Key: "errmsg", Value: "not primary"}}
+		}
+		return bson.D{{Key: "n", Value: 1}, {Key: "ok", Value: 1.0}}
+	})
+	s := NewServer(connectTestReplset(t, mock))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	doc, _ := bson.Marshal(bson.D{{Key: "name", Value: "John"}})
+	resp, err := s.Insert(ctx, &pb.InsertRequest{Db: "test", Collection: "col", Documents: [][]byte{doc}})
+	if err != nil || !resp.GetSuccess() {
+		t.Fatalf("Expected the failover to be invisible, got %v", err)
+	}
+	if got := len(mock.commands(2)); got != 1 {
+		t.Errorf("Expected the new primary to receive the retry, got %d commands", got)
+	}
+}
+
+func findCommand() bson.D {
+	return bson.D{{Key: "find", Value: "col"}, {Key: "$db", Value: "test"}}
+}
+
+func TestRetryableReadAfterNetworkError(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var reads commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if reads.record(command) == 1 {
+			return nil
+		}
+		return bson.D{
+			{Key: "cursor", Value: bson.D{{Key: "firstBatch", Value: bson.A{}}, {Key: "id", Value: int64(0)}, {Key: "ns", Value: "test.col"}}},
+			{Key: "ok", Value: 1.0},
+		}
+	})
+	replset := connectTestReplset(t, mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := replset.SendQuery(ctx, findCommand()); err != nil {
+		t.Fatalf("Expected the read to be retried, got %v", err)
+	}
+	if got := len(reads.all()); got != 2 {
+		t.Errorf("Expected 2 attempts, got %d", got)
+	}
+}
+
+func TestRetryableReadAfterFailover(t *testing.T) {
+	mock := newMockReplicaSet(t, 3)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if !mock.isPrimary(member) {
+			return bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 11602}, {Key: "errmsg", Value: "interrupted due to repl state change"}}
+		}
+		return bson.D{
+			{Key: "cursor", Value: bson.D{{Key: "firstBatch", Value: bson.A{bson.D{{Key: "i", Value: 1}}}}, {Key: "id", Value: int64(0)}, {Key: "ns", Value: "test.col"}}},
+			{Key: "ok", Value: 1.0},
+		}
+	})
+	replset := connectTestReplset(t, mock)
+	mock.setPrimary(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := replset.RunCursorCommand(ctx, findCommand(), CursorOptions{})
+	if err != nil {
+		t.Fatalf("Expected the read to be retried on the new primary, got %v", err)
+	}
+	if c.server.Addr != mock.addrs[1] {
+		t.Errorf("Expected the cursor to be pinned to %s, got %s", mock.addrs[1], c.server.Addr)
+	}
+}
+
+func TestRetryableReadNotRetried(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  bson.D
+		reply    bson.D
+		disabled bool
+	}{
+		{
+			name:    "other command error",
+			command: findCommand(),
+			reply:   bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 2}, {Key: "errmsg", Value: "bad value"}},
+		},
+		{
+			name:    "writing aggregation",
+			command: bson.D{{Key: "aggregate", Value: "col"}, {Key: "pipeline", Value: bson.A{bson.D{{Key: "$out", Value: "other"}}}}, {Key: "$db", Value: "test"}},
+			reply:   bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 11602}, {Key: "errmsg", Value: "interrupted"}},
+		},
+		{
+			name:     "retry reads disabled",
+			command:  findCommand(),
+			reply:    bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 11602}, {Key: "errmsg", Value: "interrupted"}},
+			disabled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockReplicaSet(t, 1)
+			var reads commandRecorder
+			mock.setHandler(func(member int, command *Message) bson.D {
+				reads.record(command)
+				return tt.reply
+			})
+			opts := DefaultOptions()
+			if tt.disabled {
+				retryReads := false
+				opts.RetryReads = &retryReads
+			}
+			replset := NewReplsetWithOptions(mock.addrs, opts)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := replset.Connect(ctx); err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			defer replset.Disconnect()
+
+			if _, err := replset.SendQuery(ctx, tt.command); err == nil {
+				t.Fatal("Expected the read to fail")
+			}
+			if got := len(reads.all()); got != 1 {
+				t.Errorf("Expected 1 attempt, got %d", got)
+			}
+		})
+	}
+}
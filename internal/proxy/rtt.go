@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// rttAverage is the exponentially weighted moving average of the round trip
+// times to a member
+type rttAverage struct {
+	mu      sync.Mutex
+	average time.Duration
+}
+
+// add weighs a new sample into the average
+func (a *rttAverage) add(sample time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.average == 0 {
+		a.average = sample
+	} else {
+		a.average = time.Duration(rttAlpha*float64(sample) + (1-rttAlpha)*float64(a.average))
+	}
+}
+
+func (a *rttAverage) value() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.average
+}
+
+// rttMonitor measures the round trip time to a streaming member on a
+// connection of its own, polling hello every HeartbeatInterval. The replies
+// of the streaming connection come when the member has news, so they say
+// nothing about the round trip time.
+type rttMonitor struct {
+	monitor *monitor
+
+	connMu sync.Mutex
+	conn   net.Conn
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+func newRTTMonitor(m *monitor) *rttMonitor {
+	return &rttMonitor{
+		monitor: m,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// run samples the round trip time until the monitor is stopped
+func (r *rttMonitor) run() {
+	defer close(r.done)
+	defer r.closeConn()
+
+	for {
+		r.sample()
+		select {
+		case <-r.quit:
+			return
+		case <-time.After(r.monitor.topology.opts.HeartbeatInterval):
+		}
+	}
+}
+
+// stop terminates the monitor and waits for it to exit
+func (r *rttMonitor) stop() {
+	close(r.quit)
+	// Closing the connection unblocks a hello that is waiting on the network
+	if conn := r.currentConn(); conn != nil {
+		conn.Close()
+	}
+	<-r.done
+}
+
+func (r *rttMonitor) currentConn() net.Conn {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	return r.conn
+}
+
+func (r *rttMonitor) setConn(conn net.Conn) {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	r.conn = conn
+}
+
+func (r *rttMonitor) closeConn() {
+	if conn := r.currentConn(); conn != nil {
+		conn.Close()
+		r.setConn(nil)
+	}
+}
+
+// sample runs hello once and adds its round trip time to the average. A
+// failed connection is closed and dialed again on the next sample; the
+// streaming connection reports the member as unreachable.
+func (r *rttMonitor) sample() {
+	opts := r.monitor.topology.opts
+	timeout := opts.ConnectTimeout
+
+	conn := r.currentConn()
+	if conn == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		var err error
+		conn, err = dialMember(ctx, r.monitor.addr, opts)
+		cancel()
+		if err != nil {
+			return
+		}
+		r.setConn(conn)
+		select {
+		case <-r.quit:
+			r.closeConn()
+			return
+		default:
+		}
+		if _, err := r.monitor.handshake(conn, timeout); err != nil {
+			r.closeConn()
+			return
+		}
+	}
+
+	start := time.Now()
+	if _, err := r.monitor.runCommand(conn, timeout, 0, bson.D{{Key: "hello", Value: 1}, {Key: "$db", Value: "admin"}}); err != nil {
+		r.closeConn()
+		return
+	}
+	r.monitor.rtt.add(time.Since(start))
+}
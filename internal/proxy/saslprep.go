@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/bidi"
+	"golang.org/x/text/unicode/norm"
+)
+
+// saslPrep prepares a password as described in RFC 4013, as required for
+// SCRAM-SHA-256
+func saslPrep(s string) (string, error) {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 || s[i] < 0x20 || s[i] == 0x7f {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return s, nil
+	}
+
+	// Mapping: non-ASCII spaces become a space, "commonly mapped to
+	// nothing" characters are dropped
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case mappedToNothing(r):
+		case nonASCIISpace(r):
+			b.WriteRune(' ')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	prepared := norm.NFKC.String(b.String())
+
+	var hasRandAL, hasL bool
+	runes := []rune(prepared)
+	for _, r := range runes {
+		if prohibited(r) {
+			return "", fmt.Errorf("password contains prohibited character %U", r)
+		}
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.R, bidi.AL:
+			hasRandAL = true
+		case bidi.L:
+			hasL = true
+		}
+	}
+
+	// A string with right-to-left characters must not contain left-to-right
+	// ones and must start and end with a right-to-left character
+	if hasRandAL {
+		first, _ := bidi.LookupRune(runes[0])
+		last, _ := bidi.LookupRune(runes[len(runes)-1])
+		isRandAL := func(c bidi.Class) bool { return c == bidi.R || c == bidi.AL }
+		if hasL || !isRandAL(first.Class()) || !isRandAL(last.Class()) {
+			return "", fmt.Errorf("password violates the bidirectional rules of SASLprep")
+		}
+	}
+	return prepared, nil
+}
+
+// mappedToNothing reports whether r is in RFC 3454 table B.1
+func mappedToNothing(r rune) bool {
+	switch r {
+	case 0x00AD, 0x034F, 0x1806, 0x180B, 0x180C, 0x180D, 0x200B, 0x200C, 0x200D, 0x2060, 0xFEFF:
+		return true
+	}
+	return r >= 0xFE00 && r <= 0xFE0F
+}
+
+// nonASCIISpace reports whether r is in RFC 3454 table C.1.2
+func nonASCIISpace(r rune) bool {
+	switch r {
+	case 0x00A0, 0x1680, 0x202F, 0x205F, 0x3000:
+		return true
+	}
+	return r >= 0x2000 && r <= 0x200B
+}
+
+// prohibited reports whether r is in one of the RFC 3454 tables prohibited
+// by SASLprep: controls, private use, non-characters, surrogates and
+// characters that change display properties
+func prohibited(r rune) bool {
+	switch {
+	case r < 0x20 || r == 0x7F: // C.2.1
+		return true
+	case r >= 0x80 && r <= 0x9F, r == 0x06DD, r == 0x070F, r == 0x180E, r == 0x200C, r == 0x200D,
+		r == 0x2028, r == 0x2029, r >= 0x2060 && r <= 0x2063, r >= 0x206A && r <= 0x206F,
+		r == 0xFEFF, r >= 0xFFF9 && r <= 0xFFFC, r >= 0x1D173 && r <= 0x1D17A: // C.2.2
+		return true
+	case r >= 0xE000 && r <= 0xF8FF, r >= 0xF0000 && r <= 0xFFFFD, r >= 0x100000 && r <= 0x10FFFD: // C.3
+		return true
+	case r >= 0xFDD0 && r <= 0xFDEF, r&0xFFFE == 0xFFFE: // C.4
+		return true
+	case r >= 0xD800 && r <= 0xDFFF: // C.5
+		return true
+	case r == 0xFFFD: // C.6
+		return true
+	case r >= 0x2FF0 && r <= 0x2FFB: // C.7
+		return true
+	case r == 0x0340, r == 0x0341, r == 0x200E, r == 0x200F, r >= 0x202A && r <= 0x202E: // C.8
+		return true
+	case r == 0xE0001, r >= 0xE0020 && r <= 0xE007F: // C.9
+		return true
+	}
+	return false
+}
@@ -2,24 +2,41 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 
+	"mongo-playground/internal/bson"
 	pb "mongo-playground/proto/proxy"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
+// defaultMaxFindResponseSize is the largest message gRPC clients receive
+// by default
+const defaultMaxFindResponseSize = 4 * 1024 * 1024
+
 // Server implements pb.MongoProxyServer and hosts the gRPC server.
 type Server struct {
 	pb.UnimplementedMongoProxyServer
 
+	// MaxFindResponseSize bounds the encoded size of a FindResponse. A find
+	// whose results exceed it fails with ResourceExhausted instead of
+	// buffering them. Zero uses the 4 MiB default receive limit of gRPC
+	// clients.
+	MaxFindResponseSize int
+
+	replset    *Replset
 	grpcServer *grpc.Server
 }
 
-// NewServer creates a new Server instance.
-func NewServer() *Server {
-	return &Server{}
+// NewServer creates a new Server instance that forwards requests to replset.
+// The caller is responsible for connecting and disconnecting the replica set.
+func NewServer(replset *Replset) *Server {
+	return &Server{replset: replset}
 }
 
 // Start begins serving on the given address, e.g., ":50051".
@@ -51,14 +68,98 @@ func (s *Server) Stop() {
 	}
 }
 
-// Insert is a placeholder implementation.
+// Insert runs an insert command for the request documents.
 func (s *Server) Insert(ctx context.Context, req *pb.InsertRequest) (*pb.InsertResponse, error) {
-	// TODO: Wire to Mongo insert logic
+	if err := s.checkNamespace(req.GetDb(), req.GetCollection()); err != nil {
+		return nil, err
+	}
+	if len(req.GetDocuments()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no documents to insert")
+	}
+
+	documents := make([]bson.Raw, len(req.GetDocuments()))
+	for i, doc := range req.GetDocuments() {
+		if err := bson.Raw(doc).Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid document %d: %v", i, err)
+		}
+		documents[i] = bson.Raw(doc)
+	}
+
+	command := bson.D{{Key: "insert", Value: req.GetCollection()}, {Key: "$db", Value: req.GetDb()}}
+
+	if _, err := s.replset.SendCommand(ctx, command, documents); err != nil {
+		return nil, backendError("insert", err)
+	}
+
 	return &pb.InsertResponse{Success: true}, nil
 }
 
-// Find is a placeholder implementation.
+// Find runs a find command and returns every matching document, fetching
+// the batches after the first one with getMore. Results larger than
+// MaxFindResponseSize fail with ResourceExhausted.
 func (s *Server) Find(ctx context.Context, req *pb.FindRequest) (*pb.FindResponse, error) {
-	// TODO: Wire to Mongo find logic
-	return &pb.FindResponse{Documents: nil}, nil
+	if err := s.checkNamespace(req.GetDb(), req.GetCollection()); err != nil {
+		return nil, err
+	}
+
+	filter := bson.Raw(req.GetFilterBson())
+	if len(filter) > 0 {
+		if err := filter.Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+		}
+	}
+
+	cursor, err := s.replset.Find(ctx, req.GetDb(), req.GetCollection(), filter, CursorOptions{})
+	if err != nil {
+		return nil, backendError("find", err)
+	}
+	defer cursor.Close(ctx)
+
+	limit := s.MaxFindResponseSize
+	if limit <= 0 {
+		limit = defaultMaxFindResponseSize
+	}
+	var documents [][]byte
+	size := 0
+	for cursor.Next(ctx) {
+		doc := cursor.Current()
+		size += protowire.SizeTag(1) + protowire.SizeBytes(len(doc))
+		if size > limit {
+			return nil, status.Errorf(codes.ResourceExhausted, "find: results exceed the response limit of %d bytes", limit)
+		}
+		documents = append(documents, doc)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, backendError("find", err)
+	}
+	return &pb.FindResponse{Documents: documents}, nil
+}
+
+// backendError converts an error from the replica set into a gRPC status,
+// keeping the distinction between an expired or cancelled request, an
+// error reported by the server and an unavailable backend
+func backendError(op string, err error) error {
+	var se serverError
+	switch {
+	case IsDuplicateKey(err):
+		return status.Errorf(codes.AlreadyExists, "%s: %v", op, err)
+	case errors.As(err, &se):
+		return status.Errorf(codes.Internal, "%s: %v", op, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Errorf(codes.DeadlineExceeded, "%s: %v", op, err)
+	case errors.Is(err, context.Canceled):
+		return status.Errorf(codes.Canceled, "%s: %v", op, err)
+	}
+	return status.Errorf(codes.Unavailable, "%s: %v", op, err)
+}
+
+// checkNamespace validates the target namespace and backend of a request
+func (s *Server) checkNamespace(db, collection string) error {
+	if db == "" || collection == "" {
+		return status.Error(codes.InvalidArgument, "db and collection are required")
+	}
+	if s.replset == nil || !s.replset.IsConnected() {
+		return status.Error(codes.Unavailable, "replica set is not connected")
+	}
+	return nil
 }
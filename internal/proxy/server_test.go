@@ -2,12 +2,94 @@ package proxy
 
 import (
 	"context"
+	"encoding/binary"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+	pb "mongo-playground/proto/proxy"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// opMsgReply wraps a body document into an OP_MSG reply payload
+func opMsgReply(t *testing.T, body bson.D) []byte {
+	doc, err := bson.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to encode reply: %v", err)
+	}
+	payload := binary.LittleEndian.AppendUint32(nil, 0)
+	payload = append(payload, 0)
+	return append(payload, doc...)
+}
+
+// commandMockHandler answers insert and find commands with canned replies
+func commandMockHandler(t *testing.T, stored bson.Raw) mockHandler {
+	return func(opCode int32, payload []byte) []byte {
+		request, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+		if err != nil {
+			t.Errorf("mock received invalid command: %v", err)
+			return opMsgReply(t, bson.D{{Key: "ok", Value: 0}})
+		}
+		elements, err := request.Body.Elements()
+		if err != nil || len(elements) == 0 {
+			t.Errorf("mock received invalid command: %v", err)
+			return opMsgReply(t, bson.D{{Key: "ok", Value: 0}})
+		}
+
+		switch elements[0].Key {
+		case "hello":
+			return opMsgReply(t, bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "maxWireVersion", Value: 21}, {Key: "ok", Value: 1.0}})
+		case "insert":
+			return opMsgReply(t, bson.D{{Key: "n", Value: 1}, {Key: "ok", Value: 1.0}})
+		case "find":
+			return opMsgReply(t, bson.D{
+				{Key: "cursor", Value: bson.D{
+					{Key: "firstBatch", Value: bson.A{stored}},
+					{Key: "id", Value: int64(0)},
+					{Key: "ns", Value: "test.col"},
+				}},
+				{Key: "ok", Value: 1.0},
+			})
+		}
+		return opMsgReply(t, bson.D{
+			{Key: "ok", Value: 0.0},
+			{Key: "errmsg", Value: "no such command"},
+		})
+	}
+}
+
+func newConnectedTestServer(t *testing.T, handler mockHandler) *Server {
+	t.Helper()
+
+	mock, err := newMockMongoServerWithHandler(handler)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	t.Cleanup(func() { mock.Close() })
+
+	replset := NewReplset([]string{mock.Addr()})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { replset.Disconnect() })
+
+	return NewServer(replset)
+}
+
 func TestServer_Insert_Direct(t *testing.T) {
-	s := NewServer()
-	resp, err := s.Insert(context.Background(), nil)
+	s := newConnectedTestServer(t, commandMockHandler(t, nil))
+	doc, _ := bson.Marshal(bson.D{{Key: "name", Value: "John"}})
+	resp, err := s.Insert(context.Background(), &pb.InsertRequest{
+		Db:         "test",
+		Collection: "col",
+		Documents:  [][]byte{doc},
+	})
 	if err != nil {
 		t.Fatalf("Insert returned error: %v", err)
 	}
@@ -17,12 +99,100 @@ func TestServer_Insert_Direct(t *testing.T) {
 }
 
 func TestServer_Find_Direct(t *testing.T) {
-	s := NewServer()
-	resp, err := s.Find(context.Background(), nil)
+	stored, _ := bson.Marshal(bson.D{{Key: "name", Value: "John"}})
+	s := newConnectedTestServer(t, commandMockHandler(t, stored))
+	filter, _ := bson.Marshal(bson.D{{Key: "name", Value: "John"}})
+	resp, err := s.Find(context.Background(), &pb.FindRequest{
+		Db:         "test",
+		Collection: "col",
+		FilterBson: filter,
+	})
 	if err != nil {
 		t.Fatalf("Find returned error: %v", err)
 	}
 	if resp == nil {
 		t.Fatalf("nil Find response")
 	}
+	if len(resp.Documents) != 1 || string(resp.Documents[0]) != string(stored) {
+		t.Fatalf("unexpected Find documents: %v", resp.Documents)
+	}
+}
+
+func TestServer_InvalidRequest(t *testing.T) {
+	s := NewServer(NewReplset([]string{"127.0.0.1:27017"}))
+	_, err := s.Insert(context.Background(), nil)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	_, err = s.Find(context.Background(), &pb.FindRequest{Db: "test", Collection: "col"})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable without a connected replset, got %v", err)
+	}
+}
+
+func TestServer_DeadlineExceeded(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	stored, _ := bson.Marshal(bson.D{{Key: "name", Value: "John"}})
+	base := commandMockHandler(t, stored)
+	s := newConnectedTestServer(t, func(opCode int32, payload []byte) []byte {
+		request, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+		if err == nil && request.Body.Lookup("find").Type != 0 {
+			<-hang
+		}
+		return base(opCode, payload)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := s.Find(ctx, &pb.FindRequest{Db: "test", Collection: "col"})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestServer_FindRejectsOversizedResults(t *testing.T) {
+	// Every batch holds a 1 MiB document of a cursor that never ends, more
+	// than a gRPC client accepts by default
+	big := bson.D{{Key: "data", Value: strings.Repeat("x", 1<<20)}}
+	var mu sync.Mutex
+	var killed int
+	mock := newMockReplicaSet(t, 1)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		key := "nextBatch"
+		switch {
+		case command.Body.Lookup("find").Type != 0:
+			key = "firstBatch"
+		case command.Body.Lookup("killCursors").Type != 0:
+			mu.Lock()
+			killed++
+			mu.Unlock()
+			return bson.D{{Key: "ok", Value: 1.0}}
+		case command.Body.Lookup("getMore").Type == 0:
+			return bson.D{{Key: "ok", Value: 1.0}}
+		}
+		return bson.D{
+			{Key: "cursor", Value: bson.D{{Key: key, Value: bson.A{big}}, {Key: "id", Value: int64(9)}, {Key: "ns", Value: "test.col"}}},
+			{Key: "ok", Value: 1.0},
+		}
+	})
+	s := NewServer(connectTestReplset(t, mock))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := s.Find(ctx, &pb.FindRequest{Db: "test", Collection: "col"})
+	if status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), "response limit of 4194304 bytes") {
+		t.Fatalf("Expected ResourceExhausted at the default limit, got %v", err)
+	}
+	mu.Lock()
+	n := killed
+	mu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected the cursor to be killed, got %d killCursors", n)
+	}
+
+	s.MaxFindResponseSize = 10 << 20
+	if _, err := s.Find(ctx, &pb.FindRequest{Db: "test", Collection: "col"}); status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), "10485760") {
+		t.Errorf("Expected ResourceExhausted at the configured limit, got %v", err)
+	}
 }
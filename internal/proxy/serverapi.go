@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+
+	"mongo-playground/internal/bson"
+)
+
+// ServerAPIVersion1 is the only stable API version servers define
+const ServerAPIVersion1 = "1"
+
+// ServerAPI declares the stable API version every command is run with.
+// Servers then reject commands and options outside that version when
+// Strict is set, and deprecated ones when DeprecationErrors is set.
+type ServerAPI struct {
+	Version           string
+	Strict            bool
+	DeprecationErrors bool
+}
+
+// validate rejects versions servers do not define
+func (a *ServerAPI) validate() error {
+	if a.Version != ServerAPIVersion1 {
+		return fmt.Errorf("unsupported server API version %q", a.Version)
+	}
+	return nil
+}
+
+// withServerAPI declares api on command. getMore runs with the version of
+// the command that opened the cursor and must not declare one, and commands
+// that already declare a version keep it.
+func withServerAPI(command bson.D, api *ServerAPI) bson.D {
+	if api == nil || len(command) == 0 || command[0].Key == "getMore" {
+		return command
+	}
+	if _, ok := command.Lookup("apiVersion"); ok {
+		return command
+	}
+	command = append(command[:len(command):len(command)], bson.E{Key: "apiVersion", Value: api.Version})
+	if api.Strict {
+		command = append(command, bson.E{Key: "apiStrict", Value: true})
+	}
+	if api.DeprecationErrors {
+		command = append(command, bson.E{Key: "apiDeprecationErrors", Value: true})
+	}
+	return command
+}
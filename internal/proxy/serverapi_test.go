@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+func TestReplsetServerAPIHandshakeUsesHello(t *testing.T) {
+	var mu sync.Mutex
+	var queries int
+	var commands []bson.Raw
+	server, err := newMockLegacyServer(func(opCode int32, payload []byte) []byte {
+		if opCode == OpQuery {
+			mu.Lock()
+			queries++
+			mu.Unlock()
+			return nil
+		}
+		command, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+		if err != nil {
+			t.Errorf("mock received invalid OP_MSG: %v", err)
+			return nil
+		}
+		mu.Lock()
+		commands = append(commands, command.Body)
+		mu.Unlock()
+		return testOpMsgPayload(t, bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "helloOk", Value: true}, {Key: "maxWireVersion", Value: 21}, {Key: "ok", Value: 1.0}})
+	})
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	opts := DefaultOptions()
+	opts.ServerAPI = &ServerAPI{Version: ServerAPIVersion1, Strict: true}
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+	if _, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if queries != 0 {
+		t.Errorf("Expected no OP_QUERY with a server API, got %d", queries)
+	}
+	var handshakes int
+	var pinged bool
+	for _, command := range commands {
+		if command.Lookup("client").Type != 0 {
+			handshakes++
+			if command.Lookup("hello").Int32() != 1 {
+				t.Errorf("Expected the handshake to be hello, got %v", command)
+			}
+		}
+		pinged = pinged || command.Lookup("ping").Type != 0
+		if command.Lookup("apiVersion").StringValue() != ServerAPIVersion1 || !command.Lookup("apiStrict").Boolean() {
+			t.Errorf("Expected the server API on every command, got %v", command)
+		}
+		if command.Lookup("apiDeprecationErrors").Type != 0 {
+			t.Errorf("Expected apiDeprecationErrors to be omitted, got %v", command)
+		}
+	}
+	if handshakes == 0 || !pinged {
+		t.Errorf("Expected the handshake and ping over OP_MSG, got %v", commands)
+	}
+}
+
+func TestWithServerAPI(t *testing.T) {
+	api := &ServerAPI{Version: ServerAPIVersion1, DeprecationErrors: true}
+	tests := []struct {
+		name    string
+		command bson.D
+		want    bson.D
+	}{
+		{
+			name:    "find",
+			command: bson.D{{Key: "find", Value: "col"}},
+			want:    bson.D{{Key: "find", Value: "col"}, {Key: "apiVersion", Value: "1"}, {Key: "apiDeprecationErrors", Value: true}},
+		},
+		{
+			name:    "getMore",
+			command: bson.D{{Key: "getMore", Value: int64(1)}, {Key: "collection", Value: "col"}},
+			want:    bson.D{{Key: "getMore", Value: int64(1)}, {Key: "collection", Value: "col"}},
+		},
+		{
+			name:    "declared version",
+			command: bson.D{{Key: "ping", Value: 1}, {Key: "apiVersion", Value: "2"}},
+			want:    bson.D{{Key: "ping", Value: 1}, {Key: "apiVersion", Value: "2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withServerAPI(tt.command, api)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+	command := bson.D{{Key: "ping", Value: 1}}
+	if got := withServerAPI(command, nil); len(got) != 1 {
+		t.Errorf("Expected no server API without one declared, got %v", got)
+	}
+}
+
+func TestReplsetRejectsUnknownServerAPIVersion(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ServerAPI = &ServerAPI{Version: "2"}
+	replset := NewReplsetWithOptions([]string{"127.0.0.1:1"}, opts)
+	if err := replset.Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "server API version") {
+		t.Errorf("Expected the server API version to be rejected, got %v", err)
+	}
+}
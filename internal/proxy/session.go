@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// sessionExpiryMargin is how long before the server side timeout a pooled
+// session is considered expired, leaving time for the operation to arrive
+const sessionExpiryMargin = time.Minute
+
+// serverSession is a logical session on the server, identified by its lsid
+type serverSession struct {
+	id        bson.Binary
+	lastUsed  time.Time
+	txnNumber int64
+
+	// dirty is set when a network error left the state of the session on
+	// the server unknown, so it must not be reused
+	dirty bool
+}
+
+// newServerSession creates a session with a random UUID
+func newServerSession() (*serverSession, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return nil, fmt.Errorf("failed to generate session id: %w", err)
+	}
+	// Version 4, variant 10 as in RFC 4122
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return &serverSession{id: bson.Binary{Subtype: 4, Data: uuid}, lastUsed: time.Now()}, nil
+}
+
+// lsid returns the session document sent with commands
+func (s *serverSession) lsid() bson.D {
+	return bson.D{{Key: "id", Value: s.id}}
+}
+
+// expired reports whether the server may time the session out before an
+// operation started now reaches it
+func (s *serverSession) expired(timeout time.Duration) bool {
+	return time.Since(s.lastUsed) > timeout-sessionExpiryMargin
+}
+
+// sessionPool reuses server sessions, most recently used first, so that the
+// server keeps few of them open
+type sessionPool struct {
+	mu       sync.Mutex
+	sessions []*serverSession
+}
+
+// checkOut returns a pooled session that has not expired under timeout or
+// creates a new one
+func (p *sessionPool) checkOut(timeout time.Duration) (*serverSession, error) {
+	p.mu.Lock()
+	for len(p.sessions) > 0 {
+		s := p.sessions[len(p.sessions)-1]
+		p.sessions = p.sessions[:len(p.sessions)-1]
+		if !s.expired(timeout) {
+			p.mu.Unlock()
+			return s, nil
+		}
+	}
+	p.mu.Unlock()
+	return newServerSession()
+}
+
+// checkIn returns a session to the pool unless it is dirty or expired.
+// Expired sessions at the bottom of the pool are dropped as well.
+func (p *sessionPool) checkIn(s *serverSession, timeout time.Duration) {
+	s.lastUsed = time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.sessions) > 0 && p.sessions[0].expired(timeout) {
+		p.sessions = p.sessions[1:]
+	}
+	if !s.dirty && !s.expired(timeout) {
+		p.sessions = append(p.sessions, s)
+	}
+}
+
+// len returns the number of pooled sessions
+func (p *sessionPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// drain removes and returns every pooled session
+func (p *sessionPool) drain() []*serverSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessions := p.sessions
+	p.sessions = nil
+	return sessions
+}
+
+// maxEndSessions is the number of sessions one endSessions command may end
+const maxEndSessions = 10000
+
+// endSessionsTimeout bounds the endSessions commands sent on Disconnect
+const endSessionsTimeout = 5 * time.Second
+
+// endSessions tells the server that the pooled sessions will not be used
+// again, so that it can release them before they time out. Errors are
+// ignored: the server times the sessions out anyway.
+func (r *Replset) endSessions() {
+	sessions := r.sessions.drain()
+	if len(sessions) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), endSessionsTimeout)
+	defer cancel()
+	server, err := r.selectServer(ctx, selectReadable(ReadPreference{Mode: ReadPrimaryPreferred}, r.opts.HeartbeatInterval, r.opts.LocalThreshold))
+	if err != nil {
+		return
+	}
+	for start := 0; start < len(sessions); start += maxEndSessions {
+		end := min(start+maxEndSessions, len(sessions))
+		ids := make(bson.A, 0, end-start)
+		for _, s := range sessions[start:end] {
+			ids = append(ids, s.lsid())
+		}
+		command := bson.D{{Key: "endSessions", Value: ids}, {Key: "$db", Value: "admin"}}
+		if _, err := r.sendCommandTo(ctx, server, command, nil); err != nil {
+			return
+		}
+	}
+}
+
+// clusterClock holds the greatest $clusterTime seen in replies, which is
+// gossiped back to the servers with every command
+type clusterClock struct {
+	mu   sync.Mutex
+	time bson.Raw
+}
+
+// advance replaces the cluster time if clusterTime is later
+func (c *clusterClock) advance(clusterTime bson.Raw) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.time = laterClusterTime(c.time, clusterTime)
+}
+
+// get returns the cluster time, or nil before any reply carried one
+func (c *clusterClock) get() bson.Raw {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.time
+}
+
+// laterClusterTime returns the later of two $clusterTime documents,
+// ignoring ones without a clusterTime timestamp
+func laterClusterTime(a, b bson.Raw) bson.Raw {
+	tb := b.Lookup("clusterTime")
+	if tb.Type != bson.TypeTimestamp {
+		return a
+	}
+	if a == nil || tb.Timestamp().Compare(a.Lookup("clusterTime").Timestamp()) > 0 {
+		return b
+	}
+	return a
+}
+
+// SessionOptions configures a client session
+type SessionOptions struct {
+	// CausalConsistency makes every read in the session observe the
+	// operations the session ran before it, even on a secondary. Nil means
+	// enabled.
+	CausalConsistency *bool
+
+	// DefaultTransactionOptions apply to the transactions of the session
+	// where TransactionOptions leave a field unset
+	DefaultTransactionOptions TransactionOptions
+}
+
+// errSessionEnded is returned for operations in a session after EndSession
+var errSessionEnded = errors.New("session has ended")
+
+// Session is a client session. Operations run with a context returned by
+// WithSession share its logical session id, and with causal consistency
+// its reads wait for the cluster time of its earlier operations. A Session
+// is not safe for concurrent use.
+type Session struct {
+	replset *Replset
+	opts    SessionOptions
+	causal  bool
+	server  *serverSession
+	ended   bool
+	txn     transaction
+
+	clusterTime   bson.Raw
+	operationTime bson.Timestamp
+}
+
+// StartSession starts a client session. The logical session is taken from
+// the pool when the first command runs in the session.
+func (r *Replset) StartSession(opts SessionOptions) (*Session, error) {
+	if !r.IsConnected() {
+		return nil, errNotConnected
+	}
+	return &Session{replset: r, opts: opts, causal: opts.CausalConsistency == nil || *opts.CausalConsistency}, nil
+}
+
+// sessionKey is the context key for the session of an operation
+type sessionKey struct{}
+
+// WithSession returns a context whose operations run in s
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// sessionFromContext returns the session of ctx, or nil
+func sessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// ClusterTime returns the latest $clusterTime the session has seen
+func (s *Session) ClusterTime() bson.Raw {
+	return s.clusterTime
+}
+
+// OperationTime returns the operationTime of the last reply in the session
+func (s *Session) OperationTime() bson.Timestamp {
+	return s.operationTime
+}
+
+// AdvanceClusterTime moves the cluster time of the session forward, for
+// example to one observed in another session
+func (s *Session) AdvanceClusterTime(clusterTime bson.Raw) {
+	s.clusterTime = laterClusterTime(s.clusterTime, clusterTime)
+}
+
+// AdvanceOperationTime moves the operation time of the session forward, so
+// that its next causally consistent read observes operationTime
+func (s *Session) AdvanceOperationTime(operationTime bson.Timestamp) {
+	if operationTime.Compare(s.operationTime) > 0 {
+		s.operationTime = operationTime
+	}
+}
+
+// EndSession aborts the transaction in progress, if any, and returns the
+// logical session to the pool. The session cannot be used afterwards.
+func (s *Session) EndSession() {
+	if s.ended {
+		return
+	}
+	if s.inTransaction() {
+		ctx, cancel := context.WithTimeout(context.Background(), endSessionsTimeout)
+		_ = s.AbortTransaction(ctx)
+		cancel()
+	}
+	s.ended = true
+	if s.server != nil {
+		s.replset.sessions.checkIn(s.server, s.replset.Topology().SessionTimeout())
+		s.server = nil
+	}
+}
+
+// serverSession returns the logical session, checking one out of the pool
+// on first use
+func (s *Session) serverSession(timeout time.Duration) (*serverSession, error) {
+	if s.ended {
+		return nil, errSessionEnded
+	}
+	if s.server == nil {
+		server, err := s.replset.sessions.checkOut(timeout)
+		if err != nil {
+			return nil, err
+		}
+		s.server = server
+	}
+	return s.server, nil
+}
+
+// observe advances the session times from a reply
+func (s *Session) observe(reply bson.Raw) {
+	s.AdvanceClusterTime(reply.Lookup("$clusterTime").Document())
+	s.AdvanceOperationTime(reply.Lookup("operationTime").Timestamp())
+}
+
+// withAfterClusterTime returns a copy of a read command whose readConcern
+// waits for the operation time of the session. It leaves commands alone
+// outside causally consistent sessions, before the first operation and
+// when they already set afterClusterTime.
+func (s *Session) withAfterClusterTime(command bson.D) (bson.D, error) {
+	if !s.causal || s.operationTime.IsZero() {
+		return command, nil
+	}
+	var readConcern bson.D
+	if v, ok := command.Lookup("readConcern"); ok {
+		switch rc := v.(type) {
+		case bson.D:
+			readConcern = append(readConcern, rc...)
+		case bson.Raw:
+			doc, err := bson.Unmarshal(rc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid readConcern: %w", err)
+			}
+			readConcern = doc
+		default:
+			return nil, fmt.Errorf("invalid readConcern of type %T", v)
+		}
+	}
+	if _, ok := readConcern.Lookup("afterClusterTime"); ok {
+		return command, nil
+	}
+	readConcern = append(readConcern, bson.E{Key: "afterClusterTime", Value: s.operationTime})
+	return append(bson.D(nil), command...).Set("readConcern", readConcern), nil
+}
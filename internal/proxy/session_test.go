@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+func TestSessionPool(t *testing.T) {
+	var p sessionPool
+	timeout := 30 * time.Minute
+
+	s, err := p.checkOut(timeout)
+	if err != nil {
+		t.Fatalf("checkOut failed: %v", err)
+	}
+	if s.id.Subtype != 4 || len(s.id.Data) != 16 || s.id.Data[6]>>4 != 4 {
+		t.Errorf("Expected a version 4 UUID, got %v", s.id)
+	}
+	p.checkIn(s, timeout)
+	if reused, _ := p.checkOut(timeout); reused != s {
+		t.Error("Expected the session to be reused")
+	}
+
+	// Sessions close to the server timeout are discarded
+	s.lastUsed = time.Now().Add(-timeout)
+	p.sessions = append(p.sessions, s)
+	if fresh, _ := p.checkOut(timeout); fresh == s {
+		t.Error("Expected an expired session to be replaced")
+	}
+
+	s.dirty = true
+	p.checkIn(s, timeout)
+	if p.len() != 0 {
+		t.Error("Expected a dirty session to be discarded")
+	}
+}
+
+// clusterTimeHandler answers every command with a cluster time and
+// operation time one tick later than the previous reply
+func clusterTimeHandler(commands *commandRecorder) func(member int, command *Message) bson.D {
+	return func(member int, command *Message) bson.D {
+		tick := bson.Timestamp{T: 100, I: uint32(commands.record(command))}
+		reply := bson.D{{Key: "ok", Value: 1.0}}
+		if command.Body.Lookup("find").Type != 0 {
+			reply = bson.D{
+				{Key: "cursor", Value: bson.D{{Key: "id", Value: int64(0)}, {Key: "ns", Value: "test.col"}, {Key: "firstBatch", Value: bson.A{}}}},
+				{Key: "ok", Value: 1.0},
+			}
+		}
+		return append(reply,
+			bson.E{Key: "$clusterTime", Value: bson.D{{Key: "clusterTime", Value: tick}, {Key: "signature", Value: bson.D{}}}},
+			bson.E{Key: "operationTime", Value: tick},
+		)
+	}
+}
+
+func TestReplsetGossipsClusterTime(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var commands commandRecorder
+	mock.setHandler(clusterTimeHandler(&commands))
+	replset := connectTestReplset(t, mock)
+
+	for i := 0; i < 2; i++ {
+		if _, err := replset.SendQuery(context.Background(), findCommand()); err != nil {
+			t.Fatalf("SendQuery failed: %v", err)
+		}
+	}
+	sent := commands.all()
+	if sent[0].Lookup("$clusterTime").Type != 0 {
+		t.Errorf("Expected no $clusterTime before any reply, got %v", sent[0])
+	}
+	if got := sent[1].Lookup("$clusterTime", "clusterTime").Timestamp(); got != (bson.Timestamp{T: 100, I: 1}) {
+		t.Errorf("Expected the cluster time of the first reply, got %v", got)
+	}
+}
+
+func TestSessionCausalConsistency(t *testing.T) {
+	mock := newMockReplicaSet(t, 2)
+	var commands commandRecorder
+	mock.setHandler(clusterTimeHandler(&commands))
+	opts := DefaultOptions()
+	opts.ReadConcern = &ReadConcern{Level: ReadConcernMajority}
+	replset := NewReplsetWithOptions(mock.addrs, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	session, err := replset.StartSession(SessionOptions{})
+	if err != nil {
+		t.Fatalf("StartSession failed: %v", err)
+	}
+	defer session.EndSession()
+	sessionCtx := WithSession(ctx, session)
+
+	if _, err := insertCommand(t, replset); err != nil {
+		t.Fatalf("insert outside the session failed: %v", err)
+	}
+	documents := []bson.Raw{mustMarshal(t, bson.D{{Key: "_id", Value: 1}})}
+	if _, err := replset.SendCommand(sessionCtx, bson.D{{Key: "insert", Value: "col"}, {Key: "$db", Value: "test"}}, documents); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	if got := session.OperationTime(); got != (bson.Timestamp{T: 100, I: 2}) {
+		t.Errorf("Expected the operation time of the insert, got %v", got)
+	}
+
+	readCtx := WithReadPreference(sessionCtx, ReadPreference{Mode: ReadSecondary})
+	cursor, err := replset.Find(readCtx, "test", "col", nil, CursorOptions{})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	cursor.Close(ctx)
+
+	sent := commands.all()
+	insert, find := sent[1], sent[2]
+	if insert.Lookup("lsid").Type == 0 || insert.Lookup("lsid").Document().String() != find.Lookup("lsid").Document().String() {
+		t.Errorf("Expected both commands to carry the session lsid, got %v and %v", insert, find)
+	}
+	if got := find.Lookup("readConcern", "afterClusterTime").Timestamp(); got != (bson.Timestamp{T: 100, I: 2}) {
+		t.Errorf("Expected afterClusterTime of the insert, got %v", find)
+	}
+	if level := find.Lookup("readConcern", "level").StringValue(); level != ReadConcernMajority {
+		t.Errorf("Expected the read concern level to be kept, got %v", find)
+	}
+
+	// Without causal consistency reads do not wait
+	causal := false
+	other, _ := replset.StartSession(SessionOptions{CausalConsistency: &causal})
+	other.AdvanceOperationTime(bson.Timestamp{T: 100, I: 2})
+	if _, err := replset.SendQuery(WithSession(ctx, other), findCommand()); err != nil {
+		t.Fatalf("SendQuery failed: %v", err)
+	}
+	sent = commands.all()
+	if last := sent[len(sent)-1]; last.Lookup("readConcern", "afterClusterTime").Type != 0 {
+		t.Errorf("Expected no afterClusterTime without causal consistency, got %v", last)
+	}
+	other.EndSession()
+	if _, err := replset.SendQuery(WithSession(ctx, other), findCommand()); err == nil {
+		t.Error("Expected an ended session to be rejected")
+	}
+}
+
+func TestSessionReusesLsidAndEndsSessionsOnDisconnect(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var commands commandRecorder
+	mock.setHandler(clusterTimeHandler(&commands))
+	replset := connectTestReplset(t, mock)
+	ctx := context.Background()
+
+	lsids := make([]string, 2)
+	for i := range lsids {
+		session, err := replset.StartSession(SessionOptions{})
+		if err != nil {
+			t.Fatalf("StartSession failed: %v", err)
+		}
+		if _, err := replset.SendQuery(WithSession(ctx, session), findCommand()); err != nil {
+			t.Fatalf("SendQuery failed: %v", err)
+		}
+		session.EndSession()
+		sent := commands.all()
+		lsids[i] = sent[len(sent)-1].Lookup("lsid").Document().String()
+	}
+	if lsids[0] != lsids[1] {
+		t.Errorf("Expected the pooled lsid to be reused, got %v and %v", lsids[0], lsids[1])
+	}
+
+	replset.Disconnect()
+	sent := commands.all()
+	last := sent[len(sent)-1]
+	if last.Lookup("endSessions").Type != bson.TypeArray {
+		t.Fatalf("Expected endSessions on Disconnect, got %v", last)
+	}
+	ended, _ := last.Lookup("endSessions").Array().Values()
+	if len(ended) != 1 || ended[0].Document().String() != lsids[0] {
+		t.Errorf("Expected endSessions for %v, got %v", lsids[0], last)
+	}
+}
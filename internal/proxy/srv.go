@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSRVRescanInterval is how often the SRV records of a mongodb+srv
+// connection string are resolved again
+const DefaultSRVRescanInterval = 60 * time.Second
+
+// Resolver looks up the DNS records of mongodb+srv connection strings.
+// *net.Resolver implements it; tests can substitute an in-process fake.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// txtOptions are the only options a TXT record may set
+var txtOptions = map[string]bool{
+	"authsource": true,
+	"replicaset": true,
+}
+
+// srvParentDomain returns the domain SRV targets must belong to, checking
+// that host is a valid mongodb+srv host name
+func srvParentDomain(host string) (string, error) {
+	if strings.Contains(host, ":") {
+		return "", fmt.Errorf("mongodb+srv host %q must not have a port", host)
+	}
+	if strings.Contains(host, ",") {
+		return "", fmt.Errorf("mongodb+srv requires exactly one host")
+	}
+	parts := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(parts) < 3 {
+		return "", fmt.Errorf("mongodb+srv host %q needs at least three domain parts", host)
+	}
+	return "." + strings.ToLower(strings.Join(parts[1:], ".")), nil
+}
+
+// lookupSRVHosts resolves the seed list published under the SRV records of
+// host. Targets outside the parent domain of host are rejected.
+func lookupSRVHosts(ctx context.Context, resolver Resolver, host, service string) ([]string, error) {
+	parent, err := srvParentDomain(host)
+	if err != nil {
+		return nil, err
+	}
+	_, records, err := resolver.LookupSRV(ctx, service, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up SRV records for %s: %w", host, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no SRV records found for %s", host)
+	}
+
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		target := strings.ToLower(strings.TrimSuffix(record.Target, "."))
+		if !strings.HasSuffix(target, parent) {
+			return nil, fmt.Errorf("SRV record %s is not in the domain %s", record.Target, parent[1:])
+		}
+		hosts = append(hosts, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	return hosts, nil
+}
+
+// lookupTXTOptions returns the options published in the TXT record of host
+// as a query string. At most one record is allowed.
+func lookupTXTOptions(ctx context.Context, resolver Resolver, host string) (string, error) {
+	records, err := resolver.LookupTXT(ctx, host)
+	if err != nil {
+		// A missing TXT record is not an error
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to look up TXT record for %s: %w", host, err)
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	if len(records) > 1 {
+		return "", fmt.Errorf("multiple TXT records found for %s", host)
+	}
+
+	query := records[0]
+	for _, pair := range strings.Split(query, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+		if !txtOptions[strings.ToLower(key)] {
+			return "", fmt.Errorf("TXT record for %s sets unsupported option %q", host, key)
+		}
+	}
+	return query, nil
+}
+
+// pollSRV resolves the SRV records again every SRVRescanInterval and
+// updates the seeds until the topology is closed. Polling stops once the
+// topology is known to be a replica set or a single member: the members of
+// a replica set come from its primary, and a single member never changes.
+func (t *topology) pollSRV() {
+	ticker := time.NewTicker(t.opts.SRVRescanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+		t.mu.Lock()
+		kind := t.desc.Kind
+		t.mu.Unlock()
+		if kind != TopologyUnknown {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), t.opts.ConnectTimeout)
+		hosts, err := lookupSRVHosts(ctx, t.opts.Resolver, t.opts.srvHost, t.opts.srvServiceName)
+		cancel()
+		// On errors the last successfully resolved hosts stay in use
+		if err == nil {
+			t.updateSeeds(hosts)
+		}
+	}
+}
+
+// updateSeeds adds newly published hosts to the topology and drops hosts
+// that are no longer published. Members that answered a check stay, since
+// their replica set configuration is authoritative.
+func (t *topology) updateSeeds(hosts []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	published := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		addr := normalizeAddr(host)
+		published[addr] = true
+		if _, ok := t.desc.Servers[addr]; !ok {
+			t.desc.Servers[addr] = unknownServer(addr, nil)
+		}
+	}
+	for addr, server := range t.desc.Servers {
+		if !published[addr] && server.Kind == ServerUnknown {
+			delete(t.desc.Servers, addr)
+		}
+	}
+	t.syncMonitorsLocked()
+
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
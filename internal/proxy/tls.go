@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLSOptions configures TLS for the connections to the replica set members
+type TLSOptions struct {
+	// CAFile is a PEM file with the certificate authorities used to verify
+	// the servers. Empty uses the system roots.
+	CAFile string
+
+	// CertFile and KeyFile are the PEM encoded client certificate and its
+	// private key, required for MONGODB-X509. KeyFile may be empty when
+	// CertFile holds both.
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the host name the server certificates are
+	// verified against, which defaults to the host of each member
+	ServerName string
+
+	// InsecureSkipVerify disables server certificate verification. It is
+	// meant for development only.
+	InsecureSkipVerify bool
+
+	// AllowInvalidHostnames verifies the server certificates against the
+	// certificate authorities but not against the host name. It is meant
+	// for development only.
+	AllowInvalidHostnames bool
+}
+
+// config loads the files referenced by the options into a tls.Config
+func (o *TLSOptions) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+	}
+
+	if o.CertFile != "" {
+		keyFile := o.KeyFile
+		if keyFile == "" {
+			keyFile = o.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	} else if o.KeyFile != "" {
+		return nil, fmt.Errorf("TLS key file given without a certificate file")
+	}
+
+	if o.AllowInvalidHostnames && !o.InsecureSkipVerify {
+		// crypto/tls verifies the host name along with the chain, so both
+		// are skipped and the chain is verified on its own
+		roots := cfg.RootCAs
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+
+	return cfg, nil
+}
+
+// dialMember opens a connection to addr, negotiating TLS when it is configured.
+// The TLS handshake is bounded by ctx as well.
+func dialMember(ctx context.Context, addr string, opts Options) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: opts.ConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	if opts.tlsConfig == nil {
+		return conn, nil
+	}
+
+	cfg := opts.tlsConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// testPKI is a locally generated certificate authority with a server and a
+// client certificate, written to PEM files
+type testPKI struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	pool       *x509.CertPool
+	serverCert tls.Certificate
+}
+
+// newTestPKI issues a server certificate for dnsName and a client
+// certificate with the given subject
+func newTestPKI(t *testing.T, dnsName string, clientSubject pkix.Name) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, caDER := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("Failed to parse CA: %v", err)
+	}
+
+	serverKey, serverDER := issueTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsName},
+		DNSNames:    []string{dnsName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	clientKey, clientDER := issueTestCert(t, &x509.Certificate{
+		Subject:     clientSubject,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	pki := &testPKI{
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "client.pem"),
+		keyFile:  filepath.Join(dir, "client-key.pem"),
+		pool:     x509.NewCertPool(),
+		serverCert: tls.Certificate{
+			Certificate: [][]byte{serverDER},
+			PrivateKey:  serverKey,
+		},
+	}
+	pki.pool.AddCert(ca)
+	writePEM(t, pki.caFile, "CERTIFICATE", caDER)
+	writePEM(t, pki.certFile, "CERTIFICATE", clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	writePEM(t, pki.keyFile, "EC PRIVATE KEY", keyDER)
+	return pki
+}
+
+func issueTestCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return key, der
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// newMockTLSServer starts a mock server that requires TLS with a client
+// certificate signed by the test CA
+func newMockTLSServer(t *testing.T, pki *testPKI, handler mockHandler) *mockMongoServer {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pki.serverCert},
+		ClientCAs:    pki.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start TLS mock server: %v", err)
+	}
+	server := &mockMongoServer{listener: listener, handler: handler}
+	go server.acceptConnections()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// helloHandler answers every command as a writable primary
+func helloHandler(t *testing.T) mockHandler {
+	return func(opCode int32, payload []byte) []byte {
+		return testOpMsgPayload(t, bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "maxWireVersion", Value: 21}, {Key: "ok", Value: 1.0}})
+	}
+}
+
+func connectTLS(server *mockMongoServer, opts Options) (*Replset, error) {
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return replset, nil
+}
+
+func TestReplsetTLS(t *testing.T) {
+	pki := newTestPKI(t, "mongo.test", pkix.Name{CommonName: "client"})
+	server := newMockTLSServer(t, pki, helloHandler(t))
+
+	opts := DefaultOptions()
+	opts.TLS = &TLSOptions{
+		CAFile:     pki.caFile,
+		CertFile:   pki.certFile,
+		KeyFile:    pki.keyFile,
+		ServerName: "mongo.test",
+	}
+	replset, err := connectTLS(server, opts)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := replset.SendCommand(ctx, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}, nil); err != nil {
+		t.Fatalf("SendCommand failed: %v", err)
+	}
+	// The monitor connects over TLS as well
+	if desc := replset.Topology().Servers[server.Addr()]; desc.Kind != ServerStandalone {
+		t.Errorf("Expected the monitor to describe the server, got %+v", desc)
+	}
+}
+
+func TestReplsetTLSVerification(t *testing.T) {
+	pki := newTestPKI(t, "mongo.test", pkix.Name{CommonName: "client"})
+	other := newTestPKI(t, "mongo.test", pkix.Name{CommonName: "client"})
+	server := newMockTLSServer(t, pki, helloHandler(t))
+
+	tests := []struct {
+		name string
+		tls  TLSOptions
+		fail string
+	}{
+		{
+			name: "server name defaults to the member host",
+			tls:  TLSOptions{CAFile: pki.caFile, CertFile: pki.certFile, KeyFile: pki.keyFile},
+			fail: "certificate",
+		},
+		{
+			name: "unknown certificate authority",
+			tls:  TLSOptions{CAFile: other.caFile, CertFile: pki.certFile, KeyFile: pki.keyFile, ServerName: "mongo.test"},
+			fail: "certificate",
+		},
+		{
+			name: "insecure skip verify",
+			tls:  TLSOptions{CertFile: pki.certFile, KeyFile: pki.keyFile, InsecureSkipVerify: true},
+		},
+		{
+			name: "allow invalid hostnames",
+			tls:  TLSOptions{CAFile: pki.caFile, CertFile: pki.certFile, KeyFile: pki.keyFile, AllowInvalidHostnames: true},
+		},
+		{
+			name: "allow invalid hostnames still verifies the chain",
+			tls:  TLSOptions{CAFile: other.caFile, CertFile: pki.certFile, KeyFile: pki.keyFile, AllowInvalidHostnames: true},
+			fail: "certificate",
+		},
+		{
+			name: "missing CA file",
+			tls:  TLSOptions{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+			fail: "invalid TLS options",
+		},
+		{
+			name: "key without certificate",
+			tls:  TLSOptions{KeyFile: pki.keyFile},
+			fail: "invalid TLS options",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			tlsOpts := tt.tls
+			opts.TLS = &tlsOpts
+			replset, err := connectTLS(server, opts)
+			if tt.fail == "" {
+				if err != nil {
+					t.Fatalf("Connect failed: %v", err)
+				}
+				replset.Disconnect()
+				return
+			}
+			if err == nil {
+				replset.Disconnect()
+				t.Fatal("Expected Connect to fail")
+			}
+			if !strings.Contains(err.Error(), tt.fail) {
+				t.Errorf("Expected an error about %q, got %v", tt.fail, err)
+			}
+		})
+	}
+}
+
+func TestReplsetX509Authentication(t *testing.T) {
+	subject := pkix.Name{CommonName: "client", Organization: []string{"Proxy"}}
+	pki := newTestPKI(t, "mongo.test", subject)
+
+	var mu sync.Mutex
+	var authenticated []bson.Raw
+	server := newMockTLSServer(t, pki, func(opCode int32, payload []byte) []byte {
+		request, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+		if err != nil {
+			t.Errorf("mock received invalid OP_MSG: %v", err)
+			return testOpMsgPayload(t, bson.D{{Key: "ok", Value: 0.0}})
+		}
+		if request.Body.Lookup("authenticate").Type != 0 {
+			mu.Lock()
+			authenticated = append(authenticated, request.Body)
+			mu.Unlock()
+			return testOpMsgPayload(t, bson.D{{Key: "user", Value: "CN=client,O=Proxy"}, {Key: "ok", Value: 1.0}})
+		}
+		return testOpMsgPayload(t, bson.D{{Key: "isWritablePrimary", Value: true}, {Key: "maxWireVersion", Value: 21}, {Key: "ok", Value: 1.0}})
+	})
+
+	opts := DefaultOptions()
+	opts.TLS = &TLSOptions{CAFile: pki.caFile, CertFile: pki.certFile, KeyFile: pki.keyFile, ServerName: "mongo.test"}
+	opts.Credential = &Credential{Mechanism: MechanismX509}
+	replset, err := connectTLS(server, opts)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(authenticated) != 1 {
+		t.Fatalf("Expected one authenticate command, got %d", len(authenticated))
+	}
+	command := authenticated[0]
+	if command.Lookup("mechanism").StringValue() != MechanismX509 || command.Lookup("$db").StringValue() != "$external" {
+		t.Errorf("Unexpected authenticate command %v", command)
+	}
+	if command.Lookup("user").Type != 0 {
+		t.Errorf("Expected the user to be derived from the certificate, got %v", command)
+	}
+}
+
+func TestCredentialValidate(t *testing.T) {
+	withCert := &TLSOptions{CertFile: "client.pem"}
+	tests := []struct {
+		cred  Credential
+		tls   *TLSOptions
+		valid bool
+	}{
+		{cred: Credential{Username: "u", Password: "p"}, valid: true},
+		{cred: Credential{Password: "p"}},
+		{cred: Credential{Mechanism: MechanismX509}, tls: withCert, valid: true},
+		{cred: Credential{Mechanism: MechanismX509}},
+		{cred: Credential{Mechanism: MechanismX509, Password: "p"}, tls: withCert},
+		{cred: Credential{Mechanism: MechanismX509, Source: "admin"}, tls: withCert},
+		{cred: Credential{Username: "u", Mechanism: "PLAIN"}},
+	}
+	for _, tt := range tests {
+		if err := tt.cred.validate(tt.tls); (err == nil) != tt.valid {
+			t.Errorf("validate(%+v) = %v, expected valid %v", tt.cred, err, tt.valid)
+		}
+	}
+}
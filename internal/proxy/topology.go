@@ -0,0 +1,468 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// ServerKind is the role of a member as reported by hello
+type ServerKind int
+
+// Server kinds, following the server discovery and monitoring specification
+const (
+	ServerUnknown ServerKind = iota
+	ServerStandalone
+	ServerMongos
+	ServerRSPrimary
+	ServerRSSecondary
+	ServerRSArbiter
+	ServerRSOther
+	ServerRSGhost
+)
+
+func (k ServerKind) String() string {
+	switch k {
+	case ServerStandalone:
+		return "Standalone"
+	case ServerMongos:
+		return "Mongos"
+	case ServerRSPrimary:
+		return "RSPrimary"
+	case ServerRSSecondary:
+		return "RSSecondary"
+	case ServerRSArbiter:
+		return "RSArbiter"
+	case ServerRSOther:
+		return "RSOther"
+	case ServerRSGhost:
+		return "RSGhost"
+	}
+	return "Unknown"
+}
+
+// TopologyKind describes the deployment as a whole
+type TopologyKind int
+
+// Topology kinds
+const (
+	TopologyUnknown TopologyKind = iota
+	TopologySingle
+	TopologyReplicaSetNoPrimary
+	TopologyReplicaSetWithPrimary
+)
+
+func (k TopologyKind) String() string {
+	switch k {
+	case TopologySingle:
+		return "Single"
+	case TopologyReplicaSetNoPrimary:
+		return "ReplicaSetNoPrimary"
+	case TopologyReplicaSetWithPrimary:
+		return "ReplicaSetWithPrimary"
+	}
+	return "Unknown"
+}
+
+// ServerDescription is what the monitor learned about a member from its last hello
+type ServerDescription struct {
+	Addr       string
+	Kind       ServerKind
+	SetName    string
+	SetVersion int64
+	ElectionID bson.ObjectID
+	Primary    string
+	Me         string
+	Hosts      []string
+	Passives   []string
+	Arbiters   []string
+	Tags       map[string]string
+
+	RTT            time.Duration
+	LastWriteDate  time.Time
+	LastUpdateTime time.Time
+
+	MinWireVersion      int32
+	MaxWireVersion      int32
+	MaxBSONObjectSize   int32
+	MaxMessageSizeBytes int32
+	MaxWriteBatchSize   int32
+
+	// SessionTimeout is the logicalSessionTimeoutMinutes of the member.
+	// Zero means it does not support sessions.
+	SessionTimeout time.Duration
+
+	// TopologyVersion is the topologyVersion of the member, against which
+	// it streams hello replies. Nil for members that cannot stream them.
+	TopologyVersion bson.Raw
+
+	Err error
+}
+
+// Members returns every host the member reported, including passives and arbiters
+func (d ServerDescription) Members() []string {
+	members := make([]string, 0, len(d.Hosts)+len(d.Passives)+len(d.Arbiters))
+	members = append(members, d.Hosts...)
+	members = append(members, d.Passives...)
+	return append(members, d.Arbiters...)
+}
+
+// DataBearing reports whether the member can serve operations
+func (d ServerDescription) DataBearing() bool {
+	switch d.Kind {
+	case ServerStandalone, ServerMongos, ServerRSPrimary, ServerRSSecondary:
+		return true
+	}
+	return false
+}
+
+// unknownServer describes a member that could not be checked
+func unknownServer(addr string, err error) ServerDescription {
+	return ServerDescription{Addr: addr, Kind: ServerUnknown, LastUpdateTime: time.Now(), Err: err}
+}
+
+// parseHello builds a ServerDescription from a hello or legacy isMaster reply
+func parseHello(addr string, reply bson.Raw, rtt time.Duration) ServerDescription {
+	desc := ServerDescription{
+		Addr:                addr,
+		RTT:                 rtt,
+		LastUpdateTime:      time.Now(),
+		SetName:             reply.Lookup("setName").StringValue(),
+		Primary:             normalizeAddr(reply.Lookup("primary").StringValue()),
+		Me:                  normalizeAddr(reply.Lookup("me").StringValue()),
+		ElectionID:          reply.Lookup("electionId").ObjectID(),
+		Hosts:               addrArray(reply.Lookup("hosts")),
+		Passives:            addrArray(reply.Lookup("passives")),
+		Arbiters:            addrArray(reply.Lookup("arbiters")),
+		MaxBSONObjectSize:   16 * 1024 * 1024,
+		MaxMessageSizeBytes: 48000000,
+		MaxWriteBatchSize:   100000,
+	}
+	if ok, _ := reply.Lookup("ok").AsFloat64OK(); ok != 1 {
+		return unknownServer(addr, fmt.Errorf("hello failed: %s", reply.Lookup("errmsg").StringValue()))
+	}
+
+	if v, ok := reply.Lookup("setVersion").AsInt64OK(); ok {
+		desc.SetVersion = v
+	}
+	if v, ok := reply.Lookup("minWireVersion").AsInt64OK(); ok {
+		desc.MinWireVersion = int32(v)
+	}
+	if v, ok := reply.Lookup("maxWireVersion").AsInt64OK(); ok {
+		desc.MaxWireVersion = int32(v)
+	}
+	if v, ok := reply.Lookup("maxBsonObjectSize").AsInt64OK(); ok {
+		desc.MaxBSONObjectSize = int32(v)
+	}
+	if v, ok := reply.Lookup("maxMessageSizeBytes").AsInt64OK(); ok {
+		desc.MaxMessageSizeBytes = int32(v)
+	}
+	if v, ok := reply.Lookup("maxWriteBatchSize").AsInt64OK(); ok {
+		desc.MaxWriteBatchSize = int32(v)
+	}
+	if v, ok := reply.Lookup("logicalSessionTimeoutMinutes").AsInt64OK(); ok {
+		desc.SessionTimeout = time.Duration(v) * time.Minute
+	}
+	if tv := reply.Lookup("topologyVersion"); tv.Type == bson.TypeDocument {
+		desc.TopologyVersion = tv.Document()
+	}
+	if lastWrite := reply.Lookup("lastWrite", "lastWriteDate"); lastWrite.Type == bson.TypeDateTime {
+		desc.LastWriteDate = lastWrite.Time()
+	}
+	if tags := reply.Lookup("tags").Document(); tags != nil {
+		elements, _ := tags.Elements()
+		desc.Tags = make(map[string]string, len(elements))
+		for _, e := range elements {
+			desc.Tags[e.Key] = e.Value.StringValue()
+		}
+	}
+
+	writablePrimary := reply.Lookup("isWritablePrimary").Boolean() || reply.Lookup("ismaster").Boolean()
+	switch {
+	case reply.Lookup("isreplicaset").Boolean():
+		desc.Kind = ServerRSGhost
+	case reply.Lookup("msg").StringValue() == "isdbgrid":
+		desc.Kind = ServerMongos
+	case desc.SetName != "" && writablePrimary:
+		desc.Kind = ServerRSPrimary
+	case desc.SetName != "" && reply.Lookup("hidden").Boolean():
+		desc.Kind = ServerRSOther
+	case desc.SetName != "" && reply.Lookup("secondary").Boolean():
+		desc.Kind = ServerRSSecondary
+	case desc.SetName != "" && reply.Lookup("arbiterOnly").Boolean():
+		desc.Kind = ServerRSArbiter
+	case desc.SetName != "":
+		desc.Kind = ServerRSOther
+	default:
+		desc.Kind = ServerStandalone
+	}
+	return desc
+}
+
+// stringArray returns the strings of an array value, skipping other types
+func stringArray(v bson.RawValue) []string {
+	values, err := v.Array().Values()
+	if err != nil {
+		return nil
+	}
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.StringValueOK(); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// addrArray returns the normalized addresses of an array of host names
+func addrArray(v bson.RawValue) []string {
+	addrs := stringArray(v)
+	for i, addr := range addrs {
+		addrs[i] = normalizeAddr(addr)
+	}
+	return addrs
+}
+
+// normalizeAddr lowercases the host and adds the default port if it is missing
+func normalizeAddr(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "27017")
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+// TopologyDescription is a snapshot of the replica set as seen by the monitors
+type TopologyDescription struct {
+	Kind          TopologyKind
+	SetName       string
+	Servers       map[string]ServerDescription
+	MaxSetVersion int64
+	MaxElectionID bson.ObjectID
+
+	seedCount int
+}
+
+// newTopologyDescription creates the initial description from the seed list
+func newTopologyDescription(seeds []string, setName string) TopologyDescription {
+	t := TopologyDescription{
+		Kind:      TopologyUnknown,
+		SetName:   setName,
+		Servers:   make(map[string]ServerDescription, len(seeds)),
+		seedCount: len(seeds),
+	}
+	if setName != "" {
+		t.Kind = TopologyReplicaSetNoPrimary
+	}
+	for _, seed := range seeds {
+		t.Servers[seed] = unknownServer(seed, nil)
+	}
+	return t
+}
+
+// clone returns a deep copy that can be modified without affecting t
+func (t TopologyDescription) clone() TopologyDescription {
+	c := t
+	c.Servers = make(map[string]ServerDescription, len(t.Servers))
+	for addr, desc := range t.Servers {
+		c.Servers[addr] = desc
+	}
+	return c
+}
+
+// Primary returns the current primary, if one is known
+func (t TopologyDescription) Primary() (ServerDescription, bool) {
+	for _, desc := range t.Servers {
+		if desc.Kind == ServerRSPrimary {
+			return desc, true
+		}
+	}
+	return ServerDescription{}, false
+}
+
+// SessionTimeout returns the smallest session timeout of the data bearing
+// members, or zero when one of them does not support sessions
+func (t TopologyDescription) SessionTimeout() time.Duration {
+	var timeout time.Duration
+	for _, desc := range t.Servers {
+		if !desc.DataBearing() {
+			continue
+		}
+		if desc.SessionTimeout == 0 {
+			return 0
+		}
+		if timeout == 0 || desc.SessionTimeout < timeout {
+			timeout = desc.SessionTimeout
+		}
+	}
+	return timeout
+}
+
+// Addrs returns the addresses of all members in sorted order
+func (t TopologyDescription) Addrs() []string {
+	addrs := make([]string, 0, len(t.Servers))
+	for addr := range t.Servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// apply updates the description with the result of a server check
+func (t *TopologyDescription) apply(desc ServerDescription) {
+	if _, ok := t.Servers[desc.Addr]; !ok {
+		// The server was removed while it was being checked
+		return
+	}
+
+	switch t.Kind {
+	case TopologySingle:
+		t.Servers[desc.Addr] = desc
+		return
+
+	case TopologyUnknown:
+		switch desc.Kind {
+		case ServerStandalone, ServerMongos:
+			if t.seedCount == 1 {
+				t.Kind = TopologySingle
+				t.Servers[desc.Addr] = desc
+			} else {
+				delete(t.Servers, desc.Addr)
+			}
+		case ServerRSPrimary:
+			t.Kind = TopologyReplicaSetWithPrimary
+			t.updateFromPrimary(desc)
+		case ServerRSSecondary, ServerRSArbiter, ServerRSOther:
+			t.Kind = TopologyReplicaSetNoPrimary
+			t.updateFromMember(desc)
+		default:
+			t.Servers[desc.Addr] = desc
+		}
+
+	case TopologyReplicaSetNoPrimary, TopologyReplicaSetWithPrimary:
+		switch desc.Kind {
+		case ServerStandalone, ServerMongos:
+			delete(t.Servers, desc.Addr)
+		case ServerRSPrimary:
+			t.updateFromPrimary(desc)
+		case ServerRSSecondary, ServerRSArbiter, ServerRSOther:
+			t.updateFromMember(desc)
+		default:
+			t.Servers[desc.Addr] = desc
+		}
+	}
+
+	t.checkIfHasPrimary()
+}
+
+// updateFromPrimary applies a primary's view of the replica set membership
+func (t *TopologyDescription) updateFromPrimary(desc ServerDescription) {
+	if t.SetName == "" {
+		t.SetName = desc.SetName
+	} else if t.SetName != desc.SetName {
+		delete(t.Servers, desc.Addr)
+		return
+	}
+
+	// A primary with an older electionId or setVersion is stale
+	if !desc.ElectionID.IsZero() {
+		cmp := desc.ElectionID.Compare(t.MaxElectionID)
+		if cmp < 0 || (cmp == 0 && desc.SetVersion < t.MaxSetVersion) {
+			t.Servers[desc.Addr] = unknownServer(desc.Addr, fmt.Errorf("stale primary: electionId %s setVersion %d", desc.ElectionID.Hex(), desc.SetVersion))
+			return
+		}
+		t.MaxElectionID = desc.ElectionID
+	}
+	if desc.SetVersion > t.MaxSetVersion {
+		t.MaxSetVersion = desc.SetVersion
+	}
+
+	// Any other member that still claims to be primary is stale
+	for addr, other := range t.Servers {
+		if addr != desc.Addr && other.Kind == ServerRSPrimary {
+			t.Servers[addr] = unknownServer(addr, fmt.Errorf("primary moved to %s", desc.Addr))
+		}
+	}
+	t.Servers[desc.Addr] = desc
+
+	members := make(map[string]bool)
+	for _, addr := range desc.Members() {
+		members[addr] = true
+		if _, ok := t.Servers[addr]; !ok {
+			t.Servers[addr] = unknownServer(addr, nil)
+		}
+	}
+	for addr := range t.Servers {
+		if !members[addr] {
+			delete(t.Servers, addr)
+		}
+	}
+}
+
+// updateFromMember applies a non-primary member's view of the replica set
+func (t *TopologyDescription) updateFromMember(desc ServerDescription) {
+	if t.SetName == "" {
+		t.SetName = desc.SetName
+	} else if t.SetName != desc.SetName {
+		delete(t.Servers, desc.Addr)
+		return
+	}
+	if desc.Me != "" && desc.Me != desc.Addr {
+		delete(t.Servers, desc.Addr)
+		return
+	}
+	t.Servers[desc.Addr] = desc
+
+	// Membership is only learned from members while there is no primary
+	if t.Kind == TopologyReplicaSetNoPrimary {
+		for _, addr := range desc.Members() {
+			if _, ok := t.Servers[addr]; !ok {
+				t.Servers[addr] = unknownServer(addr, nil)
+			}
+		}
+	}
+}
+
+func (t *TopologyDescription) checkIfHasPrimary() {
+	if t.Kind != TopologyReplicaSetNoPrimary && t.Kind != TopologyReplicaSetWithPrimary {
+		return
+	}
+	if _, ok := t.Primary(); ok {
+		t.Kind = TopologyReplicaSetWithPrimary
+	} else {
+		t.Kind = TopologyReplicaSetNoPrimary
+	}
+}
+
+// Server error codes that indicate the member is no longer primary or is
+// shutting down, so its description is out of date
+var stateChangeErrorCodes = map[int64]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10058: true, // LegacyNotPrimary
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// isStateChangeError reports whether a command reply says the member changed role
+func isStateChangeError(reply bson.Raw) bool {
+	if ok, _ := reply.Lookup("ok").AsFloat64OK(); ok == 1 {
+		return false
+	}
+	code, _ := reply.Lookup("code").AsInt64OK()
+	if stateChangeErrorCodes[code] {
+		return true
+	}
+	msg := reply.Lookup("errmsg").StringValue()
+	return code == 0 && (strings.Contains(msg, "not master") || strings.Contains(msg, "node is recovering"))
+}
@@ -0,0 +1,346 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+func testPrimary(addr string, hosts []string, term byte) ServerDescription {
+	var electionID bson.ObjectID
+	electionID[11] = term
+	return ServerDescription{
+		Addr:       addr,
+		Kind:       ServerRSPrimary,
+		SetName:    "rs0",
+		SetVersion: 1,
+		ElectionID: electionID,
+		Hosts:      hosts,
+	}
+}
+
+func testSecondary(addr string, hosts []string) ServerDescription {
+	return ServerDescription{Addr: addr, Kind: ServerRSSecondary, SetName: "rs0", Hosts: hosts}
+}
+
+func TestTopologyDiscoversMembersFromPrimary(t *testing.T) {
+	hosts := []string{"a:27017", "b:27017", "c:27017"}
+	desc := newTopologyDescription([]string{"a:27017"}, "")
+
+	desc.apply(testPrimary("a:27017", hosts, 1))
+
+	if desc.Kind != TopologyReplicaSetWithPrimary {
+		t.Errorf("Expected ReplicaSetWithPrimary, got %s", desc.Kind)
+	}
+	if desc.SetName != "rs0" {
+		t.Errorf("Expected set name rs0, got %q", desc.SetName)
+	}
+	if len(desc.Servers) != 3 {
+		t.Errorf("Expected 3 servers, got %v", desc.Addrs())
+	}
+}
+
+func TestTopologyRemovesMembersNotReportedByPrimary(t *testing.T) {
+	desc := newTopologyDescription([]string{"a:27017", "stale:27017"}, "rs0")
+
+	desc.apply(testPrimary("a:27017", []string{"a:27017", "b:27017"}, 1))
+
+	if _, ok := desc.Servers["stale:27017"]; ok {
+		t.Error("Expected stale seed to be removed")
+	}
+	if _, ok := desc.Servers["b:27017"]; !ok {
+		t.Error("Expected b to be discovered")
+	}
+}
+
+func TestTopologyNewPrimaryDemotesOldPrimary(t *testing.T) {
+	hosts := []string{"a:27017", "b:27017"}
+	desc := newTopologyDescription(hosts, "rs0")
+
+	desc.apply(testPrimary("a:27017", hosts, 1))
+	desc.apply(testPrimary("b:27017", hosts, 2))
+
+	primary, ok := desc.Primary()
+	if !ok || primary.Addr != "b:27017" {
+		t.Fatalf("Expected b to be primary, got %+v", primary)
+	}
+	if desc.Servers["a:27017"].Kind != ServerUnknown {
+		t.Errorf("Expected old primary to be Unknown, got %s", desc.Servers["a:27017"].Kind)
+	}
+}
+
+func TestTopologyIgnoresStalePrimary(t *testing.T) {
+	hosts := []string{"a:27017", "b:27017"}
+	desc := newTopologyDescription(hosts, "rs0")
+
+	desc.apply(testPrimary("b:27017", hosts, 2))
+	desc.apply(testPrimary("a:27017", hosts, 1))
+
+	primary, ok := desc.Primary()
+	if !ok || primary.Addr != "b:27017" {
+		t.Fatalf("Expected b to remain primary, got %+v", primary)
+	}
+	if desc.Servers["a:27017"].Kind != ServerUnknown {
+		t.Errorf("Expected stale primary to be Unknown, got %s", desc.Servers["a:27017"].Kind)
+	}
+}
+
+func TestTopologyRemovesWrongSetName(t *testing.T) {
+	desc := newTopologyDescription([]string{"a:27017", "b:27017"}, "rs0")
+
+	other := testSecondary("b:27017", nil)
+	other.SetName = "other"
+	desc.apply(other)
+
+	if _, ok := desc.Servers["b:27017"]; ok {
+		t.Error("Expected member of another set to be removed")
+	}
+}
+
+func TestTopologyStandalone(t *testing.T) {
+	single := newTopologyDescription([]string{"a:27017"}, "")
+	single.apply(ServerDescription{Addr: "a:27017", Kind: ServerStandalone})
+	if single.Kind != TopologySingle || len(selectWritable(single)) != 1 {
+		t.Errorf("Expected a selectable Single topology, got %s", single.Kind)
+	}
+
+	multi := newTopologyDescription([]string{"a:27017", "b:27017"}, "")
+	multi.apply(ServerDescription{Addr: "a:27017", Kind: ServerStandalone})
+	if _, ok := multi.Servers["a:27017"]; ok {
+		t.Error("Expected standalone to be removed from a multi-seed topology")
+	}
+}
+
+func TestParseHello(t *testing.T) {
+	reply := mustMarshal(t, bson.D{
+		{Key: "isWritablePrimary", Value: false},
+		{Key: "secondary", Value: true},
+		{Key: "setName", Value: "rs0"},
+		{Key: "hosts", Value: bson.A{"Host1:27017", "host2"}},
+		{Key: "tags", Value: bson.D{{Key: "dc", Value: "east"}}},
+		{Key: "maxWireVersion", Value: 21},
+		{Key: "topologyVersion", Value: bson.D{{Key: "processId", Value: bson.ObjectID{1}}, {Key: "counter", Value: int64(3)}}},
+		{Key: "ok", Value: 1.0},
+	})
+
+	desc := parseHello("host1:27017", reply, time.Millisecond)
+	if desc.Kind != ServerRSSecondary {
+		t.Errorf("Expected RSSecondary, got %s", desc.Kind)
+	}
+	if len(desc.Hosts) != 2 || desc.Hosts[0] != "host1:27017" || desc.Hosts[1] != "host2:27017" {
+		t.Errorf("Unexpected normalized hosts %v", desc.Hosts)
+	}
+	if desc.Tags["dc"] != "east" || desc.MaxWireVersion != 21 {
+		t.Errorf("Unexpected tags %v or wire version %d", desc.Tags, desc.MaxWireVersion)
+	}
+	if desc.TopologyVersion.Lookup("counter").Int64() != 3 {
+		t.Errorf("Unexpected topology version %v", desc.TopologyVersion)
+	}
+}
+
+// streamingHelloServer answers hello with a topologyVersion and streams a
+// reply every 10ms to a hello sent with exhaustAllowed, each with the next
+// counter in its "n" tag. Polled hellos other than the handshake are
+// answered after pollDelay. It records the flag bits of every hello.
+func streamingHelloServer(t *testing.T, pollDelay time.Duration) (*mockMongoServer, func() []uint32) {
+	var mu sync.Mutex
+	var hellos []uint32
+	server, err := newMockStreamingServer(func(opCode int32, payload []byte, reply func([]byte) error) error {
+		command, err := decodeOpMsg(MessageHeader{OpCode: opCode}, payload)
+		if err != nil {
+			t.Errorf("mock received invalid OP_MSG: %v", err)
+			return err
+		}
+		if command.Body.Lookup("hello").Type == 0 {
+			return reply(testOpMsgPayload(t, bson.D{{Key: "ok", Value: 1.0}}))
+		}
+		mu.Lock()
+		hellos = append(hellos, command.FlagBits)
+		mu.Unlock()
+
+		hello := func(n int, flags uint32) []byte {
+			payload := testOpMsgPayload(t, bson.D{
+				{Key: "isWritablePrimary", Value: true},
+				{Key: "helloOk", Value: true},
+				{Key: "maxWireVersion", Value: 21},
+				{Key: "topologyVersion", Value: bson.D{{Key: "processId", Value: bson.ObjectID{1}}, {Key: "counter", Value: int64(n)}}},
+				{Key: "tags", Value: bson.D{{Key: "n", Value: strconv.Itoa(n)}}},
+				{Key: "ok", Value: 1.0},
+			})
+			binary.LittleEndian.PutUint32(payload, flags)
+			return payload
+		}
+		if command.FlagBits&FlagExhaustAllowed == 0 {
+			if command.Body.Lookup("client").Type == 0 {
+				time.Sleep(pollDelay)
+			}
+			return reply(hello(0, 0))
+		}
+		if command.Body.Lookup("topologyVersion").Type == 0 || command.Body.Lookup("maxAwaitTimeMS").Type == 0 {
+			t.Errorf("Expected an awaitable hello, got %v", command.Body)
+		}
+		// The monitor closing the connection ends the stream
+		for n := 1; ; n++ {
+			if err := reply(hello(n, FlagMoreToCome)); err != nil {
+				return err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, func() []uint32 {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]uint32(nil), hellos...)
+	}
+}
+
+func TestMonitorStreamsHello(t *testing.T) {
+	server, hellos := streamingHelloServer(t, 0)
+
+	// Polling every hour would never see the later replies
+	opts := DefaultOptions()
+	opts.HeartbeatInterval = time.Hour
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	for {
+		desc := replset.Topology().Servers[normalizeAddr(server.Addr())]
+		if n, _ := strconv.Atoi(desc.Tags["n"]); n >= 3 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Expected streamed hello replies, got %+v", desc)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var awaitable int
+	for _, flags := range hellos() {
+		if flags&FlagExhaustAllowed != 0 {
+			awaitable++
+		}
+	}
+	if awaitable != 1 {
+		t.Errorf("Expected one hello with exhaustAllowed for the whole stream, got %d", awaitable)
+	}
+}
+
+func TestMonitorPollModeDoesNotStream(t *testing.T) {
+	server, hellos := streamingHelloServer(t, 0)
+
+	opts := DefaultOptions()
+	opts.HeartbeatInterval = minHeartbeatInterval
+	opts.ServerMonitoringMode = ServerMonitoringPoll
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	time.Sleep(3 * minHeartbeatInterval)
+	for _, flags := range hellos() {
+		if flags&FlagExhaustAllowed != 0 {
+			t.Fatal("Expected the poll mode to never send an awaitable hello")
+		}
+	}
+	if len(hellos()) < 3 {
+		t.Errorf("Expected repeated polled hellos, got %d", len(hellos()))
+	}
+}
+
+func TestMonitorMeasuresRTTWhileStreaming(t *testing.T) {
+	server, hellos := streamingHelloServer(t, 100*time.Millisecond)
+
+	opts := DefaultOptions()
+	opts.HeartbeatInterval = minHeartbeatInterval
+	replset := NewReplsetWithOptions([]string{server.Addr()}, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	// The handshake is answered right away, the polls of the RTT
+	// connection after 100ms
+	for {
+		desc := replset.Topology().Servers[normalizeAddr(server.Addr())]
+		if desc.RTT >= 10*time.Millisecond {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Expected the RTT to follow the polled hellos, got %v", desc.RTT)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var awaitable int
+	for _, flags := range hellos() {
+		if flags&FlagExhaustAllowed != 0 {
+			awaitable++
+		}
+	}
+	if awaitable != 1 {
+		t.Errorf("Expected the hello stream to go on while measuring the RTT, got %d awaitable hellos", awaitable)
+	}
+}
+
+func TestReplsetFollowsFailover(t *testing.T) {
+	mock := newMockReplicaSet(t, 3)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if !mock.isPrimary(member) {
+			return bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 10107}, {Key: "errmsg", Value: "not primary"}}
+		}
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+
+	opts := DefaultOptions()
+	opts.HeartbeatInterval = time.Hour
+	replset := NewReplsetWithOptions(mock.addrs, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+
+	ping := testOpMsgPayload(t, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}})
+	if _, err := replset.SendMessage(ctx, OpMsg, ping); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	// Step down member 0. The NotWritablePrimary reply must trigger an
+	// immediate check so later writes reach the new primary.
+	mock.setPrimary(2)
+	for {
+		_, err := replset.SendMessage(ctx, OpMsg, ping)
+		if err == nil {
+			break
+		}
+		if !IsNotWritablePrimary(err) {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+	}
+
+	if got := len(mock.commands(2)); got != 1 {
+		t.Errorf("Expected the new primary to receive 1 command, got %d", got)
+	}
+}
@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// minTransactionWireVersion is the first wire version (MongoDB 4.0) that
+// supports transactions on replica sets
+const minTransactionWireVersion = 7
+
+// withTransactionTimeout bounds how long WithTransaction keeps retrying a
+// transaction that fails with a transient error
+const withTransactionTimeout = 120 * time.Second
+
+// commitRetryWTimeout is the wtimeout of a retried commitTransaction
+const commitRetryWTimeout = 10 * time.Second
+
+// Server error codes that say a commit may or may not have been applied
+var unknownCommitResultCodes = map[int32]bool{
+	50: true, // MaxTimeMSExpired
+	64: true, // WriteConcernFailed
+}
+
+// Write concern error codes after which a commit certainly failed
+var commitWriteConcernFailedCodes = map[int32]bool{
+	79:  true, // UnknownReplWriteConcern
+	100: true, // UnsatisfiableWriteConcern
+}
+
+var errNoTransaction = errors.New("no transaction started")
+
+// transactionState is the progress of the current transaction of a session
+type transactionState int
+
+const (
+	txnNone transactionState = iota
+	txnStarting
+	txnInProgress
+	txnCommitted
+	txnAborted
+)
+
+// TransactionOptions configures a transaction. Nil concerns fall back to
+// the default transaction options of the session, then to the options of
+// the replset.
+type TransactionOptions struct {
+	// ReadConcern is sent with the first command of the transaction and
+	// applies to every read in it
+	ReadConcern *ReadConcern
+
+	// WriteConcern is sent with commitTransaction and abortTransaction and
+	// must be acknowledged
+	WriteConcern *WriteConcern
+
+	// MaxCommitTime bounds how long commitTransaction may run on the server
+	MaxCommitTime time.Duration
+}
+
+// transaction is the current transaction of a session
+type transaction struct {
+	state transactionState
+	opts  TransactionOptions
+
+	// pinned is the member that ran the first command. Every later command
+	// of the transaction goes to the same member.
+	pinned string
+
+	// empty is set when a transaction was committed without running any
+	// command, so there is nothing to commit on the server
+	empty bool
+}
+
+// inTransaction reports whether commands in the session are part of a
+// transaction
+func (s *Session) inTransaction() bool {
+	return s.txn.state == txnStarting || s.txn.state == txnInProgress
+}
+
+// inTransaction reports whether ctx runs in a session with an active
+// transaction
+func inTransaction(ctx context.Context) bool {
+	s := sessionFromContext(ctx)
+	return s != nil && s.inTransaction()
+}
+
+// StartTransaction starts a transaction. The commands run in the session
+// until CommitTransaction or AbortTransaction are part of it. Nothing is
+// sent to the server before the first command.
+func (s *Session) StartTransaction(opts TransactionOptions) error {
+	if s.ended {
+		return errSessionEnded
+	}
+	if s.inTransaction() {
+		return fmt.Errorf("transaction already in progress")
+	}
+	if opts.ReadConcern == nil {
+		opts.ReadConcern = s.opts.DefaultTransactionOptions.ReadConcern
+	}
+	if opts.ReadConcern == nil {
+		opts.ReadConcern = s.replset.opts.ReadConcern
+	}
+	if opts.WriteConcern == nil {
+		opts.WriteConcern = s.opts.DefaultTransactionOptions.WriteConcern
+	}
+	if opts.WriteConcern == nil {
+		opts.WriteConcern = s.replset.opts.WriteConcern
+	}
+	if opts.MaxCommitTime == 0 {
+		opts.MaxCommitTime = s.opts.DefaultTransactionOptions.MaxCommitTime
+	}
+	if !opts.WriteConcern.Acknowledged() {
+		return fmt.Errorf("transactions require an acknowledged write concern")
+	}
+	s.txn = transaction{state: txnStarting, opts: opts}
+	return nil
+}
+
+// transactionCommand returns a copy of command that runs in the current
+// transaction. The first command starts the transaction on server, which
+// the transaction is pinned to, and carries its read concern. The concerns
+// of the transaction replace those of the individual commands.
+func (s *Session) transactionCommand(server ServerDescription, command bson.D) (bson.D, error) {
+	if _, ok := command.Lookup("txnNumber"); ok {
+		// commitTransaction and abortTransaction are built complete
+		return command, nil
+	}
+	out := make(bson.D, 0, len(command)+4)
+	for _, e := range command {
+		if e.Key != "readConcern" && e.Key != "writeConcern" {
+			out = append(out, e)
+		}
+	}
+
+	if s.txn.state == txnStarting {
+		if server.MaxWireVersion < minTransactionWireVersion {
+			return nil, fmt.Errorf("%s does not support transactions", server.Addr)
+		}
+		var readConcern bson.D
+		if rc := s.txn.opts.ReadConcern; rc != nil && rc.Level != "" {
+			readConcern = rc.document()
+		}
+		if s.causal && !s.operationTime.IsZero() {
+			readConcern = append(readConcern, bson.E{Key: "afterClusterTime", Value: s.operationTime})
+		}
+		if len(readConcern) > 0 {
+			out = append(out, bson.E{Key: "readConcern", Value: readConcern})
+		}
+		out = append(out, bson.E{Key: "startTransaction", Value: true})
+		s.server.txnNumber++
+		s.txn.state = txnInProgress
+		s.txn.pinned = server.Addr
+	}
+	return append(out,
+		bson.E{Key: "txnNumber", Value: s.server.txnNumber},
+		bson.E{Key: "autocommit", Value: false},
+	), nil
+}
+
+// selectPinned selects the member the transaction is pinned to, or the
+// primary when it is not pinned or has left the topology
+func (s *Session) selectPinned(t TopologyDescription) []ServerDescription {
+	if desc, ok := t.Servers[s.txn.pinned]; ok && desc.DataBearing() {
+		return []ServerDescription{desc}
+	}
+	return selectWritable(t)
+}
+
+// CommitTransaction commits the current transaction. A commit that fails
+// with a retryable error is retried once. Errors that leave the outcome
+// unknown carry the UnknownTransactionCommitResult label; committing again
+// is safe after them.
+func (s *Session) CommitTransaction(ctx context.Context) error {
+	switch s.txn.state {
+	case txnNone:
+		return errNoTransaction
+	case txnAborted:
+		return fmt.Errorf("cannot commit an aborted transaction")
+	case txnStarting:
+		s.txn.state = txnCommitted
+		s.txn.empty = true
+		return nil
+	}
+	if s.txn.empty {
+		return nil
+	}
+
+	// Committing again must not be satisfied by fewer members than the
+	// first attempt may have reached
+	retry := s.txn.state == txnCommitted
+	s.txn.state = txnCommitted
+	err := s.endTransaction(ctx, "commitTransaction", retry)
+	if err != nil && isRetryableWriteError(err) && ctx.Err() == nil {
+		s.txn.pinned = ""
+		err = s.endTransaction(ctx, "commitTransaction", true)
+	}
+	if err != nil && isUnknownCommitResult(err) {
+		err = withErrorLabel(err, LabelUnknownTransactionCommitResult)
+	}
+	return err
+}
+
+// AbortTransaction aborts the current transaction. Errors are ignored,
+// since the server aborts a transaction on its own once it times out.
+func (s *Session) AbortTransaction(ctx context.Context) error {
+	switch s.txn.state {
+	case txnNone:
+		return errNoTransaction
+	case txnCommitted:
+		return fmt.Errorf("cannot abort a committed transaction")
+	case txnAborted:
+		return fmt.Errorf("transaction already aborted")
+	case txnStarting:
+		s.txn.state = txnAborted
+		return nil
+	}
+
+	s.txn.state = txnAborted
+	if err := s.endTransaction(ctx, "abortTransaction", false); err != nil && isRetryableWriteError(err) && ctx.Err() == nil {
+		s.txn.pinned = ""
+		_ = s.endTransaction(ctx, "abortTransaction", false)
+	}
+	s.txn.pinned = ""
+	return nil
+}
+
+// endTransaction sends commitTransaction or abortTransaction with the
+// write concern of the transaction, raised to majority for a retry
+func (s *Session) endTransaction(ctx context.Context, name string, retry bool) error {
+	ctx = WithSession(ctx, s)
+	server, err := s.replset.selectServer(ctx, s.selectPinned)
+	if err != nil {
+		return err
+	}
+
+	command := bson.D{
+		{Key: name, Value: 1},
+		{Key: "txnNumber", Value: s.server.txnNumber},
+		{Key: "autocommit", Value: false},
+	}
+	wc := s.txn.opts.WriteConcern
+	if retry {
+		majority := WriteConcern{W: "majority", WTimeout: commitRetryWTimeout}
+		if wc != nil {
+			majority.Journal = wc.Journal
+			if wc.WTimeout > 0 {
+				majority.WTimeout = wc.WTimeout
+			}
+		}
+		wc = &majority
+	}
+	if wc != nil {
+		if doc := wc.document(); len(doc) > 0 {
+			command = append(command, bson.E{Key: "writeConcern", Value: doc})
+		}
+	}
+	if name == "commitTransaction" && s.txn.opts.MaxCommitTime > 0 {
+		command = append(command, bson.E{Key: "maxTimeMS", Value: s.txn.opts.MaxCommitTime.Milliseconds()})
+	}
+	command = append(command, bson.E{Key: "$db", Value: "admin"})
+	if command, err = withMaxTimeMS(ctx, command); err != nil {
+		return err
+	}
+	_, err = s.replset.sendCommandTo(ctx, server, command, nil)
+	return err
+}
+
+// isUnknownCommitResult reports whether a commit that failed with err may
+// still have been applied
+func isUnknownCommitResult(err error) bool {
+	if isRetryableWriteError(err) {
+		return true
+	}
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		return unknownCommitResultCodes[cmdErr.Code]
+	}
+	var writeErr *WriteException
+	if errors.As(err, &writeErr) && writeErr.WriteConcernError != nil {
+		return !commitWriteConcernFailedCodes[writeErr.WriteConcernError.Code]
+	}
+	return false
+}
+
+// WithTransaction runs fn in a transaction and commits it. fn must run its
+// operations with the context it is passed. The transaction is run again
+// when it fails with a TransientTransactionError, and the commit is
+// retried after an UnknownTransactionCommitResult, until 120 seconds have
+// passed or ctx ends. fn may therefore run several times. An error
+// returned by fn aborts the transaction.
+func (s *Session) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	retrying := func() bool {
+		return ctx.Err() == nil && time.Since(start) < withTransactionTimeout
+	}
+
+	for {
+		if err := s.StartTransaction(TransactionOptions{}); err != nil {
+			return err
+		}
+		if err := fn(WithSession(ctx, s)); err != nil {
+			if s.inTransaction() {
+				_ = s.AbortTransaction(ctx)
+			}
+			if HasErrorLabel(err, LabelTransientTransaction) && retrying() {
+				continue
+			}
+			return err
+		}
+		if !s.inTransaction() {
+			// fn committed or aborted the transaction itself
+			return nil
+		}
+
+		for {
+			err := s.CommitTransaction(ctx)
+			if err == nil {
+				return nil
+			}
+			var cmdErr *CommandError
+			maxTimeExpired := errors.As(err, &cmdErr) && cmdErr.Code == 50
+			if HasErrorLabel(err, LabelUnknownTransactionCommitResult) && !maxTimeExpired && retrying() {
+				continue
+			}
+			if HasErrorLabel(err, LabelTransientTransaction) && retrying() {
+				break
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"mongo-playground/internal/bson"
+)
+
+// insertInto inserts one document into collection
+func insertInto(t *testing.T, ctx context.Context, replset *Replset, collection string, id int) error {
+	t.Helper()
+	documents := []bson.Raw{mustMarshal(t, bson.D{{Key: "_id", Value: id}})}
+	_, err := replset.SendCommand(ctx, bson.D{{Key: "insert", Value: collection}, {Key: "$db", Value: "shop"}}, documents)
+	return err
+}
+
+// startTestSession connects to mock and starts a session in it
+func startTestSession(t *testing.T, mock *mockReplicaSet) (*Replset, *Session) {
+	t.Helper()
+	replset := connectTestReplset(t, mock)
+	session, err := replset.StartSession(SessionOptions{})
+	if err != nil {
+		t.Fatalf("StartSession failed: %v", err)
+	}
+	t.Cleanup(session.EndSession)
+	return replset, session
+}
+
+func TestWithTransactionCommits(t *testing.T) {
+	mock := newMockReplicaSet(t, 2)
+	var commands commandRecorder
+	members := make(chan int, 10)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		commands.record(command)
+		members <- member
+		return bson.D{{Key: "n", Value: 1}, {Key: "ok", Value: 1.0}}
+	})
+	opts := DefaultOptions()
+	opts.ReadConcern = &ReadConcern{Level: ReadConcernSnapshot}
+	opts.WriteConcern = &WriteConcern{W: "majority"}
+	replset := NewReplsetWithOptions(mock.addrs, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replset.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer replset.Disconnect()
+	session, _ := replset.StartSession(SessionOptions{})
+	defer session.EndSession()
+
+	err := session.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := insertInto(t, ctx, replset, "orders", 1); err != nil {
+			return err
+		}
+		return insertInto(t, ctx, replset, "stock", 1)
+	})
+	if err != nil {
+		t.Fatalf("WithTransaction failed: %v", err)
+	}
+
+	sent := commands.all()
+	if len(sent) != 3 {
+		t.Fatalf("Expected two inserts and a commit, got %v", sent)
+	}
+	first, second, commit := sent[0], sent[1], sent[2]
+	if !first.Lookup("startTransaction").Boolean() || first.Lookup("readConcern", "level").StringValue() != ReadConcernSnapshot {
+		t.Errorf("Expected the first command to start the transaction, got %v", first)
+	}
+	if second.Lookup("startTransaction").Type != 0 || second.Lookup("readConcern").Type != 0 {
+		t.Errorf("Expected only the first command to start the transaction, got %v", second)
+	}
+	if commit.Lookup("commitTransaction").Type == 0 || commit.Lookup("$db").StringValue() != "admin" {
+		t.Errorf("Expected commitTransaction on admin, got %v", commit)
+	}
+	if w := commit.Lookup("writeConcern", "w").StringValue(); w != "majority" {
+		t.Errorf("Expected the commit to carry the write concern, got %v", commit)
+	}
+	for _, command := range sent {
+		if command.Lookup("txnNumber").Int64() != 1 || command.Lookup("autocommit").Type != bson.TypeBoolean || command.Lookup("autocommit").Boolean() {
+			t.Errorf("Expected txnNumber 1 and autocommit false, got %v", command)
+		}
+		if command.Lookup("lsid").Document().String() != first.Lookup("lsid").Document().String() {
+			t.Errorf("Expected every command to carry the same lsid, got %v", command)
+		}
+		if command.Lookup("writeConcern").Type != 0 && command.Lookup("commitTransaction").Type == 0 {
+			t.Errorf("Expected no write concern inside the transaction, got %v", command)
+		}
+	}
+	for i := 0; i < len(sent); i++ {
+		if member := <-members; member != 0 {
+			t.Errorf("Expected the transaction to stay on the primary, got member %d", member)
+		}
+	}
+}
+
+func TestWithTransactionRetriesTransientError(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var commands commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if commands.record(command) == 1 {
+			return bson.D{
+				{Key: "ok", Value: 0.0}, {Key: "code", Value: 251}, {Key: "codeName", Value: "NoSuchTransaction"},
+				{Key: "errorLabels", Value: bson.A{LabelTransientTransaction}},
+			}
+		}
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset, session := startTestSession(t, mock)
+
+	runs := 0
+	err := session.WithTransaction(context.Background(), func(ctx context.Context) error {
+		runs++
+		return insertInto(t, ctx, replset, "orders", 1)
+	})
+	if err != nil {
+		t.Fatalf("WithTransaction failed: %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("Expected the transaction to run twice, got %d", runs)
+	}
+
+	sent := commands.all()
+	names := []string{"insert", "abortTransaction", "insert", "commitTransaction"}
+	if len(sent) != len(names) {
+		t.Fatalf("Expected %v, got %v", names, sent)
+	}
+	for i, name := range names {
+		if sent[i].Lookup(name).Type == 0 {
+			t.Errorf("Expected command %d to be %s, got %v", i, name, sent[i])
+		}
+	}
+	if sent[2].Lookup("txnNumber").Int64() != 2 || !sent[2].Lookup("startTransaction").Boolean() {
+		t.Errorf("Expected the retry to start a new transaction, got %v", sent[2])
+	}
+}
+
+func TestWithTransactionRetriesUnknownCommitResult(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var commits commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if command.Body.Lookup("commitTransaction").Type != 0 && commits.record(command) == 1 {
+			return bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: 64}, {Key: "codeName", Value: "WriteConcernFailed"}}
+		}
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset, session := startTestSession(t, mock)
+
+	runs := 0
+	err := session.WithTransaction(context.Background(), func(ctx context.Context) error {
+		runs++
+		return insertInto(t, ctx, replset, "orders", 1)
+	})
+	if err != nil {
+		t.Fatalf("WithTransaction failed: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("Expected only the commit to be retried, got %d runs", runs)
+	}
+	sent := commits.all()
+	if len(sent) != 2 {
+		t.Fatalf("Expected the commit to be sent twice, got %v", sent)
+	}
+	if w := sent[1].Lookup("writeConcern", "w").StringValue(); w != "majority" {
+		t.Errorf("Expected the retried commit to use w: majority, got %v", sent[1])
+	}
+}
+
+func TestWithTransactionAbortsOnError(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	var commands commandRecorder
+	mock.setHandler(func(member int, command *Message) bson.D {
+		commands.record(command)
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset, session := startTestSession(t, mock)
+
+	errOutOfStock := errors.New("out of stock")
+	err := session.WithTransaction(context.Background(), func(ctx context.Context) error {
+		if err := insertInto(t, ctx, replset, "orders", 1); err != nil {
+			return err
+		}
+		return errOutOfStock
+	})
+	if !errors.Is(err, errOutOfStock) {
+		t.Fatalf("Expected the error of fn, got %v", err)
+	}
+	sent := commands.all()
+	if len(sent) != 2 || sent[1].Lookup("abortTransaction").Type == 0 {
+		t.Errorf("Expected the transaction to be aborted, got %v", sent)
+	}
+}
+
+func TestTransactionNetworkErrorIsTransient(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	mock.setHandler(func(member int, command *Message) bson.D {
+		if command.Body.Lookup("insert").Type != 0 {
+			return nil
+		}
+		return bson.D{{Key: "ok", Value: 1.0}}
+	})
+	replset, session := startTestSession(t, mock)
+
+	if err := session.StartTransaction(TransactionOptions{}); err != nil {
+		t.Fatalf("StartTransaction failed: %v", err)
+	}
+	err := insertInto(t, WithSession(context.Background(), session), replset, "orders", 1)
+	if !HasErrorLabel(err, LabelTransientTransaction) {
+		t.Errorf("Expected a TransientTransactionError, got %v", err)
+	}
+	if err := session.AbortTransaction(context.Background()); err != nil {
+		t.Errorf("AbortTransaction failed: %v", err)
+	}
+}
+
+func TestTransactionStates(t *testing.T) {
+	mock := newMockReplicaSet(t, 1)
+	replset, session := startTestSession(t, mock)
+	ctx := context.Background()
+
+	if err := session.CommitTransaction(ctx); !errors.Is(err, errNoTransaction) {
+		t.Errorf("Expected commit without a transaction to fail, got %v", err)
+	}
+	session.StartTransaction(TransactionOptions{})
+	if err := session.StartTransaction(TransactionOptions{}); err == nil {
+		t.Error("Expected a second StartTransaction to fail")
+	}
+	secondary := WithReadPreference(WithSession(ctx, session), ReadPreference{Mode: ReadSecondary})
+	if _, err := replset.SendQuery(secondary, findCommand()); err == nil {
+		t.Error("Expected a secondary read in a transaction to fail")
+	}
+
+	// A transaction without commands is committed without the server
+	if err := session.CommitTransaction(ctx); err != nil {
+		t.Errorf("CommitTransaction failed: %v", err)
+	}
+	if err := session.AbortTransaction(ctx); err == nil {
+		t.Error("Expected abort after commit to fail")
+	}
+	if got := mock.commands(0); len(got) != 0 {
+		t.Errorf("Expected no commands for an empty transaction, got %v", got)
+	}
+
+	unacknowledged := TransactionOptions{WriteConcern: &WriteConcern{W: 0}}
+	if err := session.StartTransaction(unacknowledged); err == nil {
+		t.Error("Expected an unacknowledged write concern to be rejected")
+	}
+}
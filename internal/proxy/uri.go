@@ -0,0 +1,464 @@
+package proxy
+
+import (
+	"compress/zlib"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPort is used for hosts of a connection string without a port
+const defaultPort = "27017"
+
+// NewReplsetFromURI creates a replica set abstraction from a standard
+// mongodb:// or mongodb+srv:// connection string
+func NewReplsetFromURI(uri string) (*Replset, error) {
+	return NewReplsetFromURIContext(context.Background(), uri, nil)
+}
+
+// NewReplsetFromURIContext is like NewReplsetFromURI, resolving mongodb+srv
+// records with resolver within ctx. The resolver is kept for the periodic
+// SRV rescans; nil uses the system resolver.
+func NewReplsetFromURIContext(ctx context.Context, uri string, resolver Resolver) (*Replset, error) {
+	hosts, opts, err := ParseURIContext(ctx, uri, resolver)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplsetWithOptions(hosts, opts), nil
+}
+
+// ParseURI parses a connection string into the seed list and the options it
+// configures. Options that are not set keep their defaults and unknown
+// options are ignored, as official drivers do.
+func ParseURI(uri string) ([]string, Options, error) {
+	return ParseURIContext(context.Background(), uri, nil)
+}
+
+// ParseURIContext is like ParseURI, resolving the SRV and TXT records of
+// mongodb+srv connection strings with resolver within ctx
+func ParseURIContext(ctx context.Context, uri string, resolver Resolver) ([]string, Options, error) {
+	opts := DefaultOptions()
+
+	rest, ok := strings.CutPrefix(uri, "mongodb://")
+	srv := false
+	if !ok {
+		if rest, srv = strings.CutPrefix(uri, "mongodb+srv://"); !srv {
+			return nil, opts, fmt.Errorf("invalid connection string: scheme must be mongodb:// or mongodb+srv://")
+		}
+	}
+
+	var query string
+	rest, query, _ = strings.Cut(rest, "?")
+	rest, database, hasPath := strings.Cut(rest, "/")
+	if !hasPath && query != "" {
+		return nil, opts, fmt.Errorf("invalid connection string: options must follow a slash")
+	}
+
+	var userinfo string
+	at := strings.LastIndex(rest, "@")
+	if at >= 0 {
+		userinfo, rest = rest[:at], rest[at+1:]
+	}
+
+	var hosts []string
+	var err error
+	if srv {
+		if rest, err = url.PathUnescape(rest); err != nil {
+			return nil, opts, fmt.Errorf("invalid connection string: host %q: %w", rest, err)
+		}
+		if _, err := srvParentDomain(rest); err != nil {
+			return nil, opts, fmt.Errorf("invalid connection string: %w", err)
+		}
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		opts.Resolver = resolver
+		opts.srvHost = rest
+	} else if hosts, err = parseHosts(rest); err != nil {
+		return nil, opts, err
+	}
+
+	var cred *Credential
+	if at >= 0 {
+		if cred, err = parseUserinfo(userinfo); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	if database != "" {
+		if database, err = url.PathUnescape(database); err != nil {
+			return nil, opts, fmt.Errorf("invalid connection string: database: %w", err)
+		}
+	}
+
+	p := uriParser{opts: &opts, cred: cred, srv: srv}
+	if srv {
+		// Options from the TXT record apply first, so the URI overrides them
+		txt, err := lookupTXTOptions(ctx, resolver, opts.srvHost)
+		if err != nil {
+			return nil, opts, err
+		}
+		p.inTXT = true
+		if err := p.parseOptions(txt); err != nil {
+			return nil, opts, err
+		}
+		p.inTXT = false
+	}
+	if err := p.parseOptions(query); err != nil {
+		return nil, opts, err
+	}
+	if err := p.finish(database); err != nil {
+		return nil, opts, err
+	}
+
+	if srv {
+		service := opts.srvServiceName
+		if service == "" {
+			service = DefaultSRVServiceName
+		}
+		if hosts, err = lookupSRVHosts(ctx, resolver, opts.srvHost, service); err != nil {
+			return nil, opts, err
+		}
+	}
+	return hosts, opts, nil
+}
+
+// parseHosts splits and validates the comma separated host list
+func parseHosts(s string) ([]string, error) {
+	if s == "" {
+		return nil, fmt.Errorf("invalid connection string: no hosts")
+	}
+	var hosts []string
+	for _, host := range strings.Split(s, ",") {
+		host, err := url.PathUnescape(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connection string: host %q: %w", host, err)
+		}
+		if strings.HasSuffix(host, ".sock") {
+			return nil, fmt.Errorf("invalid connection string: unix domain sockets are not supported")
+		}
+
+		name, port, err := net.SplitHostPort(host)
+		if err != nil {
+			// Hosts without a port, including bracketed IPv6 literals
+			name, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), defaultPort
+			if strings.Contains(name, "[") || strings.Contains(name, "]") ||
+				(strings.Contains(name, ":") && !strings.HasPrefix(host, "[")) {
+				return nil, fmt.Errorf("invalid connection string: host %q", host)
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid connection string: empty host in %q", s)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid connection string: invalid port in %q", host)
+		}
+		hosts = append(hosts, net.JoinHostPort(name, port))
+	}
+	return hosts, nil
+}
+
+// parseUserinfo decodes the percent-encoded username and password
+func parseUserinfo(userinfo string) (*Credential, error) {
+	username, password, hasPassword := strings.Cut(userinfo, ":")
+	if strings.ContainsAny(username, "@/") || strings.ContainsAny(password, ":@/") {
+		return nil, fmt.Errorf("invalid connection string: username and password must be percent-encoded")
+	}
+	var err error
+	if username, err = url.PathUnescape(username); err != nil {
+		return nil, fmt.Errorf("invalid connection string: username: %w", err)
+	}
+	if password, err = url.PathUnescape(password); err != nil {
+		return nil, fmt.Errorf("invalid connection string: password: %w", err)
+	}
+	if username == "" {
+		return nil, fmt.Errorf("invalid connection string: empty username")
+	}
+	if hasPassword && password == "" {
+		return nil, fmt.Errorf("invalid connection string: empty password")
+	}
+	return &Credential{Username: username, Password: password}, nil
+}
+
+// uriParser maps connection string options onto Options
+type uriParser struct {
+	opts *Options
+	cred *Credential
+	srv  bool
+
+	// inTXT is set while the options of a TXT record are parsed
+	inTXT         bool
+	txtAuthSource string
+
+	authSource    string
+	authMechanism string
+	tls           *bool
+	tlsSettings   []string
+	tlsOpts       TLSOptions
+	writeConcern  WriteConcern
+	hasWC         bool
+}
+
+// parseOptions applies the key=value pairs of the query string. Keys are
+// case-insensitive.
+func (p *uriParser) parseOptions(query string) error {
+	if query == "" {
+		return nil
+	}
+	for _, pair := range strings.FieldsFunc(query, func(r rune) bool { return r == '&' || r == ';' }) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid connection string: option %q has no value", pair)
+		}
+		var err error
+		if key, err = url.PathUnescape(key); err != nil {
+			return fmt.Errorf("invalid connection string: option %q: %w", pair, err)
+		}
+		if value, err = url.PathUnescape(value); err != nil {
+			return fmt.Errorf("invalid connection string: option %s: %w", key, err)
+		}
+		if err := p.set(strings.ToLower(key), value); err != nil {
+			return fmt.Errorf("invalid connection string: option %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// set applies a single option
+func (p *uriParser) set(key, value string) error {
+	var err error
+	switch key {
+	case "replicaset":
+		p.opts.ReplicaSet = value
+	case "appname":
+		if len(value) > maxAppNameBytes {
+			return fmt.Errorf("must be at most %d bytes", maxAppNameBytes)
+		}
+		p.opts.AppName = value
+	case "srvservicename":
+		if !p.srv {
+			return fmt.Errorf("requires a mongodb+srv connection string")
+		}
+		p.opts.srvServiceName = value
+	case "authsource":
+		// A TXT record may set authSource for clusters used without auth
+		if p.inTXT {
+			p.txtAuthSource = value
+		} else {
+			p.authSource = value
+		}
+	case "authmechanism":
+		p.authMechanism = strings.ToUpper(value)
+
+	case "tls", "ssl":
+		var enabled bool
+		if enabled, err = parseBool(value); err == nil {
+			if p.tls != nil && *p.tls != enabled {
+				return fmt.Errorf("conflicts with a previous tls or ssl option")
+			}
+			p.tls = &enabled
+		}
+	case "tlscafile":
+		p.tlsOpts.CAFile = value
+		p.tlsSettings = append(p.tlsSettings, key)
+	case "tlscertificatekeyfile":
+		p.tlsOpts.CertFile = value
+		p.tlsSettings = append(p.tlsSettings, key)
+	case "tlsinsecure", "tlsallowinvalidcertificates":
+		var insecure bool
+		if insecure, err = parseBool(value); err == nil {
+			p.tlsOpts.InsecureSkipVerify = p.tlsOpts.InsecureSkipVerify || insecure
+			p.tlsSettings = append(p.tlsSettings, key)
+		}
+	case "tlsallowinvalidhostnames":
+		var allow bool
+		if allow, err = parseBool(value); err == nil {
+			p.tlsOpts.AllowInvalidHostnames = allow
+			p.tlsSettings = append(p.tlsSettings, key)
+		}
+
+	case "connecttimeoutms":
+		p.opts.ConnectTimeout, err = parseDurationMS(value, false)
+	case "serverselectiontimeoutms":
+		p.opts.ServerSelectionTimeout, err = parseDurationMS(value, false)
+	case "heartbeatfrequencyms":
+		p.opts.HeartbeatInterval, err = parseDurationMS(value, false)
+		if err == nil && p.opts.HeartbeatInterval < minHeartbeatInterval {
+			err = fmt.Errorf("must be at least %d", minHeartbeatInterval.Milliseconds())
+		}
+	case "servermonitoringmode":
+		p.opts.ServerMonitoringMode, err = parseServerMonitoringMode(value)
+	case "maxidletimems":
+		p.opts.MaxIdleTime, err = parseDurationMS(value, true)
+	case "waitqueuetimeoutms":
+		p.opts.WaitQueueTimeout, err = parseDurationMS(value, true)
+	case "maxpoolsize":
+		p.opts.MaxPoolSize, err = parseNonNegativeInt(value)
+		if err == nil && p.opts.MaxPoolSize == 0 {
+			err = fmt.Errorf("unlimited pools are not supported")
+		}
+	case "minpoolsize":
+		p.opts.MinPoolSize, err = parseNonNegativeInt(value)
+
+	case "w":
+		p.hasWC = true
+		if n, convErr := strconv.Atoi(value); convErr == nil {
+			if n < 0 {
+				return fmt.Errorf("must not be negative")
+			}
+			p.writeConcern.W = n
+		} else {
+			p.writeConcern.W = value
+		}
+	case "journal":
+		var journal bool
+		if journal, err = parseBool(value); err == nil {
+			p.hasWC = true
+			p.writeConcern.Journal = &journal
+		}
+	case "wtimeoutms":
+		p.hasWC = true
+		p.writeConcern.WTimeout, err = parseDurationMS(value, true)
+	case "readconcernlevel":
+		var level string
+		if level, err = parseReadConcernLevel(value); err == nil {
+			p.opts.ReadConcern = &ReadConcern{Level: level}
+		}
+	case "readpreference":
+		p.opts.ReadPreference, err = parseReadPreferenceMode(value)
+	case "readpreferencetags":
+		// Repeated options add tag sets in order of preference
+		var set TagSet
+		if set, err = parseTagSet(value); err == nil {
+			p.opts.ReadPreferenceTags = append(p.opts.ReadPreferenceTags, set)
+		}
+	case "maxstalenessseconds":
+		if value == "-1" {
+			p.opts.MaxStaleness = 0
+			break
+		}
+		var seconds int
+		if seconds, err = parseNonNegativeInt(value); err == nil && seconds == 0 {
+			err = fmt.Errorf("must be positive or -1")
+		}
+		p.opts.MaxStaleness = time.Duration(seconds) * time.Second
+	case "localthresholdms":
+		p.opts.LocalThreshold, err = parseDurationMS(value, false)
+	case "retrywrites":
+		var retryWrites bool
+		if retryWrites, err = parseBool(value); err == nil {
+			p.opts.RetryWrites = &retryWrites
+		}
+	case "retryreads":
+		var retryReads bool
+		if retryReads, err = parseBool(value); err == nil {
+			p.opts.RetryReads = &retryReads
+		}
+	case "compressors":
+		// Compressors this driver does not implement, such as zstd, are
+		// skipped so that the others can still be negotiated
+		p.opts.Compressors = nil
+		for _, name := range strings.Split(value, ",") {
+			if _, supported := newCompressor(name, zlib.DefaultCompression); supported == nil {
+				p.opts.Compressors = append(p.opts.Compressors, name)
+			}
+		}
+	case "zlibcompressionlevel":
+		var level int
+		if level, err = strconv.Atoi(value); err == nil && (level < zlib.DefaultCompression || level > zlib.BestCompression) {
+			err = fmt.Errorf("must be between -1 and 9")
+		}
+		p.opts.ZlibCompressionLevel = &level
+	}
+	return err
+}
+
+// finish validates combinations of options and builds the credential and
+// TLS settings
+func (p *uriParser) finish(database string) error {
+	if p.opts.MinPoolSize > p.opts.MaxPoolSize {
+		return fmt.Errorf("invalid connection string: minPoolSize %d exceeds maxPoolSize %d", p.opts.MinPoolSize, p.opts.MaxPoolSize)
+	}
+	rp := ReadPreference{Mode: p.opts.ReadPreference, TagSets: p.opts.ReadPreferenceTags, MaxStaleness: p.opts.MaxStaleness}
+	if err := rp.validate(p.opts.HeartbeatInterval); err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+
+	if p.hasWC {
+		wc := p.writeConcern
+		if wc.unacknowledgedW() && wc.Journal != nil && *wc.Journal {
+			return fmt.Errorf("invalid connection string: journal=true conflicts with w=0")
+		}
+		p.opts.WriteConcern = &wc
+	}
+
+	if p.tls != nil && !*p.tls && len(p.tlsSettings) > 0 {
+		return fmt.Errorf("invalid connection string: %s requires TLS", p.tlsSettings[0])
+	}
+	// mongodb+srv enables TLS unless it is disabled explicitly
+	if (p.tls != nil && *p.tls) || len(p.tlsSettings) > 0 || (p.srv && p.tls == nil) {
+		tlsOpts := p.tlsOpts
+		p.opts.TLS = &tlsOpts
+	}
+
+	switch {
+	case p.cred != nil:
+	case p.authMechanism == MechanismX509:
+		p.cred = &Credential{}
+	case p.authMechanism != "" || p.authSource != "":
+		return fmt.Errorf("invalid connection string: authentication options require a username")
+	default:
+		return nil
+	}
+
+	p.cred.Mechanism = p.authMechanism
+	p.cred.Source = p.authSource
+	if p.cred.Source == "" {
+		p.cred.Source = p.txtAuthSource
+	}
+	if p.cred.Source == "" && p.cred.Mechanism != MechanismX509 {
+		p.cred.Source = database
+	}
+	if err := p.cred.validate(p.opts.TLS); err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+	p.opts.Credential = p.cred
+	return nil
+}
+
+// parseBool accepts the boolean spellings of the connection string spec
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean", value)
+}
+
+// parseNonNegativeInt parses a count such as a pool size
+func parseNonNegativeInt(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative integer", value)
+	}
+	return n, nil
+}
+
+// parseDurationMS parses a number of milliseconds. Zero is accepted only
+// where it means "no limit".
+func parseDurationMS(value string, allowZero bool) (time.Duration, error) {
+	n, err := parseNonNegativeInt(value)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && !allowZero {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
@@ -0,0 +1,310 @@
+// Package snappy implements the Snappy block format described at
+// https://github.com/google/snappy/blob/main/format_description.txt,
+// without the framing format, as used by MongoDB wire protocol compression.
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrCorrupt is returned for input that is not valid Snappy data
+var ErrCorrupt = errors.New("snappy: corrupt input")
+
+// ErrTooLarge is returned for input whose decoded length exceeds 4 GiB
+var ErrTooLarge = errors.New("snappy: decoded block is too large")
+
+// Element tags in the low two bits of a tag byte
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+)
+
+const (
+	// Inputs shorter than this are emitted as a single literal
+	minNonLiteralBlockSize = 1 + 1 + inputMargin
+
+	// inputMargin keeps the encoder's unchecked 8 byte loads in bounds
+	inputMargin = 16 - 1
+
+	tableBits = 14
+	tableSize = 1 << tableBits
+	tableMask = tableSize - 1
+)
+
+// MaxEncodedLen returns the largest size Encode may return for an input
+// of n bytes
+func MaxEncodedLen(n int) int {
+	return 32 + n + n/6
+}
+
+// DecodedLen returns the length of the decoded form of src
+func DecodedLen(src []byte) (int, error) {
+	n, _, err := decodedLen(src)
+	return n, err
+}
+
+// decodedLen reads the length preamble and returns its size as well
+func decodedLen(src []byte) (int, int, error) {
+	v, n := binary.Uvarint(src)
+	if n <= 0 {
+		return 0, 0, ErrCorrupt
+	}
+	if v > 0xffffffff {
+		return 0, 0, ErrTooLarge
+	}
+	return int(v), n, nil
+}
+
+// Encode returns the encoded form of src, using dst if it is large enough
+func Encode(dst, src []byte) []byte {
+	if n := MaxEncodedLen(len(src)); cap(dst) < n {
+		dst = make([]byte, n)
+	} else {
+		dst = dst[:n]
+	}
+
+	d := binary.PutUvarint(dst, uint64(len(src)))
+	if len(src) < minNonLiteralBlockSize {
+		if len(src) > 0 {
+			d += emitLiteral(dst[d:], src)
+		}
+		return dst[:d]
+	}
+	d += encodeBlock(dst[d:], src)
+	return dst[:d]
+}
+
+// encodeBlock encodes src, which is at least minNonLiteralBlockSize bytes
+// long, greedily replacing 4 byte sequences seen before with copies
+func encodeBlock(dst, src []byte) int {
+	var table [tableSize]int32
+	sLimit := len(src) - inputMargin
+	d, nextEmit := 0, 0
+
+	s := 1
+	nextHash := hash(load32(src, s))
+	for {
+		// Look further ahead the longer no match is found, so that
+		// incompressible input is skipped quickly
+		skip := 32
+		nextS := s
+		candidate := 0
+		for {
+			s = nextS
+			step := skip >> 5
+			nextS = s + step
+			skip += step
+			if nextS > sLimit {
+				goto emitRemainder
+			}
+			candidate = int(table[nextHash&tableMask])
+			table[nextHash&tableMask] = int32(s)
+			nextHash = hash(load32(src, nextS))
+			if load32(src, s) == load32(src, candidate) {
+				break
+			}
+		}
+
+		d += emitLiteral(dst[d:], src[nextEmit:s])
+
+		// Emit copies for as long as the bytes after a match match again
+		for {
+			base := s
+			s += 4
+			for i := candidate + 4; s < len(src) && src[i] == src[s]; i, s = i+1, s+1 {
+			}
+			d += emitCopy(dst[d:], base-candidate, s-base)
+			nextEmit = s
+			if s >= sLimit {
+				goto emitRemainder
+			}
+
+			x := load64(src, s-1)
+			table[hash(uint32(x))&tableMask] = int32(s - 1)
+			currHash := hash(uint32(x >> 8))
+			candidate = int(table[currHash&tableMask])
+			table[currHash&tableMask] = int32(s)
+			if uint32(x>>8) != load32(src, candidate) {
+				nextHash = hash(uint32(x >> 16))
+				s++
+				break
+			}
+		}
+	}
+
+emitRemainder:
+	if nextEmit < len(src) {
+		d += emitLiteral(dst[d:], src[nextEmit:])
+	}
+	return d
+}
+
+func hash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - tableBits)
+}
+
+func load32(b []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i : i+4])
+}
+
+func load64(b []byte, i int) uint64 {
+	return binary.LittleEndian.Uint64(b[i : i+8])
+}
+
+// emitLiteral writes a literal element and returns the bytes written
+func emitLiteral(dst, lit []byte) int {
+	i, n := 0, uint(len(lit)-1)
+	switch {
+	case n < 60:
+		dst[0] = uint8(n)<<2 | tagLiteral
+		i = 1
+	case n < 1<<8:
+		dst[0] = 60<<2 | tagLiteral
+		dst[1] = uint8(n)
+		i = 2
+	case n < 1<<16:
+		dst[0] = 61<<2 | tagLiteral
+		binary.LittleEndian.PutUint16(dst[1:], uint16(n))
+		i = 3
+	case n < 1<<24:
+		dst[0] = 62<<2 | tagLiteral
+		dst[1], dst[2], dst[3] = uint8(n), uint8(n>>8), uint8(n>>16)
+		i = 4
+	default:
+		dst[0] = 63<<2 | tagLiteral
+		binary.LittleEndian.PutUint32(dst[1:], uint32(n))
+		i = 5
+	}
+	return i + copy(dst[i:], lit)
+}
+
+// emitCopy writes copy elements for a match of length bytes at offset and
+// returns the bytes written. length is at least 4.
+func emitCopy(dst []byte, offset, length int) int {
+	i := 0
+	// Split long matches into copies of at most 64 bytes, keeping at least
+	// 4 bytes for the last one
+	for length >= 68 {
+		i += emitCopyN(dst[i:], offset, 64)
+		length -= 64
+	}
+	if length > 64 {
+		i += emitCopyN(dst[i:], offset, 60)
+		length -= 60
+	}
+	return i + emitCopyN(dst[i:], offset, length)
+}
+
+// emitCopyN writes one copy element of 1 to 64 bytes in its shortest form
+func emitCopyN(dst []byte, offset, length int) int {
+	switch {
+	case length >= 4 && length < 12 && offset < 2048:
+		dst[0] = uint8(offset>>8)<<5 | uint8(length-4)<<2 | tagCopy1
+		dst[1] = uint8(offset)
+		return 2
+	case offset < 1<<16:
+		dst[0] = uint8(length-1)<<2 | tagCopy2
+		binary.LittleEndian.PutUint16(dst[1:], uint16(offset))
+		return 3
+	}
+	dst[0] = uint8(length-1)<<2 | tagCopy4
+	binary.LittleEndian.PutUint32(dst[1:], uint32(offset))
+	return 5
+}
+
+// Decode returns the decoded form of src, using dst if it is large enough
+func Decode(dst, src []byte) ([]byte, error) {
+	dLen, s, err := decodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if cap(dst) < dLen {
+		dst = make([]byte, dLen)
+	} else {
+		dst = dst[:dLen]
+	}
+
+	d := 0
+	for s < len(src) {
+		var offset, length int
+		switch src[s] & 0x03 {
+		case tagLiteral:
+			x := uint32(src[s] >> 2)
+			switch {
+			case x < 60:
+				s++
+			case x == 60:
+				s += 2
+				if s > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = uint32(src[s-1])
+			case x == 61:
+				s += 3
+				if s > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = uint32(binary.LittleEndian.Uint16(src[s-2:]))
+			case x == 62:
+				s += 4
+				if s > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = uint32(src[s-3]) | uint32(src[s-2])<<8 | uint32(src[s-1])<<16
+			default:
+				s += 5
+				if s > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = binary.LittleEndian.Uint32(src[s-4:])
+			}
+			length = int(x) + 1
+			if length <= 0 || length > len(dst)-d || length > len(src)-s {
+				return nil, ErrCorrupt
+			}
+			copy(dst[d:], src[s:s+length])
+			d += length
+			s += length
+			continue
+
+		case tagCopy1:
+			s += 2
+			if s > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 4 + int(src[s-2])>>2&0x7
+			offset = int(uint32(src[s-2])&0xe0<<3 | uint32(src[s-1]))
+		case tagCopy2:
+			s += 3
+			if s > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(src[s-3])>>2
+			offset = int(binary.LittleEndian.Uint16(src[s-2:]))
+		case tagCopy4:
+			s += 5
+			if s > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(src[s-5])>>2
+			offset = int(binary.LittleEndian.Uint32(src[s-4:]))
+		}
+
+		if offset <= 0 || d < offset || length > len(dst)-d {
+			return nil, ErrCorrupt
+		}
+		// The source and destination overlap when offset < length, which
+		// repeats the last offset bytes
+		for i := 0; i < length; i++ {
+			dst[d+i] = dst[d-offset+i]
+		}
+		d += length
+	}
+	if d != dLen {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
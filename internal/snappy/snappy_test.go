@@ -0,0 +1,89 @@
+package snappy
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDecodeReferenceEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+		want    string
+	}{
+		{"empty", []byte{0x00}, ""},
+		{"literal", append([]byte{0x0b, 10 << 2}, "hello world"...), "hello world"},
+		// "abcd" followed by a 1 byte offset copy of 8 bytes at offset 4
+		{"overlapping copy", append(append([]byte{0x0c, 3 << 2}, "abcd"...), (8-4)<<2|tagCopy1, 4), "abcdabcdabcd"},
+		// "ab" followed by a 2 byte offset copy of 4 bytes at offset 2
+		{"copy2", append(append([]byte{0x06, 1 << 2}, "ab"...), (4-1)<<2|tagCopy2, 2, 0), "ababab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(nil, tt.encoded)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rng.Read(random)
+
+	inputs := map[string][]byte{
+		"empty":      nil,
+		"short":      []byte("short input"),
+		"repetitive": []byte(strings.Repeat("compressible document ", 5000)),
+		"random":     random,
+		"long run":   bytes.Repeat([]byte{'x'}, 200000),
+		// A repetition further back than a 2 byte offset reaches
+		"far match": append(append(append([]byte(nil), random[:1000]...), random[:70000]...), random[:1000]...),
+	}
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			encoded := Encode(nil, input)
+			if len(encoded) > MaxEncodedLen(len(input)) {
+				t.Errorf("Encoded %d bytes into %d, more than MaxEncodedLen", len(input), len(encoded))
+			}
+			if n, err := DecodedLen(encoded); err != nil || n != len(input) {
+				t.Errorf("Expected decoded length %d, got %d, %v", len(input), n, err)
+			}
+			decoded, err := Decode(nil, encoded)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !bytes.Equal(decoded, input) {
+				t.Error("Decoded data differs from the input")
+			}
+		})
+	}
+
+	if encoded := Encode(nil, inputs["repetitive"]); len(encoded) > len(inputs["repetitive"])/10 {
+		t.Errorf("Expected repetitive input to compress well, got %d bytes", len(encoded))
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	tests := map[string][]byte{
+		"no preamble":         nil,
+		"truncated literal":   {0x05, 4 << 2, 'a', 'b'},
+		"offset before start": {0x08, 0 << 2, 'a', (4-4)<<2 | tagCopy1, 2},
+		"zero offset":         {0x05, 0 << 2, 'a', (4-4)<<2 | tagCopy1, 0},
+		"longer than length":  {0x01, 1 << 2, 'a', 'b'},
+		"shorter than length": {0x03, 0 << 2, 'a'},
+		"truncated copy":      {0x04, 0 << 2, 'a', tagCopy2, 1},
+	}
+	for name, input := range tests {
+		if _, err := Decode(nil, input); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}